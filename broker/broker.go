@@ -0,0 +1,618 @@
+// Copyright (c) 2020–2024 The prologix developers. All rights reserved.
+// Project site: https://github.com/gotmc/prologix
+// Use of this source code is governed by a MIT-style license that
+// can be found in the LICENSE.txt file for the project.
+
+// Package broker shares a Prologix adapter between processes. A Server owns
+// the connection to the adapter and serves clients, usually over a Unix
+// domain socket, each of which sees an adapter of its own: the `++` commands
+// configuring the adapter, such as `++addr` and `++eot_char`, only apply to
+// the client sending them, and the broker sets up the adapter with the
+// client's configuration before each of its transactions on the bus.
+// Transactions of different clients are serialized, and a client may lock
+// the bus to run several transactions without others interleaving.
+//
+// Since clients speak the protocol of the adapter, Dial returns a connection
+// that can be used with prologix.NewController, and importing the package
+// registers the BROKER driver used by prologix.Open with resources like
+// `BROKER::/tmp/prologixd.sock::GPIB::10::INSTR`.
+//
+// Besides the commands of the adapter, the broker accepts:
+//
+//	++lock [timeout_ms]  lock the bus to the client, answering 1 or 0
+//	++unlock             release the lock
+//
+// Without a timeout, `++lock` waits until the bus is available. The lock is
+// released when the client disconnects. The adapter is kept in controller
+// mode with read-after-write disabled, which the broker emulates for clients
+// enabling `++auto`, and `++savecfg`, `++rst`, and the device mode commands
+// are ignored.
+package broker
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxLineSize is the longest line accepted from a client.
+const maxLineSize = 1 << 20
+
+// esc is the character escaping CR, LF, ESC, and `+` in the data sent to the
+// adapter.
+const esc = 0x1B
+
+var (
+	errAdapterClosed  = errors.New("adapter connection closed")
+	errAdapterTimeout = errors.New("timeout waiting for the adapter")
+)
+
+// config is the configuration of the adapter set by a client.
+type config struct {
+	pad       int
+	sad       int
+	auto      bool
+	eoi       bool
+	eos       int
+	eotEnable bool
+	eotChar   byte
+	readTmoMs int
+}
+
+// defaultConfig is the configuration of a new client, which is the factory
+// configuration of the adapter in controller mode.
+var defaultConfig = config{eoi: true, readTmoMs: 500}
+
+// Server shares the adapter between its clients.
+type Server struct {
+	adapter io.ReadWriter
+	timeout time.Duration
+	logger  *log.Logger
+	// in receives the data read from the adapter, and is closed when reading
+	// fails.
+	in chan []byte
+	// marker is the response of the adapter to `++ver`, which ends the output
+	// of each transaction.
+	marker []byte
+
+	mu    sync.Mutex
+	owner *session
+	busy  bool
+	// changed is closed and replaced when the bus is released or unlocked.
+	changed chan struct{}
+	// phys is the configuration of the adapter, which is only known once
+	// valid is set. Both are guarded by busy.
+	phys  config
+	valid bool
+
+	tracker   tracker
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// Option applies an option to the Server.
+type Option func(*Server)
+
+// WithTimeout sets the time allowed for the adapter to answer a transaction,
+// which defaults to 10 seconds and must exceed the read timeouts set by the
+// clients with `++read_tmo_ms`.
+func WithTimeout(timeout time.Duration) Option {
+	return func(s *Server) {
+		s.timeout = timeout
+	}
+}
+
+// WithLogger sets the logger reporting failed transactions, which defaults
+// to the standard logger.
+func WithLogger(logger *log.Logger) Option {
+	return func(s *Server) {
+		s.logger = logger
+	}
+}
+
+// NewServer creates a Server sharing the adapter, which it switches to
+// controller mode with read-after-write disabled. The server reads from the
+// adapter until it returns an error, so close the adapter once the server is
+// closed.
+func NewServer(adapter io.ReadWriter, opts ...Option) (*Server, error) {
+	s := Server{
+		adapter: adapter,
+		timeout: 10 * time.Second,
+		logger:  log.Default(),
+		in:      make(chan []byte, 64),
+		changed: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(&s)
+	}
+	go s.readAdapter()
+
+	if _, err := io.WriteString(adapter, "++savecfg 0\n++mode 1\n++auto 0\n++ver\n"); err != nil {
+		return nil, fmt.Errorf("error configuring adapter: %w", err)
+	}
+	timer := time.NewTimer(s.timeout)
+	defer timer.Stop()
+	for {
+		if i := bytes.IndexByte(s.marker, '\n'); i >= 0 {
+			s.marker = s.marker[:i+1]
+			break
+		}
+		select {
+		case p, ok := <-s.in:
+			if !ok {
+				return nil, errAdapterClosed
+			}
+			s.marker = append(s.marker, p...)
+		case <-timer.C:
+			return nil, fmt.Errorf("error reading adapter version: %w", errAdapterTimeout)
+		}
+	}
+	return &s, nil
+}
+
+// readAdapter sends the data read from the adapter to the in channel.
+func (s *Server) readAdapter() {
+	defer close(s.in)
+	buf := make([]byte, 4096)
+	for {
+		n, err := s.adapter.Read(buf)
+		if n > 0 {
+			s.in <- append([]byte(nil), buf[:n]...)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Serve accepts clients on the listener until it fails or the server is
+// closed, in which case net.ErrClosed is returned.
+func (s *Server) Serve(l net.Listener) error {
+	return s.tracker.serve(l, s.serveConn)
+}
+
+// Close closes the listeners and the connections to the clients, and waits
+// for their handlers to return. The adapter isn't closed.
+func (s *Server) Close() error {
+	s.closeOnce.Do(func() { close(s.done) })
+	s.tracker.close()
+	return nil
+}
+
+// session is a client connected to the server.
+type session struct {
+	s    *Server
+	conn net.Conn
+	cfg  config
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	sess := &session{s: s, conn: conn, cfg: defaultConfig}
+	defer s.unlock(sess)
+	var line []byte
+	escaped := false
+	buf := make([]byte, 4096)
+	for {
+		n, err := conn.Read(buf)
+		for _, b := range buf[:n] {
+			switch {
+			case escaped:
+				escaped = false
+				line = append(line, b)
+			case b == esc:
+				escaped = true
+				line = append(line, b)
+			case b == '\r' || b == '\n':
+				if len(line) > 0 {
+					if err := sess.handle(line); err != nil {
+						return
+					}
+				}
+				line = line[:0]
+			default:
+				line = append(line, b)
+			}
+		}
+		if err != nil || len(line) > maxLineSize {
+			return
+		}
+	}
+}
+
+// handle handles a line received from the client, which is either a `++`
+// command or data for the instrument at the client's address, with its
+// escape characters left in place.
+func (sess *session) handle(line []byte) error {
+	// Since escaped characters are preceded by ESC, a line starting with two
+	// plus signs is always a command.
+	if !bytes.HasPrefix(line, []byte("++")) {
+		data := append(append([]byte(nil), line...), '\n')
+		if sess.cfg.auto {
+			data = append(data, "++read eoi\n"...)
+		}
+		return sess.transact(data, sess.cfg.auto)
+	}
+	fields := strings.Fields(string(line[2:]))
+	if len(fields) == 0 {
+		return nil
+	}
+	name := strings.ToLower(fields[0])
+	args := fields[1:]
+	cfg := &sess.cfg
+	switch name {
+	case "addr":
+		return sess.cmdAddr(args)
+	case "auto":
+		return sess.boolParam(&cfg.auto, args)
+	case "eoi":
+		return sess.boolParam(&cfg.eoi, args)
+	case "eos":
+		return sess.intParam(&cfg.eos, args, 0, 3)
+	case "eot_enable":
+		return sess.boolParam(&cfg.eotEnable, args)
+	case "eot_char":
+		v := int(cfg.eotChar)
+		err := sess.intParam(&v, args, 0, 255)
+		cfg.eotChar = byte(v)
+		return err
+	case "read_tmo_ms":
+		return sess.intParam(&cfg.readTmoMs, args, 1, 3000)
+	case "mode":
+		if len(args) == 0 {
+			return sess.reply("1")
+		}
+	case "savecfg":
+		if len(args) == 0 {
+			return sess.reply("0")
+		}
+	case "ver":
+		_, err := sess.conn.Write(sess.s.marker)
+		return err
+	case "lock":
+		return sess.cmdLock(args)
+	case "unlock":
+		sess.s.unlock(sess)
+	case "read", "spoll", "srq", "help":
+		return sess.transact(append(append([]byte(nil), line...), '\n'), true)
+	case "clr", "ifc", "llo", "loc", "trg":
+		return sess.transact(append(append([]byte(nil), line...), '\n'), false)
+	case "rst", "lon", "status":
+		// Resetting the adapter would lose the configuration of the other
+		// clients, and only controller mode is shared.
+	default:
+		return sess.reply("Unrecognized command")
+	}
+	return nil
+}
+
+func (sess *session) cmdAddr(args []string) error {
+	if len(args) == 0 {
+		addr := strconv.Itoa(sess.cfg.pad)
+		if sess.cfg.sad != 0 {
+			addr += " " + strconv.Itoa(sess.cfg.sad)
+		}
+		return sess.reply(addr)
+	}
+	pad, err := strconv.Atoi(args[0])
+	if err != nil || pad < 0 || pad > 30 {
+		return nil
+	}
+	sad := 0
+	if len(args) > 1 {
+		sad, err = strconv.Atoi(args[1])
+		if err != nil || sad < 96 || sad > 126 {
+			return nil
+		}
+	}
+	sess.cfg.pad, sess.cfg.sad = pad, sad
+	return nil
+}
+
+func (sess *session) cmdLock(args []string) error {
+	timeout := time.Duration(-1)
+	if len(args) > 0 {
+		ms, err := strconv.Atoi(args[0])
+		if err != nil || ms < 0 {
+			return sess.reply("0")
+		}
+		timeout = time.Duration(ms) * time.Millisecond
+	}
+	if sess.s.lock(sess, timeout) {
+		return sess.reply("1")
+	}
+	return sess.reply("0")
+}
+
+// boolParam either answers or sets a parameter accepting 0 or 1.
+func (sess *session) boolParam(p *bool, args []string) error {
+	if len(args) == 0 {
+		if *p {
+			return sess.reply("1")
+		}
+		return sess.reply("0")
+	}
+	switch args[0] {
+	case "0":
+		*p = false
+	case "1":
+		*p = true
+	}
+	return nil
+}
+
+// intParam either answers or sets an integer parameter, ignoring values
+// outside of the range min to max, inclusive.
+func (sess *session) intParam(p *int, args []string, min, max int) error {
+	if len(args) == 0 {
+		return sess.reply(strconv.Itoa(*p))
+	}
+	v, err := strconv.Atoi(args[0])
+	if err != nil || v < min || v > max {
+		return nil
+	}
+	*p = v
+	return nil
+}
+
+// reply answers the client like the adapter, terminating the line with CR LF.
+func (sess *session) reply(s string) error {
+	_, err := io.WriteString(sess.conn, s+"\r\n")
+	return err
+}
+
+// transact sends the data to the adapter once it's configured for the client
+// and, if output is set, forwards its response to the client. An error is
+// only returned when the client connection fails, since failures of the
+// adapter are logged and the client times out waiting for the response.
+func (sess *session) transact(data []byte, output bool) error {
+	s := sess.s
+	if !s.acquire(sess) {
+		return net.ErrClosed
+	}
+	resp, err := s.exchange(append(s.setup(sess.cfg), data...), output)
+	if err != nil {
+		// The configuration of the adapter is unknown after a failure.
+		s.valid = false
+	}
+	s.release()
+	if err != nil {
+		s.logger.Printf("error on transaction: %v", err)
+		return nil
+	}
+	if len(resp) == 0 {
+		return nil
+	}
+	_, err = sess.conn.Write(resp)
+	return err
+}
+
+// setup returns the commands changing the configuration of the adapter to the
+// client's.
+func (s *Server) setup(cfg config) []byte {
+	var cmds []byte
+	set := func(changed bool, format string, a ...any) {
+		if changed || !s.valid {
+			cmds = fmt.Appendf(cmds, "++"+format+"\n", a...)
+		}
+	}
+	p := s.phys
+	if cfg.sad != 0 {
+		set(cfg.pad != p.pad || cfg.sad != p.sad, "addr %d %d", cfg.pad, cfg.sad)
+	} else {
+		set(cfg.pad != p.pad || cfg.sad != p.sad, "addr %d", cfg.pad)
+	}
+	set(cfg.eoi != p.eoi, "eoi %d", boolInt(cfg.eoi))
+	set(cfg.eos != p.eos, "eos %d", cfg.eos)
+	set(cfg.eotEnable != p.eotEnable, "eot_enable %d", boolInt(cfg.eotEnable))
+	set(cfg.eotChar != p.eotChar, "eot_char %d", cfg.eotChar)
+	set(cfg.readTmoMs != p.readTmoMs, "read_tmo_ms %d", cfg.readTmoMs)
+	s.phys, s.valid = cfg, true
+	return cmds
+}
+
+// exchange writes the data to the adapter and, if output is set, returns the
+// data it sends in response, which is delimited by asking for its version.
+// Data left over from earlier transactions is discarded.
+func (s *Server) exchange(data []byte, output bool) ([]byte, error) {
+drain:
+	for {
+		select {
+		case _, ok := <-s.in:
+			if !ok {
+				break drain
+			}
+		default:
+			break drain
+		}
+	}
+	if output {
+		data = append(data, "++ver\n"...)
+	}
+	if _, err := s.adapter.Write(data); err != nil {
+		return nil, err
+	}
+	if !output {
+		return nil, nil
+	}
+	timer := time.NewTimer(s.timeout)
+	defer timer.Stop()
+	var resp []byte
+	for !bytes.HasSuffix(resp, s.marker) {
+		select {
+		case p, ok := <-s.in:
+			if !ok {
+				return nil, errAdapterClosed
+			}
+			resp = append(resp, p...)
+		case <-timer.C:
+			return nil, errAdapterTimeout
+		}
+	}
+	return resp[:len(resp)-len(s.marker)], nil
+}
+
+// acquire waits until the bus is neither in use nor locked by another client
+// and marks it in use, reporting false if the server is closed first.
+func (s *Server) acquire(sess *session) bool {
+	for {
+		s.mu.Lock()
+		if !s.busy && (s.owner == nil || s.owner == sess) {
+			s.busy = true
+			s.mu.Unlock()
+			return true
+		}
+		changed := s.changed
+		s.mu.Unlock()
+		select {
+		case <-changed:
+		case <-s.done:
+			return false
+		}
+	}
+}
+
+// release marks the bus as no longer in use.
+func (s *Server) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.busy = false
+	s.notify()
+}
+
+// lock locks the bus to the client, waiting up to the timeout for another
+// client to unlock it, or indefinitely if the timeout is negative.
+func (s *Server) lock(sess *session, timeout time.Duration) bool {
+	var expired <-chan time.Time
+	if timeout >= 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	for {
+		s.mu.Lock()
+		if s.owner == nil || s.owner == sess {
+			s.owner = sess
+			s.mu.Unlock()
+			return true
+		}
+		changed := s.changed
+		s.mu.Unlock()
+		select {
+		case <-changed:
+		case <-expired:
+			return false
+		case <-s.done:
+			return false
+		}
+	}
+}
+
+// unlock releases the lock if the client holds it.
+func (s *Server) unlock(sess *session) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.owner == sess {
+		s.owner = nil
+		s.notify()
+	}
+}
+
+// notify wakes up the clients waiting for the bus. The caller must hold mu.
+func (s *Server) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// tracker tracks the listeners and connections of a server, so that closing
+// the server closes them and waits for their handlers to return.
+type tracker struct {
+	mu      sync.Mutex
+	closers map[io.Closer]struct{}
+	closed  bool
+	wg      sync.WaitGroup
+}
+
+// add adds a listener or connection, reporting false if the server is closed.
+func (t *tracker) add(c io.Closer) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return false
+	}
+	if t.closers == nil {
+		t.closers = make(map[io.Closer]struct{})
+	}
+	t.closers[c] = struct{}{}
+	return true
+}
+
+func (t *tracker) remove(c io.Closer) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.closers, c)
+}
+
+func (t *tracker) isClosed() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.closed
+}
+
+// close closes the listeners and connections and waits for the handlers of
+// the connections to return.
+func (t *tracker) close() {
+	t.mu.Lock()
+	t.closed = true
+	for c := range t.closers {
+		c.Close()
+	}
+	t.mu.Unlock()
+	t.wg.Wait()
+}
+
+// serve accepts connections on the listener, calling handle for each in its
+// own goroutine and closing the connection once handle returns, until the
+// listener fails or the server is closed, in which case net.ErrClosed is
+// returned.
+func (t *tracker) serve(l net.Listener, handle func(net.Conn)) error {
+	if !t.add(l) {
+		l.Close()
+		return net.ErrClosed
+	}
+	defer t.remove(l)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if t.isClosed() {
+				return net.ErrClosed
+			}
+			return err
+		}
+		if !t.add(conn) {
+			conn.Close()
+			return net.ErrClosed
+		}
+		t.wg.Add(1)
+		go func() {
+			defer t.wg.Done()
+			defer t.remove(conn)
+			defer conn.Close()
+			handle(conn)
+		}()
+	}
+}
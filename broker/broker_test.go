@@ -0,0 +1,171 @@
+// Copyright (c) 2020–2024 The prologix developers. All rights reserved.
+// Project site: https://github.com/gotmc/prologix
+// Use of this source code is governed by a MIT-style license that
+// can be found in the LICENSE.txt file for the project.
+
+package broker
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gotmc/prologix"
+	"github.com/gotmc/prologix/sim"
+)
+
+// startServer shares a simulated adapter and returns the path of the socket
+// of the server.
+func startServer(t *testing.T, adapter *sim.Adapter) string {
+	t.Helper()
+	conn := adapter.Dial()
+	t.Cleanup(func() { conn.Close() })
+	s, err := NewServer(conn, WithTimeout(time.Second), WithLogger(log.New(io.Discard, "", 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "prologixd.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+	return path
+}
+
+// newClient connects to the server and creates a controller at the address.
+func newClient(t *testing.T, path string, addr int) (*Conn, *prologix.Controller) {
+	t.Helper()
+	conn, err := Dial(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	c, err := prologix.NewController(conn, addr, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, c
+}
+
+func newAdapter(t *testing.T) *sim.Adapter {
+	t.Helper()
+	adapter := sim.NewAdapter()
+	if err := adapter.Attach(10, sim.NewScripted("SIM,DMM,1,1.0", map[string]string{"meas:volt?": "1.5"})); err != nil {
+		t.Fatal(err)
+	}
+	if err := adapter.Attach(12, sim.NewScripted("SIM,SRC,2,1.0", map[string]string{"curr?": "0.25"})); err != nil {
+		t.Fatal(err)
+	}
+	return adapter
+}
+
+func TestServer(t *testing.T) {
+	path := startServer(t, newAdapter(t))
+	_, dmm := newClient(t, path, 10)
+	_, src := newClient(t, path, 12)
+
+	for i := 0; i < 3; i++ {
+		if got, err := dmm.Query("MEAS:VOLT?"); err != nil || got != "1.5\n" {
+			t.Errorf("got %q, %v querying DMM; want 1.5", got, err)
+		}
+		if got, err := src.Query("CURR?"); err != nil || got != "0.25\n" {
+			t.Errorf("got %q, %v querying source; want 0.25", got, err)
+		}
+	}
+
+	// The configuration of each client only applies to its transactions, and
+	// the broker emulates read-after-write.
+	for _, cmd := range []string{"eot_char 13", "auto 1"} {
+		if err := src.CommandController(cmd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := src.Write([]byte("CURR?\n")); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := dmm.Query("MEAS:VOLT?"); err != nil || got != "1.5\n" {
+		t.Errorf("got %q, %v querying DMM; want 1.5", got, err)
+	}
+	buf := make([]byte, 16)
+	if n, err := src.Read(buf); err != nil || string(buf[:n]) != "0.25\n\r" {
+		t.Errorf("got %q, %v reading source with auto; want 0.25 followed by CR", buf[:n], err)
+	}
+	for _, tc := range []struct {
+		c    *prologix.Controller
+		cmd  string
+		want string
+	}{
+		{dmm, "addr", "10\r\n"},
+		{src, "addr", "12\r\n"},
+		{dmm, "eot_char", "10\r\n"},
+		{src, "eot_char", "13\r\n"},
+		{dmm, "auto", "0\r\n"},
+		{dmm, "mode", "1\r\n"},
+		{dmm, "ver", sim.VersionUSB + "\r\n"},
+		{dmm, "nope", "Unrecognized command\r\n"},
+	} {
+		if got, err := tc.c.QueryController(tc.cmd); err != nil || got != tc.want {
+			t.Errorf("got %q, %v for ++%s; want %q", got, err, tc.cmd, tc.want)
+		}
+	}
+}
+
+func TestServerLock(t *testing.T) {
+	path := startServer(t, newAdapter(t))
+	conn1, dmm := newClient(t, path, 10)
+	conn2, src := newClient(t, path, 12)
+
+	if err := conn1.Lock(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn2.Lock(0); !errors.Is(err, ErrLockTimeout) {
+		t.Errorf("got %v locking a locked bus; want ErrLockTimeout", err)
+	}
+	done := make(chan string)
+	go func() {
+		s, _ := src.Query("CURR?")
+		done <- s
+	}()
+	if got, err := dmm.Query("MEAS:VOLT?"); err != nil || got != "1.5\n" {
+		t.Errorf("got %q, %v querying DMM while locked; want 1.5", got, err)
+	}
+	select {
+	case s := <-done:
+		t.Fatalf("got %q querying source while the bus is locked", s)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := conn1.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-done; got != "0.25\n" {
+		t.Errorf("got %q querying source after unlocking; want 0.25", got)
+	}
+
+	// Disconnecting releases the lock.
+	if err := conn1.Lock(-1); err != nil {
+		t.Fatal(err)
+	}
+	conn1.Close()
+	if err := conn2.Lock(time.Second); err != nil {
+		t.Errorf("got %v locking after the owner disconnected", err)
+	}
+}
+
+func TestOpen(t *testing.T) {
+	path := startServer(t, newAdapter(t))
+	dmm, err := prologix.Open("BROKER::" + path + "::GPIB::10::INSTR")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dmm.Close()
+	if got, err := dmm.Query("MEAS:VOLT?"); err != nil || strings.TrimSpace(got) != "1.5" {
+		t.Errorf("got %q, %v querying DMM; want 1.5", got, err)
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright (c) 2020–2024 The prologix developers. All rights reserved.
+// Project site: https://github.com/gotmc/prologix
+// Use of this source code is governed by a MIT-style license that
+// can be found in the LICENSE.txt file for the project.
+
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gotmc/prologix/driver"
+)
+
+// ErrLockTimeout is returned by Lock when another client holds the lock
+// until the timeout expires.
+var ErrLockTimeout = errors.New("bus locked by another client")
+
+func init() {
+	driver.Register("BROKER", driver.OpenFunc(func(path string) (io.ReadWriteCloser, error) {
+		c, err := Dial(path)
+		if err != nil {
+			return nil, err
+		}
+		return c, nil
+	}))
+}
+
+// Conn is a connection to a Server, which is used like a connection to the
+// adapter, such as with prologix.NewController.
+type Conn struct {
+	net.Conn
+}
+
+// Dial connects to the Server listening on the Unix domain socket.
+func Dial(path string) (*Conn, error) {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to broker: %w", err)
+	}
+	return &Conn{Conn: conn}, nil
+}
+
+// Lock locks the bus, so that the transactions of other clients wait until
+// Unlock is called or the connection is closed. Lock waits up to the timeout
+// for another client to release the lock, returning ErrLockTimeout if it
+// doesn't, or indefinitely if the timeout is negative. Lock must not be
+// called while a response from an instrument is pending.
+func (c *Conn) Lock(timeout time.Duration) error {
+	cmd := "++lock\n"
+	if timeout >= 0 {
+		cmd = "++lock " + strconv.FormatInt(timeout.Milliseconds(), 10) + "\n"
+	}
+	if _, err := io.WriteString(c.Conn, cmd); err != nil {
+		return err
+	}
+	// Read the response a byte at a time, so that nothing following it is
+	// consumed.
+	var resp []byte
+	b := make([]byte, 1)
+	for len(resp) == 0 || resp[len(resp)-1] != '\n' {
+		if _, err := c.Conn.Read(b); err != nil {
+			return fmt.Errorf("error reading lock response: %w", err)
+		}
+		resp = append(resp, b[0])
+	}
+	switch s := strings.TrimSpace(string(resp)); s {
+	case "1":
+		return nil
+	case "0":
+		return ErrLockTimeout
+	default:
+		return fmt.Errorf("unexpected lock response %q", s)
+	}
+}
+
+// Unlock releases the lock acquired with Lock.
+func (c *Conn) Unlock() error {
+	_, err := io.WriteString(c.Conn, "++unlock\n")
+	return err
+}
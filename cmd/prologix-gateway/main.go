@@ -0,0 +1,313 @@
+// Copyright (c) 2020–2024 The prologix developers. All rights reserved.
+// Project site: https://github.com/gotmc/prologix
+// Use of this source code is governed by a MIT-style license that
+// can be found in the LICENSE.txt file for the project.
+
+// Command prologix-gateway serves the instruments on the GPIB bus of a
+// Prologix adapter over raw SCPI sockets, so that software that only speaks
+// SCPI over TCP, like to the port 5025 of LAN instruments, can use them, and
+// over VXI-11 and HiSLIP, so that VISA libraries see the adapter as a LAN/GPIB
+// gateway.
+//
+// Usage:
+//
+//	prologix-gateway [flags] [host:]port=gpib[,secondary] ...
+//
+// Each argument maps a TCP listener to a GPIB address, such as `5025=10` or
+// `127.0.0.1:5026=22,96`. The adapter is given by the -adapter flag as a VISA
+// resource name, such as `ASRL/dev/ttyUSB0` for a GPIB-USB controller or
+// `TCPIP::192.168.1.50::1234::SOCKET` for a GPIB-ETHERNET controller, which
+// defaults to the PROLOGIX_ADAPTER environment variable.
+//
+// Each line received from a client is sent to the instrument, and the
+// response is sent back after a query. The lines of all clients are
+// serialized on the bus.
+//
+// With the -vxi11 flag, all the instruments on the bus are also served over
+// the VXI-11 core channel, as devices named like `gpib0,10`, along with a
+// portmapper on the address given by the -portmap flag, which defaults to
+// port 111 and usually requires privileges. Give an empty -portmap when the
+// host already runs a portmapper, and register the core channel with it.
+//
+// With the -hislip flag, all the instruments on the bus are also served over
+// HiSLIP, with sub-addresses like `hislip0,10`.
+//
+// With the -http flag, all the instruments on the bus are also served over an
+// HTTP/JSON API, with a websocket streaming service requests and periodic
+// query results, as documented by gateway.HTTPHandler. Web pages served from
+// other origins than the gateway may only use the API once given by the
+// -http-origin flag, as a comma separated list like
+// `https://dashboard.example.com`.
+//
+// With the -tls-cert and -tls-key flags, the raw sockets and the HTTP API are
+// served over TLS, and with -tls-client-ca, clients must present a
+// certificate signed by one of its certificate authorities. The -access flag
+// gives a JSON file with the access policy of all the servers, as documented
+// by gateway.AccessPolicy, which lists the clients allowed each instrument
+// and, optionally, the commands they may send.
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gotmc/prologix"
+	"github.com/gotmc/prologix/gateway"
+
+	_ "github.com/gotmc/prologix/driver/ethernet"
+	_ "github.com/gotmc/prologix/driver/vcp"
+)
+
+var (
+	adapterResource string
+	timeout         time.Duration
+	vxi11Addr       string
+	portmapAddr     string
+	hislipAddr      string
+	httpAddr        string
+	httpOrigins     string
+	tlsCert         string
+	tlsKey          string
+	tlsClientCA     string
+	accessFile      string
+)
+
+func init() {
+	flag.StringVar(
+		&adapterResource,
+		"adapter",
+		os.Getenv("PROLOGIX_ADAPTER"),
+		"VISA resource name of the Prologix adapter [$PROLOGIX_ADAPTER]",
+	)
+	flag.DurationVar(&timeout, "timeout", 5*time.Second, "Timeout for the response to each query")
+	flag.StringVar(&vxi11Addr, "vxi11", "", "Address on which to serve the VXI-11 core channel, such as :1024")
+	flag.StringVar(
+		&portmapAddr,
+		"portmap",
+		":"+strconv.Itoa(gateway.PortmapPort),
+		"Address on which to serve the portmapper with -vxi11",
+	)
+	flag.StringVar(&hislipAddr, "hislip", "", "Address on which to serve HiSLIP, such as :"+strconv.Itoa(gateway.HiSLIPPort))
+	flag.StringVar(&httpAddr, "http", "", "Address on which to serve the HTTP/JSON API, such as :8080")
+	flag.StringVar(&httpOrigins, "http-origin", "", "Comma separated origins of other web pages allowed to use the HTTP API")
+	flag.StringVar(&tlsCert, "tls-cert", "", "PEM file with the certificate for serving raw sockets and HTTP over TLS")
+	flag.StringVar(&tlsKey, "tls-key", "", "PEM file with the key of the -tls-cert certificate")
+	flag.StringVar(&tlsClientCA, "tls-client-ca", "", "PEM file with the certificate authorities of the client certificates required over TLS")
+	flag.StringVar(&accessFile, "access", "", "JSON file with the access policy of the clients")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(),
+			"Usage: %s [flags] [[host:]port=gpib[,secondary] ...]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+}
+
+// mapping maps a TCP listener address to a GPIB address.
+type mapping struct {
+	listen   string
+	resource string
+}
+
+// parseMapping parses a command line argument of the form
+// `[host:]port=gpib[,secondary]`.
+func parseMapping(arg string) (mapping, error) {
+	listen, gpib, ok := strings.Cut(arg, "=")
+	if !ok || listen == "" || gpib == "" {
+		return mapping{}, fmt.Errorf("invalid mapping %s (want [host:]port=gpib[,secondary])", arg)
+	}
+	if _, err := strconv.Atoi(listen); err == nil {
+		listen = ":" + listen
+	}
+	resource := "GPIB0::" + strings.ReplaceAll(gpib, ",", "::") + "::INSTR"
+	if _, err := prologix.ParseResource(resource); err != nil {
+		return mapping{}, fmt.Errorf("invalid GPIB address in %s", arg)
+	}
+	return mapping{listen: listen, resource: resource}, nil
+}
+
+func main() {
+	flag.Parse()
+	log.SetPrefix("prologix-gateway: ")
+	if flag.NArg() == 0 && vxi11Addr == "" && hislipAddr == "" && httpAddr == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if adapterResource == "" {
+		log.Fatal("no Prologix adapter given; use -adapter")
+	}
+	if err := prologix.MapBoard(0, adapterResource); err != nil {
+		log.Fatal(err)
+	}
+	var tlsConfig *tls.Config
+	if tlsCert != "" || tlsKey != "" || tlsClientCA != "" {
+		var err error
+		tlsConfig, err = gateway.NewTLSConfig(tlsCert, tlsKey, tlsClientCA)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	var access *gateway.AccessControl
+	if accessFile != "" {
+		p, err := gateway.LoadAccessPolicy(accessFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		access, err = gateway.NewAccessControl(p)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	listenTLS := func(addr string) (net.Listener, error) {
+		l, err := net.Listen("tcp", addr)
+		if err != nil || tlsConfig == nil {
+			return l, err
+		}
+		return tls.NewListener(l, tlsConfig), nil
+	}
+
+	var mappings []mapping
+	for _, arg := range flag.Args() {
+		m, err := parseMapping(arg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		mappings = append(mappings, m)
+	}
+
+	var servers []io.Closer
+	var wg sync.WaitGroup
+	serve := func(l net.Listener, serve func(net.Listener) error) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := serve(l); !errors.Is(err, net.ErrClosed) {
+				log.Print(err)
+			}
+		}()
+	}
+	for _, m := range mappings {
+		inst, err := prologix.Open(m.resource)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer inst.Close()
+		l, err := listenTLS(m.listen)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("serving GPIB address %s on %s", inst.Address(), l.Addr())
+		s := gateway.NewSocketServer(inst, gateway.WithQueryTimeout(timeout), gateway.WithAccessControl(access))
+		servers = append(servers, s)
+		serve(l, s.Serve)
+	}
+
+	// The VXI-11, HiSLIP, and HTTP servers create the instruments they serve
+	// themselves, so any address gets the controller shared by the
+	// instruments opened on the adapter.
+	var board *prologix.Instrument
+	if vxi11Addr != "" || hislipAddr != "" || httpAddr != "" {
+		var err error
+		board, err = prologix.Open("GPIB0::0::INSTR")
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer board.Close()
+	}
+
+	if vxi11Addr != "" {
+		l, err := net.Listen("tcp", vxi11Addr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("serving VXI-11 core channel on %s", l.Addr())
+		s := gateway.NewVXI11Server(board.Controller(), gateway.WithVXI11AccessControl(access))
+		servers = append(servers, s)
+		serve(l, s.Serve)
+
+		if portmapAddr != "" {
+			p := gateway.NewPortmapper()
+			p.Set(gateway.VXI11CoreProgram, gateway.VXI11CoreVersion, l.Addr().(*net.TCPAddr).Port)
+			pl, err := net.Listen("tcp", portmapAddr)
+			if err != nil {
+				log.Fatal(err)
+			}
+			pc, err := net.ListenPacket("udp", portmapAddr)
+			if err != nil {
+				log.Fatal(err)
+			}
+			log.Printf("serving portmapper on %s", pl.Addr())
+			servers = append(servers, p)
+			serve(pl, p.Serve)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := p.ServePacket(pc); !errors.Is(err, net.ErrClosed) {
+					log.Print(err)
+				}
+			}()
+		}
+	}
+
+	if hislipAddr != "" {
+		l, err := net.Listen("tcp", hislipAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("serving HiSLIP on %s", l.Addr())
+		s := gateway.NewHiSLIPServer(
+			board.Controller(),
+			gateway.WithHiSLIPQueryTimeout(timeout),
+			gateway.WithHiSLIPAccessControl(access),
+		)
+		servers = append(servers, s)
+		serve(l, s.Serve)
+	}
+
+	if httpAddr != "" {
+		l, err := listenTLS(httpAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("serving HTTP on %s", l.Addr())
+		var origins []string
+		for _, o := range strings.Split(httpOrigins, ",") {
+			if o = strings.TrimSpace(o); o != "" {
+				origins = append(origins, o)
+			}
+		}
+		h := gateway.NewHTTPHandler(
+			board.Controller(),
+			gateway.WithHTTPQueryTimeout(timeout),
+			gateway.WithHTTPAccessControl(access),
+			gateway.WithAllowedOrigins(origins...),
+		)
+		srv := &http.Server{Handler: h}
+		servers = append(servers, srv, h)
+		serve(l, func(l net.Listener) error {
+			if err := srv.Serve(l); !errors.Is(err, http.ErrServerClosed) {
+				return err
+			}
+			return net.ErrClosed
+		})
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	<-sig
+	log.Print("shutting down")
+	for _, s := range servers {
+		s.Close()
+	}
+	wg.Wait()
+}
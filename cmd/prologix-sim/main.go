@@ -0,0 +1,153 @@
+// Copyright (c) 2020–2024 The prologix developers. All rights reserved.
+// Project site: https://github.com/gotmc/prologix
+// Use of this source code is governed by a MIT-style license that
+// can be found in the LICENSE.txt file for the project.
+
+// Command prologix-sim emulates a Prologix GPIB-ETHERNET controller listening
+// on a TCP port with simulated instruments attached to its GPIB bus. On Linux,
+// the -pty flag additionally emulates a GPIB-USB controller on a
+// pseudo-terminal, whose path is printed to stdout, so that programs using the
+// vcp driver can be run without hardware.
+//
+// Usage:
+//
+//	prologix-sim [flags] [addr=]config.json ...
+//
+// Each argument names a JSON instrument configuration file. The GPIB address
+// in the configuration file can be overridden by prefixing the file with the
+// address and an equals sign.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gotmc/prologix/sim"
+)
+
+var (
+	listenAddr    string
+	version       string
+	netfinder     bool
+	netfinderAddr string
+	usePTY        bool
+	faultsPath    string
+)
+
+func init() {
+	flag.StringVar(
+		&listenAddr,
+		"listen",
+		":1234",
+		"TCP address on which to listen (empty to disable)",
+	)
+	flag.StringVar(&version, "version", sim.VersionEthernet, "Version string reported by ++ver")
+	flag.BoolVar(&netfinder, "netfinder", false, "Answer NetFinder discovery requests")
+	flag.StringVar(
+		&netfinderAddr,
+		"netfinder-addr",
+		fmt.Sprintf("127.0.0.1:%d", sim.NetFinderPort),
+		"UDP address on which to answer NetFinder discovery requests",
+	)
+	flag.BoolVar(&usePTY, "pty", false, "Emulate a GPIB-USB controller on a pseudo-terminal")
+	flag.StringVar(&faultsPath, "faults", "", "JSON fault injection schedule")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(),
+			"Usage: %s [flags] [addr=]config.json ...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+}
+
+func main() {
+	flag.Parse()
+
+	opts := []sim.AdapterOption{sim.WithVersion(version)}
+	if faultsPath != "" {
+		opt, err := sim.LoadFaultSchedule(faultsPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, opt)
+	}
+	adapter := sim.NewAdapter(opts...)
+	for _, arg := range flag.Args() {
+		cfg, err := loadConfig(arg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := adapter.AttachConfig(cfg); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("attached %s at GPIB address %d", arg, cfg.Address)
+	}
+
+	if usePTY {
+		pty, err := adapter.OpenPTY()
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer pty.Close()
+		log.Printf("emulating Prologix controller on %s", pty.Path())
+		fmt.Println(pty.Path())
+		if listenAddr == "" {
+			log.Fatal(pty.Serve())
+		}
+		go func() {
+			log.Fatal(pty.Serve())
+		}()
+	}
+	if listenAddr == "" {
+		log.Fatal("no TCP address or pseudo-terminal to serve")
+	}
+
+	l, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("emulating Prologix controller on %s", l.Addr())
+
+	if netfinder {
+		pc, err := net.ListenPacket("udp", netfinderAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		ip := net.IPv4(127, 0, 0, 1)
+		if tcp, ok := l.Addr().(*net.TCPAddr); ok && !tcp.IP.IsUnspecified() {
+			ip = tcp.IP
+		}
+		log.Printf("answering NetFinder discovery on %s", pc.LocalAddr())
+		go func() {
+			log.Fatal(sim.NewNetFinder(ip).Serve(pc))
+		}()
+	}
+
+	log.Fatal(adapter.Serve(l))
+}
+
+// loadConfig loads the instrument configuration given as a command line
+// argument of the form `[addr=]path`.
+func loadConfig(arg string) (sim.InstrumentConfig, error) {
+	path := arg
+	addr := -1
+	if before, after, ok := strings.Cut(arg, "="); ok {
+		a, err := strconv.Atoi(before)
+		if err != nil {
+			return sim.InstrumentConfig{}, fmt.Errorf("invalid GPIB address in %s", arg)
+		}
+		addr = a
+		path = after
+	}
+	cfg, err := sim.LoadInstrumentConfig(path)
+	if err != nil {
+		return cfg, err
+	}
+	if addr >= 0 {
+		cfg.Address = addr
+	}
+	return cfg, nil
+}
@@ -0,0 +1,391 @@
+// Copyright (c) 2020–2024 The prologix developers. All rights reserved.
+// Project site: https://github.com/gotmc/prologix
+// Use of this source code is governed by a MIT-style license that
+// can be found in the LICENSE.txt file for the project.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/gotmc/prologix"
+)
+
+// command is a subcommand of the prologix command.
+type command struct {
+	name  string
+	usage string
+	help  string
+	// raw commands take the rest of the line as a single argument, so that the
+	// spacing of instrument commands is preserved.
+	raw bool
+	run func(s *session, args []string) (any, error)
+}
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{name: "version", usage: "version", help: "print the Prologix controller version", run: runVersion},
+		{name: "config", usage: "config show|set k v", help: "print or change the controller configuration", run: runConfig},
+		{name: "write", usage: "write cmd", help: "send a command to the instrument", raw: true, run: runWrite},
+		{name: "query", usage: "query cmd", help: "send a query and print the response", raw: true, run: runQuery},
+		{name: "read", usage: "read", help: "read a response from the instrument", run: runRead},
+		{name: "spoll", usage: "spoll", help: "serial poll the instrument and print its status byte", run: runSerialPoll},
+		{name: "trigger", usage: "trigger", help: "send Group Execute Trigger (GET)", run: runTrigger},
+		{name: "clear", usage: "clear", help: "send Selected Device Clear (SDC)", run: runClear},
+		{name: "ifc", usage: "ifc", help: "assert Interface Clear (IFC)", run: runInterfaceClear},
+		{name: "local", usage: "local", help: "return the instrument to front panel control", run: runLocal},
+		{name: "reset", usage: "reset", help: "reset the Prologix controller", run: runReset},
+		{name: "scan", usage: "scan [-secondary] [addr]", help: "list the instruments on the bus", run: runScan},
+		{name: "run", usage: "run script [var=val]", help: "run a script of commands and assertions", run: runScript},
+		{name: "term", usage: "term", help: "start an interactive terminal", run: runTerm},
+	}
+}
+
+// lookup returns the command with the given name.
+func lookup(name string) (command, error) {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd, nil
+		}
+	}
+	return command{}, fmt.Errorf("unknown command %q", name)
+}
+
+// result is the outcome of a command printed with -json.
+type result struct {
+	Command  string   `json:"command,omitempty"`
+	Args     []string `json:"args,omitempty"`
+	Response any      `json:"response,omitempty"`
+	Error    string   `json:"error,omitempty"`
+}
+
+// session runs commands using a connection to a Prologix controller.
+type session struct {
+	gpib      *prologix.Controller
+	transport *transport
+	out       io.Writer
+	// batch is set when the commands are read from stdin.
+	batch bool
+}
+
+// run runs the command given by the command line arguments and prints its
+// result.
+func (s *session) run(args []string) error {
+	cmd, err := lookup(args[0])
+	if err != nil {
+		s.print(result{Command: args[0], Error: err.Error()})
+		return err
+	}
+	args = args[1:]
+	if cmd.raw && len(args) > 0 {
+		args = []string{strings.Join(args, " ")}
+	}
+	s.transport.arm()
+	resp, err := cmd.run(s, args)
+	r := result{Command: cmd.name, Args: args, Response: resp}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	s.print(r)
+	return err
+}
+
+// runBatch runs each command read from r, continuing after errors. The error
+// returned reports the number of commands that failed.
+func (s *session) runBatch(r io.Reader) error {
+	var failed int
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, rest, _ := strings.Cut(line, " ")
+		args := append([]string{name}, strings.Fields(rest)...)
+		if cmd, err := lookup(name); err == nil && cmd.raw {
+			args = []string{name, strings.TrimSpace(rest)}
+		}
+		if err := s.run(args); err != nil {
+			failed++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d commands failed", failed)
+	}
+	return nil
+}
+
+// print prints the result as JSON when requested. Otherwise, the response is
+// printed to the output and the error to stderr.
+func (s *session) print(r result) {
+	if jsonOutput {
+		b, err := json.Marshal(r)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "prologix: %s\n", err)
+			return
+		}
+		fmt.Fprintln(s.out, string(b))
+		return
+	}
+	if r.Error != "" {
+		fmt.Fprintf(os.Stderr, "prologix: %s: %s\n", r.Command, r.Error)
+		return
+	}
+	if r.Response != nil {
+		fmt.Fprintln(s.out, r.Response)
+	}
+}
+
+// controllerConfig is the configuration of the Prologix controller printed by
+// `config show`.
+type controllerConfig struct {
+	Address int    `json:"addr"`
+	Auto    bool   `json:"auto"`
+	EOI     bool   `json:"eoi"`
+	EOS     int    `json:"eos"`
+	Timeout int    `json:"timeout_ms"`
+	Version string `json:"version"`
+}
+
+func (cfg controllerConfig) String() string {
+	return fmt.Sprintf(
+		"addr     %d\nauto     %t\neoi      %t\neos      %d (%s)\ntimeout  %d ms\nversion  %s",
+		cfg.Address, cfg.Auto, cfg.EOI, cfg.EOS, prologix.GpibTerm(cfg.EOS),
+		cfg.Timeout, cfg.Version,
+	)
+}
+
+func runVersion(s *session, args []string) (any, error) {
+	ver, err := s.gpib.Version()
+	return strings.TrimSpace(ver), err
+}
+
+func runConfig(s *session, args []string) (any, error) {
+	if len(args) == 0 {
+		return nil, errors.New("usage: config show | config set key value [key value ...]")
+	}
+	switch args[0] {
+	case "show":
+		return showConfig(s.gpib)
+	case "set":
+		if len(args) < 3 || len(args)%2 == 0 {
+			return nil, errors.New("usage: config set key value [key value ...]")
+		}
+		for i := 1; i < len(args); i += 2 {
+			if err := setConfig(s.gpib, args[i], args[i+1]); err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unknown config command %q", args[0])
+}
+
+func showConfig(gpib *prologix.Controller) (controllerConfig, error) {
+	var cfg controllerConfig
+	var err error
+	if cfg.Address, err = gpib.InstrumentAddress(); err != nil {
+		return cfg, err
+	}
+	if cfg.Auto, err = gpib.ReadAfterWrite(); err != nil {
+		return cfg, err
+	}
+	if cfg.EOI, err = gpib.AssertEOI(); err != nil {
+		return cfg, err
+	}
+	term, err := gpib.GPIBTermination()
+	if err != nil {
+		return cfg, err
+	}
+	cfg.EOS = int(term)
+	if cfg.Timeout, err = gpib.ReadTimeout(); err != nil {
+		return cfg, err
+	}
+	ver, err := gpib.Version()
+	cfg.Version = strings.TrimSpace(ver)
+	return cfg, err
+}
+
+func setConfig(gpib *prologix.Controller, key, value string) error {
+	switch strings.ToLower(key) {
+	case "addr":
+		addr, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid GPIB address %q", value)
+		}
+		return gpib.SetInstrumentAddress(addr)
+	case "auto":
+		enable, err := parseBool(value)
+		if err != nil {
+			return err
+		}
+		return gpib.SetReadAfterWrite(enable)
+	case "eoi":
+		enable, err := parseBool(value)
+		if err != nil {
+			return err
+		}
+		return gpib.SetAssertEOI(enable)
+	case "eos":
+		term, err := parseTerm(value)
+		if err != nil {
+			return err
+		}
+		return gpib.SetGPIBTermination(term)
+	case "timeout", "read_tmo_ms":
+		ms, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid read timeout %q", value)
+		}
+		return gpib.SetReadTimeout(ms)
+	}
+	return fmt.Errorf("unknown config key %q (must be addr, auto, eoi, eos, or timeout)", key)
+}
+
+func parseBool(s string) (bool, error) {
+	switch strings.ToLower(s) {
+	case "1", "on", "true":
+		return true, nil
+	case "0", "off", "false":
+		return false, nil
+	}
+	return false, fmt.Errorf("invalid boolean %q", s)
+}
+
+// parseTerm parses the GPIB terminator given either as the Prologix eos value
+// from 0 to 3 or as crlf, cr, lf, or none.
+func parseTerm(s string) (prologix.GpibTerm, error) {
+	switch strings.ToLower(s) {
+	case "0", "crlf":
+		return prologix.AppendCRLF, nil
+	case "1", "cr":
+		return prologix.AppendCR, nil
+	case "2", "lf":
+		return prologix.AppendLF, nil
+	case "3", "none":
+		return prologix.AppendNothing, nil
+	}
+	return 0, fmt.Errorf("invalid GPIB terminator %q (must be crlf, cr, lf, or none)", s)
+}
+
+func runWrite(s *session, args []string) (any, error) {
+	if len(args) == 0 || args[0] == "" {
+		return nil, errors.New("usage: write cmd")
+	}
+	return nil, s.gpib.Command(args[0])
+}
+
+func runQuery(s *session, args []string) (any, error) {
+	if len(args) == 0 || args[0] == "" {
+		return nil, errors.New("usage: query cmd")
+	}
+	resp, err := s.gpib.Query(args[0])
+	return strings.TrimRight(resp, "\r\n"), err
+}
+
+func runRead(s *session, args []string) (any, error) {
+	if err := s.gpib.CommandController("read eoi"); err != nil {
+		return nil, err
+	}
+	resp, err := bufio.NewReader(s.gpib).ReadString('\n')
+	return strings.TrimRight(resp, "\r\n"), err
+}
+
+func runSerialPoll(s *session, args []string) (any, error) {
+	stb, err := s.gpib.SerialPoll()
+	if err != nil {
+		return nil, err
+	}
+	return stb, nil
+}
+
+func runTrigger(s *session, args []string) (any, error) {
+	return nil, s.gpib.Trigger()
+}
+
+func runClear(s *session, args []string) (any, error) {
+	return nil, s.gpib.ClearDevice()
+}
+
+func runInterfaceClear(s *session, args []string) (any, error) {
+	return nil, s.gpib.ClearInterface()
+}
+
+func runLocal(s *session, args []string) (any, error) {
+	return nil, s.gpib.FrontPanel(true)
+}
+
+func runReset(s *session, args []string) (any, error) {
+	return nil, s.gpib.Reset()
+}
+
+// inventory prints the scan results as a table.
+type inventory struct {
+	prologix.Inventory
+}
+
+func (inv inventory) String() string {
+	var b strings.Builder
+	w := tabwriter.NewWriter(&b, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ADDR\tSTB\tMANUFACTURER\tMODEL\tSERIAL\tFIRMWARE")
+	for _, l := range inv.Listeners {
+		id := l.Identity
+		if id == (prologix.Identity{}) {
+			id.Model = l.RawID
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t%s\n",
+			l.Address(), l.StatusByte, id.Manufacturer, id.Model, id.SerialNumber, id.Firmware)
+	}
+	w.Flush()
+	return strings.TrimRight(b.String(), "\n")
+}
+
+func runScan(s *session, args []string) (any, error) {
+	fs := flag.NewFlagSet("scan", flag.ContinueOnError)
+	secondary := fs.Bool("secondary", false, "Probe secondary addresses 96-126")
+	probe := fs.Int("probe", 100, "Read timeout in ms while probing each address")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	opts := []prologix.ScanOption{prologix.WithScanTimeout(*probe)}
+	if *secondary {
+		opts = append(opts, prologix.WithScanSecondary())
+	}
+	if fs.NArg() > 0 {
+		var addrs []int
+		for _, arg := range fs.Args() {
+			addr, err := strconv.Atoi(arg)
+			if err != nil {
+				return nil, fmt.Errorf("invalid GPIB address %q", arg)
+			}
+			addrs = append(addrs, addr)
+		}
+		opts = append(opts, prologix.WithScanAddresses(addrs...))
+	}
+
+	// A scan takes much longer than other commands, so it's only stopped by
+	// an interrupt.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	prev := s.transport.timeout
+	s.transport.setTimeout(0)
+	defer s.transport.setTimeout(prev)
+	inv, err := s.gpib.Scan(ctx, opts...)
+	return inventory{inv}, err
+}
@@ -0,0 +1,138 @@
+// Copyright (c) 2020–2024 The prologix developers. All rights reserved.
+// Project site: https://github.com/gotmc/prologix
+// Use of this source code is governed by a MIT-style license that
+// can be found in the LICENSE.txt file for the project.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+// maxHistory is the number of lines kept in each history file.
+const maxHistory = 500
+
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// history is the command history of the terminal, which is kept in a separate
+// file for each Prologix controller so that the commands for its instruments
+// can be recalled. A nil history records nothing.
+type history struct {
+	path  string
+	lines []string
+}
+
+// openHistory loads the history for the named connection, such as a serial
+// port or host. Errors are ignored, since the terminal works without history.
+func openHistory(name string) *history {
+	h := history{}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return &h
+	}
+	name = strings.Trim(unsafeFileChars.ReplaceAllString(name, "_"), "_")
+	h.path = filepath.Join(dir, "prologix", "history", name)
+	f, err := os.Open(h.path)
+	if err != nil {
+		return &h
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := scanner.Text(); line != "" {
+			h.lines = append(h.lines, line)
+		}
+	}
+	if len(h.lines) > maxHistory {
+		h.lines = h.lines[len(h.lines)-maxHistory:]
+	}
+	return &h
+}
+
+// preload adds the saved history to the line editor, so that it can be
+// recalled with the arrow keys, by entering each line with the output
+// discarded.
+func (h *history) preload(t *term.Terminal, rw *switchableIO) {
+	if h == nil || len(h.lines) == 0 {
+		return
+	}
+	r, w := rw.r, rw.w
+	rw.r = strings.NewReader(strings.Join(h.lines, "\r") + "\r")
+	rw.w = io.Discard
+	for range h.lines {
+		if _, err := t.ReadLine(); err != nil {
+			break
+		}
+	}
+	rw.r, rw.w = r, w
+}
+
+// add records the line unless it repeats the previous line, and appends it to
+// the history file.
+func (h *history) add(line string) {
+	if h == nil || (len(h.lines) > 0 && h.lines[len(h.lines)-1] == line) {
+		return
+	}
+	h.lines = append(h.lines, line)
+	if h.path == "" {
+		return
+	}
+	if len(h.lines) > 2*maxHistory {
+		// Rewrite the file occasionally so that it doesn't grow forever.
+		h.lines = h.lines[len(h.lines)-maxHistory:]
+		_ = h.save()
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(h.path), 0o755); err != nil {
+		return
+	}
+	f, err := os.OpenFile(h.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	fmt.Fprintln(f, line)
+}
+
+func (h *history) save() error {
+	if err := os.MkdirAll(filepath.Dir(h.path), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(h.path, []byte(strings.Join(h.lines, "\n")+"\n"), 0o600)
+}
+
+// recall returns the history line numbered n as shown by list, or the last
+// line when n is `!`.
+func (h *history) recall(n string) (string, error) {
+	if h == nil || len(h.lines) == 0 {
+		return "", errors.New("history is empty")
+	}
+	if n == "!" {
+		return h.lines[len(h.lines)-1], nil
+	}
+	i, err := strconv.Atoi(n)
+	if err != nil || i < 1 || i > len(h.lines) {
+		return "", fmt.Errorf("no history entry %s", n)
+	}
+	return h.lines[i-1], nil
+}
+
+// list prints the numbered history lines.
+func (h *history) list(w io.Writer) {
+	if h == nil {
+		return
+	}
+	for i, line := range h.lines {
+		fmt.Fprintf(w, "%5d  %s\n", i+1, line)
+	}
+}
@@ -0,0 +1,209 @@
+// Copyright (c) 2020–2024 The prologix developers. All rights reserved.
+// Project site: https://github.com/gotmc/prologix
+// Use of this source code is governed by a MIT-style license that
+// can be found in the LICENSE.txt file for the project.
+
+// Command prologix controls a Prologix GPIB controller and the instruments on
+// its bus from the command line.
+//
+// Usage:
+//
+//	prologix [flags] <command> [args]
+//
+// The commands are:
+//
+//	version               print the Prologix controller version
+//	config show           print the controller configuration
+//	config set key value  change the controller configuration, where key is
+//	                      addr, auto, eoi, eos, or timeout
+//	write cmd             send a command to the instrument
+//	query cmd             send a query to the instrument and print the response
+//	read                  read a response from the instrument
+//	spoll                 serial poll the instrument and print its status byte
+//	trigger               send Group Execute Trigger (GET) to the instrument
+//	clear                 send Selected Device Clear (SDC) to the instrument
+//	ifc                   assert Interface Clear (IFC) on the bus
+//	local                 return the instrument to front panel control
+//	reset                 reset the Prologix controller
+//	scan [-secondary] [addr ...]
+//	                      list the instruments on the bus
+//	run script [var=value ...]
+//	                      run a script, setting its variables
+//	term                  start an interactive terminal
+//	-                     read commands from stdin, one per line
+//
+// The Prologix controller is selected using exactly one of the -port, -usb,
+// -host, or -broker flags, which default to the PROLOGIX_PORT, PROLOGIX_USB,
+// PROLOGIX_HOST, and PROLOGIXD_SOCKET environment variables. The -broker flag
+// gives the socket of a prologixd broker sharing the controller with other
+// processes. The GPIB address defaults to the PROLOGIX_GPIB environment
+// variable.
+//
+// When the command is `-`, or no command is given and stdin isn't a terminal,
+// each line read from stdin is run as a command, such as `query *IDN?`, using
+// the same connection. Blank lines and lines starting with `#` are ignored.
+// Configuration changed with `config set` applies to the remaining commands.
+//
+// With -json, the result of each command is printed as a JSON object on its
+// own line.
+//
+// The run command runs a script of instrument commands, waits, and assertions,
+// in the format documented by the github.com/gotmc/prologix/script package,
+// starting with the instrument at the GPIB address given by -gpib. The result
+// and timing of each step are printed as it's done, and the command fails if
+// any step fails. The -timeout flag applies to each response read.
+//
+// The term command starts an interactive terminal, similar to the one in the
+// Prologix GPIB Configurator, which sends each line entered to the instrument
+// and reads the response after queries. Lines starting with `++` are sent to
+// the Prologix controller, and lines starting with `.` are meta-commands; enter
+// `.help` to list them. The history of each controller is saved in the user's
+// cache directory.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gotmc/prologix"
+)
+
+var (
+	serialPort  string
+	usbSerial   string
+	host        string
+	brokerPath  string
+	gpibAddress int
+	timeout     time.Duration
+	clear       bool
+	jsonOutput  bool
+	verbose     bool
+)
+
+func init() {
+	flag.StringVar(
+		&serialPort,
+		"port",
+		os.Getenv("PROLOGIX_PORT"),
+		"Serial port for Prologix VCP GPIB controller [$PROLOGIX_PORT]",
+	)
+	flag.StringVar(
+		&usbSerial,
+		"usb",
+		os.Getenv("PROLOGIX_USB"),
+		"USB serial number of Prologix GPIB-USB controller [$PROLOGIX_USB]",
+	)
+	flag.StringVar(
+		&host,
+		"host",
+		os.Getenv("PROLOGIX_HOST"),
+		"Host and optional port of Prologix GPIB-ETHERNET controller [$PROLOGIX_HOST]",
+	)
+	flag.StringVar(
+		&brokerPath,
+		"broker",
+		os.Getenv("PROLOGIXD_SOCKET"),
+		"Unix domain socket of the prologixd broker sharing the controller [$PROLOGIXD_SOCKET]",
+	)
+	flag.IntVar(&gpibAddress, "gpib", envInt("PROLOGIX_GPIB", 0), "GPIB address [$PROLOGIX_GPIB]")
+	flag.DurationVar(&timeout, "timeout", 5*time.Second, "Timeout for each command")
+	flag.BoolVar(&clear, "clear", false, "Send Selected Device Clear (SDC) after connecting")
+	flag.BoolVar(&jsonOutput, "json", false, "Print results as JSON objects")
+	flag.BoolVar(&verbose, "v", false, "Log the traffic sent to the Prologix controller")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(),
+			"Usage: %s [flags] <command> [args]\n\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "Commands:\n")
+		for _, cmd := range commands {
+			fmt.Fprintf(flag.CommandLine.Output(), "  %-22s %s\n", cmd.usage, cmd.help)
+		}
+		fmt.Fprintf(flag.CommandLine.Output(), "  %-22s %s\n\nFlags:\n",
+			"-", "read commands from stdin, one per line")
+		flag.PrintDefaults()
+	}
+}
+
+// envInt returns the integer value of the environment variable or def if the
+// variable is unset or invalid.
+func envInt(key string, def int) int {
+	v, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+func main() {
+	flag.Parse()
+	log.SetFlags(0)
+	log.SetPrefix("prologix: ")
+	if !verbose {
+		// The controller logs every string written, which would otherwise be
+		// mixed with the output of the commands.
+		log.SetOutput(io.Discard)
+	}
+
+	args := flag.Args()
+	batch := len(args) == 1 && args[0] == "-"
+	if len(args) == 0 {
+		if !stdinIsPipe() {
+			flag.Usage()
+			os.Exit(2)
+		}
+		batch = true
+	}
+	if !batch {
+		if _, err := lookup(args[0]); err != nil {
+			fatal(err)
+		}
+	}
+
+	t, err := openTransport()
+	if err != nil {
+		fatal(err)
+	}
+	defer t.Close()
+
+	t.setTimeout(timeout)
+	gpib, err := prologix.NewController(t, gpibAddress, clear)
+	if err != nil {
+		fatal(err)
+	}
+
+	s := session{gpib: gpib, transport: t, out: os.Stdout, batch: batch}
+	if batch {
+		err = s.runBatch(os.Stdin)
+	} else {
+		err = s.run(args)
+	}
+	if err != nil {
+		t.Close()
+		os.Exit(1)
+	}
+}
+
+// stdinIsPipe reports whether stdin is a pipe or file instead of a terminal.
+func stdinIsPipe() bool {
+	fi, err := os.Stdin.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice == 0
+}
+
+// fatal prints the error, as JSON when requested, and exits.
+func fatal(err error) {
+	if jsonOutput {
+		b, _ := json.Marshal(result{Error: err.Error()})
+		fmt.Println(string(b))
+	} else {
+		fmt.Fprintf(os.Stderr, "prologix: %s\n", err)
+	}
+	os.Exit(1)
+}
@@ -0,0 +1,93 @@
+// Copyright (c) 2020–2024 The prologix developers. All rights reserved.
+// Project site: https://github.com/gotmc/prologix
+// Use of this source code is governed by a MIT-style license that
+// can be found in the LICENSE.txt file for the project.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/gotmc/prologix/script"
+)
+
+// stepResult is the outcome of a step of a script, which is printed as soon
+// as the step is done.
+type stepResult struct {
+	File     string  `json:"file"`
+	Line     int     `json:"line"`
+	Step     string  `json:"step"`
+	Response string  `json:"response,omitempty"`
+	Error    string  `json:"error,omitempty"`
+	Duration float64 `json:"duration_ms"`
+}
+
+func (r stepResult) String() string {
+	status, detail := "ok", r.Response
+	if r.Error != "" {
+		status, detail = "FAIL", r.Error
+	}
+	d := time.Duration(r.Duration * float64(time.Millisecond)).Round(time.Microsecond)
+	s := fmt.Sprintf("%-4s %10s  %s:%d  %s", status, d, r.File, r.Line, r.Step)
+	if detail != "" {
+		s += "  => " + detail
+	}
+	return s
+}
+
+func runScript(s *session, args []string) (any, error) {
+	if len(args) == 0 {
+		return nil, errors.New("usage: run script [var=value ...]")
+	}
+	sc, err := script.ParseFile(args[0])
+	if err != nil {
+		return nil, err
+	}
+	opts := []script.Option{script.WithAddress(gpibAddress, 0), script.WithTimeout(timeout)}
+	for _, arg := range args[1:] {
+		name, value, ok := strings.Cut(arg, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid variable %q (want var=value)", arg)
+		}
+		opts = append(opts, script.WithVariable(name, value))
+	}
+	var steps, failed int
+	opts = append(opts, script.WithReporter(func(r script.Result) {
+		res := stepResult{
+			File:     r.File,
+			Line:     r.Line,
+			Step:     r.Step,
+			Response: r.Response,
+			Duration: float64(r.Duration) / float64(time.Millisecond),
+		}
+		steps++
+		if r.Err != nil {
+			res.Error = r.Err.Error()
+			failed++
+		}
+		if jsonOutput {
+			b, _ := json.Marshal(res)
+			fmt.Fprintln(s.out, string(b))
+			return
+		}
+		fmt.Fprintln(s.out, res)
+	}))
+
+	// The steps set their own timeouts, and the script is stopped by an
+	// interrupt.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	prev := s.transport.timeout
+	s.transport.setTimeout(0)
+	defer s.transport.setTimeout(prev)
+	start := time.Now()
+	err = sc.Run(ctx, s.gpib, opts...)
+	return fmt.Sprintf("%d steps, %d failed in %s", steps, failed, time.Since(start).Round(time.Millisecond)), err
+}
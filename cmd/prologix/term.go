@@ -0,0 +1,393 @@
+// Copyright (c) 2020–2024 The prologix developers. All rights reserved.
+// Project site: https://github.com/gotmc/prologix
+// Use of this source code is governed by a MIT-style license that
+// can be found in the LICENSE.txt file for the project.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gotmc/prologix"
+	"golang.org/x/term"
+)
+
+// quietPeriod is how long the terminal waits for further data after a
+// response terminator before printing the response, so that the EOT character
+// and multiline responses, such as that to `++help`, are shown together.
+const quietPeriod = 30 * time.Millisecond
+
+// controllerQueries lists the Prologix commands that respond when given
+// without arguments.
+var controllerQueries = map[string]bool{
+	"addr":        true,
+	"auto":        true,
+	"eoi":         true,
+	"eos":         true,
+	"eot_char":    true,
+	"eot_enable":  true,
+	"lon":         true,
+	"mode":        true,
+	"read_tmo_ms": true,
+	"savecfg":     true,
+	"status":      true,
+}
+
+// controllerResponds reports whether the Prologix controller responds to the
+// command, which excludes the leading `++`.
+func controllerResponds(cmd string) bool {
+	fields := strings.Fields(strings.ToLower(cmd))
+	if len(fields) == 0 {
+		return false
+	}
+	switch fields[0] {
+	case "ver", "help", "srq", "spoll", "read":
+		return true
+	}
+	return len(fields) == 1 && controllerQueries[fields[0]]
+}
+
+const termHelp = `Lines are sent to the instrument at the current GPIB address and the
+response is read after lines containing a query, such as *IDN?. Lines
+starting with ++ are sent to the Prologix controller.
+
+Meta-commands:
+  .addr [pad]     show or change the GPIB address
+  .auto           toggle reading the response after queries
+  .hex            toggle showing responses as a hex dump
+  .time           toggle showing the response time
+  .timeout [dur]  show or change the time to wait for a response
+  .config         show the controller and terminal configuration
+  .read           read a response from the instrument
+  .history        list the command history
+  !n              run command n from the history (!! for the last)
+  .help           show this help
+  .quit           exit the terminal (or Ctrl-D)`
+
+// console is the interactive terminal connected to a Prologix controller.
+type console struct {
+	s        *session
+	line     *term.Terminal
+	out      io.Writer
+	history  *history
+	data     chan []byte
+	readErr  chan error
+	addr     int
+	autoRead bool
+	hex      bool
+	timing   bool
+	timeout  time.Duration
+}
+
+func runTerm(s *session, args []string) (any, error) {
+	if s.batch {
+		return nil, errors.New("term cannot be run from stdin")
+	}
+	addr, err := s.gpib.InstrumentAddress()
+	if err != nil {
+		return nil, err
+	}
+	c := console{
+		s:        s,
+		out:      s.out,
+		data:     make(chan []byte, 64),
+		readErr:  make(chan error, 1),
+		addr:     addr,
+		autoRead: true,
+		timeout:  s.transport.timeout,
+	}
+	if c.timeout <= 0 {
+		c.timeout = 5 * time.Second
+	}
+	// The terminal waits for responses itself, so the connection mustn't time
+	// out while waiting for the user.
+	s.transport.setTimeout(0)
+	go c.receive()
+
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		scanner := bufio.NewScanner(os.Stdin)
+		return nil, c.loop(func() (string, error) {
+			if !scanner.Scan() {
+				return "", io.EOF
+			}
+			return scanner.Text(), nil
+		})
+	}
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return nil, err
+	}
+	defer term.Restore(fd, state)
+
+	c.history = openHistory(s.transport.name)
+	rw := &switchableIO{r: os.Stdin, w: os.Stdout}
+	c.line = term.NewTerminal(rw, "")
+	c.history.preload(c.line, rw)
+	c.out = c.line
+	if w, h, err := term.GetSize(fd); err == nil && w > 0 {
+		_ = c.line.SetSize(w, h)
+	}
+	fmt.Fprintf(c.out, "Connected to %s. Type .help for help.\n", s.transport.name)
+	return nil, c.loop(func() (string, error) {
+		c.line.SetPrompt(fmt.Sprintf("gpib%d> ", c.addr))
+		return c.line.ReadLine()
+	})
+}
+
+// loop reads and handles lines until the input ends or the user quits.
+func (c *console) loop(readLine func() (string, error)) error {
+	for {
+		c.printUnsolicited()
+		line, err := readLine()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "!") && len(line) > 1 {
+			recalled, err := c.history.recall(line[1:])
+			if err != nil {
+				fmt.Fprintf(c.out, "error: %s\n", err)
+				continue
+			}
+			line = recalled
+			fmt.Fprintln(c.out, line)
+		}
+		if line == "" {
+			continue
+		}
+		c.history.add(line)
+		quit, err := c.handle(line)
+		if err != nil {
+			fmt.Fprintf(c.out, "error: %s\n", err)
+		}
+		if quit {
+			return nil
+		}
+	}
+}
+
+// handle handles a line entered by the user and reports whether to quit.
+func (c *console) handle(line string) (bool, error) {
+	if strings.HasPrefix(line, ".") {
+		return c.meta(line)
+	}
+	if strings.HasPrefix(line, "++") {
+		return false, c.exchange(controllerResponds(line[2:]), line)
+	}
+	if c.autoRead && prologix.IsQuery(line) {
+		return false, c.exchange(true, line, "++read eoi")
+	}
+	return false, c.exchange(false, line)
+}
+
+// meta handles the terminal meta-commands and reports whether to quit.
+func (c *console) meta(line string) (bool, error) {
+	fields := strings.Fields(line)
+	switch fields[0] {
+	case ".quit", ".exit", ".q":
+		return true, nil
+	case ".help", ".h", ".?":
+		fmt.Fprintln(c.out, termHelp)
+	case ".addr":
+		if len(fields) == 1 {
+			fmt.Fprintf(c.out, "GPIB address %d\n", c.addr)
+			return false, nil
+		}
+		addr, err := strconv.Atoi(fields[1])
+		if err != nil || addr < 0 || addr > 30 {
+			return false, fmt.Errorf("invalid primary address %s (must by 0-30)", fields[1])
+		}
+		if err := c.s.gpib.SetInstrumentAddress(addr); err != nil {
+			return false, err
+		}
+		c.addr = addr
+	case ".auto":
+		c.autoRead = !c.autoRead
+		fmt.Fprintf(c.out, "auto-read %s\n", onOff(c.autoRead))
+	case ".hex":
+		c.hex = !c.hex
+		fmt.Fprintf(c.out, "hex view %s\n", onOff(c.hex))
+	case ".time":
+		c.timing = !c.timing
+		fmt.Fprintf(c.out, "timing %s\n", onOff(c.timing))
+	case ".timeout":
+		if len(fields) > 1 {
+			d, err := time.ParseDuration(fields[1])
+			if err != nil || d <= 0 {
+				return false, fmt.Errorf("invalid timeout %s", fields[1])
+			}
+			c.timeout = d
+		}
+		fmt.Fprintf(c.out, "timeout %s\n", c.timeout)
+	case ".config":
+		return false, c.showConfig()
+	case ".read":
+		return false, c.exchange(true, "++read eoi")
+	case ".history":
+		c.history.list(c.out)
+	default:
+		return false, fmt.Errorf("unknown meta-command %s; type .help for help", fields[0])
+	}
+	return false, nil
+}
+
+// showConfig prints the terminal settings and queries the Prologix controller
+// configuration.
+func (c *console) showConfig() error {
+	fmt.Fprintf(c.out, "connection   %s\n", c.s.transport.name)
+	fmt.Fprintf(c.out, "auto-read    %s\n", onOff(c.autoRead))
+	fmt.Fprintf(c.out, "hex view     %s\n", onOff(c.hex))
+	fmt.Fprintf(c.out, "timing       %s\n", onOff(c.timing))
+	fmt.Fprintf(c.out, "timeout      %s\n", c.timeout)
+	for _, cmd := range []string{"addr", "auto", "eoi", "eos", "eot_enable", "eot_char", "read_tmo_ms", "ver"} {
+		resp, _, err := c.send(true, "++"+cmd)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(c.out, "%-12s %s\n", cmd, strings.TrimSpace(string(resp)))
+	}
+	return nil
+}
+
+// exchange sends the lines and, when a response is expected, prints it.
+func (c *console) exchange(respond bool, lines ...string) error {
+	resp, elapsed, err := c.send(respond, lines...)
+	if err != nil {
+		return err
+	}
+	if !respond {
+		return nil
+	}
+	c.print(resp)
+	if c.timing {
+		fmt.Fprintf(c.out, "(%.1f ms)\n", float64(elapsed.Microseconds())/1000)
+	}
+	return nil
+}
+
+// send writes the lines to the Prologix controller and, when a response is
+// expected, waits for it. The elapsed time is measured from sending the first
+// line until the last byte of the response is received.
+func (c *console) send(respond bool, lines ...string) ([]byte, time.Duration, error) {
+	c.printUnsolicited()
+	start := time.Now()
+	for _, line := range lines {
+		if _, err := c.s.gpib.WriteString(line); err != nil {
+			return nil, 0, err
+		}
+	}
+	if !respond {
+		return nil, 0, nil
+	}
+	resp, end, err := c.wait()
+	return resp, end.Sub(start), err
+}
+
+// wait collects the data received until a newline followed by a quiet period,
+// or returns an error if the timeout expires first. The time the last data
+// was received is returned with the data.
+func (c *console) wait() ([]byte, time.Time, error) {
+	var buf []byte
+	var end time.Time
+	timeout := time.NewTimer(c.timeout)
+	defer timeout.Stop()
+	var quiet <-chan time.Time
+	for {
+		select {
+		case b := <-c.data:
+			buf = append(buf, b...)
+			end = time.Now()
+			if bytes.IndexByte(buf, '\n') >= 0 {
+				quiet = time.After(quietPeriod)
+			}
+		case <-quiet:
+			return buf, end, nil
+		case err := <-c.readErr:
+			return buf, end, err
+		case <-timeout.C:
+			if len(buf) > 0 {
+				return buf, end, nil
+			}
+			return nil, end, fmt.Errorf("no response within %s", c.timeout)
+		}
+	}
+}
+
+// receive forwards the data read from the Prologix controller until an error
+// occurs.
+func (c *console) receive() {
+	for {
+		buf := make([]byte, 4096)
+		n, err := c.s.gpib.Read(buf)
+		if n > 0 {
+			c.data <- buf[:n]
+		}
+		if err != nil {
+			c.readErr <- err
+			return
+		}
+	}
+}
+
+// printUnsolicited prints any data received outside of an exchange, such as
+// a late response.
+func (c *console) printUnsolicited() {
+	var buf []byte
+	for {
+		select {
+		case b := <-c.data:
+			buf = append(buf, b...)
+			continue
+		default:
+		}
+		break
+	}
+	if len(buf) > 0 {
+		c.print(buf)
+	}
+}
+
+// print prints the response, either as text without the trailing
+// terminators or as a hex dump.
+func (c *console) print(resp []byte) {
+	if c.hex {
+		fmt.Fprint(c.out, hex.Dump(resp))
+		return
+	}
+	fmt.Fprintln(c.out, strings.TrimRight(string(resp), "\r\n"))
+}
+
+func onOff(b bool) string {
+	if b {
+		return "on"
+	}
+	return "off"
+}
+
+// switchableIO is the io.ReadWriter of the line editor, whose reader and
+// writer are replaced while loading the history.
+type switchableIO struct {
+	r io.Reader
+	w io.Writer
+}
+
+func (s *switchableIO) Read(p []byte) (int, error) {
+	return s.r.Read(p)
+}
+
+func (s *switchableIO) Write(p []byte) (int, error) {
+	return s.w.Write(p)
+}
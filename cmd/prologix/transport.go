@@ -0,0 +1,105 @@
+// Copyright (c) 2020–2024 The prologix developers. All rights reserved.
+// Project site: https://github.com/gotmc/prologix
+// Use of this source code is governed by a MIT-style license that
+// can be found in the LICENSE.txt file for the project.
+
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"github.com/gotmc/prologix/broker"
+	"github.com/gotmc/prologix/driver/vcp"
+)
+
+// ethernetPort is the TCP port on which the Prologix GPIB-ETHERNET controller
+// listens.
+const ethernetPort = "1234"
+
+// transport is the connection to the Prologix controller.
+type transport struct {
+	io.ReadWriteCloser
+	// name describes the connection, such as the serial port or host.
+	name    string
+	timeout time.Duration
+}
+
+// openTransport opens the connection selected by the -port, -usb, -host, or
+// -broker flag.
+func openTransport() (*transport, error) {
+	n := 0
+	for _, s := range []string{serialPort, usbSerial, host, brokerPath} {
+		if s != "" {
+			n++
+		}
+	}
+	switch {
+	case n == 0:
+		return nil, errors.New("no Prologix controller given; use -port, -usb, -host, or -broker")
+	case n > 1:
+		return nil, errors.New("only one of -port, -usb, -host, or -broker may be given")
+	}
+
+	if brokerPath != "" {
+		conn, err := broker.Dial(brokerPath)
+		if err != nil {
+			return nil, err
+		}
+		return &transport{ReadWriteCloser: conn, name: brokerPath}, nil
+	}
+
+	if host != "" {
+		addr := host
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort(addr, ethernetPort)
+		}
+		conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+		if err != nil {
+			return nil, err
+		}
+		return &transport{ReadWriteCloser: conn, name: addr}, nil
+	}
+
+	port := serialPort
+	if usbSerial != "" {
+		p, err := vcp.FindPort(usbSerial)
+		if err != nil {
+			return nil, err
+		}
+		port = p
+	}
+	v, err := vcp.NewVCP(port, vcp.WithExclusiveLock())
+	if err != nil {
+		return nil, err
+	}
+	return &transport{ReadWriteCloser: v, name: port}, nil
+}
+
+// setTimeout sets the time allowed for each command and starts the timeout for
+// the next command. For a GPIB-USB controller, the timeout applies to each
+// read from the serial port instead. A zero timeout disables it.
+func (t *transport) setTimeout(d time.Duration) {
+	t.timeout = d
+	t.arm()
+}
+
+// arm starts the timeout for the next command, or removes the deadline when
+// the timeout is zero.
+func (t *transport) arm() {
+	if v, ok := t.ReadWriteCloser.(*vcp.VCP); ok {
+		_ = v.SetReadTimeout(t.timeout)
+		return
+	}
+	conn, ok := t.ReadWriteCloser.(net.Conn)
+	if !ok {
+		return
+	}
+	if t.timeout <= 0 {
+		_ = conn.SetDeadline(time.Time{})
+		return
+	}
+	_ = conn.SetDeadline(time.Now().Add(t.timeout))
+}
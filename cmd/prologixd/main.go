@@ -0,0 +1,107 @@
+// Copyright (c) 2020–2024 The prologix developers. All rights reserved.
+// Project site: https://github.com/gotmc/prologix
+// Use of this source code is governed by a MIT-style license that
+// can be found in the LICENSE.txt file for the project.
+
+// Command prologixd owns the connection to a Prologix adapter and shares it
+// with other processes over a Unix domain socket, since only one process can
+// hold the serial port of a GPIB-USB controller.
+//
+// Usage:
+//
+//	prologixd [flags]
+//
+// The adapter is given by the -adapter flag as a VISA resource name, such as
+// `ASRL/dev/ttyUSB0` for a GPIB-USB controller or
+// `TCPIP::192.168.1.50::1234::SOCKET` for a GPIB-ETHERNET controller, which
+// defaults to the PROLOGIX_ADAPTER environment variable. The socket is given
+// by the -socket flag, which defaults to the PROLOGIXD_SOCKET environment
+// variable or /tmp/prologixd.sock.
+//
+// Clients speak the protocol of the adapter, so programs open instruments
+// with resources like `BROKER::/tmp/prologixd.sock::GPIB::10::INSTR` once
+// they import github.com/gotmc/prologix/broker, and the prologix command uses
+// the broker given by its -broker flag. Each client has its own adapter
+// configuration, the transactions of the clients are serialized, and a client
+// may lock the bus, as documented by the broker package.
+package main
+
+import (
+	"errors"
+	"flag"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/gotmc/prologix"
+	"github.com/gotmc/prologix/broker"
+
+	_ "github.com/gotmc/prologix/driver/ethernet"
+	_ "github.com/gotmc/prologix/driver/vcp"
+)
+
+var (
+	adapterResource string
+	socketPath      string
+	timeout         time.Duration
+)
+
+func init() {
+	flag.StringVar(
+		&adapterResource,
+		"adapter",
+		os.Getenv("PROLOGIX_ADAPTER"),
+		"VISA resource name of the Prologix adapter [$PROLOGIX_ADAPTER]",
+	)
+	socket := os.Getenv("PROLOGIXD_SOCKET")
+	if socket == "" {
+		socket = "/tmp/prologixd.sock"
+	}
+	flag.StringVar(&socketPath, "socket", socket, "Unix domain socket on which to serve clients [$PROLOGIXD_SOCKET]")
+	flag.DurationVar(&timeout, "timeout", 10*time.Second, "Timeout for the adapter to answer each transaction")
+}
+
+func main() {
+	flag.Parse()
+	log.SetPrefix("prologixd: ")
+	if adapterResource == "" {
+		log.Fatal("no Prologix adapter given; use -adapter")
+	}
+	adapter, err := prologix.OpenAdapter(adapterResource)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer adapter.Close()
+	s, err := broker.NewServer(adapter, broker.WithTimeout(timeout))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Remove the socket left behind by a previous run, unless it's in use.
+	if conn, err := net.Dial("unix", socketPath); err == nil {
+		conn.Close()
+		log.Fatalf("%s is already served", socketPath)
+	}
+	os.Remove(socketPath)
+	l, err := net.Listen("unix", socketPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("serving %s on %s", adapterResource, socketPath)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := s.Serve(l); !errors.Is(err, net.ErrClosed) {
+			log.Print(err)
+		}
+	}()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	<-sig
+	log.Print("shutting down")
+	s.Close()
+	<-done
+}
@@ -59,6 +59,52 @@ func (c *Controller) FrontPanel(enable bool) error {
 	return c.CommandController(cmd)
 }
 
+// Config is the configuration of the Prologix controller.
+type Config struct {
+	// Version is the version string of the Prologix controller.
+	Version string `json:"version"`
+	// Address is the GPIB address of the instrument under control, formatted
+	// as the primary address followed by the secondary address, if any.
+	Address         string   `json:"address"`
+	ReadAfterWrite  bool     `json:"read_after_write"`
+	AssertEOI       bool     `json:"assert_eoi"`
+	GPIBTermination GpibTerm `json:"gpib_termination"`
+	// ReadTimeout is the read timeout in milliseconds.
+	ReadTimeout int `json:"read_timeout_ms"`
+}
+
+// Config queries the configuration of the Prologix controller. Unlike the
+// methods querying each setting, Config waits for the operations of the
+// Instruments sharing the controller, so it can be used while they are in
+// use.
+func (c *Controller) Config() (cfg Config, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ver, err := c.Version()
+	if err != nil {
+		return cfg, err
+	}
+	cfg.Version = strings.TrimSpace(ver)
+	addr, err := c.QueryController("addr")
+	if err != nil {
+		return cfg, err
+	}
+	cfg.Address = strings.TrimSpace(addr)
+	if cfg.ReadAfterWrite, err = c.ReadAfterWrite(); err != nil {
+		return cfg, err
+	}
+	if cfg.AssertEOI, err = c.AssertEOI(); err != nil {
+		return cfg, err
+	}
+	if cfg.GPIBTermination, err = c.GPIBTermination(); err != nil {
+		return cfg, err
+	}
+	if cfg.ReadTimeout, err = c.ReadTimeout(); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
 // GPIBTermination uses the Prologix `eos` command to query the GPIB
 // terminator.
 func (c *Controller) GPIBTermination() (GpibTerm, error) {
@@ -85,8 +131,8 @@ func (c *Controller) InstrumentAddress() (int, error) {
 		return 0, err
 	}
 	addr := int(i)
-	if addr != c.instrumentAddr {
-		c.instrumentAddr = addr
+	if addr != c.primaryAddr {
+		c.primaryAddr = addr
 		return addr, fmt.Errorf("internal state mismatch, address is now %d", addr)
 	}
 	return addr, nil
@@ -141,6 +187,21 @@ func (c *Controller) Reset() error {
 	return c.CommandController("rst")
 }
 
+// SerialPoll sends the `spoll` command to the Prologix controller to perform a
+// serial poll of the instrument at the current GPIB address and returns its
+// status byte.
+func (c *Controller) SerialPoll() (byte, error) {
+	s, err := c.QueryController("spoll")
+	if err != nil {
+		return 0, err
+	}
+	stb, err := strconv.ParseUint(strings.TrimSpace(s), 10, 8)
+	if err != nil {
+		return 0, fmt.Errorf("status byte not determinable; received %s", s)
+	}
+	return byte(stb), nil
+}
+
 // ServiceRequest sends the `srq` command to the Prologix controller to
 // determine if the GPIB SRQ signal is asserted or not.
 func (c *Controller) ServiceRequest() (bool, error) {
@@ -190,7 +251,8 @@ func (c *Controller) SetInstrumentAddress(addr int) error {
 	if err != nil {
 		return err
 	}
-	c.instrumentAddr = addr
+	c.primaryAddr = addr
+	c.hasSecondaryAddr = false
 	return nil
 }
 
@@ -220,6 +282,13 @@ func (c *Controller) SetReadTimeout(timeout int) error {
 	return c.CommandController(fmt.Sprintf("read_tmo_ms %d", timeout))
 }
 
+// Trigger sends the `trg` command to the Prologix controller, which sends the
+// Group Execute Trigger (GET) message to the instrument at the current GPIB
+// address.
+func (c *Controller) Trigger() error {
+	return c.CommandController("trg")
+}
+
 // Version returns the version string from the Prologix GPIB controller.
 func (c *Controller) Version() (string, error) {
 	return c.QueryController("ver")
@@ -7,15 +7,23 @@ package prologix
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"io"
 	"log"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Controller models a GPIB controller-in-charge.
 type Controller struct {
-	rw               io.ReadWriter
+	// mu serializes the use of the controller by Instruments, Scan, the
+	// HealthMonitor, and the queries made directly on the controller.
+	mu               sync.Mutex
+	rw               *conn
 	primaryAddr      int
 	hasSecondaryAddr bool
 	secondaryAddr    int
@@ -23,6 +31,33 @@ type Controller struct {
 	eoi              bool
 	usbTerm          byte
 	eotChar          byte
+	metrics          *Metrics
+	interceptors     []Interceptor
+	// scoped holds the interceptors of the Instrument using the controller.
+	scoped []Interceptor
+}
+
+// conn is the connection to the Prologix adapter, which records when data was
+// last written and received.
+type conn struct {
+	io.ReadWriter
+	lastWrite atomic.Int64
+	lastRead  atomic.Int64
+}
+
+func (c *conn) Write(p []byte) (int, error) {
+	n, err := c.ReadWriter.Write(p)
+	c.lastWrite.Store(time.Now().UnixNano())
+	return n, err
+}
+
+// Read reads from the connection, recording the time if data was received.
+func (c *conn) Read(p []byte) (int, error) {
+	n, err := c.ReadWriter.Read(p)
+	if n > 0 {
+		c.lastRead.Store(time.Now().UnixNano())
+	}
+	return n, err
 }
 
 // ControllerOption applies an option to the controller.
@@ -40,7 +75,7 @@ func NewController(
 	opts ...ControllerOption,
 ) (*Controller, error) {
 	c := Controller{
-		rw:               rw,
+		rw:               &conn{ReadWriter: rw},
 		primaryAddr:      addr,
 		hasSecondaryAddr: false,
 		auto:             false,
@@ -104,13 +139,33 @@ func WithSecondaryAddress(addr int) ControllerOption {
 // Write writes the given data to the instrument at the currently assigned GPIB
 // address.
 func (c *Controller) Write(p []byte) (n int, err error) {
-	return c.rw.Write(p)
+	op := Operation{Kind: WriteOperation, Payload: string(p)}
+	err = c.intercept(&op, func(op *Operation) error {
+		n, err = c.rw.Write([]byte(op.Payload))
+		return err
+	})
+	// An interceptor may have changed the length of the data.
+	if err == nil || n > len(p) {
+		n = len(p)
+	}
+	return n, err
 }
 
 // Read reads from the instrument at the currently assigned GPIB address into
-// the given byte slice.
+// the given byte slice. If an interceptor makes the data read longer than the
+// byte slice, the data is truncated and io.ErrShortBuffer is returned.
 func (c *Controller) Read(p []byte) (n int, err error) {
-	return c.rw.Read(p)
+	op := Operation{Kind: ReadOperation}
+	err = c.intercept(&op, func(op *Operation) error {
+		n, err = c.rw.Read(p)
+		op.Response = string(p[:n])
+		return err
+	})
+	n = copy(p, op.Response)
+	if err == nil && n < len(op.Response) {
+		err = io.ErrShortBuffer
+	}
+	return n, err
 }
 
 // WriteString writes a string to the instrument at the currently assigned GPIB
@@ -118,7 +173,7 @@ func (c *Controller) Read(p []byte) (n int, err error) {
 func (c *Controller) WriteString(s string) (n int, err error) {
 	cmd := fmt.Sprintf("%s%c", strings.TrimSpace(s), c.usbTerm)
 	log.Printf("prologix driver writing string: %s", cmd)
-	return c.rw.Write([]byte(cmd))
+	return c.Write([]byte(cmd))
 }
 
 // Command formats according to a format specifier if provided and sends a
@@ -130,13 +185,12 @@ func (c *Controller) Command(format string, a ...any) error {
 	if a != nil {
 		cmd = fmt.Sprintf(format, a...)
 	}
-	// log.Printf("sending cmd (terminator not yet added): %#v", cmd)
-	// TODO: Why am I trimming whitespace and adding the USB terminator here if
-	// I'm calling the WriteString method, which does that as well?
-	cmd = fmt.Sprintf("%s%c", strings.TrimSpace(cmd), c.usbTerm)
-	// log.Printf("sending cmd (with terminator added): %#v", cmd)
-	_, err := fmt.Fprint(c.rw, cmd)
-	return err
+	op := Operation{Kind: CommandOperation, Payload: strings.TrimSpace(cmd)}
+	return c.intercept(&op, func(op *Operation) error {
+		// log.Printf("sending cmd (with terminator added): %#v", cmd)
+		_, err := fmt.Fprintf(c.rw, "%s%c", op.Payload, c.usbTerm)
+		return err
+	})
 }
 
 // Query queries the instrument at the currently assigned GPIB using the given
@@ -147,12 +201,33 @@ func (c *Controller) Command(format string, a ...any) error {
 // non-escaped LF, CR and ESC characters and appends the GPIB terminator, as
 // specified by the `eos` command, before sending the data to instruments.  To
 // change the GPIB terminator use the SetGPIBTermination method.
+//
+// The controller is held for the whole query, so the query waits for the
+// operations of the Instruments sharing the controller, and a HealthMonitor
+// doesn't probe the adapter before the response is read.
 func (c *Controller) Query(cmd string) (string, error) {
-	cmd = fmt.Sprintf("%s%c", strings.TrimSpace(cmd), c.usbTerm)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.query(cmd)
+}
+
+// query performs the query. The lock must be held.
+func (c *Controller) query(cmd string) (string, error) {
+	op := Operation{Kind: QueryOperation, Payload: strings.TrimSpace(cmd)}
+	err := c.intercept(&op, func(op *Operation) error {
+		var err error
+		op.Response, err = c.sendQuery(op.Payload)
+		return err
+	})
+	return op.Response, err
+}
+
+// sendQuery sends the query and reads the response.
+func (c *Controller) sendQuery(cmd string) (string, error) {
 	// log.Printf("sending query cmd: %#v", cmd)
-	_, err := fmt.Fprint(c.rw, cmd)
+	_, err := fmt.Fprintf(c.rw, "%s%c", cmd, c.usbTerm)
 	if err != nil {
-		return "", fmt.Errorf("error writing command: %s", err)
+		return "", fmt.Errorf("error writing command: %w", err)
 	}
 	// If read-after-write is disabled, need to tell the Prologix controller to
 	// read.
@@ -160,7 +235,7 @@ func (c *Controller) Query(cmd string) (string, error) {
 		readCmd := "++read eoi"
 		_, err = fmt.Fprintf(c.rw, "%s%c", readCmd, c.usbTerm)
 		if err != nil {
-			return "", fmt.Errorf("error sending `%s` command: %s", readCmd, err)
+			return "", fmt.Errorf("error sending `%s` command: %w", readCmd, err)
 		}
 	}
 	s, err := bufio.NewReader(c.rw).ReadString(c.eotChar)
@@ -171,17 +246,83 @@ func (c *Controller) Query(cmd string) (string, error) {
 	return s, err
 }
 
+// QueryBlock queries the instrument at the currently assigned GPIB address
+// using the given command and returns the data of the IEEE 488.2 definite
+// length arbitrary block it answers with, such as `#15hello`. Unlike the
+// response returned by Query, the data may contain any bytes, including the
+// EOT character. Like Query, the controller is held for the whole query.
+func (c *Controller) QueryBlock(cmd string) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.queryBlock(cmd)
+}
+
+// queryBlock performs the block query. The lock must be held.
+func (c *Controller) queryBlock(cmd string) ([]byte, error) {
+	op := Operation{Kind: QueryOperation, Payload: strings.TrimSpace(cmd)}
+	err := c.intercept(&op, func(op *Operation) error {
+		if _, err := fmt.Fprintf(c.rw, "%s%c", op.Payload, c.usbTerm); err != nil {
+			return fmt.Errorf("error writing command: %w", err)
+		}
+		if !c.auto {
+			if _, err := fmt.Fprintf(c.rw, "++read eoi%c", c.usbTerm); err != nil {
+				return fmt.Errorf("error sending `++read eoi` command: %w", err)
+			}
+		}
+		data, err := c.readBlock(bufio.NewReader(c.rw))
+		op.Response = string(data)
+		return err
+	})
+	return []byte(op.Response), err
+}
+
+// readBlock reads a definite length arbitrary block, which consists of `#`,
+// a digit giving the number of digits of the length, the length, and the
+// data, followed by the end of the response.
+func (c *Controller) readBlock(r *bufio.Reader) ([]byte, error) {
+	header, err := r.Peek(2)
+	if err != nil {
+		return nil, fmt.Errorf("error reading block header: %w", err)
+	}
+	if header[0] != '#' || header[1] < '1' || header[1] > '9' {
+		s, _ := r.ReadString(c.eotChar)
+		return nil, fmt.Errorf("definite length block not determinable; received %s", strings.TrimSpace(s))
+	}
+	digits := make([]byte, 2+header[1]-'0')
+	if _, err := io.ReadFull(r, digits); err != nil {
+		return nil, fmt.Errorf("error reading block header: %w", err)
+	}
+	n, err := strconv.Atoi(string(digits[2:]))
+	if err != nil {
+		return nil, fmt.Errorf("block length not determinable; received %s", digits)
+	}
+	var data bytes.Buffer
+	if _, err := io.CopyN(&data, r, int64(n)); err != nil {
+		return nil, fmt.Errorf("error reading %d byte block: %w", n, err)
+	}
+	// Discard the terminator following the block and the EOT character.
+	if _, err := r.ReadString(c.eotChar); err != nil {
+		return nil, fmt.Errorf("error reading end of block: %w", err)
+	}
+	return data.Bytes(), nil
+}
+
 // QueryController sends the given command to the Prologix controller and
 // returns its response as a string. To indicate this is a command for the
 // Prologix controller, thereby not transmitting over GPIB, two plus signs `++`
 // are prepended. Addtionally, a new line is appended to act as the USB
 // termination character.
 func (c *Controller) QueryController(cmd string) (string, error) {
-	_, err := fmt.Fprintf(c.rw, "++%s%c", strings.ToLower(strings.TrimSpace(cmd)), c.usbTerm)
-	if err != nil {
-		return "", err
-	}
-	return bufio.NewReader(c.rw).ReadString(c.eotChar)
+	op := Operation{Kind: ControllerQueryOperation, Payload: strings.ToLower(strings.TrimSpace(cmd))}
+	err := c.intercept(&op, func(op *Operation) error {
+		_, err := fmt.Fprintf(c.rw, "++%s%c", op.Payload, c.usbTerm)
+		if err != nil {
+			return err
+		}
+		op.Response, err = bufio.NewReader(c.rw).ReadString(c.eotChar)
+		return err
+	})
+	return op.Response, err
 }
 
 // CommandController sends the given command to the Prologix controller. To
@@ -189,8 +330,11 @@ func (c *Controller) QueryController(cmd string) (string, error) {
 // transmitting to the instrument over GPIB, two plus signs `++` are prepended.
 // Addtionally, a new line is appended to act as the USB termination character.
 func (c *Controller) CommandController(cmd string) error {
-	_, err := fmt.Fprintf(c.rw, "++%s%c", strings.ToLower(strings.TrimSpace(cmd)), c.usbTerm)
-	return err
+	op := Operation{Kind: ControllerCommandOperation, Payload: strings.ToLower(strings.TrimSpace(cmd))}
+	return c.intercept(&op, func(op *Operation) error {
+		_, err := fmt.Fprintf(c.rw, "++%s%c", op.Payload, c.usbTerm)
+		return err
+	})
 }
 
 // GpibTerm provides the type for the available GPIB terminators.
@@ -8,6 +8,8 @@ package prologix
 import (
 	"fmt"
 	"testing"
+
+	"github.com/gotmc/prologix/sim"
 )
 
 func TestIsPrimaryAddressValid(t *testing.T) {
@@ -69,3 +71,26 @@ func TestIsSecondaryAddressValid(t *testing.T) {
 		})
 	}
 }
+
+func TestConfig(t *testing.T) {
+	conn := sim.NewAdapter().Dial()
+	defer conn.Close()
+	gpib, err := NewController(conn, 5, false, WithSecondaryAddress(96))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := gpib.Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Config{
+		Version:         sim.VersionUSB,
+		Address:         "5 96",
+		AssertEOI:       true,
+		GPIBTermination: AppendCRLF,
+		ReadTimeout:     500,
+	}
+	if got != want {
+		t.Errorf("got %+v; want %+v", got, want)
+	}
+}
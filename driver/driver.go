@@ -0,0 +1,79 @@
+// Copyright (c) 2020–2024 The prologix developers. All rights reserved.
+// Project site: https://github.com/gotmc/prologix
+// Use of this source code is governed by a MIT-style license that
+// can be found in the LICENSE.txt file for the project.
+
+// Package driver provides the registry of the transport drivers used by
+// prologix.Open to connect to a Prologix adapter. Drivers register themselves
+// when imported, so a program imports the drivers it needs, if only for their
+// side effects:
+//
+//	import _ "github.com/gotmc/prologix/driver/vcp"
+package driver
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// Driver opens connections to Prologix adapters.
+type Driver interface {
+	// Open opens a connection to the adapter at the given address, whose
+	// format depends on the driver, such as a serial port or a host and port.
+	Open(addr string) (io.ReadWriteCloser, error)
+}
+
+// OpenFunc is an adapter to allow the use of an ordinary function as a
+// Driver.
+type OpenFunc func(addr string) (io.ReadWriteCloser, error)
+
+// Open calls f(addr).
+func (f OpenFunc) Open(addr string) (io.ReadWriteCloser, error) {
+	return f(addr)
+}
+
+var (
+	mu      sync.RWMutex
+	drivers = make(map[string]Driver)
+)
+
+// Register makes a driver available for the given VISA interface type, such
+// as ASRL or TCPIP. Register panics if it's called twice for the same
+// interface type or if the driver is nil.
+func Register(name string, d Driver) {
+	mu.Lock()
+	defer mu.Unlock()
+	if d == nil {
+		panic("driver: Register driver is nil")
+	}
+	if _, dup := drivers[name]; dup {
+		panic("driver: Register called twice for driver " + name)
+	}
+	drivers[name] = d
+}
+
+// Open opens a connection to the adapter at the given address using the
+// driver registered for the interface type.
+func Open(name, addr string) (io.ReadWriteCloser, error) {
+	mu.RLock()
+	d, ok := drivers[name]
+	mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("no driver registered for %s (forgotten import?)", name)
+	}
+	return d.Open(addr)
+}
+
+// Drivers returns the sorted interface types of the registered drivers.
+func Drivers() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	names := make([]string, 0, len(drivers))
+	for name := range drivers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,89 @@
+// Copyright (c) 2020–2024 The prologix developers. All rights reserved.
+// Project site: https://github.com/gotmc/prologix
+// Use of this source code is governed by a MIT-style license that
+// can be found in the LICENSE.txt file for the project.
+
+// Package ethernet provides the driver for the Prologix GPIB-ETHERNET
+// controller, which is registered for the TCPIP interface type.
+package ethernet
+
+import (
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/gotmc/prologix/driver"
+)
+
+// Port is the TCP port on which the Prologix GPIB-ETHERNET controller
+// listens.
+const Port = "1234"
+
+// dialTimeout is the time allowed to connect to the controller.
+const dialTimeout = 5 * time.Second
+
+func init() {
+	driver.Register("TCPIP", driver.OpenFunc(func(addr string) (io.ReadWriteCloser, error) {
+		return NewEthernet(addr)
+	}))
+}
+
+// Ethernet models a Prologix GPIB-ETHERNET controller communicating over TCP.
+type Ethernet struct {
+	conn net.Conn
+}
+
+// NewEthernet connects to the Prologix GPIB-ETHERNET controller at the given
+// host, which may include the TCP port, defaulting to port 1234.
+func NewEthernet(host string) (*Ethernet, error) {
+	addr := host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, Port)
+	}
+	conn, err := net.DialTimeout("tcp", addr, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	e := Ethernet{
+		conn: conn,
+	}
+	return &e, nil
+}
+
+// Dialer returns a function connecting to the Prologix GPIB-ETHERNET
+// controller at the given host, such as for use as the prologix.Dialer of a
+// Reconnector.
+func Dialer(host string) func() (io.ReadWriteCloser, error) {
+	return func() (io.ReadWriteCloser, error) {
+		return NewEthernet(host)
+	}
+}
+
+// Write writes the given data to the TCP connection.
+func (e *Ethernet) Write(p []byte) (n int, err error) {
+	return e.conn.Write(p)
+}
+
+// Read reads from the TCP connection into the given byte slice.
+func (e *Ethernet) Read(p []byte) (n int, err error) {
+	return e.conn.Read(p)
+}
+
+// Close closes the underlying TCP connection.
+func (e *Ethernet) Close() error {
+	return e.conn.Close()
+}
+
+// SetReadDeadline sets the deadline for future Read calls, which allows a
+// read in progress to be interrupted. A zero value means Read won't time out.
+func (e *Ethernet) SetReadDeadline(t time.Time) error {
+	return e.conn.SetReadDeadline(t)
+}
+
+// WriteString trims all whitespace, adds a newline, and then writes the
+// string using the underlying TCP connection.
+func (e *Ethernet) WriteString(s string) (n int, err error) {
+	s = strings.TrimSpace(s) + "\n"
+	return io.WriteString(e.conn, s)
+}
@@ -0,0 +1,16 @@
+// Copyright (c) 2020–2024 The prologix developers. All rights reserved.
+// Project site: https://github.com/gotmc/prologix
+// Use of this source code is governed by a MIT-style license that
+// can be found in the LICENSE.txt file for the project.
+
+//go:build !unix
+
+package vcp
+
+import "os"
+
+// lockPort does nothing on systems without flock, where serial ports are
+// opened for exclusive access by the operating system.
+func lockPort(name string) (*os.File, error) {
+	return nil, nil
+}
@@ -6,50 +6,269 @@
 package vcp
 
 import (
+	"errors"
+	"fmt"
 	"io"
+	"os"
 	"strings"
+	"time"
 
+	"github.com/gotmc/prologix/driver"
 	"go.bug.st/serial"
+	"go.bug.st/serial/enumerator"
 )
 
+// ErrInUse is returned, wrapped with the serial port, when the serial port is
+// already in use by another process.
+var ErrInUse = errors.New("adapter in use")
+
+// ErrTimeout is returned by Read when no data is received within the read
+// timeout. Like the errors of a net.Conn whose deadline expired, it has a
+// Timeout method returning true.
+var ErrTimeout error = timeoutError{}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "serial port read timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func init() {
+	driver.Register("ASRL", driver.OpenFunc(func(addr string) (io.ReadWriteCloser, error) {
+		return NewVCP(addr, WithExclusiveLock())
+	}))
+}
+
 // VCP models a Prologix GPIB-USB controller communicating using a Virtual COM
 // Port (VCP).
 type VCP struct {
-	port serial.Port
+	port        serial.Port
+	mode        serial.Mode
+	readTimeout time.Duration
+	exclusive   bool
+	lock        *os.File
 }
 
-// NewVCP creates a new Virtual COM Port (VCP).
-func NewVCP(serialPort string) (*VCP, error) {
-	mode := &serial.Mode{
-		BaudRate: 115200,
-		Parity:   serial.EvenParity,
-		DataBits: 7,
-		StopBits: serial.OneStopBit,
+// Option applies an option to the Virtual COM Port.
+type Option func(*VCP)
+
+// NewVCP creates a new Virtual COM Port (VCP), which by default uses 115200
+// baud, 7 data bits, even parity, and one stop bit with DTR and RTS asserted
+// and no read timeout. Optionally the serial port configuration can be
+// included using an Option.
+func NewVCP(serialPort string, opts ...Option) (*VCP, error) {
+	vcp := VCP{
+		mode: serial.Mode{
+			BaudRate: 115200,
+			Parity:   serial.EvenParity,
+			DataBits: 7,
+			StopBits: serial.OneStopBit,
+		},
+	}
+	for _, opt := range opts {
+		opt(&vcp)
 	}
-	port, err := serial.Open(serialPort, mode)
+	// Lock the serial port before opening it, since the serial port is opened
+	// for exclusive access, which would prevent opening it again to lock it.
+	if vcp.exclusive {
+		lock, err := lockPort(serialPort)
+		if err != nil {
+			return nil, err
+		}
+		vcp.lock = lock
+	}
+	port, err := serial.Open(serialPort, &vcp.mode)
 	if err != nil {
+		vcp.unlock()
+		var portErr *serial.PortError
+		if errors.As(err, &portErr) && portErr.Code() == serial.PortBusy {
+			return nil, fmt.Errorf("%w: %s is busy", ErrInUse, serialPort)
+		}
 		return nil, err
 	}
-
-	vcp := VCP{
-		port: port,
+	vcp.port = port
+	if vcp.readTimeout > 0 {
+		if err := port.SetReadTimeout(vcp.readTimeout); err != nil {
+			vcp.Close()
+			return nil, err
+		}
 	}
 	return &vcp, nil
 }
 
+// FindPort returns the serial port of the Prologix GPIB-USB controller with
+// the given USB serial number, such as PX8X3YR6, which unlike the serial port
+// doesn't change when the controller is plugged in again.
+func FindPort(serialNumber string) (string, error) {
+	ports, err := enumerator.GetDetailedPortsList()
+	if err != nil {
+		return "", err
+	}
+	for _, p := range ports {
+		if p.IsUSB && strings.EqualFold(p.SerialNumber, serialNumber) {
+			return p.Name, nil
+		}
+	}
+	return "", fmt.Errorf("no USB serial port with serial number %s", serialNumber)
+}
+
+// Dialer returns a function opening the Prologix GPIB-USB controller with the
+// given USB serial number using the options, which finds its serial port
+// again each time, such as for use as the prologix.Dialer of a Reconnector.
+func Dialer(serialNumber string, opts ...Option) func() (io.ReadWriteCloser, error) {
+	return func() (io.ReadWriteCloser, error) {
+		port, err := FindPort(serialNumber)
+		if err != nil {
+			return nil, err
+		}
+		return NewVCP(port, opts...)
+	}
+}
+
+// WithBaudRate sets the baud rate of the serial port, which defaults to
+// 115200 baud. The Prologix GPIB-USB controller ignores the baud rate.
+func WithBaudRate(baudRate int) Option {
+	return func(vcp *VCP) {
+		vcp.mode.BaudRate = baudRate
+	}
+}
+
+// WithDataBits sets the number of data bits, which defaults to 7.
+func WithDataBits(dataBits int) Option {
+	return func(vcp *VCP) {
+		vcp.mode.DataBits = dataBits
+	}
+}
+
+// WithParity sets the parity, which defaults to even parity.
+func WithParity(parity serial.Parity) Option {
+	return func(vcp *VCP) {
+		vcp.mode.Parity = parity
+	}
+}
+
+// WithStopBits sets the number of stop bits, which defaults to one.
+func WithStopBits(stopBits serial.StopBits) Option {
+	return func(vcp *VCP) {
+		vcp.mode.StopBits = stopBits
+	}
+}
+
+// WithReadTimeout sets the time Read waits for data, after which it returns
+// ErrTimeout. By default, Read waits until data is received.
+func WithReadTimeout(timeout time.Duration) Option {
+	return func(vcp *VCP) {
+		vcp.readTimeout = timeout
+	}
+}
+
+// WithDTR sets whether the Data Terminal Ready (DTR) signal is asserted when
+// the serial port is opened, which it is by default.
+func WithDTR(enable bool) Option {
+	return func(vcp *VCP) {
+		vcp.initialModemBits().DTR = enable
+	}
+}
+
+// WithRTS sets whether the Request To Send (RTS) signal is asserted when the
+// serial port is opened, which it is by default.
+func WithRTS(enable bool) Option {
+	return func(vcp *VCP) {
+		vcp.initialModemBits().RTS = enable
+	}
+}
+
+// WithExclusiveLock takes an advisory exclusive lock on the serial port using
+// flock, so that opening a serial port already locked by another process, or
+// another VCP in this process, fails with an error wrapping ErrInUse. The
+// lock is released by Close. On systems without flock, the lock is skipped.
+func WithExclusiveLock() Option {
+	return func(vcp *VCP) {
+		vcp.exclusive = true
+	}
+}
+
+// initialModemBits returns the modem output bits set when the serial port is
+// opened. They are only set when changed by an option, since setting them
+// fails for pseudo-terminals.
+func (vcp *VCP) initialModemBits() *serial.ModemOutputBits {
+	if vcp.mode.InitialStatusBits == nil {
+		vcp.mode.InitialStatusBits = &serial.ModemOutputBits{DTR: true, RTS: true}
+	}
+	return vcp.mode.InitialStatusBits
+}
+
 // Write writes the given data to the serial port.
 func (vcp *VCP) Write(p []byte) (n int, err error) {
 	return vcp.port.Write(p)
 }
 
-// Read reads from the serial port into the given byte slice.
+// Read reads from the serial port into the given byte slice. When a read
+// timeout is set and no data is received in time, ErrTimeout is returned.
 func (vcp *VCP) Read(p []byte) (n int, err error) {
-	return vcp.port.Read(p)
+	n, err = vcp.port.Read(p)
+	if n == 0 && err == nil && len(p) > 0 {
+		return 0, ErrTimeout
+	}
+	return n, err
+}
+
+// SetReadTimeout sets the time Read waits for data. A zero or negative
+// timeout makes Read wait until data is received.
+func (vcp *VCP) SetReadTimeout(timeout time.Duration) error {
+	vcp.readTimeout = timeout
+	return vcp.setPortTimeout(timeout)
+}
+
+// SetReadDeadline sets the read timeout to the time remaining until t, so
+// that the prologix package can bound the time spent waiting for a response.
+// Unlike with a net.Conn, a read already in progress isn't interrupted, and
+// the deadline must not be set while a read is in progress, since the timeout
+// of the serial port isn't synchronized with Read. A zero value restores the
+// read timeout.
+func (vcp *VCP) SetReadDeadline(t time.Time) error {
+	if t.IsZero() {
+		return vcp.setPortTimeout(vcp.readTimeout)
+	}
+	return vcp.setPortTimeout(max(time.Until(t), time.Millisecond))
+}
+
+// InterruptsRead reports false, so that the prologix package only sets the
+// read deadline before reading, rather than from another goroutine to
+// interrupt a read in progress.
+func (vcp *VCP) InterruptsRead() bool {
+	return false
+}
+
+func (vcp *VCP) setPortTimeout(timeout time.Duration) error {
+	if timeout <= 0 {
+		timeout = serial.NoTimeout
+	}
+	return vcp.port.SetReadTimeout(timeout)
+}
+
+// SetDTR sets the Data Terminal Ready (DTR) signal.
+func (vcp *VCP) SetDTR(enable bool) error {
+	return vcp.port.SetDTR(enable)
+}
+
+// SetRTS sets the Request To Send (RTS) signal.
+func (vcp *VCP) SetRTS(enable bool) error {
+	return vcp.port.SetRTS(enable)
 }
 
-// Close closes the underlying serial port.
+// Close closes the underlying serial port and releases its lock.
 func (vcp *VCP) Close() error {
-	return vcp.port.Close()
+	err := vcp.port.Close()
+	vcp.unlock()
+	return err
+}
+
+func (vcp *VCP) unlock() {
+	if vcp.lock != nil {
+		vcp.lock.Close()
+		vcp.lock = nil
+	}
 }
 
 func (vcp *VCP) Flush() error {
@@ -6,6 +6,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"io"
 	"log"
@@ -114,13 +115,24 @@ func main() {
 		"MTYP5",      // Set the modulation to burst
 		"MENA1",      // Enable modulation
 	}
+	// Wait for the function generator to complete each command before sending
+	// the next one.
+	fgen, err := gpib.Instrument(gpibAddress)
+	if err != nil {
+		log.Fatal(err)
+	}
 	for _, cmd := range cmds {
 		log.Printf("Sending command: %s", cmd)
-		err = gpib.Command(cmd)
+		err = fgen.Command(cmd)
 		if err != nil {
 			log.Fatal(err)
 		}
-		time.Sleep(250 * time.Millisecond)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err = fgen.WaitOperationComplete(ctx)
+		cancel()
+		if err != nil {
+			log.Fatalf("error waiting for %s to complete: %s", cmd, err)
+		}
 	}
 
 	// Return local control to the front panel.
@@ -12,7 +12,6 @@ import (
 
 	"github.com/gotmc/prologix"
 	"github.com/gotmc/prologix/driver/vcp"
-	"github.com/gotmc/query"
 )
 
 var (
@@ -119,7 +118,7 @@ func main() {
 	}
 
 	// Query the output state
-	state, err := query.Bool(gpib, "OUTP:STAT?")
+	state, err := prologix.QueryBool(gpib, "OUTP:STAT?")
 	if err != nil && err != io.EOF {
 		log.Fatalf("error querying serial port: %s", err)
 	}
@@ -142,21 +141,21 @@ func main() {
 	}
 
 	// Query the voltage and current at the output
-	vc, err := gpib.Query("appl? p6v")
-	if err != nil && err != io.EOF {
-		log.Fatalf("error querying serial port: %s", err)
+	vc, err := prologix.QueryFloat64s(gpib, "appl? p6v")
+	if err != nil {
+		log.Fatalf("error querying voltage and current: %s", err)
 	}
-	log.Printf("voltage, current = %s", vc)
+	log.Printf("voltage, current = %v", vc)
 
 	// Query the voltage at the output
-	volt, err := gpib.Query("meas? p6v")
-	if err != nil && err != io.EOF {
-		log.Fatalf("error querying serial port: %s", err)
+	volt, err := prologix.QueryFloat64(gpib, "meas? p6v")
+	if err != nil {
+		log.Fatalf("error measuring voltage: %s", err)
 	}
-	log.Printf("voltage = %s", volt)
+	log.Printf("voltage = %f V", volt)
 
 	// Query the output state
-	state, err = query.Bool(gpib, "OUTP:STAT?")
+	state, err = prologix.QueryBool(gpib, "OUTP:STAT?")
 	if err != nil && err != io.EOF {
 		log.Fatalf("error querying serial port: %s", err)
 	}
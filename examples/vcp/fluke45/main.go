@@ -6,19 +6,38 @@
 package main
 
 import (
+	"flag"
 	"io"
 	"log"
-	"strconv"
-	"strings"
 	"time"
 
 	"github.com/gotmc/prologix"
 	"github.com/gotmc/prologix/driver/vcp"
 )
 
+var (
+	serialPort  string
+	gpibAddress int
+)
+
+func init() {
+	// Get Virtual COM Port (VCP) serial port for Prologix.
+	flag.StringVar(
+		&serialPort,
+		"port",
+		"/dev/tty.usbserial-PXFJL0WD",
+		"Serial port for Prologix VCP GPIB controller",
+	)
+
+	flag.IntVar(&gpibAddress, "gpib", 10, "GPIB address for the Fluke 45")
+}
+
 func main() {
+	// Parse the flags
+	flag.Parse()
+
 	// Open virtual comm port.
-	serialPort := "/dev/tty.usbserial-PXFJL0WD"
+	log.Printf("Serial port = %s", serialPort)
 	vcp, err := vcp.NewVCP(serialPort)
 	if err != nil {
 		log.Fatal(err)
@@ -26,7 +45,7 @@ func main() {
 
 	// Create a new GPIB controller using the aforementioned serial port
 	// communicating with the instrument at the given GPIB address.
-	gpib, err := prologix.NewController(vcp, 10, true)
+	gpib, err := prologix.NewController(vcp, gpibAddress, true)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -144,18 +163,10 @@ func main() {
 	log.Printf("query idn = %s", idn)
 
 	// Measure the resistance
-	resString, err := gpib.Query("meas1?")
-	if err != nil && err != io.EOF {
-		log.Fatalf("error querying serial port: %s", err)
-	} else if err == io.EOF {
-		log.Printf("received EOF")
-	}
-	resString = strings.TrimSpace(resString)
-	res, err := strconv.ParseFloat(resString, 64)
+	res, err := prologix.QueryFloat64(gpib, "meas1?")
 	if err != nil {
-		log.Printf("error converting %s into a float64", resString)
+		log.Fatalf("error measuring resistance: %s", err)
 	}
-	log.Printf("resistance = %s ohms (string)", resString)
 	log.Printf("resistance = %f ohms", res)
 
 	// Return local control to the front panel.
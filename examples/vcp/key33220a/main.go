@@ -6,6 +6,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"io"
 	"log"
@@ -123,15 +124,25 @@ func main() {
 		"OUTP ON",              // Enable the output
 		"SYST:LOC",             // Set the instrument state to local
 	}
+	// Wait for the function generator to complete each command before sending
+	// the next one. In strict mode, a command the function generator rejects
+	// returns the errors from its SCPI error queue.
+	fgen, err := gpib.Instrument(gpibAddress, prologix.WithStrictErrors())
+	if err != nil {
+		log.Fatal(err)
+	}
 	for _, cmd := range cmds {
 		log.Printf("Sending command: %s", cmd)
-		err = gpib.Command(cmd)
+		err = fgen.Command(cmd)
 		if err != nil {
 			log.Fatal(err)
 		}
-		// FIXME: I had to enter this to get the function generator to accept all
-		// commands.
-		time.Sleep(250 * time.Millisecond)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err = fgen.WaitOperationComplete(ctx)
+		cancel()
+		if err != nil {
+			log.Fatalf("error waiting for %s to complete: %s", cmd, err)
+		}
 	}
 
 	// Return local control to the front panel.
@@ -0,0 +1,430 @@
+// Copyright (c) 2020–2024 The prologix developers. All rights reserved.
+// Project site: https://github.com/gotmc/prologix
+// Use of this source code is governed by a MIT-style license that
+// can be found in the LICENSE.txt file for the project.
+
+package gateway
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// handshakeTimeout is the time allowed for a client to complete the TLS
+// handshake.
+const handshakeTimeout = 10 * time.Second
+
+var (
+	errAccessDenied = errors.New("access denied")
+	errInvalidToken = errors.New("invalid token")
+)
+
+// AccessPolicy lists the clients of the gateway servers and the instruments
+// they may use. It's usually loaded from a JSON file using LoadAccessPolicy,
+// such as:
+//
+//	{
+//	  "tokens": {"6f1c...": "dashboard"},
+//	  "rules": [
+//	    {"clients": ["alice", "192.168.1.0/24"]},
+//	    {"clients": ["dashboard"], "addresses": ["10", "22,96"], "commands": ["*?"]}
+//	  ]
+//	}
+type AccessPolicy struct {
+	// Tokens maps the bearer tokens accepted by the HTTP API to the names of
+	// their clients.
+	Tokens map[string]string `json:"tokens,omitempty"`
+	// Rules grant access to the instruments. Whatever isn't granted by a rule
+	// is denied.
+	Rules []AccessRule `json:"rules"`
+}
+
+// AccessRule grants clients access to instruments.
+type AccessRule struct {
+	// Clients lists the names of the clients the rule applies to, `*` for any
+	// authenticated client, or networks in CIDR notation, such as
+	// `192.168.1.0/24`, matching clients by IP address whether authenticated
+	// or not.
+	Clients []string `json:"clients"`
+	// Addresses lists the GPIB addresses of the instruments, as the primary
+	// address optionally followed by a comma and the secondary address, such
+	// as `10` or `22,96`. An empty list grants all the instruments, along with
+	// scanning the bus and reading the configuration of the controller.
+	Addresses []string `json:"addresses,omitempty"`
+	// Commands lists patterns matched ignoring case against the header of each
+	// command sent, in which `*` matches any characters, such as `*?` for
+	// queries only or `SOUR:VOLT*`. An empty list grants all commands along
+	// with triggering, clearing, locking, and the remote and local control of
+	// the instruments, which are otherwise denied. Reading responses and
+	// serial polling are granted along with the instruments.
+	Commands []string `json:"commands,omitempty"`
+}
+
+// LoadAccessPolicy reads an access policy from a JSON file.
+func LoadAccessPolicy(name string) (AccessPolicy, error) {
+	var p AccessPolicy
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return p, err
+	}
+	if err := json.Unmarshal(data, &p); err != nil {
+		return p, fmt.Errorf("error parsing access policy %s: %w", name, err)
+	}
+	return p, nil
+}
+
+// AccessControl authenticates the clients of the gateway servers and
+// enforces an access policy, logging the denied attempts. Clients are
+// identified by the common name of the certificate they present over mutual
+// TLS, by a bearer token with the HTTP API, or else only by their IP address.
+// Since VXI-11 and HiSLIP clients usually can't present either, their rules
+// normally list networks.
+//
+// A nil *AccessControl grants everything to anyone.
+type AccessControl struct {
+	tokens map[string]string
+	rules  []accessRule
+	logger *log.Logger
+}
+
+// accessRule is a parsed AccessRule.
+type accessRule struct {
+	anyClient bool
+	names     map[string]bool
+	networks  []*net.IPNet
+	// addrs holds the addresses formatted like devices.instrument does, or is
+	// nil for all addresses.
+	addrs    map[string]bool
+	commands []string
+}
+
+// AccessOption applies an option to the access control.
+type AccessOption func(*AccessControl)
+
+// WithAccessLogger sets the logger of denied attempts, which defaults to the
+// standard logger.
+func WithAccessLogger(l *log.Logger) AccessOption {
+	return func(ac *AccessControl) {
+		ac.logger = l
+	}
+}
+
+// NewAccessControl creates an access control enforcing the policy.
+// Optionally the access control can be configured using an AccessOption.
+func NewAccessControl(p AccessPolicy, opts ...AccessOption) (*AccessControl, error) {
+	ac := AccessControl{
+		tokens: make(map[string]string),
+		logger: log.Default(),
+	}
+	for token, name := range p.Tokens {
+		if token == "" || name == "" {
+			return nil, errors.New("access policy has an empty token or client name")
+		}
+		ac.tokens[token] = name
+	}
+	for i, r := range p.Rules {
+		rule := accessRule{names: make(map[string]bool)}
+		for _, c := range r.Clients {
+			switch _, network, err := net.ParseCIDR(c); {
+			case err == nil:
+				rule.networks = append(rule.networks, network)
+			case c == "*":
+				rule.anyClient = true
+			case c != "":
+				rule.names[c] = true
+			}
+		}
+		if len(r.Addresses) > 0 {
+			rule.addrs = make(map[string]bool)
+		}
+		for _, a := range r.Addresses {
+			addr, err := normalizeAddress(a)
+			if err != nil {
+				return nil, fmt.Errorf("access rule %d: %w %s", i+1, err, a)
+			}
+			rule.addrs[addr] = true
+		}
+		for _, c := range r.Commands {
+			rule.commands = append(rule.commands, strings.ToUpper(strings.TrimSpace(c)))
+		}
+		ac.rules = append(ac.rules, rule)
+	}
+	for _, opt := range opts {
+		opt(&ac)
+	}
+	return &ac, nil
+}
+
+// normalizeAddress formats a GPIB address given like `22,96` as `22 96`.
+func normalizeAddress(addr string) (string, error) {
+	fields := strings.Split(addr, ",")
+	if len(fields) > 2 {
+		return "", errInvalidAddress
+	}
+	for i, f := range fields {
+		n, err := strconv.Atoi(strings.TrimSpace(f))
+		if err != nil {
+			return "", errInvalidAddress
+		}
+		fields[i] = strconv.Itoa(n)
+	}
+	return strings.Join(fields, " "), nil
+}
+
+// NewTLSConfig returns a TLS configuration serving the certificate and key in
+// the PEM files. Unless clientCAFile is empty, clients must present a
+// certificate signed by one of the certificate authorities in the PEM file,
+// whose common name is then the name of the client.
+func NewTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if clientCAFile != "" {
+		pem, err := os.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ClientCAs = x509.NewCertPool()
+		if !cfg.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", clientCAFile)
+		}
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+// client is a client of a gateway server.
+type client struct {
+	// name is the name of an authenticated client, or empty.
+	name string
+	addr string
+	ip   net.IP
+}
+
+func newClient(name, addr string) client {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	return client{name: name, addr: addr, ip: net.ParseIP(host)}
+}
+
+func (c client) String() string {
+	if c.name == "" {
+		return c.addr
+	}
+	return c.name + " (" + c.addr + ")"
+}
+
+// identify identifies the client of the connection, completing the TLS
+// handshake of a TLS connection.
+func (ac *AccessControl) identify(conn net.Conn) (client, error) {
+	tc, ok := conn.(*tls.Conn)
+	if !ok {
+		return newClient("", conn.RemoteAddr().String()), nil
+	}
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	err := tc.Handshake()
+	conn.SetDeadline(time.Time{})
+	if err != nil {
+		return client{}, fmt.Errorf("TLS handshake: %w", err)
+	}
+	return newClient(peerName(tc.ConnectionState()), conn.RemoteAddr().String()), nil
+}
+
+// authenticate identifies the client of the HTTP request by its bearer token,
+// if any, or else by its certificate.
+func (ac *AccessControl) authenticate(r *http.Request) (client, error) {
+	if ac == nil {
+		return newClient("", r.RemoteAddr), nil
+	}
+	var name string
+	if r.TLS != nil {
+		name = peerName(*r.TLS)
+	}
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		name = ""
+		// The tokens are compared in constant time so their contents can't
+		// be guessed from the response time.
+		for t, n := range ac.tokens {
+			if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+				name = n
+			}
+		}
+		if name == "" {
+			c := newClient("", r.RemoteAddr)
+			ac.deny(c, "authentication with invalid token")
+			return c, errInvalidToken
+		}
+	}
+	return newClient(name, r.RemoteAddr), nil
+}
+
+// peerName returns the common name of the verified client certificate, if
+// any.
+func peerName(cs tls.ConnectionState) string {
+	if len(cs.VerifiedChains) == 0 || len(cs.PeerCertificates) == 0 {
+		return ""
+	}
+	return cs.PeerCertificates[0].Subject.CommonName
+}
+
+// allowBus reports whether the client may use the whole bus, such as to scan
+// it.
+func (ac *AccessControl) allowBus(c client, op string) error {
+	if ac == nil {
+		return nil
+	}
+	for _, r := range ac.rules {
+		if r.appliesTo(c) && r.addrs == nil {
+			return nil
+		}
+	}
+	return ac.deny(c, op)
+}
+
+// allowAddress reports whether the client may use the instrument at the
+// address, formatted like devices.instrument does, to read responses and
+// serial poll.
+func (ac *AccessControl) allowAddress(c client, addr string) error {
+	if ac == nil {
+		return nil
+	}
+	for _, r := range ac.rules {
+		if r.appliesTo(c) && r.allowsAddress(addr) {
+			return nil
+		}
+	}
+	return ac.deny(c, "use of GPIB address "+addr)
+}
+
+// allowCommand reports whether the client may send the line of commands to
+// the instrument at the address.
+func (ac *AccessControl) allowCommand(c client, addr, line string) error {
+	if ac == nil {
+		return nil
+	}
+	for _, r := range ac.rules {
+		if r.appliesTo(c) && r.allowsAddress(addr) && r.allowsLine(line) {
+			return nil
+		}
+	}
+	return ac.deny(c, fmt.Sprintf("command %q to GPIB address %s", line, addr))
+}
+
+// allowControl reports whether the client may perform an operation other
+// than sending commands, such as triggering, on the instrument at the
+// address.
+func (ac *AccessControl) allowControl(c client, addr, op string) error {
+	if ac == nil {
+		return nil
+	}
+	for _, r := range ac.rules {
+		if r.appliesTo(c) && r.allowsAddress(addr) && r.commands == nil {
+			return nil
+		}
+	}
+	return ac.deny(c, op+" of GPIB address "+addr)
+}
+
+// deny logs the denied attempt and returns errAccessDenied.
+func (ac *AccessControl) deny(c client, attempt string) error {
+	if ac != nil {
+		ac.logger.Printf("access denied to %s: %s", c, attempt)
+	}
+	return errAccessDenied
+}
+
+func (r accessRule) appliesTo(c client) bool {
+	if c.name != "" && (r.anyClient || r.names[c.name]) {
+		return true
+	}
+	for _, n := range r.networks {
+		if c.ip != nil && n.Contains(c.ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r accessRule) allowsAddress(addr string) bool {
+	return r.addrs == nil || r.addrs[addr]
+}
+
+// allowsLine reports whether the header of each command in the line matches
+// one of the command patterns.
+func (r accessRule) allowsLine(line string) bool {
+	if r.commands == nil {
+		return true
+	}
+	msgs := strings.FieldsFunc(line, func(r rune) bool {
+		return r == ';' || r == '\n' || r == '\r'
+	})
+	for _, msg := range msgs {
+		header := strings.TrimSpace(msg)
+		if header == "" {
+			continue
+		}
+		if i := strings.IndexFunc(header, unicode.IsSpace); i >= 0 {
+			header = header[:i]
+		}
+		header = strings.ToUpper(header)
+		matched := false
+		for _, pattern := range r.commands {
+			if matchPattern(pattern, header) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// matchPattern reports whether s matches the pattern, in which `*` matches
+// any sequence of characters and other characters match themselves. When a
+// character doesn't match, only the last `*` matches one more character, so
+// the time taken is at most proportional to the product of the lengths.
+func matchPattern(pattern, s string) bool {
+	p, i := 0, 0
+	star, next := -1, 0
+	for i < len(s) {
+		switch {
+		case p < len(pattern) && pattern[p] == '*':
+			star, next = p, i
+			p++
+		case p < len(pattern) && pattern[p] == s[i]:
+			p++
+			i++
+		case star >= 0:
+			p = star + 1
+			next++
+			i = next
+		default:
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
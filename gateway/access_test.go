@@ -0,0 +1,413 @@
+// Copyright (c) 2020–2024 The prologix developers. All rights reserved.
+// Project site: https://github.com/gotmc/prologix
+// Use of this source code is governed by a MIT-style license that
+// can be found in the LICENSE.txt file for the project.
+
+package gateway
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gotmc/prologix/sim"
+)
+
+// syncBuffer is a buffer safe for concurrent use, collecting log output.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func newAccessControl(t *testing.T, p AccessPolicy, logs *syncBuffer) *AccessControl {
+	t.Helper()
+	ac, err := NewAccessControl(p, WithAccessLogger(log.New(logs, "", 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ac
+}
+
+func TestAccessControl(t *testing.T) {
+	var logs syncBuffer
+	ac := newAccessControl(t, AccessPolicy{Rules: []AccessRule{
+		{Clients: []string{"alice", "10.0.0.0/8"}},
+		{Clients: []string{"*"}, Addresses: []string{"10", "22, 96"}, Commands: []string{"*?", "meas:*"}},
+	}}, &logs)
+	alice := newClient("alice", "192.168.1.2:5000")
+	bob := newClient("bob", "192.168.1.3:5000")
+	lan := newClient("", "10.1.2.3:5000")
+	anonymous := newClient("", "192.168.1.4:5000")
+
+	for _, tc := range []struct {
+		name  string
+		err   error
+		allow bool
+	}{
+		{"alice any command", ac.allowCommand(alice, "5", "OUTP ON"), true},
+		{"alice trigger", ac.allowControl(alice, "5", "trigger"), true},
+		{"alice scan", ac.allowBus(alice, "scan"), true},
+		{"network any command", ac.allowCommand(lan, "5", "OUTP ON"), true},
+		{"bob query", ac.allowCommand(bob, "10", "*IDN?"), true},
+		{"bob queries", ac.allowCommand(bob, "22 96", "MEAS:VOLT? P6V;*ESR?"), true},
+		{"bob measure", ac.allowCommand(bob, "10", "meas:curr"), true},
+		{"bob command", ac.allowCommand(bob, "10", "*IDN?;OUTP ON"), false},
+		{"bob command on next line", ac.allowCommand(bob, "10", "*IDN?\nOUTP ON"), false},
+		{"bob query with tab", ac.allowCommand(bob, "10", "MEAS:VOLT?\tP6V"), true},
+		{"bob command with tab", ac.allowCommand(bob, "10", "OUTP\tON?"), false},
+		{"bob other address", ac.allowCommand(bob, "11", "*IDN?"), false},
+		{"bob serial poll", ac.allowAddress(bob, "22 96"), true},
+		{"bob primary address only", ac.allowAddress(bob, "22"), false},
+		{"bob trigger", ac.allowControl(bob, "10", "trigger"), false},
+		{"bob scan", ac.allowBus(bob, "scan"), false},
+		{"anonymous query", ac.allowCommand(anonymous, "10", "*IDN?"), false},
+	} {
+		if got := tc.err == nil; got != tc.allow {
+			t.Errorf("%s: got %v; want allowed %t", tc.name, tc.err, tc.allow)
+		}
+	}
+	if got := strings.Count(logs.String(), "access denied"); got != 8 {
+		t.Errorf("got %d denials logged; want 8:\n%s", got, logs.String())
+	}
+	if !strings.Contains(logs.String(), `access denied to bob (192.168.1.3:5000): command "*IDN?;OUTP ON" to GPIB address 10`) {
+		t.Errorf("got log %q", logs.String())
+	}
+
+	var nilAC *AccessControl
+	if err := nilAC.allowControl(anonymous, "10", "trigger"); err != nil {
+		t.Errorf("got %v from nil access control", err)
+	}
+	if _, err := NewAccessControl(AccessPolicy{Rules: []AccessRule{{Addresses: []string{"x"}}}}); err == nil {
+		t.Error("got no error for invalid address")
+	}
+}
+
+func TestMatchPattern(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, s string
+		want       bool
+	}{
+		{"*?", "*IDN?", true},
+		{"*?", "*RST", false},
+		{"*", "", true},
+		{"SOUR:VOLT*", "SOUR:VOLT:LEV", true},
+		{"SOUR:VOLT*", "SOUR:CURR", false},
+		{"*:VOLT*?", "MEAS:VOLT:DC?", true},
+		{"OUTP", "OUTP", true},
+		{"OUTP", "OUTP?", false},
+		{"*A*", "XAY", true},
+		{"A*B*C", "AXBYBZC", true},
+		{"A*B*C", "AXBYC", true},
+		{"A*B*C", "AXCYB", false},
+		{"*a*a*a*a*a*a*a*a*b", strings.Repeat("a", 1<<20), false},
+	} {
+		if got := matchPattern(tc.pattern, tc.s); got != tc.want {
+			t.Errorf("matchPattern(%q, %q) = %t; want %t", tc.pattern, tc.s, got, tc.want)
+		}
+	}
+}
+
+// writeCert writes a certificate with the common name, signed by the parent
+// or else self-signed, and its key to PEM files in dir.
+func writeCert(t *testing.T, dir, cn string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(filepath.Join(dir, cn+".pem"), certPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, cn+"-key.pem"), keyPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func TestSocketServerMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := writeCert(t, dir, "ca", nil, nil)
+	writeCert(t, dir, "server", ca, caKey)
+	writeCert(t, dir, "alice", ca, caKey)
+	cfg, err := NewTLSConfig(filepath.Join(dir, "server.pem"), filepath.Join(dir, "server-key.pem"), filepath.Join(dir, "ca.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	adapter := sim.NewAdapter()
+	dmm := sim.NewScripted("SIM,DMM,1,1.0", nil)
+	if err := adapter.Attach(10, dmm); err != nil {
+		t.Fatal(err)
+	}
+	var logs syncBuffer
+	ac := newAccessControl(t, AccessPolicy{Rules: []AccessRule{
+		{Clients: []string{"alice"}, Commands: []string{"*?"}},
+	}}, &logs)
+	inst, err := newSimController(t, adapter).Instrument(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := tls.Listen("tcp", "127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewSocketServer(inst, WithLogger(log.New(io.Discard, "", 0)), WithAccessControl(ac))
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+	addr := l.Addr().String()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	alice, err := tls.LoadX509KeyPair(filepath.Join(dir, "alice.pem"), filepath.Join(dir, "alice-key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{alice}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+	// The denied command is dropped, so the query is answered next.
+	if _, err := conn.Write([]byte("*RST\n*IDN?\n")); err != nil {
+		t.Fatal(err)
+	}
+	if resp, err := r.ReadString('\n'); err != nil || resp != "SIM,DMM,1,1.0\n" {
+		t.Errorf("got response %q (%v)", resp, err)
+	}
+	if received := dmm.Received(); len(received) != 1 || received[0] != "*IDN?" {
+		t.Errorf("got commands %q; want only *IDN?", received)
+	}
+	if !strings.Contains(logs.String(), `access denied to alice (`) {
+		t.Errorf("got log %q", logs.String())
+	}
+
+	// Clients without a certificate are refused.
+	anon, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: roots})
+	if err == nil {
+		anon.SetDeadline(time.Now().Add(5 * time.Second))
+		_, err = anon.Read(make([]byte, 1))
+		anon.Close()
+	}
+	if err == nil {
+		t.Error("got no error connecting without a certificate")
+	}
+}
+
+func TestSocketServerAccessControl(t *testing.T) {
+	adapter := sim.NewAdapter()
+	dmm := sim.NewScripted("SIM,DMM,1,1.0", nil)
+	if err := adapter.Attach(10, dmm); err != nil {
+		t.Fatal(err)
+	}
+	psu := sim.NewScripted("SIM,PSU,2,1.0", nil)
+	if err := adapter.Attach(5, psu); err != nil {
+		t.Fatal(err)
+	}
+	var logs syncBuffer
+	ac := newAccessControl(t, AccessPolicy{Rules: []AccessRule{
+		{Clients: []string{"127.0.0.0/8"}, Addresses: []string{"10"}},
+	}}, &logs)
+	addr := startSocketServer(t, newSimController(t, adapter), 10, WithAccessControl(ac))
+
+	// The command to address 5 embedded after a CR is refused, so the query
+	// is answered next.
+	conn, r := dial(t, addr)
+	fmt.Fprint(conn, "SYST:BEEP\r++addr 5\rOUTP ON\n*IDN?\n")
+	if resp, err := r.ReadString('\n'); err != nil || resp != "SIM,DMM,1,1.0\n" {
+		t.Errorf("got response %q (%v)", resp, err)
+	}
+	if received := dmm.Received(); len(received) != 1 || received[0] != "*IDN?" {
+		t.Errorf("got commands %q; want only *IDN?", received)
+	}
+	if received := psu.Received(); len(received) != 0 {
+		t.Errorf("got commands %q sent to address 5", received)
+	}
+}
+
+func TestHTTPAccessControl(t *testing.T) {
+	adapter := sim.NewAdapter()
+	if err := adapter.Attach(10, sim.NewScripted("SIM,DMM,1,1.0", nil)); err != nil {
+		t.Fatal(err)
+	}
+	var logs syncBuffer
+	ac := newAccessControl(t, AccessPolicy{
+		Tokens: map[string]string{"secret": "dashboard"},
+		Rules: []AccessRule{
+			{Clients: []string{"dashboard"}, Addresses: []string{"10"}, Commands: []string{"*?"}},
+		},
+	}, &logs)
+	url := startHTTPServer(t, adapter, WithHTTPAccessControl(ac))
+
+	for _, tc := range []struct {
+		token, method, path, body string
+		want                      int
+	}{
+		{"secret", "POST", "/instruments/10/query", `{"query": "*IDN?"}`, http.StatusOK},
+		{"secret", "GET", "/instruments/10/stb", "", http.StatusOK},
+		{"secret", "POST", "/instruments/10/command", `{"command": "*RST"}`, http.StatusForbidden},
+		{"secret", "POST", "/instruments/10/trigger", "", http.StatusForbidden},
+		{"secret", "POST", "/instruments/11/query", `{"query": "*IDN?"}`, http.StatusForbidden},
+		{"secret", "GET", "/instruments", "", http.StatusForbidden},
+		{"wrong", "POST", "/instruments/10/query", `{"query": "*IDN?"}`, http.StatusUnauthorized},
+		{"", "POST", "/instruments/10/query", `{"query": "*IDN?"}`, http.StatusForbidden},
+	} {
+		req, err := http.NewRequest(tc.method, url+tc.path, strings.NewReader(tc.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tc.token)
+		}
+		if tc.body != "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.want {
+			t.Errorf("%s %s with token %q: got status %d; want %d", tc.method, tc.path, tc.token, resp.StatusCode, tc.want)
+		}
+	}
+	if got := strings.Count(logs.String(), "access denied"); got != 6 {
+		t.Errorf("got %d denials logged; want 6:\n%s", got, logs.String())
+	}
+}
+
+func TestVXI11AccessControl(t *testing.T) {
+	adapter := sim.NewAdapter()
+	dmm := sim.NewScripted("SIM,DMM,1,1.0", nil)
+	for _, addr := range []int{10, 22} {
+		if err := adapter.Attach(addr, dmm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var logs syncBuffer
+	ac := newAccessControl(t, AccessPolicy{Rules: []AccessRule{
+		{Clients: []string{"127.0.0.0/8"}, Addresses: []string{"10"}, Commands: []string{"*?"}},
+	}}, &logs)
+	c := dialVXI11(t, startVXI11Server(t, adapter, WithVXI11AccessControl(ac)))
+
+	if code, _ := c.createLink(t, "gpib0,22", false); code != vxiNotAccessible {
+		t.Errorf("got error %d creating link to denied address; want %d", code, vxiNotAccessible)
+	}
+	if code, _ := c.createLink(t, "gpib0,10", true); code != vxiNotAccessible {
+		t.Errorf("got error %d creating locked link; want %d", code, vxiNotAccessible)
+	}
+	code, lid := c.createLink(t, "gpib0,10", false)
+	if code != vxiNoError {
+		t.Fatalf("got error %d creating link", code)
+	}
+	if code := c.write(t, lid, flagEnd, "*IDN?\n"); code != vxiNoError {
+		t.Errorf("got error %d writing query", code)
+	}
+	if code, _, data := c.read(t, lid, 100, 1000); code != vxiNoError || data != "SIM,DMM,1,1.0\n" {
+		t.Errorf("got error %d reading %q", code, data)
+	}
+	if code := c.write(t, lid, flagEnd, "*RST\n"); code != vxiNotAccessible {
+		t.Errorf("got error %d writing command; want %d", code, vxiNotAccessible)
+	}
+	if code := c.generic(t, procDeviceTrigger, lid, 0).uint32(); code != vxiNotAccessible {
+		t.Errorf("got error %d triggering; want %d", code, vxiNotAccessible)
+	}
+	if code := c.generic(t, procDeviceReadStb, lid, 0).uint32(); code != vxiNoError {
+		t.Errorf("got error %d reading status byte", code)
+	}
+	if received := dmm.Received(); len(received) != 1 {
+		t.Errorf("got commands %q; want only *IDN?", received)
+	}
+}
+
+func TestHiSLIPAccessControl(t *testing.T) {
+	adapter := sim.NewAdapter()
+	if err := adapter.Attach(10, sim.NewScripted("SIM,DMM,1,1.0", nil)); err != nil {
+		t.Fatal(err)
+	}
+	var logs syncBuffer
+	ac := newAccessControl(t, AccessPolicy{Rules: []AccessRule{
+		{Clients: []string{"127.0.0.0/8"}, Addresses: []string{"10"}, Commands: []string{"*?"}},
+	}}, &logs)
+	addr := startHiSLIPServer(t, adapter, WithHiSLIPAccessControl(ac))
+
+	conn := dialConn(t, addr)
+	send(t, conn, hsMessage{typ: hsInitialize, param: hsProtocolVersion << 16, payload: []byte("hislip0,22")})
+	expect(t, conn, hsFatalError)
+
+	c := dialHiSLIP(t, addr, "hislip0,10")
+	if resp := c.query(t, "*IDN?"); resp != "SIM,DMM,1,1.0\n" {
+		t.Errorf("got response %q", resp)
+	}
+	c.write(t, "*RST")
+	expect(t, c.sync, hsError)
+	send(t, c.sync, hsMessage{typ: hsTrigger, param: c.msgID})
+	expect(t, c.sync, hsError)
+	if got := c.lock(t, "", 0); got != hsLockFailure {
+		t.Errorf("got lock response %d; want failure", got)
+	}
+	send(t, c.async, hsMessage{typ: hsAsyncDeviceClear})
+	expect(t, c.async, hsError)
+	if got := strings.Count(logs.String(), "access denied"); got != 5 {
+		t.Errorf("got %d denials logged; want 5:\n%s", got, logs.String())
+	}
+}
@@ -0,0 +1,870 @@
+// Copyright (c) 2020–2024 The prologix developers. All rights reserved.
+// Project site: https://github.com/gotmc/prologix
+// Use of this source code is governed by a MIT-style license that
+// can be found in the LICENSE.txt file for the project.
+
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gotmc/prologix"
+)
+
+// HiSLIPPort is the port on which clients expect a HiSLIP server.
+const HiSLIPPort = 4880
+
+// HiSLIP message types from IVI-6.1.
+const (
+	hsInitialize                      = 0
+	hsInitializeResponse              = 1
+	hsFatalError                      = 2
+	hsError                           = 3
+	hsAsyncLock                       = 4
+	hsAsyncLockResponse               = 5
+	hsData                            = 6
+	hsDataEnd                         = 7
+	hsDeviceClearComplete             = 8
+	hsDeviceClearAcknowledge          = 9
+	hsAsyncRemoteLocalControl         = 10
+	hsAsyncRemoteLocalResponse        = 11
+	hsTrigger                         = 12
+	hsInterrupted                     = 13
+	hsAsyncInterrupted                = 14
+	hsAsyncMaximumMessageSize         = 15
+	hsAsyncMaximumMessageSizeResponse = 16
+	hsAsyncInitialize                 = 17
+	hsAsyncInitializeResponse         = 18
+	hsAsyncDeviceClear                = 19
+	hsAsyncServiceRequest             = 20
+	hsAsyncStatusQuery                = 21
+	hsAsyncStatusResponse             = 22
+	hsAsyncDeviceClearAcknowledge     = 23
+	hsAsyncLockInfo                   = 24
+	hsAsyncLockInfoResponse           = 25
+)
+
+// HiSLIP fatal error codes, sent as the control code of FatalError.
+const (
+	hsFatalUnidentified = 0
+	hsFatalBadHeader    = 1
+	hsFatalNoChannels   = 2
+	hsFatalInvalidInit  = 3
+)
+
+// HiSLIP error codes, sent as the control code of Error.
+const (
+	hsErrorUnidentified     = 0
+	hsErrorUnrecognizedType = 1
+	hsErrorTooLarge         = 4
+)
+
+// AsyncLock and AsyncLockResponse control codes.
+const (
+	hsLockRelease = 0
+	hsLockRequest = 1
+
+	hsLockFailure        = 0
+	hsLockSuccess        = 1
+	hsLockSharedReleased = 2
+	hsLockError          = 3
+)
+
+const (
+	hsHeaderSize = 16
+	// hsProtocolVersion is version 1.0, the major version in the high byte.
+	hsProtocolVersion = 0x0100
+	// hsVendorID is the vendor ID of the server, two ASCII characters.
+	hsVendorID = 'P'<<8 | 'X'
+	// hsMaxMessageSize is the largest payload and data accepted from clients.
+	hsMaxMessageSize = 1 << 20
+)
+
+var errMessageTooLarge = errors.New("message too large")
+
+// hsMessage is a HiSLIP message.
+type hsMessage struct {
+	typ     byte
+	control byte
+	param   uint32
+	payload []byte
+}
+
+// HiSLIPServer serves the instruments on the GPIB bus of a Controller over
+// HiSLIP, so that the Prologix adapter appears to VISA libraries as a LAN
+// instrument for each GPIB address. Clients open sessions with sub-addresses
+// like `hislip0,10`, or `hislip0,10,96` with a secondary address, where
+// hislip0 is the interface name.
+//
+// The server operates in synchronized mode. A message ending with DataEnd is
+// sent to the instrument with EOI asserted on its last byte and, when it
+// contains a query as reported by prologix.IsQuery, the response is read and
+// sent back with the message ID of the query. Device clear interrupts a query
+// waiting for its response. Exclusive and shared locks only apply between
+// HiSLIP sessions: Data and Trigger messages wait until no other session
+// holds a lock on the device. Service requests are forwarded to the sessions
+// of the instruments requesting service by polling the SRQ line. Sessions to
+// devices denied by the access control, if any, aren't opened, and denied
+// messages are answered with Error messages.
+type HiSLIPServer struct {
+	devices     devices
+	timeout     time.Duration
+	srqInterval time.Duration
+	logger      *log.Logger
+	access      *AccessControl
+	tracker     tracker
+	srqOnce     sync.Once
+	closeOnce   sync.Once
+	done        chan struct{}
+
+	mu          sync.Mutex
+	sessions    map[uint16]*hsSession
+	nextSession uint16
+	locks       map[string]*hsLock
+	// released is closed and replaced when a lock is released.
+	released chan struct{}
+}
+
+// hsSession is a session opened by a client over a synchronous channel and
+// an asynchronous channel.
+type hsSession struct {
+	id     uint16
+	addr   string
+	inst   *prologix.Instrument
+	client client
+	sync   net.Conn
+	// done is closed when the session ends.
+	done chan struct{}
+
+	mu      sync.Mutex
+	async   net.Conn
+	maxSize uint64
+	// cancel interrupts the read of a response in progress.
+	cancel context.CancelFunc
+
+	asyncWriteMu sync.Mutex
+}
+
+// hsLock is the lock state of a device.
+type hsLock struct {
+	exclusive uint16
+	shared    string
+	holders   map[uint16]bool
+}
+
+// HiSLIPOption applies an option to the HiSLIP server.
+type HiSLIPOption func(*HiSLIPServer)
+
+// NewHiSLIPServer creates a HiSLIP server for the instruments on the bus of
+// the controller. Optionally the server can be configured using a
+// HiSLIPOption.
+func NewHiSLIPServer(c *prologix.Controller, opts ...HiSLIPOption) *HiSLIPServer {
+	s := HiSLIPServer{
+		devices:     devices{c: c, iface: "hislip0"},
+		timeout:     5 * time.Second,
+		srqInterval: 100 * time.Millisecond,
+		logger:      log.Default(),
+		done:        make(chan struct{}),
+		sessions:    make(map[uint16]*hsSession),
+		locks:       make(map[string]*hsLock),
+		released:    make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(&s)
+	}
+	return &s
+}
+
+// WithHiSLIPInterfaceName sets the interface name of the sub-addresses, which
+// defaults to hislip0.
+func WithHiSLIPInterfaceName(name string) HiSLIPOption {
+	return func(s *HiSLIPServer) {
+		s.devices.iface = name
+	}
+}
+
+// WithHiSLIPQueryTimeout sets the time allowed for the instrument to answer a
+// query, which defaults to 5 s. When it expires, the instrument is cleared
+// and nothing is sent to the client.
+func WithHiSLIPQueryTimeout(d time.Duration) HiSLIPOption {
+	return func(s *HiSLIPServer) {
+		s.timeout = d
+	}
+}
+
+// WithSRQPollInterval sets the interval between checks of the SRQ line while
+// clients are connected, which defaults to 100 ms. Each check takes the
+// controller for one `++srq` command. An interval of 0 disables forwarding
+// service requests.
+func WithSRQPollInterval(d time.Duration) HiSLIPOption {
+	return func(s *HiSLIPServer) {
+		s.srqInterval = d
+	}
+}
+
+// WithHiSLIPLogger sets the logger of errors and sessions, which defaults to
+// the standard logger.
+func WithHiSLIPLogger(l *log.Logger) HiSLIPOption {
+	return func(s *HiSLIPServer) {
+		s.logger = l
+	}
+}
+
+// WithHiSLIPAccessControl sets the access control of the clients.
+func WithHiSLIPAccessControl(ac *AccessControl) HiSLIPOption {
+	return func(s *HiSLIPServer) {
+		s.access = ac
+	}
+}
+
+// Serve accepts the connections of both channels on the listener until it
+// fails or the server is closed. Serve always returns a non-nil error, which
+// is net.ErrClosed after Close.
+func (s *HiSLIPServer) Serve(l net.Listener) error {
+	return s.tracker.serve(l, s.serveConn)
+}
+
+// Close stops the listeners and closes the client connections, ending their
+// sessions.
+func (s *HiSLIPServer) Close() error {
+	s.closeOnce.Do(func() { close(s.done) })
+	s.tracker.close()
+	return nil
+}
+
+// serveConn serves a synchronous or asynchronous channel, as determined by
+// the first message received.
+func (s *HiSLIPServer) serveConn(conn net.Conn) {
+	msg, err := readHSMessage(conn)
+	if err != nil {
+		s.connError(conn, err)
+		return
+	}
+	switch msg.typ {
+	case hsInitialize:
+		s.serveSync(conn, msg)
+	case hsAsyncInitialize:
+		s.serveAsync(conn, msg)
+	default:
+		s.fatal(conn, hsFatalInvalidInit, "expected Initialize or AsyncInitialize")
+	}
+}
+
+// serveSync opens a session with the sub-address of the Initialize message
+// and handles the messages received over its synchronous channel.
+func (s *HiSLIPServer) serveSync(conn net.Conn, init hsMessage) {
+	c, err := s.access.identify(conn)
+	if err != nil {
+		s.logger.Printf("HiSLIP client %s: %s", conn.RemoteAddr(), err)
+		return
+	}
+	sess, err := s.open(conn, c, string(init.payload))
+	if err != nil {
+		s.fatal(conn, hsFatalUnidentified, err.Error())
+		return
+	}
+	defer s.end(sess)
+	s.logger.Printf("HiSLIP session %d opened to %s by %s", sess.id, init.payload, conn.RemoteAddr())
+	resp := hsMessage{typ: hsInitializeResponse, param: hsProtocolVersion<<16 | uint32(sess.id)}
+	if err := writeHSMessage(conn, resp); err != nil {
+		return
+	}
+
+	var pending []byte
+	for {
+		msg, err := readHSMessage(conn)
+		if errors.Is(err, errMessageTooLarge) {
+			pending = nil
+			err = writeHSMessage(conn, hsErrorMessage(hsErrorTooLarge, err.Error()))
+		}
+		if err != nil {
+			s.connError(conn, err)
+			return
+		}
+		switch msg.typ {
+		case hsData, hsDataEnd, hsTrigger:
+			if !sess.hasAsync() {
+				s.fatal(conn, hsFatalNoChannels, "asynchronous channel not initialized")
+				return
+			}
+		}
+		switch msg.typ {
+		case hsData, hsDataEnd:
+			if len(pending)+len(msg.payload) > hsMaxMessageSize {
+				pending = nil
+				err = writeHSMessage(conn, hsErrorMessage(hsErrorTooLarge, errMessageTooLarge.Error()))
+				break
+			}
+			pending = append(pending, msg.payload...)
+			if msg.typ == hsDataEnd {
+				data := pending
+				pending = nil
+				err = s.transact(sess, msg.param, data)
+			}
+		case hsTrigger:
+			if s.access.allowControl(sess.client, sess.addr, "trigger") != nil {
+				err = writeHSMessage(conn, hsErrorMessage(hsErrorUnidentified, errAccessDenied.Error()))
+				break
+			}
+			if !s.waitAccess(sess) {
+				return
+			}
+			if err := sess.inst.Trigger(); err != nil {
+				s.logger.Printf("HiSLIP session %d: %s", sess.id, err)
+			}
+		case hsDeviceClearComplete:
+			pending = nil
+			err = writeHSMessage(conn, hsMessage{typ: hsDeviceClearAcknowledge})
+		default:
+			err = writeHSMessage(conn, hsErrorMessage(hsErrorUnrecognizedType,
+				fmt.Sprintf("unrecognized message type %d on synchronous channel", msg.typ)))
+		}
+		if err != nil {
+			s.connError(conn, err)
+			return
+		}
+	}
+}
+
+// transact sends the data to the instrument and, after a query, sends the
+// response back with the message ID of the query. Only errors sending the
+// response are returned.
+func (s *HiSLIPServer) transact(sess *hsSession, id uint32, data []byte) error {
+	msg := bytes.TrimSuffix(bytes.TrimSuffix(data, []byte("\n")), []byte("\r"))
+	if len(msg) == 0 {
+		return nil
+	}
+	if s.access.allowCommand(sess.client, sess.addr, string(msg)) != nil {
+		return writeHSMessage(sess.sync, hsErrorMessage(hsErrorUnidentified, errAccessDenied.Error()))
+	}
+	if !s.waitAccess(sess) {
+		return net.ErrClosed
+	}
+	if _, err := sess.inst.Write(append(escape(msg), '\n')); err != nil {
+		s.logger.Printf("HiSLIP session %d: %s", sess.id, err)
+		return nil
+	}
+	if !prologix.IsQuery(string(msg)) {
+		return nil
+	}
+	resp, err := s.read(sess)
+	if err != nil {
+		s.logger.Printf("HiSLIP session %d: %s", sess.id, err)
+		return nil
+	}
+
+	// The response is split into messages the client can receive.
+	chunk := uint64(len(resp))
+	if limit := sess.maxPayload(); chunk > limit {
+		chunk = limit
+	}
+	for {
+		n := min(int(chunk), len(resp))
+		m := hsMessage{typ: hsData, param: id, payload: []byte(resp[:n])}
+		resp = resp[n:]
+		if len(resp) == 0 {
+			m.typ = hsDataEnd
+		}
+		if err := writeHSMessage(sess.sync, m); err != nil {
+			return err
+		}
+		if len(resp) == 0 {
+			return nil
+		}
+	}
+}
+
+// read reads the response to a query, clearing the instrument when it
+// doesn't answer in time.
+func (s *HiSLIPServer) read(sess *hsSession) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	sess.mu.Lock()
+	sess.cancel = cancel
+	sess.mu.Unlock()
+	defer func() {
+		sess.mu.Lock()
+		sess.cancel = nil
+		sess.mu.Unlock()
+	}()
+	resp, err := sess.inst.ReadContext(ctx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		_ = sess.inst.ClearDevice()
+	}
+	return resp, err
+}
+
+// serveAsync attaches the asynchronous channel to the session identified by
+// the AsyncInitialize message and handles the messages received over it.
+func (s *HiSLIPServer) serveAsync(conn net.Conn, init hsMessage) {
+	c, err := s.access.identify(conn)
+	if err != nil {
+		s.logger.Printf("HiSLIP client %s: %s", conn.RemoteAddr(), err)
+		return
+	}
+	sess := s.attach(conn, c, uint16(init.param))
+	if sess == nil {
+		s.fatal(conn, hsFatalInvalidInit, "unknown session")
+		return
+	}
+	// Either channel closing ends the session.
+	defer sess.sync.Close()
+	if err := sess.writeAsync(hsMessage{typ: hsAsyncInitializeResponse, param: hsVendorID}); err != nil {
+		return
+	}
+	if s.srqInterval > 0 {
+		s.srqOnce.Do(func() {
+			s.tracker.wg.Add(1)
+			go s.pollServiceRequests()
+		})
+	}
+
+	for {
+		msg, err := readHSMessage(conn)
+		if errors.Is(err, errMessageTooLarge) {
+			err = sess.writeAsync(hsErrorMessage(hsErrorTooLarge, err.Error()))
+		}
+		if err != nil {
+			s.connError(conn, err)
+			return
+		}
+		var resp hsMessage
+		switch msg.typ {
+		case hsAsyncMaximumMessageSize:
+			if len(msg.payload) == 8 {
+				sess.mu.Lock()
+				sess.maxSize = binary.BigEndian.Uint64(msg.payload)
+				sess.mu.Unlock()
+			}
+			resp = hsMessage{typ: hsAsyncMaximumMessageSizeResponse, payload: binary.BigEndian.AppendUint64(nil, hsMaxMessageSize)}
+		case hsAsyncLock:
+			resp = hsMessage{typ: hsAsyncLockResponse}
+			switch msg.control {
+			case hsLockRequest:
+				resp.control = hsLockFailure
+				if s.access.allowControl(sess.client, sess.addr, "lock") == nil && s.lock(sess, string(msg.payload), msg.param) {
+					resp.control = hsLockSuccess
+				}
+			case hsLockRelease:
+				resp.control = s.unlock(sess)
+			default:
+				resp.control = hsLockError
+			}
+		case hsAsyncLockInfo:
+			resp = s.lockInfo(sess)
+		case hsAsyncRemoteLocalControl:
+			if s.access.allowControl(sess.client, sess.addr, "remote/local control") != nil {
+				resp = hsErrorMessage(hsErrorUnidentified, errAccessDenied.Error())
+				break
+			}
+			if err := remoteLocal(sess.inst, msg.control); err != nil {
+				s.logger.Printf("HiSLIP session %d: %s", sess.id, err)
+			}
+			resp = hsMessage{typ: hsAsyncRemoteLocalResponse}
+		case hsAsyncDeviceClear:
+			if s.access.allowControl(sess.client, sess.addr, "clear") != nil {
+				resp = hsErrorMessage(hsErrorUnidentified, errAccessDenied.Error())
+				break
+			}
+			sess.interrupt()
+			if err := sess.inst.ClearDevice(); err != nil {
+				s.logger.Printf("HiSLIP session %d: %s", sess.id, err)
+			}
+			resp = hsMessage{typ: hsAsyncDeviceClearAcknowledge}
+		case hsAsyncStatusQuery:
+			stb, err := sess.inst.SerialPoll()
+			if err != nil {
+				s.logger.Printf("HiSLIP session %d: %s", sess.id, err)
+			}
+			resp = hsMessage{typ: hsAsyncStatusResponse, control: stb}
+		default:
+			resp = hsErrorMessage(hsErrorUnrecognizedType,
+				fmt.Sprintf("unrecognized message type %d on asynchronous channel", msg.typ))
+		}
+		if err := sess.writeAsync(resp); err != nil {
+			s.connError(conn, err)
+			return
+		}
+	}
+}
+
+// remoteLocal applies the AsyncRemoteLocalControl request. The Prologix
+// adapter keeps REN asserted and addresses the instrument when it's next
+// used, so only local lockout and go to local are sent.
+func remoteLocal(inst *prologix.Instrument, request byte) error {
+	switch request {
+	case 0, 2, 6: // Disable remote, go to local, or GTL.
+		return inst.FrontPanel(true)
+	case 4, 5: // Enable remote with local lockout.
+		return inst.FrontPanel(false)
+	case 1, 3:
+		return nil
+	}
+	return fmt.Errorf("unrecognized remote/local request %d", request)
+}
+
+// open opens a session of the client over the synchronous channel.
+func (s *HiSLIPServer) open(conn net.Conn, c client, subAddress string) (*hsSession, error) {
+	addr, inst, err := s.devices.open(subAddress)
+	if err != nil {
+		return nil, fmt.Errorf("sub-address %s: %w", subAddress, err)
+	}
+	if err := s.access.allowAddress(c, addr); err != nil {
+		return nil, fmt.Errorf("sub-address %s: %w", subAddress, err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		s.nextSession++
+		if _, ok := s.sessions[s.nextSession]; !ok && s.nextSession != 0 {
+			break
+		}
+	}
+	sess := &hsSession{
+		id:      s.nextSession,
+		addr:    addr,
+		inst:    inst,
+		client:  c,
+		sync:    conn,
+		done:    make(chan struct{}),
+		maxSize: math.MaxUint64,
+	}
+	s.sessions[sess.id] = sess
+	return sess, nil
+}
+
+// attach attaches the asynchronous channel of the client to the session,
+// returning nil if there's no such session of the client or it already has
+// one.
+func (s *HiSLIPServer) attach(conn net.Conn, c client, id uint16) *hsSession {
+	s.mu.Lock()
+	sess, ok := s.sessions[id]
+	s.mu.Unlock()
+	if !ok || sess.client.name != c.name {
+		return nil
+	}
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	if sess.async != nil {
+		return nil
+	}
+	sess.async = conn
+	return sess
+}
+
+// end ends the session, releasing its locks and closing its asynchronous
+// channel.
+func (s *HiSLIPServer) end(sess *hsSession) {
+	close(sess.done)
+	sess.interrupt()
+	s.mu.Lock()
+	delete(s.sessions, sess.id)
+	if l, ok := s.locks[sess.addr]; ok && l.holds(sess.id) {
+		if l.exclusive == sess.id {
+			l.exclusive = 0
+		}
+		delete(l.holders, sess.id)
+		s.broadcastRelease()
+	}
+	s.mu.Unlock()
+	sess.mu.Lock()
+	if sess.async != nil {
+		sess.async.Close()
+	}
+	sess.mu.Unlock()
+	s.logger.Printf("HiSLIP session %d closed", sess.id)
+}
+
+// waitAccess waits until no other session holds a lock preventing the
+// session from using its device, reporting false if the session ends first.
+func (s *HiSLIPServer) waitAccess(sess *hsSession) bool {
+	for {
+		s.mu.Lock()
+		l, ok := s.locks[sess.addr]
+		if !ok || l.allows(sess.id) {
+			s.mu.Unlock()
+			return true
+		}
+		released := s.released
+		s.mu.Unlock()
+		select {
+		case <-released:
+		case <-sess.done:
+			return false
+		}
+	}
+}
+
+// lock waits up to timeout milliseconds for the lock to be granted to the
+// session. The lock is exclusive when no name is given, and otherwise shared
+// with the sessions requesting a lock with the same name.
+func (s *HiSLIPServer) lock(sess *hsSession, name string, timeout uint32) bool {
+	var expired <-chan time.Time
+	for {
+		s.mu.Lock()
+		l, ok := s.locks[sess.addr]
+		if !ok {
+			l = &hsLock{holders: make(map[uint16]bool)}
+			s.locks[sess.addr] = l
+		}
+		if l.grant(sess.id, name) {
+			s.mu.Unlock()
+			return true
+		}
+		released := s.released
+		s.mu.Unlock()
+		if timeout == 0 {
+			return false
+		}
+		if expired == nil {
+			t := time.NewTimer(milliseconds(timeout))
+			defer t.Stop()
+			expired = t.C
+		}
+		select {
+		case <-released:
+		case <-expired:
+			return false
+		case <-sess.done:
+			return false
+		}
+	}
+}
+
+// unlock releases a lock held by the session, returning the control code of
+// AsyncLockResponse.
+func (s *HiSLIPServer) unlock(sess *hsSession) byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l, ok := s.locks[sess.addr]
+	if !ok {
+		return hsLockError
+	}
+	code := l.release(sess.id)
+	if code != hsLockError {
+		s.broadcastRelease()
+	}
+	return code
+}
+
+func (s *HiSLIPServer) lockInfo(sess *hsSession) hsMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	resp := hsMessage{typ: hsAsyncLockInfoResponse}
+	l, ok := s.locks[sess.addr]
+	if !ok {
+		return resp
+	}
+	resp.param = uint32(len(l.holders))
+	if l.exclusive != 0 {
+		resp.control = 1
+		if !l.holders[l.exclusive] {
+			resp.param++
+		}
+	}
+	return resp
+}
+
+// broadcastRelease wakes the sessions waiting for a lock. The server's mutex
+// must be held.
+func (s *HiSLIPServer) broadcastRelease() {
+	close(s.released)
+	s.released = make(chan struct{})
+}
+
+// pollServiceRequests checks the SRQ line at each poll interval until the
+// server is closed.
+func (s *HiSLIPServer) pollServiceRequests() {
+	defer s.tracker.wg.Done()
+	t := time.NewTicker(s.srqInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-t.C:
+		}
+		s.forwardServiceRequests()
+	}
+}
+
+// forwardServiceRequests serially polls the devices of the sessions when SRQ
+// is asserted, and sends the status byte of those requesting service to their
+// sessions. SRQ may be asserted by a device without sessions, which is left
+// alone. Errors are ignored, since they recur at each poll.
+func (s *HiSLIPServer) forwardServiceRequests() {
+	byAddr := make(map[string][]*hsSession)
+	var probe *prologix.Instrument
+	s.mu.Lock()
+	for _, sess := range s.sessions {
+		if sess.hasAsync() {
+			byAddr[sess.addr] = append(byAddr[sess.addr], sess)
+			probe = sess.inst
+		}
+	}
+	s.mu.Unlock()
+	if probe == nil {
+		return
+	}
+	// The SRQ line is checked using any of the instruments, so that the check
+	// is serialized with the operations of the others.
+	srq, err := probe.ServiceRequest()
+	if err != nil || !srq {
+		return
+	}
+	for _, sessions := range byAddr {
+		stb, err := sessions[0].inst.SerialPoll()
+		if err != nil || !prologix.StatusByte(stb).Has(prologix.StatusRequestService) {
+			continue
+		}
+		for _, sess := range sessions {
+			_ = sess.writeAsync(hsMessage{typ: hsAsyncServiceRequest, control: stb})
+		}
+	}
+}
+
+// fatal sends a FatalError message, after which the connection is closed.
+func (s *HiSLIPServer) fatal(conn net.Conn, code byte, msg string) {
+	s.logger.Printf("HiSLIP client %s: %s", conn.RemoteAddr(), msg)
+	_ = writeHSMessage(conn, hsMessage{typ: hsFatalError, control: code, payload: []byte(msg)})
+}
+
+// connError handles an error reading or writing a message, telling the client
+// about a poorly formed header.
+func (s *HiSLIPServer) connError(conn net.Conn, err error) {
+	if errors.Is(err, errBadHeader) {
+		s.fatal(conn, hsFatalBadHeader, err.Error())
+		return
+	}
+	if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+		s.logger.Printf("HiSLIP client %s: %s", conn.RemoteAddr(), err)
+	}
+}
+
+func (sess *hsSession) hasAsync() bool {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	return sess.async != nil
+}
+
+// maxPayload returns the largest payload of the messages sent to the client.
+func (sess *hsSession) maxPayload() uint64 {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	if sess.maxSize <= hsHeaderSize {
+		return 1
+	}
+	return sess.maxSize - hsHeaderSize
+}
+
+// interrupt interrupts the read of a response in progress.
+func (sess *hsSession) interrupt() {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	if sess.cancel != nil {
+		sess.cancel()
+	}
+}
+
+func (sess *hsSession) writeAsync(m hsMessage) error {
+	sess.asyncWriteMu.Lock()
+	defer sess.asyncWriteMu.Unlock()
+	return writeHSMessage(sess.async, m)
+}
+
+// allows reports whether the session may use the device.
+func (l *hsLock) allows(id uint16) bool {
+	return (l.exclusive == 0 || l.exclusive == id) && (len(l.holders) == 0 || l.holders[id])
+}
+
+// grant grants an exclusive lock, or a shared lock with the given name, to
+// the session if possible.
+func (l *hsLock) grant(id uint16, name string) bool {
+	if l.exclusive != 0 && l.exclusive != id {
+		return false
+	}
+	if name == "" {
+		if len(l.holders) > 0 && !l.holders[id] {
+			return false
+		}
+		l.exclusive = id
+		return true
+	}
+	if len(l.holders) > 0 && name != l.shared {
+		return false
+	}
+	l.shared = name
+	l.holders[id] = true
+	return true
+}
+
+// release releases the exclusive lock held by the session or else its shared
+// lock, returning the control code of AsyncLockResponse.
+func (l *hsLock) release(id uint16) byte {
+	if l.exclusive == id {
+		l.exclusive = 0
+		return hsLockSuccess
+	}
+	if l.holders[id] {
+		delete(l.holders, id)
+		return hsLockSharedReleased
+	}
+	return hsLockError
+}
+
+func (l *hsLock) holds(id uint16) bool {
+	return l.exclusive == id || l.holders[id]
+}
+
+var errBadHeader = errors.New("poorly formed message header")
+
+// readHSMessage reads a message. The payload of a message larger than
+// hsMaxMessageSize is discarded and errMessageTooLarge returned.
+func readHSMessage(r io.Reader) (hsMessage, error) {
+	var hdr [hsHeaderSize]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return hsMessage{}, err
+	}
+	if hdr[0] != 'H' || hdr[1] != 'S' {
+		return hsMessage{}, errBadHeader
+	}
+	m := hsMessage{
+		typ:     hdr[2],
+		control: hdr[3],
+		param:   binary.BigEndian.Uint32(hdr[4:8]),
+	}
+	size := binary.BigEndian.Uint64(hdr[8:16])
+	if size > hsMaxMessageSize {
+		if _, err := io.CopyN(io.Discard, r, int64(min(size, math.MaxInt64))); err != nil {
+			return m, err
+		}
+		return m, errMessageTooLarge
+	}
+	m.payload = make([]byte, size)
+	_, err := io.ReadFull(r, m.payload)
+	return m, err
+}
+
+// writeHSMessage writes a message using a single write.
+func writeHSMessage(w io.Writer, m hsMessage) error {
+	b := make([]byte, hsHeaderSize, hsHeaderSize+len(m.payload))
+	b[0], b[1], b[2], b[3] = 'H', 'S', m.typ, m.control
+	binary.BigEndian.PutUint32(b[4:8], m.param)
+	binary.BigEndian.PutUint64(b[8:16], uint64(len(m.payload)))
+	_, err := w.Write(append(b, m.payload...))
+	return err
+}
+
+func hsErrorMessage(code byte, msg string) hsMessage {
+	return hsMessage{typ: hsError, control: code, payload: []byte(msg)}
+}
@@ -0,0 +1,337 @@
+// Copyright (c) 2020–2024 The prologix developers. All rights reserved.
+// Project site: https://github.com/gotmc/prologix
+// Use of this source code is governed by a MIT-style license that
+// can be found in the LICENSE.txt file for the project.
+
+package gateway
+
+import (
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gotmc/prologix/sim"
+)
+
+// srqInstrument is a scripted instrument with a status byte that can request
+// service.
+type srqInstrument struct {
+	*sim.Scripted
+	mu       sync.Mutex
+	stb      byte
+	triggers int
+}
+
+func (i *srqInstrument) SerialPoll() byte {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	stb := i.stb
+	i.stb &^= 0x40
+	return stb
+}
+
+func (i *srqInstrument) ServiceRequest() bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.stb&0x40 != 0
+}
+
+func (i *srqInstrument) Trigger() {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.triggers++
+}
+
+func (i *srqInstrument) setStatus(stb byte) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.stb = stb
+}
+
+// startHiSLIPServer serves the bus of a simulated adapter over HiSLIP and
+// returns the address of the listener.
+func startHiSLIPServer(t *testing.T, adapter *sim.Adapter, opts ...HiSLIPOption) string {
+	t.Helper()
+	opts = append([]HiSLIPOption{
+		WithHiSLIPLogger(log.New(io.Discard, "", 0)),
+		WithSRQPollInterval(10 * time.Millisecond),
+	}, opts...)
+	s := NewHiSLIPServer(newSimController(t, adapter), opts...)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+	return l.Addr().String()
+}
+
+// hsClient is a HiSLIP client session in synchronized mode.
+type hsClient struct {
+	sync  net.Conn
+	async net.Conn
+	id    uint16
+	msgID uint32
+}
+
+func dialHiSLIP(t *testing.T, addr, subAddress string) *hsClient {
+	t.Helper()
+	c := &hsClient{msgID: 0xffffff00}
+	c.sync = dialConn(t, addr)
+	send(t, c.sync, hsMessage{typ: hsInitialize, param: hsProtocolVersion<<16 | 'T'<<8 | 'C', payload: []byte(subAddress)})
+	resp := expect(t, c.sync, hsInitializeResponse)
+	if resp.param>>16 != hsProtocolVersion {
+		t.Errorf("got protocol version %#x; want %#x", resp.param>>16, hsProtocolVersion)
+	}
+	c.id = uint16(resp.param)
+	c.async = dialConn(t, addr)
+	send(t, c.async, hsMessage{typ: hsAsyncInitialize, param: uint32(c.id)})
+	expect(t, c.async, hsAsyncInitializeResponse)
+	return c
+}
+
+func dialConn(t *testing.T, addr string) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn
+}
+
+func send(t *testing.T, conn net.Conn, m hsMessage) {
+	t.Helper()
+	if err := writeHSMessage(conn, m); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// expect receives a message, failing unless it has the given type.
+func expect(t *testing.T, conn net.Conn, typ byte) hsMessage {
+	t.Helper()
+	m, err := readHSMessage(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.typ != typ {
+		t.Fatalf("got message type %d (%q); want %d", m.typ, m.payload, typ)
+	}
+	return m
+}
+
+// write sends the data with DataEnd and returns its message ID.
+func (c *hsClient) write(t *testing.T, data string) uint32 {
+	t.Helper()
+	id := c.msgID
+	c.msgID += 2
+	send(t, c.sync, hsMessage{typ: hsDataEnd, param: id, payload: []byte(data)})
+	return id
+}
+
+// read receives a response, failing unless it has the message ID.
+func (c *hsClient) read(t *testing.T, id uint32) (resp string, messages int) {
+	t.Helper()
+	for {
+		m, err := readHSMessage(c.sync)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.typ != hsData && m.typ != hsDataEnd {
+			t.Fatalf("got message type %d; want Data or DataEnd", m.typ)
+		}
+		if m.param != id {
+			t.Errorf("got message ID %#x; want %#x", m.param, id)
+		}
+		resp += string(m.payload)
+		messages++
+		if m.typ == hsDataEnd {
+			return resp, messages
+		}
+	}
+}
+
+func (c *hsClient) query(t *testing.T, cmd string) string {
+	t.Helper()
+	resp, _ := c.read(t, c.write(t, cmd))
+	return resp
+}
+
+func (c *hsClient) lock(t *testing.T, name string, timeout uint32) byte {
+	t.Helper()
+	send(t, c.async, hsMessage{typ: hsAsyncLock, control: hsLockRequest, param: timeout, payload: []byte(name)})
+	return expect(t, c.async, hsAsyncLockResponse).control
+}
+
+func (c *hsClient) unlock(t *testing.T) byte {
+	t.Helper()
+	send(t, c.async, hsMessage{typ: hsAsyncLock, control: hsLockRelease, param: c.msgID - 2})
+	return expect(t, c.async, hsAsyncLockResponse).control
+}
+
+func TestHiSLIP(t *testing.T) {
+	adapter := sim.NewAdapter()
+	dmm := &srqInstrument{Scripted: sim.NewScripted("SIM,DMM,1,1.0", nil)}
+	if err := adapter.Attach(10, dmm); err != nil {
+		t.Fatal(err)
+	}
+	addr := startHiSLIPServer(t, adapter)
+
+	for _, subAddress := range []string{"hislip0,40", "inst0", "hislip1,10"} {
+		conn := dialConn(t, addr)
+		send(t, conn, hsMessage{typ: hsInitialize, param: hsProtocolVersion << 16, payload: []byte(subAddress)})
+		expect(t, conn, hsFatalError)
+	}
+	conn := dialConn(t, addr)
+	send(t, conn, hsMessage{typ: hsAsyncInitialize, param: 999})
+	expect(t, conn, hsFatalError)
+
+	c := dialHiSLIP(t, addr, "hislip0,10")
+	if got := c.query(t, "*IDN?\n"); got != "SIM,DMM,1,1.0\n" {
+		t.Errorf("got response %q", got)
+	}
+
+	// Data is held until DataEnd.
+	send(t, c.sync, hsMessage{typ: hsData, param: c.msgID, payload: []byte("*ID")})
+	if got := c.query(t, "N?"); got != "SIM,DMM,1,1.0\n" {
+		t.Errorf("got response %q to query split over Data and DataEnd", got)
+	}
+
+	// Responses are split into messages the client can receive.
+	size := binary.BigEndian.AppendUint64(nil, hsHeaderSize+4)
+	send(t, c.async, hsMessage{typ: hsAsyncMaximumMessageSize, payload: size})
+	resp := expect(t, c.async, hsAsyncMaximumMessageSizeResponse)
+	if got := binary.BigEndian.Uint64(resp.payload); got != hsMaxMessageSize {
+		t.Errorf("got maximum message size %d; want %d", got, hsMaxMessageSize)
+	}
+	got, messages := c.read(t, c.write(t, "*IDN?"))
+	if got != "SIM,DMM,1,1.0\n" || messages != 4 {
+		t.Errorf("got response %q in %d messages; want 4", got, messages)
+	}
+
+	c.write(t, "*RST")
+	send(t, c.sync, hsMessage{typ: hsTrigger, param: c.msgID})
+	dmm.setStatus(0x10)
+	send(t, c.async, hsMessage{typ: hsAsyncStatusQuery, param: c.msgID - 2})
+	if stb := expect(t, c.async, hsAsyncStatusResponse).control; stb != 0x10 {
+		t.Errorf("got status byte %#x; want 0x10", stb)
+	}
+	received := dmm.Received()
+	if got := received[len(received)-1]; got != "*RST" {
+		t.Errorf("got command %q; want *RST", got)
+	}
+	dmm.mu.Lock()
+	if dmm.triggers != 1 {
+		t.Errorf("got %d triggers; want 1", dmm.triggers)
+	}
+	dmm.mu.Unlock()
+
+	// The service request is forwarded by the SRQ poll.
+	dmm.setStatus(0x50)
+	if stb := expect(t, c.async, hsAsyncServiceRequest).control; stb != 0x50 {
+		t.Errorf("got status byte %#x with service request; want 0x50", stb)
+	}
+
+	send(t, c.async, hsMessage{typ: hsAsyncRemoteLocalControl, control: 6})
+	expect(t, c.async, hsAsyncRemoteLocalResponse)
+	send(t, c.async, hsMessage{typ: hsDataEnd})
+	expect(t, c.async, hsError)
+
+	// Device clear interrupts a query the instrument doesn't answer.
+	c.write(t, "NOPE?")
+	time.Sleep(50 * time.Millisecond)
+	start := time.Now()
+	send(t, c.async, hsMessage{typ: hsAsyncDeviceClear})
+	expect(t, c.async, hsAsyncDeviceClearAcknowledge)
+	send(t, c.sync, hsMessage{typ: hsDeviceClearComplete})
+	expect(t, c.sync, hsDeviceClearAcknowledge)
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("device clear took %s", d)
+	}
+	if got := c.query(t, "*IDN?"); got != "SIM,DMM,1,1.0\n" {
+		t.Errorf("got response %q after device clear", got)
+	}
+}
+
+func TestHiSLIPDataWithoutAsyncChannel(t *testing.T) {
+	adapter := sim.NewAdapter()
+	if err := adapter.Attach(10, sim.NewScripted("", nil)); err != nil {
+		t.Fatal(err)
+	}
+	conn := dialConn(t, startHiSLIPServer(t, adapter))
+	send(t, conn, hsMessage{typ: hsInitialize, param: hsProtocolVersion << 16, payload: []byte("hislip0,10")})
+	expect(t, conn, hsInitializeResponse)
+	send(t, conn, hsMessage{typ: hsDataEnd, payload: []byte("*RST")})
+	if m := expect(t, conn, hsFatalError); m.control != hsFatalNoChannels {
+		t.Errorf("got fatal error %d; want %d", m.control, hsFatalNoChannels)
+	}
+}
+
+func TestHiSLIPLocks(t *testing.T) {
+	adapter := sim.NewAdapter()
+	if err := adapter.Attach(10, sim.NewScripted("SIM,DMM,1,1.0", nil)); err != nil {
+		t.Fatal(err)
+	}
+	addr := startHiSLIPServer(t, adapter)
+	a, b := dialHiSLIP(t, addr, "hislip0,10"), dialHiSLIP(t, addr, "hislip0,10")
+
+	if code := a.lock(t, "", 0); code != hsLockSuccess {
+		t.Fatalf("got lock response %d; want success", code)
+	}
+	if code := b.lock(t, "", 0); code != hsLockFailure {
+		t.Errorf("got lock response %d for locked device; want failure", code)
+	}
+	send(t, b.async, hsMessage{typ: hsAsyncLockInfo})
+	if m := expect(t, b.async, hsAsyncLockInfoResponse); m.control != 1 || m.param != 1 {
+		t.Errorf("got lock info %d, %d; want exclusive lock held by 1 client", m.control, m.param)
+	}
+
+	// The query waits for the lock to be released.
+	id := b.write(t, "*IDN?")
+	time.Sleep(50 * time.Millisecond)
+	if got := a.query(t, "*IDN?"); got != "SIM,DMM,1,1.0\n" {
+		t.Errorf("got response %q with lock held", got)
+	}
+	if code := a.unlock(t); code != hsLockSuccess {
+		t.Errorf("got unlock response %d; want success", code)
+	}
+	if got, _ := b.read(t, id); got != "SIM,DMM,1,1.0\n" {
+		t.Errorf("got response %q after lock released", got)
+	}
+
+	for _, step := range []struct {
+		c    *hsClient
+		name string
+		want byte
+	}{
+		{a, "bench", hsLockSuccess},
+		{b, "bench", hsLockSuccess},
+		{b, "other", hsLockFailure},
+		// A session sharing the lock can take the exclusive lock.
+		{b, "", hsLockSuccess},
+		{a, "", hsLockFailure},
+	} {
+		if code := step.c.lock(t, step.name, 0); code != step.want {
+			t.Errorf("got lock response %d requesting lock %q; want %d", code, step.name, step.want)
+		}
+	}
+	for _, want := range []byte{hsLockSharedReleased, hsLockError} {
+		if code := a.unlock(t); code != want {
+			t.Errorf("got unlock response %d; want %d", code, want)
+		}
+	}
+
+	// The locks of a session are released when it ends.
+	if code := b.lock(t, "", 0); code != hsLockSuccess {
+		t.Fatalf("got lock response %d; want success", code)
+	}
+	b.sync.Close()
+	if code := a.lock(t, "", 2000); code != hsLockSuccess {
+		t.Errorf("got lock response %d after session ended; want success", code)
+	}
+}
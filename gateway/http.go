@@ -0,0 +1,590 @@
+// Copyright (c) 2020–2024 The prologix developers. All rights reserved.
+// Project site: https://github.com/gotmc/prologix
+// Use of this source code is governed by a MIT-style license that
+// can be found in the LICENSE.txt file for the project.
+
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gotmc/prologix"
+)
+
+// maxRequestSize is the largest request body accepted by the HTTP API.
+const maxRequestSize = 1 << 20
+
+// closeGoingAway is the status code of the close frame sent to the client of
+// a stream when the handler is closed.
+const closeGoingAway = 1001
+
+// HTTPHandler serves an HTTP/JSON API to the instruments on the bus of a
+// Prologix controller, so that programs like web dashboards can use them
+// without Go bindings. Instruments are addressed by their primary address,
+// optionally followed by a comma and the secondary address, such as `10` or
+// `10,96`. The endpoints are:
+//
+//	GET  /instruments                  scan the bus; ?secondary=true also scans secondary addresses
+//	GET  /controller                   configuration of the controller
+//	POST /instruments/{addr}/command   send {"command": "..."}
+//	POST /instruments/{addr}/query     send {"query": "..."}, answering {"response": "..."}, or
+//	                                   with "block": true, {"data": "<base64>"} read from a
+//	                                   definite length arbitrary block
+//	GET  /instruments/{addr}/stb       serial poll, answering {"status_byte": n}
+//	POST /instruments/{addr}/trigger   send the Group Execute Trigger message
+//	GET  /stream                       websocket streaming events
+//
+// Errors are answered with a JSON object holding the error message, such as
+// {"error": "..."}, with status 400 for a malformed request, 401 for an
+// invalid bearer token, 403 when denied by the access control, 404 for an
+// unknown endpoint or invalid address, 502 when communicating with the
+// instrument fails, and 504 when it doesn't answer in time.
+//
+// The websocket at /stream sends a JSON text message for each event. Each
+// `poll=<addr>:<query>` parameter queries an instrument once the stream opens
+// and then at the interval given by the `interval` parameter as a duration
+// like `500ms`, which defaults to 1 s, sending {"type": "query", "address":
+// ..., "query": ..., "response": ...}. Each `srq=<addr>` parameter sends
+// {"type": "srq", "address": ..., "status_byte": n} when the instrument
+// requests service. Events also hold their time, and failures are sent as
+// {"type": "error", "error": ...}.
+//
+// Commands and queries can't contain CR, LF, or ESC characters, or start with
+// `++`, so that clients can't reconfigure the adapter.
+//
+// So that web pages of other sites can't drive the instruments through the
+// browsers of their visitors, request bodies must have the application/json
+// content type, answering status 415 otherwise, and requests from browsers
+// with an Origin header, including the opening of streams, are answered with
+// status 403 unless the origin is the host of the request or is allowed by
+// WithAllowedOrigins.
+type HTTPHandler struct {
+	devices     devices
+	timeout     time.Duration
+	srqInterval time.Duration
+	logger      *log.Logger
+	access      *AccessControl
+	origins     []string
+	// tracker tracks the connections taken over by streams.
+	tracker   tracker
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// HTTPOption applies an option to the HTTP handler.
+type HTTPOption func(*HTTPHandler)
+
+// NewHTTPHandler creates an HTTP handler for the instruments on the bus of
+// the controller. Optionally the handler can be configured using an
+// HTTPOption.
+func NewHTTPHandler(c *prologix.Controller, opts ...HTTPOption) *HTTPHandler {
+	h := HTTPHandler{
+		devices:     devices{c: c},
+		timeout:     5 * time.Second,
+		srqInterval: 100 * time.Millisecond,
+		logger:      log.Default(),
+		done:        make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(&h)
+	}
+	return &h
+}
+
+// WithHTTPQueryTimeout sets the time allowed for the instrument to answer a
+// query, which defaults to 5 s. When it expires, the instrument is cleared
+// and the request fails with status 504.
+func WithHTTPQueryTimeout(d time.Duration) HTTPOption {
+	return func(h *HTTPHandler) {
+		h.timeout = d
+	}
+}
+
+// WithStreamSRQPollInterval sets the interval between checks of the SRQ line
+// by streams with `srq` parameters, which defaults to 100 ms.
+func WithStreamSRQPollInterval(d time.Duration) HTTPOption {
+	return func(h *HTTPHandler) {
+		h.srqInterval = d
+	}
+}
+
+// WithHTTPLogger sets the logger of stream errors, which defaults to the
+// standard logger.
+func WithHTTPLogger(l *log.Logger) HTTPOption {
+	return func(h *HTTPHandler) {
+		h.logger = l
+	}
+}
+
+// WithHTTPAccessControl sets the access control of the clients, which are
+// authenticated by their bearer token given in the Authorization header, or
+// else by their TLS client certificate.
+func WithHTTPAccessControl(ac *AccessControl) HTTPOption {
+	return func(h *HTTPHandler) {
+		h.access = ac
+	}
+}
+
+// WithAllowedOrigins allows requests from web pages served by the origins,
+// such as `https://dashboard.example.com`, besides those served by the
+// gateway itself. The origin `*` allows any.
+func WithAllowedOrigins(origins ...string) HTTPOption {
+	return func(h *HTTPHandler) {
+		h.origins = append(h.origins, origins...)
+	}
+}
+
+// Close closes the streams and waits for them to end. Since streams take over
+// their connections, they aren't closed by shutting down the http.Server.
+func (h *HTTPHandler) Close() error {
+	h.closeOnce.Do(func() { close(h.done) })
+	h.tracker.close()
+	return nil
+}
+
+// ServeHTTP routes the request to its endpoint.
+func (h *HTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.allowOrigin(r) {
+		writeError(w, http.StatusForbidden, fmt.Errorf("origin %s not allowed", r.Header.Get("Origin")))
+		return
+	}
+	c, err := h.access.authenticate(r)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, http.StatusUnauthorized, err)
+		return
+	}
+	path := strings.Trim(r.URL.Path, "/")
+	parts := strings.Split(path, "/")
+	switch {
+	case path == "instruments":
+		if allow(w, r, http.MethodGet) && permit(w, h.access.allowBus(c, "scan")) {
+			h.scan(w, r)
+		}
+	case path == "controller":
+		if allow(w, r, http.MethodGet) && permit(w, h.access.allowBus(c, "controller configuration")) {
+			h.config(w)
+		}
+	case path == "stream":
+		if allow(w, r, http.MethodGet) {
+			h.stream(w, r, c)
+		}
+	case len(parts) == 3 && parts[0] == "instruments":
+		h.serveInstrument(w, r, c, parts[1], parts[2])
+	default:
+		writeError(w, http.StatusNotFound, errors.New("not found"))
+	}
+}
+
+// serveInstrument serves the endpoints of the instrument at the address.
+func (h *HTTPHandler) serveInstrument(w http.ResponseWriter, r *http.Request, c client, addr, endpoint string) {
+	method := http.MethodPost
+	switch endpoint {
+	case "command", "query", "trigger":
+	case "stb":
+		method = http.MethodGet
+	default:
+		writeError(w, http.StatusNotFound, errors.New("not found"))
+		return
+	}
+	if !allow(w, r, method) {
+		return
+	}
+	gpib, inst, err := h.devices.instrument(addr)
+	if err != nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("%w %s", err, addr))
+		return
+	}
+	switch endpoint {
+	case "command":
+		h.command(w, r, c, gpib, inst)
+	case "query":
+		h.query(w, r, c, gpib, inst)
+	case "stb":
+		if !permit(w, h.access.allowAddress(c, gpib)) {
+			return
+		}
+		stb, err := inst.SerialPoll()
+		if err != nil {
+			writeInstrumentError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, struct {
+			StatusByte byte `json:"status_byte"`
+		}{stb})
+	case "trigger":
+		if !permit(w, h.access.allowControl(c, gpib, "trigger")) {
+			return
+		}
+		if err := inst.Trigger(); err != nil {
+			writeInstrumentError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (h *HTTPHandler) scan(w http.ResponseWriter, r *http.Request) {
+	var opts []prologix.ScanOption
+	if r.URL.Query().Get("secondary") == "true" {
+		opts = append(opts, prologix.WithScanSecondary())
+	}
+	inv, err := h.devices.c.Scan(r.Context(), opts...)
+	if err != nil {
+		writeInstrumentError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, inv)
+}
+
+func (h *HTTPHandler) config(w http.ResponseWriter) {
+	cfg, err := h.devices.c.Config()
+	if err != nil {
+		writeInstrumentError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, cfg)
+}
+
+func (h *HTTPHandler) command(w http.ResponseWriter, r *http.Request, c client, gpib string, inst *prologix.Instrument) {
+	var req struct {
+		Command string `json:"command"`
+	}
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if err := checkLine(req.Command); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if !permit(w, h.access.allowCommand(c, gpib, req.Command)) {
+		return
+	}
+	if err := inst.Command(req.Command); err != nil {
+		writeInstrumentError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *HTTPHandler) query(w http.ResponseWriter, r *http.Request, c client, gpib string, inst *prologix.Instrument) {
+	var req struct {
+		Query string `json:"query"`
+		Block bool   `json:"block"`
+	}
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if err := checkLine(req.Query); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if !permit(w, h.access.allowCommand(c, gpib, req.Query)) {
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), h.timeout)
+	defer cancel()
+	if req.Block {
+		data, err := inst.QueryBlockContext(ctx, req.Query)
+		if err != nil {
+			writeInstrumentError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, struct {
+			Data []byte `json:"data"`
+		}{data})
+		return
+	}
+	resp, err := inst.QueryContext(ctx, req.Query)
+	if err != nil {
+		writeInstrumentError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, struct {
+		Response string `json:"response"`
+	}{strings.TrimRight(resp, "\r\n")})
+}
+
+// streamEvent is an event sent to the client of a stream.
+type streamEvent struct {
+	Type       string    `json:"type"`
+	Time       time.Time `json:"time"`
+	Address    string    `json:"address"`
+	Query      string    `json:"query,omitempty"`
+	Response   string    `json:"response,omitempty"`
+	StatusByte byte      `json:"status_byte,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// streamPoll is an instrument queried periodically by a stream.
+type streamPoll struct {
+	addr  string
+	query string
+	inst  *prologix.Instrument
+}
+
+// streamSRQ is an instrument whose service requests are sent by a stream.
+type streamSRQ struct {
+	addr string
+	inst *prologix.Instrument
+}
+
+// stream parses the parameters of a stream, then takes over the connection
+// and sends events until the client closes the stream or the handler is
+// closed.
+func (h *HTTPHandler) stream(w http.ResponseWriter, r *http.Request, c client) {
+	params := r.URL.Query()
+	interval := time.Second
+	if s := params.Get("interval"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid interval %s", s))
+			return
+		}
+		interval = d
+	}
+	var polls []streamPoll
+	for _, p := range params["poll"] {
+		addr, query, ok := strings.Cut(p, ":")
+		if !ok || checkLine(query) != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid poll %s (want <addr>:<query>)", p))
+			return
+		}
+		gpib, inst, err := h.devices.instrument(addr)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("%w %s", err, addr))
+			return
+		}
+		if !permit(w, h.access.allowCommand(c, gpib, query)) {
+			return
+		}
+		polls = append(polls, streamPoll{addr: addr, query: query, inst: inst})
+	}
+	var srqs []streamSRQ
+	for _, addr := range params["srq"] {
+		gpib, inst, err := h.devices.instrument(addr)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("%w %s", err, addr))
+			return
+		}
+		if !permit(w, h.access.allowAddress(c, gpib)) {
+			return
+		}
+		srqs = append(srqs, streamSRQ{addr: addr, inst: inst})
+	}
+
+	ws, err := upgradeWebsocket(w, r)
+	if err != nil {
+		return
+	}
+	if !h.tracker.add(ws.conn) {
+		ws.close(closeGoingAway)
+		return
+	}
+	h.tracker.wg.Add(1)
+	defer h.tracker.wg.Done()
+	defer h.tracker.remove(ws.conn)
+	defer ws.conn.Close()
+	if err := h.sendEvents(ws, interval, polls, srqs); err != nil && !errors.Is(err, net.ErrClosed) {
+		h.logger.Printf("stream client %s: %s", ws.conn.RemoteAddr(), err)
+	}
+}
+
+// sendEvents sends the events of a stream until it's closed.
+func (h *HTTPHandler) sendEvents(ws *websocket, interval time.Duration, polls []streamPoll, srqs []streamSRQ) error {
+	closed := make(chan error, 1)
+	go func() { closed <- ws.serveControl() }()
+
+	var pollC, srqC <-chan time.Time
+	if len(polls) > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		pollC = ticker.C
+		if err := h.poll(ws, polls); err != nil {
+			return err
+		}
+	}
+	if len(srqs) > 0 && h.srqInterval > 0 {
+		ticker := time.NewTicker(h.srqInterval)
+		defer ticker.Stop()
+		srqC = ticker.C
+	}
+	for {
+		select {
+		case err := <-closed:
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		case <-h.done:
+			return ws.close(closeGoingAway)
+		case <-pollC:
+			if err := h.poll(ws, polls); err != nil {
+				return err
+			}
+		case <-srqC:
+			if err := h.forwardServiceRequests(ws, srqs); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// poll queries the instruments polled by a stream and sends the responses.
+func (h *HTTPHandler) poll(ws *websocket, polls []streamPoll) error {
+	for _, p := range polls {
+		ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+		resp, err := p.inst.QueryContext(ctx, p.query)
+		cancel()
+		ev := streamEvent{Type: "query", Address: p.addr, Query: p.query, Response: strings.TrimRight(resp, "\r\n")}
+		if err != nil {
+			ev = streamEvent{Type: "error", Address: p.addr, Query: p.query, Error: err.Error()}
+		}
+		if err := sendEvent(ws, ev); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// forwardServiceRequests checks the SRQ line and, when asserted, serial polls
+// the instruments of a stream, sending an event for those requesting service.
+func (h *HTTPHandler) forwardServiceRequests(ws *websocket, srqs []streamSRQ) error {
+	// The SRQ line is checked using an instrument, so that the check is
+	// serialized with the operations of the others.
+	srq, err := srqs[0].inst.ServiceRequest()
+	if err != nil {
+		return sendEvent(ws, streamEvent{Type: "error", Address: srqs[0].addr, Error: err.Error()})
+	}
+	if !srq {
+		return nil
+	}
+	for _, s := range srqs {
+		stb, err := s.inst.SerialPoll()
+		if err != nil {
+			if err := sendEvent(ws, streamEvent{Type: "error", Address: s.addr, Error: err.Error()}); err != nil {
+				return err
+			}
+			continue
+		}
+		if !prologix.StatusByte(stb).Has(prologix.StatusRequestService) {
+			continue
+		}
+		if err := sendEvent(ws, streamEvent{Type: "srq", Address: s.addr, StatusByte: stb}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sendEvent(ws *websocket, ev streamEvent) error {
+	ev.Time = time.Now()
+	msg, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	return ws.writeText(msg)
+}
+
+// checkLine checks that a command or query is a single line that isn't a
+// command of the Prologix adapter.
+func checkLine(line string) error {
+	switch {
+	case strings.TrimSpace(line) == "":
+		return errors.New("empty command")
+	case strings.ContainsAny(line, "\r\n\x1b"):
+		return errors.New("command contains CR, LF, or ESC characters")
+	case strings.HasPrefix(strings.TrimSpace(line), "++"):
+		return errors.New("commands of the Prologix adapter aren't allowed")
+	}
+	return nil
+}
+
+// allow reports whether the request uses the method, answering with status
+// 405 if not.
+func allow(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	return false
+}
+
+// permit reports whether the access control allowed the request, answering
+// with status 403 if not.
+func permit(w http.ResponseWriter, err error) bool {
+	if err == nil {
+		return true
+	}
+	writeError(w, http.StatusForbidden, err)
+	return false
+}
+
+// allowOrigin reports whether the request was sent by a client other than a
+// browser, which doesn't send an Origin header, or from an allowed origin.
+func (h *HTTPHandler) allowOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	for _, o := range h.origins {
+		if o == "*" || strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host != "" && strings.EqualFold(u.Host, r.Host)
+}
+
+// readJSON decodes the JSON body of the request, answering with status 415
+// if it isn't JSON, or 400 if it's malformed.
+func readJSON(w http.ResponseWriter, r *http.Request, v any) bool {
+	// Requiring the JSON content type keeps cross-site forms from posting
+	// commands, since browsers only send it after a CORS preflight.
+	if ct, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || ct != "application/json" {
+		writeError(w, http.StatusUnsupportedMediaType, errors.New("request body must be application/json"))
+		return false
+	}
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestSize))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, struct {
+		Error string `json:"error"`
+	}{err.Error()})
+}
+
+// writeInstrumentError answers with status 504 if the instrument didn't answer
+// in time, or 502 otherwise.
+func writeInstrumentError(w http.ResponseWriter, err error) {
+	status := http.StatusBadGateway
+	if isTimeout(err) {
+		status = http.StatusGatewayTimeout
+	}
+	writeError(w, status, err)
+}
@@ -0,0 +1,317 @@
+// Copyright (c) 2020–2024 The prologix developers. All rights reserved.
+// Project site: https://github.com/gotmc/prologix
+// Use of this source code is governed by a MIT-style license that
+// can be found in the LICENSE.txt file for the project.
+
+package gateway
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gotmc/prologix/sim"
+)
+
+// startHTTPServer serves the bus of a simulated adapter over the HTTP API and
+// returns the URL of the server.
+func startHTTPServer(t *testing.T, adapter *sim.Adapter, opts ...HTTPOption) string {
+	t.Helper()
+	opts = append([]HTTPOption{
+		WithHTTPQueryTimeout(200 * time.Millisecond),
+		WithStreamSRQPollInterval(10 * time.Millisecond),
+		WithHTTPLogger(log.New(io.Discard, "", 0)),
+	}, opts...)
+	h := NewHTTPHandler(newSimController(t, adapter), opts...)
+	srv := httptest.NewServer(h)
+	t.Cleanup(func() {
+		h.Close()
+		srv.Close()
+	})
+	return srv.URL
+}
+
+// doJSON sends the request and decodes the JSON response, if any, into v.
+func doJSON(t *testing.T, method, url, body string, v any) int {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && v != nil {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("%s %s: %v", method, url, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestHTTP(t *testing.T) {
+	adapter := sim.NewAdapter()
+	dmm := &srqInstrument{Scripted: sim.NewScripted("SIM,DMM,1,1.0", map[string]string{
+		"meas:volt?": "1.5",
+		"curv?":      "#15a\nb\x00c",
+	})}
+	if err := adapter.Attach(10, dmm); err != nil {
+		t.Fatal(err)
+	}
+	url := startHTTPServer(t, adapter)
+
+	var resp struct {
+		Response string `json:"response"`
+		Data     []byte `json:"data"`
+		Status   *byte  `json:"status_byte"`
+		Error    string `json:"error"`
+	}
+	if code := doJSON(t, "POST", url+"/instruments/10/query", `{"query": "MEAS:VOLT?"}`, &resp); code != http.StatusOK || resp.Response != "1.5" {
+		t.Errorf("got status %d and response %+v querying; want 1.5", code, resp)
+	}
+	if code := doJSON(t, "POST", url+"/instruments/10/query", `{"query": "CURV?", "block": true}`, &resp); code != http.StatusOK || string(resp.Data) != "a\nb\x00c" {
+		t.Errorf("got status %d and response %+v querying block", code, resp)
+	}
+	if code := doJSON(t, "POST", url+"/instruments/10/command", `{"command": "*RST"}`, nil); code != http.StatusNoContent {
+		t.Errorf("got status %d sending command; want 204", code)
+	}
+	if received := dmm.Received(); received[len(received)-1] != "*RST" {
+		t.Errorf("got commands %q; want *RST last", received)
+	}
+	if code := doJSON(t, "POST", url+"/instruments/10/trigger", "", nil); code != http.StatusNoContent || dmm.triggers != 1 {
+		t.Errorf("got status %d and %d triggers; want 204 and 1", code, dmm.triggers)
+	}
+	dmm.setStatus(0x50)
+	resp.Status = nil
+	if code := doJSON(t, "GET", url+"/instruments/10/stb", "", &resp); code != http.StatusOK || resp.Status == nil || *resp.Status != 0x50 {
+		t.Errorf("got status %d and response %+v serial polling; want status byte 0x50", code, resp)
+	}
+
+	var cfg struct {
+		Version string `json:"version"`
+	}
+	if code := doJSON(t, "GET", url+"/controller", "", &cfg); code != http.StatusOK || cfg.Version != sim.VersionUSB {
+		t.Errorf("got status %d and version %q; want %q", code, cfg.Version, sim.VersionUSB)
+	}
+	var inv struct {
+		Listeners []struct {
+			PrimaryAddress int `json:"primary_address"`
+		} `json:"listeners"`
+	}
+	if code := doJSON(t, "GET", url+"/instruments", "", &inv); code != http.StatusOK || len(inv.Listeners) != 1 || inv.Listeners[0].PrimaryAddress != 10 {
+		t.Errorf("got status %d and inventory %+v; want instrument at 10", code, inv)
+	}
+
+	for _, tc := range []struct {
+		method, path, body string
+		want               int
+	}{
+		{"GET", "/nowhere", "", http.StatusNotFound},
+		{"GET", "/instruments/10/nowhere", "", http.StatusNotFound},
+		{"POST", "/instruments/31/command", `{"command": "*RST"}`, http.StatusNotFound},
+		{"POST", "/instruments/x/command", `{"command": "*RST"}`, http.StatusNotFound},
+		{"GET", "/instruments/10/query", "", http.StatusMethodNotAllowed},
+		{"POST", "/instruments", "", http.StatusMethodNotAllowed},
+		{"POST", "/instruments/10/command", `{"command": `, http.StatusBadRequest},
+		{"POST", "/instruments/10/command", `{"cmd": "*RST"}`, http.StatusBadRequest},
+		{"POST", "/instruments/10/command", `{"command": "++addr 5"}`, http.StatusBadRequest},
+		{"POST", "/instruments/10/command", `{"command": "*RST\n++addr 5"}`, http.StatusBadRequest},
+		{"POST", "/instruments/10/query", `{"query": "NOPE?"}`, http.StatusGatewayTimeout},
+		{"GET", "/stream", "", http.StatusBadRequest},
+	} {
+		resp.Error = ""
+		if code := doJSON(t, tc.method, url+tc.path, tc.body, &resp); code != tc.want || resp.Error == "" {
+			t.Errorf("%s %s %s: got status %d and error %q; want status %d with error", tc.method, tc.path, tc.body, code, resp.Error, tc.want)
+		}
+	}
+}
+
+// dialStream opens a stream with the query parameters.
+func dialStream(t *testing.T, url, params string) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	conn, r, resp := handshake(t, url, params, "")
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("got status %d opening stream", resp.StatusCode)
+	}
+	// The accept key of the sample handshake of RFC 6455.
+	if got := resp.Header.Get("Sec-WebSocket-Accept"); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("got Sec-WebSocket-Accept %q", got)
+	}
+	return conn, r
+}
+
+// handshake sends the opening handshake of a stream, from a web page of the
+// origin if not empty, and returns the response.
+func handshake(t *testing.T, url, params, origin string) (net.Conn, *bufio.Reader, *http.Response) {
+	t.Helper()
+	conn, r := dial(t, strings.TrimPrefix(url, "http://"))
+	header := ""
+	if origin != "" {
+		header = "Origin: " + origin + "\r\n"
+	}
+	fmt.Fprintf(conn, "GET /stream?%s HTTP/1.1\r\n"+
+		"Host: localhost\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: keep-alive, Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n"+
+		"Sec-WebSocket-Version: 13\r\n%s\r\n", params, header)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, r, resp
+}
+
+// readServerFrame reads an unmasked frame with a short payload.
+func readServerFrame(t *testing.T, r *bufio.Reader) (byte, []byte) {
+	t.Helper()
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		t.Fatal(err)
+	}
+	n := int(hdr[1])
+	if n == 126 {
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			t.Fatal(err)
+		}
+		n = int(binary.BigEndian.Uint16(ext[:]))
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		t.Fatal(err)
+	}
+	return hdr[0] & 0x0F, payload
+}
+
+func readEvent(t *testing.T, r *bufio.Reader) streamEvent {
+	t.Helper()
+	opcode, payload := readServerFrame(t, r)
+	if opcode != opText {
+		t.Fatalf("got opcode %d; want text", opcode)
+	}
+	var ev streamEvent
+	if err := json.Unmarshal(payload, &ev); err != nil {
+		t.Fatal(err)
+	}
+	return ev
+}
+
+// writeClientFrame writes a masked frame with a short payload.
+func writeClientFrame(t *testing.T, conn net.Conn, opcode byte, payload []byte) {
+	t.Helper()
+	mask := []byte{1, 2, 3, 4}
+	frame := append([]byte{0x80 | opcode, 0x80 | byte(len(payload))}, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	if _, err := conn.Write(frame); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHTTPStream(t *testing.T) {
+	adapter := sim.NewAdapter()
+	dmm := &srqInstrument{Scripted: sim.NewScripted("SIM,DMM,1,1.0", map[string]string{"meas:volt?": "1.5"})}
+	if err := adapter.Attach(10, dmm); err != nil {
+		t.Fatal(err)
+	}
+	url := startHTTPServer(t, adapter)
+	conn, r := dialStream(t, url, "poll=10:MEAS:VOLT%3F&interval=1h&srq=10")
+
+	ev := readEvent(t, r)
+	if ev.Type != "query" || ev.Address != "10" || ev.Query != "MEAS:VOLT?" || ev.Response != "1.5" || ev.Time.IsZero() {
+		t.Errorf("got event %+v; want query response 1.5", ev)
+	}
+	dmm.setStatus(0x41)
+	if ev := readEvent(t, r); ev.Type != "srq" || ev.Address != "10" || ev.StatusByte != 0x41 {
+		t.Errorf("got event %+v; want service request with status byte 0x41", ev)
+	}
+
+	writeClientFrame(t, conn, opPing, []byte("hi"))
+	if opcode, payload := readServerFrame(t, r); opcode != opPong || string(payload) != "hi" {
+		t.Errorf("got opcode %d with %q; want pong with hi", opcode, payload)
+	}
+	writeClientFrame(t, conn, opClose, []byte{0x03, 0xE8})
+	if opcode, payload := readServerFrame(t, r); opcode != opClose || string(payload) != "\x03\xe8" {
+		t.Errorf("got opcode %d with %q; want close with status 1000", opcode, payload)
+	}
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Errorf("got %v after closing handshake; want EOF", err)
+	}
+}
+
+func TestHTTPCrossOrigin(t *testing.T) {
+	adapter := sim.NewAdapter()
+	dmm := sim.NewScripted("SIM,DMM,1,1.0", nil)
+	if err := adapter.Attach(10, dmm); err != nil {
+		t.Fatal(err)
+	}
+	url := startHTTPServer(t, adapter, WithAllowedOrigins("https://dashboard.example.com"))
+	host := strings.TrimPrefix(url, "http://")
+
+	for _, tc := range []struct {
+		contentType, origin string
+		want                int
+	}{
+		{"application/json", "", http.StatusNoContent},
+		{"application/json; charset=utf-8", "", http.StatusNoContent},
+		{"application/json", "http://" + host, http.StatusNoContent},
+		{"application/json", "https://dashboard.example.com", http.StatusNoContent},
+		{"text/plain", "", http.StatusUnsupportedMediaType},
+		{"", "", http.StatusUnsupportedMediaType},
+		{"application/json", "http://evil.example.com", http.StatusForbidden},
+		{"application/json", "null", http.StatusForbidden},
+	} {
+		req, err := http.NewRequest("POST", url+"/instruments/10/command", strings.NewReader(`{"command": "*RST"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.contentType != "" {
+			req.Header.Set("Content-Type", tc.contentType)
+		}
+		if tc.origin != "" {
+			req.Header.Set("Origin", tc.origin)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.want {
+			t.Errorf("content type %q from origin %q: got status %d; want %d", tc.contentType, tc.origin, resp.StatusCode, tc.want)
+		}
+	}
+	if got := len(dmm.Received()); got != 4 {
+		t.Errorf("got %d commands received; want 4", got)
+	}
+
+	for _, tc := range []struct {
+		origin string
+		want   int
+	}{
+		{"http://localhost", http.StatusSwitchingProtocols},
+		{"https://dashboard.example.com", http.StatusSwitchingProtocols},
+		{"http://evil.example.com", http.StatusForbidden},
+	} {
+		conn, _, resp := handshake(t, url, "srq=10", tc.origin)
+		conn.Close()
+		if resp.StatusCode != tc.want {
+			t.Errorf("stream from origin %s: got status %d; want %d", tc.origin, resp.StatusCode, tc.want)
+		}
+	}
+}
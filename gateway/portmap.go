@@ -0,0 +1,147 @@
+// Copyright (c) 2020–2024 The prologix developers. All rights reserved.
+// Project site: https://github.com/gotmc/prologix
+// Use of this source code is governed by a MIT-style license that
+// can be found in the LICENSE.txt file for the project.
+
+package gateway
+
+import (
+	"net"
+	"sync"
+)
+
+// Portmapper program constants from RFC 1833.
+const (
+	portmapProgram = 100000
+	portmapVersion = 2
+	// PortmapPort is the port on which clients expect the portmapper.
+	PortmapPort = 111
+
+	pmapSet     = 1
+	pmapUnset   = 2
+	pmapGetPort = 3
+	pmapDump    = 4
+
+	protoTCP = 6
+)
+
+// Portmapper is a version 2 ONC RPC portmapper, which VXI-11 clients query
+// for the TCP port of the core channel. Only the mappings set using Set are
+// reported, and clients can't change them.
+type Portmapper struct {
+	mu       sync.Mutex
+	mappings []portMapping
+	tracker  tracker
+}
+
+type portMapping struct {
+	prog, vers, proto, port uint32
+}
+
+// NewPortmapper creates a portmapper without mappings.
+func NewPortmapper() *Portmapper {
+	return &Portmapper{}
+}
+
+// Set maps a version of an RPC program to the TCP port on which it's served,
+// replacing an earlier mapping.
+func (p *Portmapper) Set(prog, vers uint32, port int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	m := portMapping{prog: prog, vers: vers, proto: protoTCP, port: uint32(port)}
+	for i, prev := range p.mappings {
+		if prev.prog == prog && prev.vers == vers {
+			p.mappings[i] = m
+			return
+		}
+	}
+	p.mappings = append(p.mappings, m)
+}
+
+// Serve accepts TCP connections on the listener until it fails or the
+// portmapper is closed. Serve always returns a non-nil error, which is
+// net.ErrClosed after Close.
+func (p *Portmapper) Serve(l net.Listener) error {
+	return p.tracker.serve(l, func(conn net.Conn) {
+		p.program().serve(conn)
+	})
+}
+
+// ServePacket answers the calls received as UDP datagrams until the
+// connection fails or the portmapper is closed. ServePacket always returns a
+// non-nil error, which is net.ErrClosed after Close.
+func (p *Portmapper) ServePacket(pc net.PacketConn) error {
+	if !p.tracker.add(pc) {
+		pc.Close()
+		return net.ErrClosed
+	}
+	defer p.tracker.remove(pc)
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if p.tracker.isClosed() {
+				return net.ErrClosed
+			}
+			return err
+		}
+		if reply := p.program().reply(buf[:n]); reply != nil {
+			pc.WriteTo(reply, addr)
+		}
+	}
+}
+
+// Close stops serving and closes the client connections.
+func (p *Portmapper) Close() error {
+	p.tracker.close()
+	return nil
+}
+
+func (p *Portmapper) program() rpcProgram {
+	return rpcProgram{
+		prog: portmapProgram,
+		vers: portmapVersion,
+		procs: map[uint32]rpcProc{
+			pmapSet:     p.refuse,
+			pmapUnset:   p.refuse,
+			pmapGetPort: p.getPort,
+			pmapDump:    p.dump,
+		},
+	}
+}
+
+// refuse refuses to set or unset a mapping.
+func (p *Portmapper) refuse(args *xdrReader, res *xdrWriter) {
+	args.uint32()
+	args.uint32()
+	args.uint32()
+	args.uint32()
+	res.bool(false)
+}
+
+func (p *Portmapper) getPort(args *xdrReader, res *xdrWriter) {
+	prog, vers, proto := args.uint32(), args.uint32(), args.uint32()
+	args.uint32()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, m := range p.mappings {
+		if m.prog == prog && m.vers == vers && m.proto == proto {
+			res.uint32(m.port)
+			return
+		}
+	}
+	res.uint32(0)
+}
+
+func (p *Portmapper) dump(args *xdrReader, res *xdrWriter) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, m := range p.mappings {
+		res.bool(true)
+		res.uint32(m.prog)
+		res.uint32(m.vers)
+		res.uint32(m.proto)
+		res.uint32(m.port)
+	}
+	res.bool(false)
+}
@@ -0,0 +1,245 @@
+// Copyright (c) 2020–2024 The prologix developers. All rights reserved.
+// Project site: https://github.com/gotmc/prologix
+// Use of this source code is governed by a MIT-style license that
+// can be found in the LICENSE.txt file for the project.
+
+package gateway
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ONC RPC message constants from RFC 5531.
+const (
+	rpcVersion = 2
+
+	msgCall  = 0
+	msgReply = 1
+
+	replyAccepted = 0
+	replyDenied   = 1
+
+	acceptSuccess      = 0
+	acceptProgUnavail  = 1
+	acceptProgMismatch = 2
+	acceptProcUnavail  = 3
+	acceptGarbageArgs  = 4
+
+	rejectRPCMismatch = 0
+
+	authNone = 0
+
+	// lastFragment flags the last fragment of a record sent over TCP.
+	lastFragment = 1 << 31
+	// maxRecordSize is the largest record accepted from a client.
+	maxRecordSize = 4 << 20
+)
+
+// xdrReader decodes XDR (RFC 4506) data. The first error is kept and the
+// values decoded after it are zero.
+type xdrReader struct {
+	b   []byte
+	err error
+}
+
+func (r *xdrReader) uint32() uint32 {
+	if r.err != nil {
+		return 0
+	}
+	if len(r.b) < 4 {
+		r.err = io.ErrUnexpectedEOF
+		return 0
+	}
+	v := binary.BigEndian.Uint32(r.b)
+	r.b = r.b[4:]
+	return v
+}
+
+func (r *xdrReader) int32() int32 {
+	return int32(r.uint32())
+}
+
+func (r *xdrReader) bool() bool {
+	return r.uint32() != 0
+}
+
+// opaque decodes variable length opaque data.
+func (r *xdrReader) opaque() []byte {
+	n := r.uint32()
+	if r.err != nil {
+		return nil
+	}
+	padded := (uint64(n) + 3) &^ 3
+	if uint64(len(r.b)) < padded {
+		r.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	v := r.b[:n:n]
+	r.b = r.b[padded:]
+	return v
+}
+
+func (r *xdrReader) string() string {
+	return string(r.opaque())
+}
+
+// xdrWriter encodes XDR data.
+type xdrWriter struct {
+	b []byte
+}
+
+func (w *xdrWriter) uint32(v uint32) {
+	w.b = binary.BigEndian.AppendUint32(w.b, v)
+}
+
+func (w *xdrWriter) int32(v int32) {
+	w.uint32(uint32(v))
+}
+
+func (w *xdrWriter) bool(v bool) {
+	if v {
+		w.uint32(1)
+	} else {
+		w.uint32(0)
+	}
+}
+
+// opaque encodes variable length opaque data.
+func (w *xdrWriter) opaque(v []byte) {
+	w.uint32(uint32(len(v)))
+	w.b = append(w.b, v...)
+	for len(w.b)%4 != 0 {
+		w.b = append(w.b, 0)
+	}
+}
+
+func (w *xdrWriter) string(v string) {
+	w.opaque([]byte(v))
+}
+
+// rpcProc decodes the arguments of a procedure and encodes its results.
+type rpcProc func(args *xdrReader, res *xdrWriter)
+
+// rpcProgram is a version of an ONC RPC program, whose procedures are
+// numbered from 1. Procedure 0, which does nothing, is provided.
+type rpcProgram struct {
+	prog  uint32
+	vers  uint32
+	procs map[uint32]rpcProc
+}
+
+// reply handles a call message and returns the reply message, or nil if the
+// message isn't a call.
+func (p rpcProgram) reply(msg []byte) []byte {
+	r := xdrReader{b: msg}
+	xid := r.uint32()
+	if r.uint32() != msgCall || r.err != nil {
+		return nil
+	}
+	rpcvers := r.uint32()
+	prog, vers, proc := r.uint32(), r.uint32(), r.uint32()
+	// Skip the credentials and verifier, since only AUTH_NONE is expected.
+	r.uint32()
+	r.opaque()
+	r.uint32()
+	r.opaque()
+	if r.err != nil {
+		return nil
+	}
+
+	w := xdrWriter{}
+	w.uint32(xid)
+	w.uint32(msgReply)
+	if rpcvers != rpcVersion {
+		w.uint32(replyDenied)
+		w.uint32(rejectRPCMismatch)
+		w.uint32(rpcVersion)
+		w.uint32(rpcVersion)
+		return w.b
+	}
+	w.uint32(replyAccepted)
+	w.uint32(authNone)
+	w.opaque(nil)
+	switch {
+	case prog != p.prog:
+		w.uint32(acceptProgUnavail)
+		return w.b
+	case vers != p.vers:
+		w.uint32(acceptProgMismatch)
+		w.uint32(p.vers)
+		w.uint32(p.vers)
+		return w.b
+	case proc == 0:
+		w.uint32(acceptSuccess)
+		return w.b
+	}
+	fn, ok := p.procs[proc]
+	if !ok {
+		w.uint32(acceptProcUnavail)
+		return w.b
+	}
+	res := xdrWriter{}
+	fn(&r, &res)
+	if r.err != nil {
+		w.uint32(acceptGarbageArgs)
+		return w.b
+	}
+	w.uint32(acceptSuccess)
+	return append(w.b, res.b...)
+}
+
+// serve handles the calls received over a stream connection, using record
+// marking, until the connection is closed.
+func (p rpcProgram) serve(rw io.ReadWriter) error {
+	for {
+		msg, err := readRecord(rw)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		if reply := p.reply(msg); reply != nil {
+			if err := writeRecord(rw, reply); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// readRecord reads a record made of one or more fragments.
+func readRecord(r io.Reader) ([]byte, error) {
+	var msg []byte
+	for {
+		var hdr [4]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			if len(msg) > 0 && errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		h := binary.BigEndian.Uint32(hdr[:])
+		n := int(h &^ lastFragment)
+		if len(msg)+n > maxRecordSize {
+			return nil, fmt.Errorf("RPC record larger than %d bytes", maxRecordSize)
+		}
+		start := len(msg)
+		msg = append(msg, make([]byte, n)...)
+		if _, err := io.ReadFull(r, msg[start:]); err != nil {
+			return nil, err
+		}
+		if h&lastFragment != 0 {
+			return msg, nil
+		}
+	}
+}
+
+// writeRecord writes the message as a record made of a single fragment.
+func writeRecord(w io.Writer, msg []byte) error {
+	b := binary.BigEndian.AppendUint32(make([]byte, 0, 4+len(msg)), lastFragment|uint32(len(msg)))
+	_, err := w.Write(append(b, msg...))
+	return err
+}
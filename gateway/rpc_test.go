@@ -0,0 +1,174 @@
+// Copyright (c) 2020–2024 The prologix developers. All rights reserved.
+// Project site: https://github.com/gotmc/prologix
+// Use of this source code is governed by a MIT-style license that
+// can be found in the LICENSE.txt file for the project.
+
+package gateway
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// rpcClient is an ONC RPC client calling the procedures of a program over a
+// stream connection.
+type rpcClient struct {
+	conn net.Conn
+	prog uint32
+	vers uint32
+	xid  uint32
+}
+
+func dialRPC(t *testing.T, addr string, prog, vers uint32) *rpcClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return &rpcClient{conn: conn, prog: prog, vers: vers}
+}
+
+// callMessage encodes a call message.
+func callMessage(xid, prog, vers, proc uint32, args func(*xdrWriter)) []byte {
+	w := xdrWriter{}
+	w.uint32(xid)
+	w.uint32(msgCall)
+	w.uint32(rpcVersion)
+	w.uint32(prog)
+	w.uint32(vers)
+	w.uint32(proc)
+	for n := 0; n < 2; n++ {
+		w.uint32(authNone)
+		w.opaque(nil)
+	}
+	if args != nil {
+		args(&w)
+	}
+	return w.b
+}
+
+// parseReply decodes an accepted reply message, returning the accept status
+// and the results.
+func parseReply(xid uint32, msg []byte) (uint32, *xdrReader, error) {
+	r := &xdrReader{b: msg}
+	if got := r.uint32(); got != xid {
+		return 0, nil, fmt.Errorf("got xid %d; want %d", got, xid)
+	}
+	if r.uint32() != msgReply || r.uint32() != replyAccepted {
+		return 0, nil, fmt.Errorf("reply not accepted")
+	}
+	r.uint32()
+	r.opaque()
+	stat := r.uint32()
+	return stat, r, r.err
+}
+
+// call calls the procedure and returns the results, failing unless the call
+// succeeded.
+func (c *rpcClient) call(t *testing.T, proc uint32, args func(*xdrWriter)) *xdrReader {
+	t.Helper()
+	stat, res := c.callStatus(t, proc, args)
+	if stat != acceptSuccess {
+		t.Fatalf("got accept status %d calling procedure %d", stat, proc)
+	}
+	return res
+}
+
+func (c *rpcClient) callStatus(t *testing.T, proc uint32, args func(*xdrWriter)) (uint32, *xdrReader) {
+	t.Helper()
+	c.xid++
+	if err := writeRecord(c.conn, callMessage(c.xid, c.prog, c.vers, proc, args)); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := readRecord(c.conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat, res, err := parseReply(c.xid, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stat, res
+}
+
+func TestXDROpaque(t *testing.T) {
+	for _, data := range []string{"", "a", "abcd", "abcde"} {
+		w := xdrWriter{}
+		w.string(data)
+		w.uint32(7)
+		if len(w.b)%4 != 0 {
+			t.Errorf("got %d bytes encoding %q; want a multiple of 4", len(w.b), data)
+		}
+		r := xdrReader{b: w.b}
+		if got := r.string(); got != data {
+			t.Errorf("got %q; want %q", got, data)
+		}
+		if got := r.uint32(); got != 7 || r.err != nil {
+			t.Errorf("got %d, %v after %q; want 7", got, r.err, data)
+		}
+	}
+	r := xdrReader{b: []byte{0, 0, 0, 9, 'a'}}
+	if r.opaque(); r.err == nil {
+		t.Error("expected error decoding truncated opaque data")
+	}
+}
+
+func TestRPCReplyStatus(t *testing.T) {
+	p := rpcProgram{
+		prog: 1000,
+		vers: 2,
+		procs: map[uint32]rpcProc{
+			1: func(args *xdrReader, res *xdrWriter) {
+				res.uint32(args.uint32() + 1)
+			},
+		},
+	}
+	testCases := []struct {
+		name string
+		prog uint32
+		vers uint32
+		proc uint32
+		args func(*xdrWriter)
+		stat uint32
+	}{
+		{"success", 1000, 2, 1, func(w *xdrWriter) { w.uint32(41) }, acceptSuccess},
+		{"null procedure", 1000, 2, 0, nil, acceptSuccess},
+		{"unknown program", 1001, 2, 1, nil, acceptProgUnavail},
+		{"wrong version", 1000, 3, 1, nil, acceptProgMismatch},
+		{"unknown procedure", 1000, 2, 9, nil, acceptProcUnavail},
+		{"missing arguments", 1000, 2, 1, nil, acceptGarbageArgs},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			reply := p.reply(callMessage(5, tc.prog, tc.vers, tc.proc, tc.args))
+			stat, res, err := parseReply(5, reply)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stat != tc.stat {
+				t.Fatalf("got accept status %d; want %d", stat, tc.stat)
+			}
+			if tc.name == "success" && res.uint32() != 42 {
+				t.Error("got wrong result")
+			}
+		})
+	}
+}
+
+func TestRecordFragments(t *testing.T) {
+	var buf bytes.Buffer
+	buf.Write([]byte{0, 0, 0, 2, 'a', 'b'})
+	buf.Write([]byte{0x80, 0, 0, 1, 'c'})
+	msg, err := readRecord(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(msg) != "abc" {
+		t.Errorf("got record %q; want abc", msg)
+	}
+}
@@ -0,0 +1,169 @@
+// Copyright (c) 2020–2024 The prologix developers. All rights reserved.
+// Project site: https://github.com/gotmc/prologix
+// Use of this source code is governed by a MIT-style license that
+// can be found in the LICENSE.txt file for the project.
+
+package gateway
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gotmc/prologix"
+)
+
+// tracker tracks the listeners and connections of a server, so that closing
+// the server closes them and waits for their handlers to return.
+type tracker struct {
+	mu      sync.Mutex
+	closers map[io.Closer]struct{}
+	closed  bool
+	wg      sync.WaitGroup
+}
+
+// add adds a listener or connection, reporting false if the server is closed.
+func (t *tracker) add(c io.Closer) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return false
+	}
+	if t.closers == nil {
+		t.closers = make(map[io.Closer]struct{})
+	}
+	t.closers[c] = struct{}{}
+	return true
+}
+
+func (t *tracker) remove(c io.Closer) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.closers, c)
+}
+
+func (t *tracker) isClosed() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.closed
+}
+
+// close closes the listeners and connections and waits for the handlers of
+// the connections to return.
+func (t *tracker) close() {
+	t.mu.Lock()
+	t.closed = true
+	for c := range t.closers {
+		c.Close()
+	}
+	t.mu.Unlock()
+	t.wg.Wait()
+}
+
+// serve accepts connections on the listener, calling handle for each in its
+// own goroutine and closing the connection once handle returns, until the
+// listener fails or the server is closed, in which case net.ErrClosed is
+// returned.
+func (t *tracker) serve(l net.Listener, handle func(net.Conn)) error {
+	if !t.add(l) {
+		l.Close()
+		return net.ErrClosed
+	}
+	defer t.remove(l)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if t.isClosed() {
+				return net.ErrClosed
+			}
+			return err
+		}
+		if !t.add(conn) {
+			conn.Close()
+			return net.ErrClosed
+		}
+		t.wg.Add(1)
+		go func() {
+			defer t.wg.Done()
+			defer t.remove(conn)
+			defer conn.Close()
+			handle(conn)
+		}()
+	}
+}
+
+var (
+	errUnknownInterface = errors.New("unknown interface")
+	errInvalidAddress   = errors.New("invalid GPIB address")
+)
+
+// devices opens the instruments on the bus of a controller by device names
+// like `gpib0,10` or `gpib0,10,96`, sharing each instrument between the
+// clients using it.
+type devices struct {
+	c     *prologix.Controller
+	iface string
+
+	mu    sync.Mutex
+	insts map[string]*prologix.Instrument
+}
+
+// open returns the instrument with the device name along with its address,
+// which is the primary address followed by the secondary address, if any.
+func (d *devices) open(name string) (string, *prologix.Instrument, error) {
+	iface, addr, ok := strings.Cut(strings.TrimSpace(name), ",")
+	if !ok || !strings.EqualFold(iface, d.iface) {
+		return "", nil, errUnknownInterface
+	}
+	return d.instrument(addr)
+}
+
+// instrument returns the instrument with the GPIB address given as the
+// primary address optionally followed by a comma and the secondary address,
+// such as `10` or `10,96`, along with its address formatted like the
+// instrument's Address method.
+func (d *devices) instrument(gpib string) (string, *prologix.Instrument, error) {
+	fields := strings.Split(gpib, ",")
+	if len(fields) > 2 {
+		return "", nil, errInvalidAddress
+	}
+	pad, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return "", nil, errInvalidAddress
+	}
+	var opts []prologix.InstrumentOption
+	if len(fields) == 2 {
+		sad, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return "", nil, errInvalidAddress
+		}
+		opts = append(opts, prologix.WithInstrumentSecondaryAddress(sad))
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	addr := strings.Join(fields, " ")
+	if inst, ok := d.insts[addr]; ok {
+		return addr, inst, nil
+	}
+	inst, err := d.c.Instrument(pad, opts...)
+	if err != nil {
+		return "", nil, errInvalidAddress
+	}
+	if d.insts == nil {
+		d.insts = make(map[string]*prologix.Instrument)
+	}
+	d.insts[addr] = inst
+	return addr, inst, nil
+}
+
+// isTimeout reports whether the error is due to the instrument not answering
+// in time.
+func isTimeout(err error) bool {
+	var t interface{ Timeout() bool }
+	return errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &t) && t.Timeout())
+}
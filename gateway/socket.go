@@ -0,0 +1,167 @@
+// Copyright (c) 2020–2024 The prologix developers. All rights reserved.
+// Project site: https://github.com/gotmc/prologix
+// Use of this source code is governed by a MIT-style license that
+// can be found in the LICENSE.txt file for the project.
+
+// Package gateway serves the instruments on the GPIB bus of a Prologix
+// adapter to network clients.
+package gateway
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/gotmc/prologix"
+)
+
+// maxLineLength is the longest command accepted from a socket client.
+const maxLineLength = 1 << 20
+
+// SocketServer serves an instrument over raw TCP sockets, like the SCPI
+// socket on port 5025 of LAN instruments. Each newline terminated line
+// received from a client is sent to the instrument, and after a query, such
+// as `*IDN?`, the response is read and sent back to the client.
+//
+// Each line is handled as one transaction on the bus, so the lines of the
+// clients of all the servers sharing the adapter are serialized, and a client
+// disconnecting doesn't interrupt a transaction in progress. Lines starting
+// with `++`, which the Prologix adapter would take as a command for itself,
+// are refused, as are the lines denied by the access control, if any.
+type SocketServer struct {
+	inst    *prologix.Instrument
+	timeout time.Duration
+	logger  *log.Logger
+	access  *AccessControl
+	tracker tracker
+}
+
+// SocketOption applies an option to the socket server.
+type SocketOption func(*SocketServer)
+
+// NewSocketServer creates a server for the instrument. Optionally the server
+// can be configured using a SocketOption.
+func NewSocketServer(inst *prologix.Instrument, opts ...SocketOption) *SocketServer {
+	s := SocketServer{
+		inst:    inst,
+		timeout: 5 * time.Second,
+		logger:  log.Default(),
+	}
+	for _, opt := range opts {
+		opt(&s)
+	}
+	return &s
+}
+
+// WithQueryTimeout sets the time allowed for the instrument to answer a
+// query, which defaults to 5 s. When it expires, the instrument is cleared
+// and nothing is sent to the client.
+func WithQueryTimeout(d time.Duration) SocketOption {
+	return func(s *SocketServer) {
+		s.timeout = d
+	}
+}
+
+// WithLogger sets the logger of errors and client connections, which
+// defaults to the standard logger.
+func WithLogger(l *log.Logger) SocketOption {
+	return func(s *SocketServer) {
+		s.logger = l
+	}
+}
+
+// WithAccessControl sets the access control of the clients. Clients denied
+// the instrument are disconnected.
+func WithAccessControl(ac *AccessControl) SocketOption {
+	return func(s *SocketServer) {
+		s.access = ac
+	}
+}
+
+// Serve accepts client connections on the listener, serving each in its own
+// goroutine, until the listener fails or the server is closed. Serve always
+// returns a non-nil error, which is net.ErrClosed after Close.
+func (s *SocketServer) Serve(l net.Listener) error {
+	return s.tracker.serve(l, s.serveConn)
+}
+
+// Close stops the listeners and closes the client connections, waiting for the
+// transactions in progress to finish.
+func (s *SocketServer) Close() error {
+	s.tracker.close()
+	return nil
+}
+
+// serveConn handles the lines received from a client until it disconnects.
+func (s *SocketServer) serveConn(conn net.Conn) {
+	addr := conn.RemoteAddr()
+	c, err := s.access.identify(conn)
+	if err != nil {
+		s.logger.Printf("client %s: %s", addr, err)
+		return
+	}
+	if s.access.allowAddress(c, s.inst.Address()) != nil {
+		return
+	}
+	s.logger.Printf("client %s connected to GPIB address %s", c, s.inst.Address())
+	sc := bufio.NewScanner(conn)
+	sc.Buffer(make([]byte, 4096), maxLineLength)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+		resp, err := s.handle(c, line)
+		if errors.Is(err, errAccessDenied) {
+			continue
+		}
+		if err != nil {
+			s.logger.Printf("client %s: %s", addr, err)
+			continue
+		}
+		if resp == "" {
+			continue
+		}
+		if _, err := io.WriteString(conn, resp); err != nil {
+			// The transaction is complete, so the response is simply dropped.
+			s.logger.Printf("client %s: error sending response: %s", addr, err)
+			return
+		}
+	}
+	if err := sc.Err(); err != nil && !errors.Is(err, net.ErrClosed) {
+		s.logger.Printf("client %s: %s", addr, err)
+	}
+	s.logger.Printf("client %s disconnected", addr)
+}
+
+// handle sends the line to the instrument and returns the response to a
+// query, terminated by a newline.
+func (s *SocketServer) handle(c client, line string) (string, error) {
+	// A CR or ESC would let the line carry commands of the adapter, such as
+	// ++addr, past the controller.
+	if err := checkLine(line); err != nil {
+		return "", fmt.Errorf("refused %q: %w", line, err)
+	}
+	if err := s.access.allowCommand(c, s.inst.Address(), line); err != nil {
+		return "", err
+	}
+	if !prologix.IsQuery(line) {
+		return "", s.inst.Command(line)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	resp, err := s.inst.QueryContext(ctx, line)
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasSuffix(resp, "\n") {
+		resp += "\n"
+	}
+	return resp, nil
+}
@@ -0,0 +1,159 @@
+// Copyright (c) 2020–2024 The prologix developers. All rights reserved.
+// Project site: https://github.com/gotmc/prologix
+// Use of this source code is governed by a MIT-style license that
+// can be found in the LICENSE.txt file for the project.
+
+package gateway
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gotmc/prologix"
+	"github.com/gotmc/prologix/sim"
+)
+
+// startSocketServer serves the instrument at the address of a simulated
+// adapter and returns the address of the listener.
+func startSocketServer(t *testing.T, c *prologix.Controller, addr int, opts ...SocketOption) string {
+	t.Helper()
+	inst, err := c.Instrument(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts = append([]SocketOption{WithLogger(log.New(io.Discard, "", 0))}, opts...)
+	s := NewSocketServer(inst, opts...)
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+	return l.Addr().String()
+}
+
+func newSimController(t *testing.T, adapter *sim.Adapter) *prologix.Controller {
+	t.Helper()
+	conn := adapter.Dial()
+	t.Cleanup(func() { conn.Close() })
+	c, err := prologix.NewController(conn, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func dial(t *testing.T, addr string) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn, bufio.NewReader(conn)
+}
+
+func TestSocketServer(t *testing.T) {
+	adapter := sim.NewAdapter()
+	dmm := sim.NewScripted("SIM,DMM,1,1.0", map[string]string{"volt?": "1.5"})
+	if err := adapter.Attach(10, dmm); err != nil {
+		t.Fatal(err)
+	}
+	psu := sim.NewScripted("SIM,PSU,2,1.0", nil)
+	if err := adapter.Attach(22, psu); err != nil {
+		t.Fatal(err)
+	}
+	c := newSimController(t, adapter)
+	dmmAddr := startSocketServer(t, c, 10)
+	psuAddr := startSocketServer(t, c, 22)
+
+	conn, r := dial(t, dmmAddr)
+	fmt.Fprint(conn, "CONF:VOLT\n\n++addr 22\nSYST:BEEP\r++addr 22\rOUTP OFF\n*IDN?\nVOLT?\n")
+	for _, want := range []string{"SIM,DMM,1,1.0\n", "1.5\n"} {
+		got, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("got response %q; want %q", got, want)
+		}
+	}
+	conn, r = dial(t, psuAddr)
+	fmt.Fprint(conn, "OUTP ON\n*IDN?\n")
+	if got, err := r.ReadString('\n'); err != nil || got != "SIM,PSU,2,1.0\n" {
+		t.Errorf("got response %q, %v; want PSU identity", got, err)
+	}
+	if got := strings.Join(dmm.Received(), ","); got != "CONF:VOLT,*IDN?,VOLT?" {
+		t.Errorf("got commands %s received by DMM", got)
+	}
+	if got := strings.Join(psu.Received(), ","); got != "OUTP ON,*IDN?" {
+		t.Errorf("got commands %s received by PSU", got)
+	}
+}
+
+func TestSocketServerConcurrentClients(t *testing.T) {
+	adapter := sim.NewAdapter()
+	for addr := 1; addr <= 2; addr++ {
+		inst := sim.NewScripted("", map[string]string{"addr?": fmt.Sprint(addr)})
+		if err := adapter.Attach(addr, inst); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := newSimController(t, adapter)
+	servers := []string{startSocketServer(t, c, 1), startSocketServer(t, c, 2)}
+
+	var wg sync.WaitGroup
+	for client := 0; client < 6; client++ {
+		want := client%2 + 1
+		conn, r := dial(t, servers[client%2])
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < 20; n++ {
+				fmt.Fprint(conn, "ADDR?\n")
+				got, err := r.ReadString('\n')
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if got != fmt.Sprintf("%d\n", want) {
+					t.Errorf("got response %q from instrument %d", got, want)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestSocketServerClientDisconnects(t *testing.T) {
+	adapter := sim.NewAdapter()
+	dmm := sim.NewScripted("", map[string]string{"volt?": "1.5", "curr?": "0.1"})
+	if err := adapter.Attach(10, dmm); err != nil {
+		t.Fatal(err)
+	}
+	c := newSimController(t, adapter)
+	addr := startSocketServer(t, c, 10, WithQueryTimeout(50*time.Millisecond))
+
+	// A client sending a query and leaving before the response, or sending a
+	// query that isn't answered, doesn't leave a response to be read by the
+	// next client.
+	conn, _ := dial(t, addr)
+	fmt.Fprint(conn, "VOLT?\nFREQ?\n")
+	conn.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	conn, r := dial(t, addr)
+	fmt.Fprint(conn, "CURR?\n")
+	if got, err := r.ReadString('\n'); err != nil || got != "0.1\n" {
+		t.Errorf("got response %q, %v; want 0.1", got, err)
+	}
+}
@@ -0,0 +1,590 @@
+// Copyright (c) 2020–2024 The prologix developers. All rights reserved.
+// Project site: https://github.com/gotmc/prologix
+// Use of this source code is governed by a MIT-style license that
+// can be found in the LICENSE.txt file for the project.
+
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gotmc/prologix"
+)
+
+// VXI-11 core channel program.
+const (
+	VXI11CoreProgram = 0x0607AF
+	VXI11CoreVersion = 1
+)
+
+// VXI-11 core channel procedures.
+const (
+	procCreateLink      = 10
+	procDeviceWrite     = 11
+	procDeviceRead      = 12
+	procDeviceReadStb   = 13
+	procDeviceTrigger   = 14
+	procDeviceClear     = 15
+	procDeviceRemote    = 16
+	procDeviceLocal     = 17
+	procDeviceLock      = 18
+	procDeviceUnlock    = 19
+	procDeviceEnableSRQ = 20
+	procDeviceDocmd     = 22
+	procDestroyLink     = 23
+	procCreateIntrChan  = 25
+	procDestroyIntrChan = 26
+)
+
+// VXI-11 error codes.
+const (
+	vxiNoError        = 0
+	vxiNotAccessible  = 3
+	vxiInvalidLink    = 4
+	vxiParameterError = 5
+	vxiNotSupported   = 8
+	vxiLocked         = 11
+	vxiNoLockHeld     = 12
+	vxiIOTimeout      = 15
+	vxiIOError        = 17
+	vxiInvalidAddress = 21
+)
+
+// VXI-11 operation flags and read termination reasons.
+const (
+	flagWaitLock = 0x01
+	flagEnd      = 0x08
+	flagTermChar = 0x80
+
+	reasonRequestCount = 0x01
+	reasonTermChar     = 0x02
+	reasonEnd          = 0x04
+)
+
+// maxRecvSize is the largest data accepted by device_write, as reported to
+// clients when creating a link.
+const maxRecvSize = 1 << 20
+
+// VXI11Server serves the instruments on the GPIB bus of a Controller over the
+// VXI-11 core channel, so that the Prologix adapter appears to VISA libraries
+// as a LAN/GPIB gateway. Clients create links to devices named like
+// `gpib0,10`, or `gpib0,10,96` with a secondary address, where gpib0 is the
+// interface name.
+//
+// The data of device_write is sent to the instrument with EOI asserted on the
+// last byte once the END flag is set, and device_read reads the response using
+// the `++read eoi` command. Device locks only apply between VXI-11 links.
+// The abort channel, service requests, and links to the interface itself
+// aren't supported. Operations denied by the access control, if any, fail
+// with the device not accessible error.
+type VXI11Server struct {
+	devices devices
+	logger  *log.Logger
+	access  *AccessControl
+	tracker tracker
+
+	mu       sync.Mutex
+	nextLink uint32
+	locks    map[string]uint32
+	// released is closed and replaced when a lock is released.
+	released chan struct{}
+}
+
+// vxiLink is a link to a device created by a client.
+type vxiLink struct {
+	id   uint32
+	addr string
+	inst *prologix.Instrument
+	// pending is data written without the END flag.
+	pending []byte
+	// response is the unread part of the last response.
+	response []byte
+}
+
+// vxiConn holds the client of a connection and the links it created.
+type vxiConn struct {
+	client client
+	links  map[uint32]*vxiLink
+}
+
+// VXI11Option applies an option to the VXI-11 server.
+type VXI11Option func(*VXI11Server)
+
+// NewVXI11Server creates a VXI-11 server for the instruments on the bus of the
+// controller. Optionally the server can be configured using a VXI11Option.
+func NewVXI11Server(c *prologix.Controller, opts ...VXI11Option) *VXI11Server {
+	s := VXI11Server{
+		devices:  devices{c: c, iface: "gpib0"},
+		logger:   log.Default(),
+		locks:    make(map[string]uint32),
+		released: make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(&s)
+	}
+	return &s
+}
+
+// WithInterfaceName sets the interface name of the device names, which
+// defaults to gpib0.
+func WithInterfaceName(name string) VXI11Option {
+	return func(s *VXI11Server) {
+		s.devices.iface = name
+	}
+}
+
+// WithVXI11Logger sets the logger of errors and links, which defaults to the
+// standard logger.
+func WithVXI11Logger(l *log.Logger) VXI11Option {
+	return func(s *VXI11Server) {
+		s.logger = l
+	}
+}
+
+// WithVXI11AccessControl sets the access control of the clients.
+func WithVXI11AccessControl(ac *AccessControl) VXI11Option {
+	return func(s *VXI11Server) {
+		s.access = ac
+	}
+}
+
+// Serve accepts core channel connections on the listener until it fails or
+// the server is closed. The port of the listener is usually registered with a
+// Portmapper for VXI11CoreProgram. Serve always returns a non-nil error, which
+// is net.ErrClosed after Close.
+func (s *VXI11Server) Serve(l net.Listener) error {
+	return s.tracker.serve(l, s.serveConn)
+}
+
+// Close stops the listeners and closes the client connections, destroying
+// their links.
+func (s *VXI11Server) Close() error {
+	s.tracker.close()
+	return nil
+}
+
+func (s *VXI11Server) serveConn(conn net.Conn) {
+	c, err := s.access.identify(conn)
+	if err != nil {
+		s.logger.Printf("VXI-11 client %s: %s", conn.RemoteAddr(), err)
+		return
+	}
+	vc := &vxiConn{client: c, links: make(map[uint32]*vxiLink)}
+	defer func() {
+		for _, l := range vc.links {
+			s.destroy(vc, l)
+		}
+	}()
+	p := rpcProgram{
+		prog: VXI11CoreProgram,
+		vers: VXI11CoreVersion,
+		procs: map[uint32]rpcProc{
+			procCreateLink:      func(a *xdrReader, r *xdrWriter) { s.createLink(vc, a, r) },
+			procDeviceWrite:     func(a *xdrReader, r *xdrWriter) { s.deviceWrite(vc, a, r) },
+			procDeviceRead:      func(a *xdrReader, r *xdrWriter) { s.deviceRead(vc, a, r) },
+			procDeviceReadStb:   func(a *xdrReader, r *xdrWriter) { s.deviceReadStb(vc, a, r) },
+			procDeviceTrigger:   func(a *xdrReader, r *xdrWriter) { s.generic(vc, a, r, "trigger", s.trigger) },
+			procDeviceClear:     func(a *xdrReader, r *xdrWriter) { s.generic(vc, a, r, "clear", s.clear) },
+			procDeviceRemote:    func(a *xdrReader, r *xdrWriter) { s.generic(vc, a, r, "remote control", s.remote) },
+			procDeviceLocal:     func(a *xdrReader, r *xdrWriter) { s.generic(vc, a, r, "local control", s.local) },
+			procDeviceLock:      func(a *xdrReader, r *xdrWriter) { s.deviceLock(vc, a, r) },
+			procDeviceUnlock:    func(a *xdrReader, r *xdrWriter) { s.deviceUnlock(vc, a, r) },
+			procDeviceEnableSRQ: s.enableSRQ,
+			procDeviceDocmd:     s.docmd,
+			procDestroyLink:     func(a *xdrReader, r *xdrWriter) { s.destroyLink(vc, a, r) },
+			procCreateIntrChan:  s.createIntrChan,
+			procDestroyIntrChan: func(a *xdrReader, r *xdrWriter) { r.uint32(vxiNotSupported) },
+		},
+	}
+	if err := p.serve(conn); err != nil && !errors.Is(err, net.ErrClosed) {
+		s.logger.Printf("VXI-11 client %s: %s", conn.RemoteAddr(), err)
+	}
+}
+
+// createLink decodes Create_LinkParms and encodes Create_LinkResp.
+func (s *VXI11Server) createLink(vc *vxiConn, args *xdrReader, res *xdrWriter) {
+	args.int32() // clientId
+	lockDevice := args.bool()
+	lockTimeout := args.uint32()
+	device := args.string()
+	if args.err != nil {
+		return
+	}
+	l, code := s.link(device)
+	if code == vxiNoError && s.access.allowAddress(vc.client, l.addr) != nil {
+		code = vxiNotAccessible
+	}
+	if code == vxiNoError && lockDevice && s.access.allowControl(vc.client, l.addr, "lock") != nil {
+		code = vxiNotAccessible
+	}
+	if code == vxiNoError && lockDevice {
+		code = s.waitLock(l, flagWaitLock, lockTimeout, true)
+	}
+	if code != vxiNoError {
+		res.uint32(code)
+		res.uint32(0)
+		res.uint32(0)
+		res.uint32(0)
+		return
+	}
+	vc.links[l.id] = l
+	s.logger.Printf("VXI-11 link %d created to %s", l.id, device)
+	res.uint32(vxiNoError)
+	res.uint32(l.id)
+	res.uint32(0) // abortPort
+	res.uint32(maxRecvSize)
+}
+
+// link creates a link to the device with the given name.
+func (s *VXI11Server) link(device string) (*vxiLink, uint32) {
+	addr, inst, err := s.devices.open(device)
+	switch {
+	case errors.Is(err, errUnknownInterface):
+		return nil, vxiNotAccessible
+	case err != nil:
+		return nil, vxiInvalidAddress
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextLink++
+	return &vxiLink{id: s.nextLink, addr: addr, inst: inst}, vxiNoError
+}
+
+// deviceWrite decodes Device_WriteParms and encodes Device_WriteResp.
+func (s *VXI11Server) deviceWrite(vc *vxiConn, args *xdrReader, res *xdrWriter) {
+	lid := args.uint32()
+	args.uint32() // io_timeout
+	lockTimeout := args.uint32()
+	flags := args.uint32()
+	data := args.opaque()
+	if args.err != nil {
+		return
+	}
+	code := s.write(vc, lid, lockTimeout, flags, data)
+	res.uint32(code)
+	if code != vxiNoError {
+		res.uint32(0)
+		return
+	}
+	res.uint32(uint32(len(data)))
+}
+
+func (s *VXI11Server) write(vc *vxiConn, lid, lockTimeout, flags uint32, data []byte) uint32 {
+	l, ok := vc.links[lid]
+	if !ok {
+		return vxiInvalidLink
+	}
+	if len(data) > maxRecvSize || len(l.pending)+len(data) > maxRecordSize {
+		return vxiParameterError
+	}
+	if code := s.waitLock(l, flags, lockTimeout, false); code != vxiNoError {
+		return code
+	}
+	l.pending = append(l.pending, data...)
+	if flags&flagEnd == 0 {
+		return vxiNoError
+	}
+	msg := bytes.TrimSuffix(bytes.TrimSuffix(l.pending, []byte("\n")), []byte("\r"))
+	l.pending = nil
+	l.response = nil
+	if len(msg) == 0 {
+		return vxiNoError
+	}
+	if s.access.allowCommand(vc.client, l.addr, string(msg)) != nil {
+		return vxiNotAccessible
+	}
+	if _, err := l.inst.Write(append(escape(msg), '\n')); err != nil {
+		s.logger.Printf("VXI-11 link %d: %s", lid, err)
+		return ioErrorCode(err)
+	}
+	return vxiNoError
+}
+
+// deviceRead decodes Device_ReadParms and encodes Device_ReadResp.
+func (s *VXI11Server) deviceRead(vc *vxiConn, args *xdrReader, res *xdrWriter) {
+	lid := args.uint32()
+	requestSize := args.uint32()
+	ioTimeout := args.uint32()
+	lockTimeout := args.uint32()
+	flags := args.uint32()
+	termChar := byte(args.uint32())
+	if args.err != nil {
+		return
+	}
+	data, reason, code := s.read(vc, lid, requestSize, ioTimeout, lockTimeout, flags, termChar)
+	res.uint32(code)
+	res.uint32(reason)
+	res.opaque(data)
+}
+
+func (s *VXI11Server) read(
+	vc *vxiConn,
+	lid, requestSize, ioTimeout, lockTimeout, flags uint32,
+	termChar byte,
+) ([]byte, uint32, uint32) {
+	l, ok := vc.links[lid]
+	if !ok {
+		return nil, 0, vxiInvalidLink
+	}
+	if code := s.waitLock(l, flags, lockTimeout, false); code != vxiNoError {
+		return nil, 0, code
+	}
+	if len(l.response) == 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), milliseconds(ioTimeout))
+		defer cancel()
+		resp, err := l.inst.ReadContext(ctx)
+		if err != nil {
+			s.logger.Printf("VXI-11 link %d: %s", lid, err)
+			return nil, 0, ioErrorCode(err)
+		}
+		l.response = []byte(resp)
+	}
+
+	n := min(int(requestSize), len(l.response))
+	var reason uint32
+	if flags&flagTermChar != 0 {
+		if i := bytes.IndexByte(l.response[:n], termChar); i >= 0 {
+			n = i + 1
+			reason |= reasonTermChar
+		}
+	}
+	data := l.response[:n]
+	l.response = l.response[n:]
+	switch {
+	case len(l.response) == 0:
+		reason |= reasonEnd
+		l.response = nil
+	case reason == 0:
+		reason = reasonRequestCount
+	}
+	return data, reason, vxiNoError
+}
+
+// deviceReadStb decodes Device_GenericParms and encodes Device_ReadStbResp.
+func (s *VXI11Server) deviceReadStb(vc *vxiConn, args *xdrReader, res *xdrWriter) {
+	var stb byte
+	s.generic(vc, args, res, "", func(l *vxiLink) (err error) {
+		stb, err = l.inst.SerialPoll()
+		return err
+	})
+	res.uint32(uint32(stb))
+}
+
+// generic decodes Device_GenericParms, calls fn with the link once no other
+// link holds the device lock, and encodes Device_Error. Unless op is empty,
+// the client must be allowed the operation by the access control.
+func (s *VXI11Server) generic(vc *vxiConn, args *xdrReader, res *xdrWriter, op string, fn func(*vxiLink) error) {
+	lid := args.uint32()
+	flags := args.uint32()
+	lockTimeout := args.uint32()
+	args.uint32() // io_timeout
+	if args.err != nil {
+		return
+	}
+	l, ok := vc.links[lid]
+	if !ok {
+		res.uint32(vxiInvalidLink)
+		return
+	}
+	if op != "" && s.access.allowControl(vc.client, l.addr, op) != nil {
+		res.uint32(vxiNotAccessible)
+		return
+	}
+	if code := s.waitLock(l, flags, lockTimeout, false); code != vxiNoError {
+		res.uint32(code)
+		return
+	}
+	if err := fn(l); err != nil {
+		s.logger.Printf("VXI-11 link %d: %s", lid, err)
+		res.uint32(ioErrorCode(err))
+		return
+	}
+	res.uint32(vxiNoError)
+}
+
+func (s *VXI11Server) trigger(l *vxiLink) error {
+	return l.inst.Trigger()
+}
+
+// clear sends Selected Device Clear and discards the pending data and
+// response of the link.
+func (s *VXI11Server) clear(l *vxiLink) error {
+	l.pending = nil
+	l.response = nil
+	return l.inst.ClearDevice()
+}
+
+// remote places the instrument in remote state with local lockout.
+func (s *VXI11Server) remote(l *vxiLink) error {
+	return l.inst.FrontPanel(false)
+}
+
+func (s *VXI11Server) local(l *vxiLink) error {
+	return l.inst.FrontPanel(true)
+}
+
+// deviceLock decodes Device_LockParms and encodes Device_Error.
+func (s *VXI11Server) deviceLock(vc *vxiConn, args *xdrReader, res *xdrWriter) {
+	lid := args.uint32()
+	flags := args.uint32()
+	lockTimeout := args.uint32()
+	if args.err != nil {
+		return
+	}
+	l, ok := vc.links[lid]
+	if !ok {
+		res.uint32(vxiInvalidLink)
+		return
+	}
+	if s.access.allowControl(vc.client, l.addr, "lock") != nil {
+		res.uint32(vxiNotAccessible)
+		return
+	}
+	res.uint32(s.waitLock(l, flags, lockTimeout, true))
+}
+
+// deviceUnlock decodes Device_Link and encodes Device_Error.
+func (s *VXI11Server) deviceUnlock(vc *vxiConn, args *xdrReader, res *xdrWriter) {
+	lid := args.uint32()
+	if args.err != nil {
+		return
+	}
+	l, ok := vc.links[lid]
+	if !ok {
+		res.uint32(vxiInvalidLink)
+		return
+	}
+	if !s.unlock(l) {
+		res.uint32(vxiNoLockHeld)
+		return
+	}
+	res.uint32(vxiNoError)
+}
+
+// destroyLink decodes Device_Link and encodes Device_Error.
+func (s *VXI11Server) destroyLink(vc *vxiConn, args *xdrReader, res *xdrWriter) {
+	lid := args.uint32()
+	if args.err != nil {
+		return
+	}
+	l, ok := vc.links[lid]
+	if !ok {
+		res.uint32(vxiInvalidLink)
+		return
+	}
+	s.destroy(vc, l)
+	res.uint32(vxiNoError)
+}
+
+func (s *VXI11Server) destroy(vc *vxiConn, l *vxiLink) {
+	s.unlock(l)
+	delete(vc.links, l.id)
+	s.logger.Printf("VXI-11 link %d destroyed", l.id)
+}
+
+// enableSRQ decodes Device_EnableSrqParms and encodes Device_Error.
+func (s *VXI11Server) enableSRQ(args *xdrReader, res *xdrWriter) {
+	args.uint32()
+	args.bool()
+	args.opaque()
+	res.uint32(vxiNotSupported)
+}
+
+// docmd decodes Device_DocmdParms and encodes Device_DocmdResp.
+func (s *VXI11Server) docmd(args *xdrReader, res *xdrWriter) {
+	for n := 0; n < 7; n++ {
+		args.uint32()
+	}
+	args.opaque()
+	res.uint32(vxiNotSupported)
+	res.opaque(nil)
+}
+
+// createIntrChan decodes Device_RemoteFunc and encodes Device_Error.
+func (s *VXI11Server) createIntrChan(args *xdrReader, res *xdrWriter) {
+	for n := 0; n < 5; n++ {
+		args.uint32()
+	}
+	res.uint32(vxiNotSupported)
+}
+
+// waitLock waits until no other link holds the lock of the link's device, and
+// takes the lock if requested. Without the waitlock flag, the error is
+// returned at once.
+func (s *VXI11Server) waitLock(l *vxiLink, flags, lockTimeout uint32, take bool) uint32 {
+	var timeout <-chan time.Time
+	for {
+		s.mu.Lock()
+		owner, locked := s.locks[l.addr]
+		if !locked || owner == l.id {
+			if take {
+				s.locks[l.addr] = l.id
+			}
+			s.mu.Unlock()
+			return vxiNoError
+		}
+		released := s.released
+		s.mu.Unlock()
+		if flags&flagWaitLock == 0 {
+			return vxiLocked
+		}
+		if timeout == nil {
+			t := time.NewTimer(milliseconds(lockTimeout))
+			defer t.Stop()
+			timeout = t.C
+		}
+		select {
+		case <-released:
+		case <-timeout:
+			return vxiLocked
+		}
+	}
+}
+
+// unlock releases the lock held by the link, reporting whether it was held.
+func (s *VXI11Server) unlock(l *vxiLink) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if owner, ok := s.locks[l.addr]; !ok || owner != l.id {
+		return false
+	}
+	delete(s.locks, l.addr)
+	close(s.released)
+	s.released = make(chan struct{})
+	return true
+}
+
+// ioErrorCode returns the VXI-11 error code of an error communicating with
+// the instrument.
+func ioErrorCode(err error) uint32 {
+	if isTimeout(err) {
+		return vxiIOTimeout
+	}
+	return vxiIOError
+}
+
+func milliseconds(ms uint32) time.Duration {
+	return time.Duration(ms) * time.Millisecond
+}
+
+// escape escapes the CR, LF, ESC, and `+` characters in the data, so that the
+// Prologix adapter sends them to the instrument instead of taking them as the
+// end of the data or as a `++` command.
+func escape(data []byte) []byte {
+	const esc = 27
+	escaped := make([]byte, 0, len(data))
+	for _, b := range data {
+		switch b {
+		case '\r', '\n', esc, '+':
+			escaped = append(escaped, esc)
+		}
+		escaped = append(escaped, b)
+	}
+	return escaped
+}
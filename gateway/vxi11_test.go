@@ -0,0 +1,304 @@
+// Copyright (c) 2020–2024 The prologix developers. All rights reserved.
+// Project site: https://github.com/gotmc/prologix
+// Use of this source code is governed by a MIT-style license that
+// can be found in the LICENSE.txt file for the project.
+
+package gateway
+
+import (
+	"io"
+	"log"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gotmc/prologix/sim"
+)
+
+// startVXI11Server serves the bus of a simulated adapter over VXI-11 and
+// returns the address of the core channel listener.
+func startVXI11Server(t *testing.T, adapter *sim.Adapter, opts ...VXI11Option) string {
+	t.Helper()
+	opts = append([]VXI11Option{WithVXI11Logger(log.New(io.Discard, "", 0))}, opts...)
+	s := NewVXI11Server(newSimController(t, adapter), opts...)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+	return l.Addr().String()
+}
+
+// vxiClient calls the procedures of the VXI-11 core channel.
+type vxiClient struct {
+	*rpcClient
+}
+
+func dialVXI11(t *testing.T, addr string) vxiClient {
+	return vxiClient{dialRPC(t, addr, VXI11CoreProgram, VXI11CoreVersion)}
+}
+
+func (c vxiClient) createLink(t *testing.T, device string, lock bool) (code, lid uint32) {
+	t.Helper()
+	res := c.call(t, procCreateLink, func(w *xdrWriter) {
+		w.int32(1)
+		w.bool(lock)
+		w.uint32(100)
+		w.string(device)
+	})
+	code, lid = res.uint32(), res.uint32()
+	res.uint32()
+	if maxRecv := res.uint32(); code == vxiNoError && maxRecv != maxRecvSize {
+		t.Errorf("got maxRecvSize %d; want %d", maxRecv, maxRecvSize)
+	}
+	return code, lid
+}
+
+func (c vxiClient) write(t *testing.T, lid, flags uint32, data string) uint32 {
+	t.Helper()
+	res := c.call(t, procDeviceWrite, func(w *xdrWriter) {
+		w.uint32(lid)
+		w.uint32(1000)
+		w.uint32(50)
+		w.uint32(flags)
+		w.string(data)
+	})
+	code, size := res.uint32(), res.uint32()
+	if code == vxiNoError && size != uint32(len(data)) {
+		t.Errorf("got size %d written; want %d", size, len(data))
+	}
+	return code
+}
+
+func (c vxiClient) read(t *testing.T, lid, size, ioTimeout uint32) (code, reason uint32, data string) {
+	t.Helper()
+	res := c.call(t, procDeviceRead, func(w *xdrWriter) {
+		w.uint32(lid)
+		w.uint32(size)
+		w.uint32(ioTimeout)
+		w.uint32(0)
+		w.uint32(0)
+		w.uint32(0)
+	})
+	return res.uint32(), res.uint32(), res.string()
+}
+
+// generic calls a procedure taking Device_GenericParms.
+func (c vxiClient) generic(t *testing.T, proc, lid, flags uint32) *xdrReader {
+	t.Helper()
+	return c.call(t, proc, func(w *xdrWriter) {
+		w.uint32(lid)
+		w.uint32(flags)
+		w.uint32(50)
+		w.uint32(1000)
+	})
+}
+
+func (c vxiClient) lock(t *testing.T, lid, flags uint32) uint32 {
+	t.Helper()
+	return c.call(t, procDeviceLock, func(w *xdrWriter) {
+		w.uint32(lid)
+		w.uint32(flags)
+		w.uint32(50)
+	}).uint32()
+}
+
+func (c vxiClient) linkCall(t *testing.T, proc, lid uint32) uint32 {
+	t.Helper()
+	return c.call(t, proc, func(w *xdrWriter) { w.uint32(lid) }).uint32()
+}
+
+func TestVXI11(t *testing.T) {
+	adapter := sim.NewAdapter()
+	dmm := sim.NewScripted("SIM,DMM,1,1.0", nil)
+	if err := adapter.Attach(10, dmm); err != nil {
+		t.Fatal(err)
+	}
+	c := dialVXI11(t, startVXI11Server(t, adapter))
+
+	for device, want := range map[string]uint32{
+		"gpib1,10":   vxiNotAccessible,
+		"inst0":      vxiNotAccessible,
+		"gpib0,x":    vxiInvalidAddress,
+		"gpib0,31":   vxiInvalidAddress,
+		"gpib0,10,5": vxiInvalidAddress,
+	} {
+		if code, _ := c.createLink(t, device, false); code != want {
+			t.Errorf("got error %d creating link to %s; want %d", code, device, want)
+		}
+	}
+	code, lid := c.createLink(t, "GPIB0,10", false)
+	if code != vxiNoError {
+		t.Fatalf("got error %d creating link", code)
+	}
+
+	// Data written without END is held until the END flag is set.
+	if code := c.write(t, lid, 0, "*ID"); code != vxiNoError {
+		t.Fatalf("got error %d writing", code)
+	}
+	if got := len(dmm.Received()); got != 0 {
+		t.Errorf("got %d commands received before END; want 0", got)
+	}
+	if code := c.write(t, lid, flagEnd, "N?\n"); code != vxiNoError {
+		t.Fatalf("got error %d writing", code)
+	}
+	var resp string
+	for _, want := range []uint32{reasonRequestCount, reasonRequestCount, reasonEnd} {
+		code, reason, data := c.read(t, lid, 5, 1000)
+		if code != vxiNoError || reason != want {
+			t.Fatalf("got error %d and reason %d reading; want reason %d", code, reason, want)
+		}
+		resp += data
+	}
+	if resp != "SIM,DMM,1,1.0\n" {
+		t.Errorf("got response %q", resp)
+	}
+	if code, _, _ := c.read(t, lid, 100, 50); code != vxiIOTimeout {
+		t.Errorf("got error %d reading without response; want %d", code, vxiIOTimeout)
+	}
+
+	// Characters special to the Prologix adapter are escaped.
+	if code := c.write(t, lid, flagEnd, "++addr 5;SYST:BEEP\r\n"); code != vxiNoError {
+		t.Fatalf("got error %d writing", code)
+	}
+	received := dmm.Received()
+	if got := received[len(received)-1]; got != "++ADDR 5;SYST:BEEP" {
+		t.Errorf("got command %q; want ++ADDR 5;SYST:BEEP", got)
+	}
+
+	res := c.generic(t, procDeviceReadStb, lid, 0)
+	if code := res.uint32(); code != vxiNoError {
+		t.Errorf("got error %d reading status byte", code)
+	}
+	for _, proc := range []uint32{procDeviceTrigger, procDeviceClear, procDeviceRemote, procDeviceLocal} {
+		if code := c.generic(t, proc, lid, 0).uint32(); code != vxiNoError {
+			t.Errorf("got error %d calling procedure %d", code, proc)
+		}
+	}
+	if code := c.generic(t, procDeviceTrigger, lid+1, 0).uint32(); code != vxiInvalidLink {
+		t.Errorf("got error %d using invalid link; want %d", code, vxiInvalidLink)
+	}
+	if code := c.linkCall(t, procDestroyLink, lid); code != vxiNoError {
+		t.Errorf("got error %d destroying link", code)
+	}
+	if code := c.write(t, lid, flagEnd, "*RST"); code != vxiInvalidLink {
+		t.Errorf("got error %d writing to destroyed link; want %d", code, vxiInvalidLink)
+	}
+}
+
+func TestVXI11Locks(t *testing.T) {
+	adapter := sim.NewAdapter()
+	if err := adapter.Attach(10, sim.NewScripted("", nil)); err != nil {
+		t.Fatal(err)
+	}
+	addr := startVXI11Server(t, adapter)
+	a, b := dialVXI11(t, addr), dialVXI11(t, addr)
+	_, lidA := a.createLink(t, "gpib0,10", true)
+	_, lidB := b.createLink(t, "gpib0,10", false)
+	if code, _ := b.createLink(t, "gpib0,10", true); code != vxiLocked {
+		t.Errorf("got error %d creating locked link to locked device; want %d", code, vxiLocked)
+	}
+
+	if code := b.write(t, lidB, flagEnd, "*RST"); code != vxiLocked {
+		t.Errorf("got error %d writing to locked device; want %d", code, vxiLocked)
+	}
+	start := time.Now()
+	if code := b.lock(t, lidB, flagWaitLock); code != vxiLocked {
+		t.Errorf("got error %d waiting for lock; want %d", code, vxiLocked)
+	}
+	if d := time.Since(start); d < 40*time.Millisecond {
+		t.Errorf("gave up waiting for lock after %s; want 50ms", d)
+	}
+	if code := a.write(t, lidA, flagEnd, "*RST"); code != vxiNoError {
+		t.Errorf("got error %d writing with lock held", code)
+	}
+	if code := b.linkCall(t, procDeviceUnlock, lidB); code != vxiNoLockHeld {
+		t.Errorf("got error %d unlocking without lock; want %d", code, vxiNoLockHeld)
+	}
+
+	// The lock is released when its link's connection closes.
+	done := make(chan uint32)
+	go func() {
+		done <- b.call(t, procDeviceLock, func(w *xdrWriter) {
+			w.uint32(lidB)
+			w.uint32(flagWaitLock)
+			w.uint32(2000)
+		}).uint32()
+	}()
+	time.Sleep(20 * time.Millisecond)
+	a.conn.Close()
+	if code := <-done; code != vxiNoError {
+		t.Errorf("got error %d waiting for lock released by closed connection", code)
+	}
+	if code := b.write(t, lidB, flagEnd, "*RST"); code != vxiNoError {
+		t.Errorf("got error %d writing with lock held", code)
+	}
+}
+
+func TestPortmapper(t *testing.T) {
+	p := NewPortmapper()
+	p.Set(VXI11CoreProgram, VXI11CoreVersion, 4321)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go p.Serve(l)
+	go p.ServePacket(pc)
+	defer p.Close()
+
+	getPort := func(prog uint32) func(*xdrWriter) {
+		return func(w *xdrWriter) {
+			w.uint32(prog)
+			w.uint32(VXI11CoreVersion)
+			w.uint32(protoTCP)
+			w.uint32(0)
+		}
+	}
+	c := dialRPC(t, l.Addr().String(), portmapProgram, portmapVersion)
+	if port := c.call(t, pmapGetPort, getPort(VXI11CoreProgram)).uint32(); port != 4321 {
+		t.Errorf("got port %d; want 4321", port)
+	}
+	if port := c.call(t, pmapGetPort, getPort(VXI11CoreProgram+1)).uint32(); port != 0 {
+		t.Errorf("got port %d for unregistered program; want 0", port)
+	}
+
+	conn, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write(callMessage(9, portmapProgram, portmapVersion, pmapGetPort, getPort(VXI11CoreProgram))); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1024)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat, res, err := parseReply(9, buf[:n])
+	if err != nil || stat != acceptSuccess {
+		t.Fatalf("got status %d, %v", stat, err)
+	}
+	if port := res.uint32(); port != 4321 {
+		t.Errorf("got port %d over UDP; want 4321", port)
+	}
+}
+
+// The escaped data shouldn't contain an unescaped line terminator.
+func TestEscape(t *testing.T) {
+	got := string(escape([]byte("a+\r\n\x1bb")))
+	want := "a\x1b+\x1b\r\x1b\n\x1b\x1bb"
+	if got != want {
+		t.Errorf("got %q; want %q", got, want)
+	}
+	if strings.Contains(strings.ReplaceAll(got, "\x1b\n", ""), "\n") {
+		t.Error("unescaped newline")
+	}
+}
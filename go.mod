@@ -3,11 +3,9 @@ module github.com/gotmc/prologix
 go 1.21
 
 require (
-	github.com/gotmc/query v0.5.0
 	go.bug.st/serial v1.6.2
+	golang.org/x/sys v0.29.0
+	golang.org/x/term v0.28.0
 )
 
-require (
-	github.com/creack/goselect v0.1.2 // indirect
-	golang.org/x/sys v0.0.0-20220829200755-d48e67d00261 // indirect
-)
+require github.com/creack/goselect v0.1.2 // indirect
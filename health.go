@@ -0,0 +1,287 @@
+// Copyright (c) 2020–2024 The prologix developers. All rights reserved.
+// Project site: https://github.com/gotmc/prologix
+// Use of this source code is governed by a MIT-style license that
+// can be found in the LICENSE.txt file for the project.
+
+package prologix
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// HealthState is the liveness of the Prologix adapter as determined by a
+// HealthMonitor.
+type HealthState int
+
+// Health states.
+const (
+	// HealthUnknown is the state before the first check.
+	HealthUnknown HealthState = iota
+	// Healthy means the adapter answered the last check in time.
+	Healthy
+	// Degraded means the adapter answered the last check slowly or failed
+	// fewer consecutive checks than needed to be unreachable.
+	Degraded
+	// Unreachable means the adapter failed the configured number of
+	// consecutive checks.
+	Unreachable
+)
+
+var healthStateDesc = map[HealthState]string{
+	HealthUnknown: "unknown",
+	Healthy:       "healthy",
+	Degraded:      "degraded",
+	Unreachable:   "unreachable",
+}
+
+func (s HealthState) String() string {
+	return healthStateDesc[s]
+}
+
+// MarshalText implements the encoding.TextMarshaler interface.
+func (s HealthState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// Health is a snapshot of the liveness of the Prologix adapter.
+type Health struct {
+	State HealthState `json:"state"`
+	// Version is the version string returned by the last successful probe.
+	Version     string    `json:"version,omitempty"`
+	LastCheck   time.Time `json:"last_check"`
+	LastSuccess time.Time `json:"last_success"`
+	// Latency is the round trip time of the last successful probe.
+	Latency             time.Duration `json:"latency_ns"`
+	ConsecutiveFailures int           `json:"consecutive_failures"`
+	Checks              uint64        `json:"checks"`
+	Failures            uint64        `json:"failures"`
+	LastError           string        `json:"last_error,omitempty"`
+}
+
+// HealthMonitor periodically checks that the Prologix adapter of a Controller
+// is answering.
+type HealthMonitor struct {
+	c                *Controller
+	interval         time.Duration
+	timeout          time.Duration
+	quiet            time.Duration
+	slow             time.Duration
+	unreachableAfter int
+	onChange         func(from, to HealthState, h Health)
+
+	mu        sync.Mutex
+	health    Health
+	lastProbe int64
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// HealthOption applies an option to the health monitor.
+type HealthOption func(*HealthMonitor)
+
+// WithHealthInterval sets the interval between checks, which defaults to 10 s.
+func WithHealthInterval(d time.Duration) HealthOption {
+	return func(m *HealthMonitor) {
+		m.interval = d
+	}
+}
+
+// WithHealthTimeout sets the time allowed for the adapter to answer a probe,
+// which defaults to 1 s.
+func WithHealthTimeout(d time.Duration) HealthOption {
+	return func(m *HealthMonitor) {
+		m.timeout = d
+	}
+}
+
+// WithDegradedLatency sets the probe latency above which the adapter is
+// considered degraded, which defaults to 250 ms.
+func WithDegradedLatency(d time.Duration) HealthOption {
+	return func(m *HealthMonitor) {
+		m.slow = d
+	}
+}
+
+// WithUnreachableAfter sets the number of consecutive failed checks after
+// which the adapter is considered unreachable, which defaults to 3.
+func WithUnreachableAfter(n int) HealthOption {
+	return func(m *HealthMonitor) {
+		m.unreachableAfter = n
+	}
+}
+
+// WithHealthChange sets the function called when the health state changes.
+// The function is called from the monitor's goroutine, or from Check, with
+// the new health snapshot.
+func WithHealthChange(fn func(from, to HealthState, h Health)) HealthOption {
+	return func(m *HealthMonitor) {
+		m.onChange = fn
+	}
+}
+
+// MonitorHealth starts monitoring the health of the Prologix adapter. At each
+// interval, the monitor waits for the operations of Instruments, Scan and the
+// controller's Query and QueryBlock to finish and for the connection to be
+// quiet, and then sends the `++ver` command, measuring how long the adapter
+// takes to answer. Data received since the previous check shows the adapter
+// is answering, so no probe is sent while the controller is busy. Call Stop
+// to stop the monitor.
+//
+// A Write followed by a Read on the controller isn't a single operation, so
+// the monitor only waits for the connection to be quiet for 50 ms after the
+// write. Use Query or an Instrument for instruments slower to answer, or the
+// probe may be sent before their response is read.
+//
+// A probe that isn't answered is only abandoned in time if the connection
+// supports read deadlines, which the vcp and ethernet drivers and the
+// Reconnector do.
+func (c *Controller) MonitorHealth(opts ...HealthOption) *HealthMonitor {
+	m := HealthMonitor{
+		c:                c,
+		interval:         10 * time.Second,
+		timeout:          time.Second,
+		quiet:            50 * time.Millisecond,
+		slow:             250 * time.Millisecond,
+		unreachableAfter: 3,
+		done:             make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(&m)
+	}
+	m.unreachableAfter = max(m.unreachableAfter, 1)
+	m.ctx, m.cancel = context.WithCancel(context.Background())
+	go m.run()
+	return &m
+}
+
+// Health returns a snapshot of the adapter's health.
+func (m *HealthMonitor) Health() Health {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.health
+}
+
+// Check probes the adapter immediately and returns the resulting health.
+func (m *HealthMonitor) Check() Health {
+	m.check(false)
+	return m.Health()
+}
+
+// Stop stops the monitor and waits for a check in progress to finish.
+func (m *HealthMonitor) Stop() {
+	m.cancel()
+	<-m.done
+}
+
+func (m *HealthMonitor) run() {
+	defer close(m.done)
+	t := time.NewTicker(m.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-m.ctx.Done():
+			return
+		case <-t.C:
+			m.check(true)
+		}
+	}
+}
+
+// check probes the adapter between transactions. When passive, traffic
+// received since the last check counts as a successful check.
+func (m *HealthMonitor) check(passive bool) {
+	c := m.c
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if passive && m.lastProbe != 0 && c.rw.lastRead.Load() > m.lastProbe {
+		h := m.Health()
+		m.record(h.Version, h.Latency, nil)
+		m.lastProbe = time.Now().UnixNano()
+		return
+	}
+	// Let a transaction in progress by a caller not using an Instrument, such
+	// as a write followed by a read, finish before probing, without holding
+	// the lock while waiting.
+	for {
+		idle := time.Since(time.Unix(0, c.rw.lastWrite.Load()))
+		if idle >= m.quiet {
+			break
+		}
+		c.mu.Unlock()
+		err := sleep(m.ctx, m.quiet-idle)
+		c.mu.Lock()
+		if err != nil {
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(m.ctx, m.timeout)
+	defer cancel()
+	stop := c.interruptOn(ctx)
+	start := time.Now()
+	p, err := newProber(ctx, c)
+	latency := time.Since(start)
+	stop()
+	if err != nil && (ctx.Err() != nil || isTimeout(err)) {
+		m.resync()
+	}
+	m.lastProbe = time.Now().UnixNano()
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	if err != nil {
+		m.record("", 0, err)
+		return
+	}
+	m.record(p.ver, latency, nil)
+}
+
+// resync discards the reply to a probe that wasn't answered in time, so that
+// it isn't read as the response to the next query. A slow adapter is given
+// the timeout once more to answer. The lock must be held.
+func (m *HealthMonitor) resync() {
+	ctx, cancel := context.WithTimeout(context.Background(), m.timeout)
+	defer cancel()
+	defer m.c.interruptOn(ctx)()
+	_, _ = bufio.NewReader(m.c.rw).ReadString('\n')
+}
+
+// record updates the health with the result of a check and reports a change
+// of state.
+func (m *HealthMonitor) record(ver string, latency time.Duration, err error) {
+	m.mu.Lock()
+	h := &m.health
+	from := h.State
+	h.Checks++
+	h.LastCheck = time.Now()
+	if err != nil {
+		h.Failures++
+		h.ConsecutiveFailures++
+		h.LastError = err.Error()
+		h.State = Degraded
+		if h.ConsecutiveFailures >= m.unreachableAfter {
+			h.State = Unreachable
+		}
+	} else {
+		h.ConsecutiveFailures = 0
+		h.LastSuccess = h.LastCheck
+		h.LastError = ""
+		h.Version = ver
+		h.Latency = latency
+		h.State = Healthy
+		if latency > m.slow {
+			h.State = Degraded
+		}
+	}
+	snapshot := *h
+	m.mu.Unlock()
+	if snapshot.State != from && m.onChange != nil {
+		m.onChange(from, snapshot.State, snapshot)
+	}
+}
@@ -0,0 +1,226 @@
+// Copyright (c) 2020–2024 The prologix developers. All rights reserved.
+// Project site: https://github.com/gotmc/prologix
+// Use of this source code is governed by a MIT-style license that
+// can be found in the LICENSE.txt file for the project.
+
+package prologix
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gotmc/prologix/sim"
+)
+
+// mutableConn is a connection to a simulated adapter that stops answering
+// while muted.
+type mutableConn struct {
+	*sim.Conn
+	muted atomic.Bool
+}
+
+func (c *mutableConn) Write(p []byte) (int, error) {
+	if c.muted.Load() {
+		return len(p), nil
+	}
+	return c.Conn.Write(p)
+}
+
+// slowConn is a connection to a simulated adapter that delays the lines
+// written while slow, keeping them in order, as a slow adapter would.
+type slowConn struct {
+	*sim.Conn
+	delay  atomic.Int64
+	writes chan slowWrite
+}
+
+type slowWrite struct {
+	p     []byte
+	delay time.Duration
+	done  chan struct{}
+}
+
+func newSlowConn(t *testing.T, conn *sim.Conn) *slowConn {
+	c := &slowConn{Conn: conn, writes: make(chan slowWrite, 16)}
+	go func() {
+		for w := range c.writes {
+			time.Sleep(w.delay)
+			c.Conn.Write(w.p)
+			close(w.done)
+		}
+	}()
+	t.Cleanup(func() { close(c.writes) })
+	return c
+}
+
+func (c *slowConn) Write(p []byte) (int, error) {
+	w := slowWrite{bytes.Clone(p), time.Duration(c.delay.Load()), make(chan struct{})}
+	c.writes <- w
+	if w.delay == 0 {
+		<-w.done
+	}
+	return len(p), nil
+}
+
+func TestHealthStates(t *testing.T) {
+	adapter := sim.NewAdapter()
+	conn := &mutableConn{Conn: adapter.Dial()}
+	gpib, err := NewController(conn, 5, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var changes []string
+	m := gpib.MonitorHealth(
+		WithHealthInterval(time.Hour),
+		WithHealthTimeout(20*time.Millisecond),
+		WithUnreachableAfter(2),
+		WithHealthChange(func(from, to HealthState, h Health) {
+			changes = append(changes, fmt.Sprintf("%s->%s", from, to))
+		}),
+	)
+	defer m.Stop()
+
+	h := m.Check()
+	if h.State != Healthy || h.Version != sim.VersionUSB || h.Latency <= 0 {
+		t.Errorf("got health %+v; want healthy with version and latency", h)
+	}
+	conn.muted.Store(true)
+	if h := m.Check(); h.State != Degraded || h.ConsecutiveFailures != 1 || h.LastError == "" {
+		t.Errorf("got health %+v after one failed check; want degraded", h)
+	}
+	if h := m.Check(); h.State != Unreachable || h.Failures != 2 {
+		t.Errorf("got health %+v after two failed checks; want unreachable", h)
+	}
+	conn.muted.Store(false)
+	if h := m.Check(); h.State != Healthy || h.ConsecutiveFailures != 0 || h.Checks != 4 {
+		t.Errorf("got health %+v after recovery; want healthy", h)
+	}
+	want := "[unknown->healthy healthy->degraded degraded->unreachable unreachable->healthy]"
+	if got := fmt.Sprint(changes); got != want {
+		t.Errorf("got state changes %s; want %s", got, want)
+	}
+}
+
+func TestHealthDegradedLatency(t *testing.T) {
+	adapter := sim.NewAdapter()
+	gpib, err := NewController(adapter.Dial(), 5, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := gpib.MonitorHealth(WithHealthInterval(time.Hour), WithDegradedLatency(time.Nanosecond))
+	defer m.Stop()
+	if h := m.Check(); h.State != Degraded || h.LastError != "" {
+		t.Errorf("got health %+v; want degraded by latency", h)
+	}
+}
+
+func TestHealthMonitorDoesNotDisturbQueries(t *testing.T) {
+	adapter := sim.NewAdapter()
+	if err := adapter.Attach(5, sim.NewE3631A(1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := adapter.Attach(6, sim.NewKey33220A(1)); err != nil {
+		t.Fatal(err)
+	}
+	gpib, err := NewController(adapter.Dial(), 5, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := gpib.MonitorHealth(WithHealthInterval(time.Millisecond))
+
+	var wg sync.WaitGroup
+	for addr, model := range map[int]string{5: "E3631A", 6: "33220A"} {
+		inst, err := gpib.Instrument(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go func(model string) {
+			defer wg.Done()
+			for n := 0; n < 20; n++ {
+				id, err := inst.Identify()
+				if err != nil || id.Model != model {
+					t.Errorf("got model %s (%v); want %s", id.Model, err, model)
+					return
+				}
+				time.Sleep(2 * time.Millisecond)
+			}
+		}(model)
+	}
+	wg.Wait()
+	time.Sleep(100 * time.Millisecond)
+	m.Stop()
+	if h := m.Health(); h.Checks == 0 || h.Failures != 0 || h.State != Healthy {
+		t.Errorf("got health %+v; want healthy after periodic checks", h)
+	}
+}
+
+func TestHealthMonitorDoesNotDisturbControllerQuery(t *testing.T) {
+	adapter := sim.NewAdapter()
+	if err := adapter.Attach(5, sim.NewE3631A(1)); err != nil {
+		t.Fatal(err)
+	}
+	conn := newSlowConn(t, adapter.Dial())
+	gpib, err := NewController(conn, 5, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := gpib.MonitorHealth(WithHealthInterval(20 * time.Millisecond))
+	defer m.Stop()
+
+	// The instrument takes longer to answer than the quiet period the
+	// monitor waits for after a write.
+	conn.delay.Store(int64(100 * time.Millisecond))
+	for n := 0; n < 2; n++ {
+		errc := make(chan error, 1)
+		go func() {
+			s, err := gpib.Query("*IDN?")
+			if err == nil && !strings.Contains(s, "E3631A") {
+				err = fmt.Errorf("got response %q; want the E3631A identification", s)
+			}
+			errc <- err
+		}()
+		select {
+		case err := <-errc:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("query not answered; the probe read its response")
+		}
+	}
+}
+
+func TestHealthCheckLateReply(t *testing.T) {
+	adapter := sim.NewAdapter()
+	if err := adapter.Attach(5, sim.NewE3631A(1)); err != nil {
+		t.Fatal(err)
+	}
+	conn := newSlowConn(t, adapter.Dial())
+	gpib, err := NewController(conn, 5, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := gpib.MonitorHealth(WithHealthInterval(time.Hour), WithHealthTimeout(50*time.Millisecond))
+	defer m.Stop()
+
+	// The version arriving after the probe timed out isn't read as the
+	// response to the next query.
+	conn.delay.Store(int64(75 * time.Millisecond))
+	if h := m.Check(); h.State != Degraded {
+		t.Errorf("got health %+v for slow reply; want degraded", h)
+	}
+	conn.delay.Store(0)
+	inst, err := gpib.Instrument(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, err := inst.Identify(); err != nil || id.Model != "E3631A" {
+		t.Errorf("got model %q (%v) after slow probe; want E3631A", id.Model, err)
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright (c) 2020–2024 The prologix developers. All rights reserved.
+// Project site: https://github.com/gotmc/prologix
+// Use of this source code is governed by a MIT-style license that
+// can be found in the LICENSE.txt file for the project.
+
+package prologix
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrIdentityMismatch is returned, wrapped with the details, when an
+// instrument doesn't have the identity pinned using WithPinnedIdentity.
+var ErrIdentityMismatch = errors.New("instrument identity mismatch")
+
+// Identity is the identification of an instrument as reported in response to
+// the IEEE 488.2 `*IDN?` query.
+type Identity struct {
+	Manufacturer string `json:"manufacturer,omitempty"`
+	Model        string `json:"model,omitempty"`
+	SerialNumber string `json:"serial_number,omitempty"`
+	Firmware     string `json:"firmware,omitempty"`
+}
+
+// manufacturerPrefixes maps the prefixes used in the model numbers returned
+// by older instruments, such as `HP3457A`, to the manufacturer names used in
+// their IEEE 488.2 identification.
+var manufacturerPrefixes = []struct {
+	prefix       string
+	manufacturer string
+}{
+	{"HP", "HEWLETT-PACKARD"},
+	{"AGILENT", "Agilent Technologies"},
+	{"KEITHLEY", "KEITHLEY INSTRUMENTS INC."},
+	{"TEK", "TEKTRONIX"},
+}
+
+// ParseIdentity parses the response to an identification query. The IEEE
+// 488.2 response to `*IDN?` consists of the four comma separated fields
+// manufacturer, model, serial number, and firmware version. Responses from
+// older instruments are parsed as follows:
+//
+//   - A leading `ID` header, as in `ID TEK/2465B,V1.0`, is removed.
+//   - A first field in the form manufacturer/model, as used by Tektronix, is
+//     split and the remaining fields are taken as the firmware.
+//   - Two fields are taken as the manufacturer and model, and three fields as
+//     the manufacturer, model, and firmware.
+//   - A single model number, such as `HP3457A`, is split into the
+//     manufacturer and model if it starts with a known manufacturer prefix.
+//     Otherwise, it is taken as the model.
+func ParseIdentity(s string) Identity {
+	s = strings.TrimSpace(s)
+	if h, rest, ok := strings.Cut(s, " "); ok && strings.EqualFold(h, "ID") {
+		s = strings.TrimSpace(rest)
+	}
+	if s == "" {
+		return Identity{}
+	}
+	fields := strings.Split(s, ",")
+	for i, f := range fields {
+		fields[i] = strings.TrimSpace(f)
+	}
+
+	if mfr, model, ok := strings.Cut(fields[0], "/"); ok && !strings.Contains(mfr, " ") {
+		return Identity{
+			Manufacturer: mfr,
+			Model:        model,
+			Firmware:     strings.Join(fields[1:], ","),
+		}
+	}
+	switch len(fields) {
+	case 1:
+		return parseModelNumber(fields[0])
+	case 2:
+		return Identity{Manufacturer: fields[0], Model: fields[1]}
+	case 3:
+		return Identity{Manufacturer: fields[0], Model: fields[1], Firmware: fields[2]}
+	}
+	return Identity{
+		Manufacturer: fields[0],
+		Model:        fields[1],
+		SerialNumber: fields[2],
+		Firmware:     strings.Join(fields[3:], ","),
+	}
+}
+
+// parseModelNumber splits a model number, such as `HP3457A`, into the
+// manufacturer and model.
+func parseModelNumber(s string) Identity {
+	upper := strings.ToUpper(s)
+	for _, p := range manufacturerPrefixes {
+		rest := strings.TrimSpace(s[min(len(p.prefix), len(s)):])
+		if strings.HasPrefix(upper, p.prefix) && rest != "" {
+			return Identity{Manufacturer: p.manufacturer, Model: rest}
+		}
+	}
+	return Identity{Model: s}
+}
+
+func (id Identity) String() string {
+	return strings.Join([]string{id.Manufacturer, id.Model, id.SerialNumber, id.Firmware}, ",")
+}
+
+// matches reports whether the identity has the given model and, if not
+// empty, serial number, ignoring case.
+func (id Identity) matches(model, serialNumber string) bool {
+	if !strings.EqualFold(id.Model, strings.TrimSpace(model)) {
+		return false
+	}
+	return serialNumber == "" || strings.EqualFold(id.SerialNumber, strings.TrimSpace(serialNumber))
+}
+
+// Identify identifies the instrument at the currently assigned GPIB address
+// using the `*IDN?` query, falling back to the `ID?` and `ID` queries used by
+// older instruments. An error is returned if the instrument doesn't answer
+// any of the queries.
+func (c *Controller) Identify() (Identity, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.identify()
+}
+
+// identify identifies the instrument at the currently assigned GPIB address.
+// The lock must be held.
+func (c *Controller) identify() (Identity, error) {
+	raw, err := c.identification(nil)
+	if err != nil {
+		return Identity{}, err
+	}
+	return ParseIdentity(raw), nil
+}
+
+// identification returns the response of the instrument at the currently
+// assigned GPIB address to the first identification query it answers, sending
+// each query using intercept unless it's nil. The lock must be held.
+func (c *Controller) identification(intercept func(*Operation, Invoker) error) (string, error) {
+	p, err := newProber(context.Background(), c)
+	if err != nil {
+		return "", err
+	}
+	_, raw, err := p.identify(c.addrString(), intercept)
+	if err != nil {
+		return "", err
+	}
+	if raw == "" {
+		return "", fmt.Errorf(
+			"instrument at GPIB address %s did not answer the identification queries",
+			c.addrString(),
+		)
+	}
+	return raw, nil
+}
@@ -0,0 +1,35 @@
+// Copyright (c) 2020–2024 The prologix developers. All rights reserved.
+// Project site: https://github.com/gotmc/prologix
+// Use of this source code is governed by a MIT-style license that
+// can be found in the LICENSE.txt file for the project.
+
+package prologix
+
+import "testing"
+
+func TestParseIdentity(t *testing.T) {
+	tests := []struct {
+		given string
+		want  Identity
+	}{
+		{
+			"Agilent Technologies,33220A,MY44000000,2.02-2.02-22-2\n",
+			Identity{"Agilent Technologies", "33220A", "MY44000000", "2.02-2.02-22-2"},
+		},
+		{"FLUKE, 45, 4620108, 1.6 D1.0\r\n", Identity{"FLUKE", "45", "4620108", "1.6 D1.0"}},
+		{"HP3457A", Identity{Manufacturer: "HEWLETT-PACKARD", Model: "3457A"}},
+		{"KEITHLEY 196", Identity{Manufacturer: "KEITHLEY INSTRUMENTS INC.", Model: "196"}},
+		{"196", Identity{Model: "196"}},
+		{"ID TEK/2465B,V81.1,FV:1.0", Identity{Manufacturer: "TEK", Model: "2465B", Firmware: "V81.1,FV:1.0"}},
+		{"LeCroy,9350AM", Identity{Manufacturer: "LeCroy", Model: "9350AM"}},
+		{"ACME,X1,2.0", Identity{Manufacturer: "ACME", Model: "X1", Firmware: "2.0"}},
+		{"", Identity{}},
+	}
+	for _, test := range tests {
+		t.Run(test.given, func(t *testing.T) {
+			if got := ParseIdentity(test.given); got != test.want {
+				t.Errorf("got %+v; want %+v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,443 @@
+// Copyright (c) 2020–2024 The prologix developers. All rights reserved.
+// Project site: https://github.com/gotmc/prologix
+// Use of this source code is governed by a MIT-style license that
+// can be found in the LICENSE.txt file for the project.
+
+package prologix
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StatusByte is the IEEE 488.2 status byte returned by a serial poll or the
+// `*STB?` query. The meaning of the bits other than MAV, ESB, and RQS is
+// defined by SCPI or the instrument.
+type StatusByte byte
+
+// Bits of the status byte. The Error/Event Queue, Questionable, and Operation
+// summary bits are defined by SCPI.
+const (
+	StatusErrorAvailable   StatusByte = 1 << 2 // EAV: error/event queue not empty
+	StatusQuestionable     StatusByte = 1 << 3 // QUES: questionable data summary
+	StatusMessageAvailable StatusByte = 1 << 4 // MAV: output queue not empty
+	StatusEventSummary     StatusByte = 1 << 5 // ESB: standard event summary
+	StatusRequestService   StatusByte = 1 << 6 // RQS/MSS: requesting service
+	StatusOperation        StatusByte = 1 << 7 // OPER: operation status summary
+)
+
+var statusByteDesc = []struct {
+	bit  StatusByte
+	desc string
+}{
+	{StatusErrorAvailable, "EAV"},
+	{StatusQuestionable, "QUES"},
+	{StatusMessageAvailable, "MAV"},
+	{StatusEventSummary, "ESB"},
+	{StatusRequestService, "RQS"},
+	{StatusOperation, "OPER"},
+}
+
+// Has reports whether all the given bits are set.
+func (stb StatusByte) Has(bits StatusByte) bool {
+	return stb&bits == bits
+}
+
+func (stb StatusByte) String() string {
+	var names []string
+	for _, d := range statusByteDesc {
+		if stb.Has(d.bit) {
+			names = append(names, d.desc)
+		}
+	}
+	for bit := 0; bit < 2; bit++ {
+		if stb&(1<<bit) != 0 {
+			names = append(names, fmt.Sprintf("bit%d", bit))
+		}
+	}
+	return fmt.Sprintf("%d (%s)", byte(stb), strings.Join(names, "|"))
+}
+
+// StandardEvent is the IEEE 488.2 Standard Event Status Register returned by
+// the `*ESR?` query and the mask set by the `*ESE` command.
+type StandardEvent byte
+
+// Bits of the Standard Event Status Register.
+const (
+	EventOperationComplete    StandardEvent = 1 << 0 // OPC
+	EventRequestControl       StandardEvent = 1 << 1 // RQC
+	EventQueryError           StandardEvent = 1 << 2 // QYE
+	EventDeviceDependentError StandardEvent = 1 << 3 // DDE
+	EventExecutionError       StandardEvent = 1 << 4 // EXE
+	EventCommandError         StandardEvent = 1 << 5 // CME
+	EventUserRequest          StandardEvent = 1 << 6 // URQ
+	EventPowerOn              StandardEvent = 1 << 7 // PON
+)
+
+var standardEventDesc = []string{"OPC", "RQC", "QYE", "DDE", "EXE", "CME", "URQ", "PON"}
+
+// Has reports whether all the given bits are set.
+func (esr StandardEvent) Has(bits StandardEvent) bool {
+	return esr&bits == bits
+}
+
+// Errors returns the error bits that are set: QYE, DDE, EXE, and CME.
+func (esr StandardEvent) Errors() StandardEvent {
+	return esr & (EventQueryError | EventDeviceDependentError | EventExecutionError | EventCommandError)
+}
+
+func (esr StandardEvent) String() string {
+	var names []string
+	for bit, desc := range standardEventDesc {
+		if esr&(1<<bit) != 0 {
+			names = append(names, desc)
+		}
+	}
+	return fmt.Sprintf("%d (%s)", byte(esr), strings.Join(names, "|"))
+}
+
+// Reset sends the `*RST` command to reset the instrument to its default
+// state.
+func (i *Instrument) Reset() error {
+	return i.Command("*RST")
+}
+
+// ClearStatus sends the `*CLS` command to clear the status registers and
+// error queue of the instrument.
+func (i *Instrument) ClearStatus() error {
+	return i.Command("*CLS")
+}
+
+// SetEventStatusEnable sends the `*ESE` command to set which standard events
+// set the Event Summary Bit (ESB) of the status byte.
+func (i *Instrument) SetEventStatusEnable(mask StandardEvent) error {
+	return i.Command("*ESE %d", mask)
+}
+
+// EventStatusEnable returns the standard event status enable mask using the
+// `*ESE?` query.
+func (i *Instrument) EventStatusEnable() (StandardEvent, error) {
+	v, err := i.queryRegister("*ESE?")
+	return StandardEvent(v), err
+}
+
+// EventStatus returns and clears the Standard Event Status Register using the
+// `*ESR?` query.
+func (i *Instrument) EventStatus() (StandardEvent, error) {
+	v, err := i.queryRegister("*ESR?")
+	return StandardEvent(v), err
+}
+
+// SetServiceRequestEnable sends the `*SRE` command to set which bits of the
+// status byte assert SRQ.
+func (i *Instrument) SetServiceRequestEnable(mask StatusByte) error {
+	return i.Command("*SRE %d", mask)
+}
+
+// ServiceRequestEnable returns the service request enable mask using the
+// `*SRE?` query.
+func (i *Instrument) ServiceRequestEnable() (StatusByte, error) {
+	v, err := i.queryRegister("*SRE?")
+	return StatusByte(v), err
+}
+
+// StatusByte returns the status byte using the `*STB?` query. Unlike a serial
+// poll, the query doesn't clear the RQS bit, which is reported as the Master
+// Summary Status (MSS).
+func (i *Instrument) StatusByte() (StatusByte, error) {
+	v, err := i.queryRegister("*STB?")
+	return StatusByte(v), err
+}
+
+// SelfTest runs the instrument's self-test using the `*TST?` query and
+// returns the result, which is zero if the self-test passed.
+func (i *Instrument) SelfTest() (int, error) {
+	s, err := i.Query("*TST?")
+	if err != nil {
+		return 0, err
+	}
+	v, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("self-test result not determinable; received %s", s)
+	}
+	return v, nil
+}
+
+// OperationComplete sends the `*OPC` command, which sets the Operation
+// Complete (OPC) bit of the Standard Event Status Register once all pending
+// operations have finished.
+func (i *Instrument) OperationComplete() error {
+	return i.Command("*OPC")
+}
+
+// QueryOperationComplete sends the `*OPC?` query, which the instrument
+// answers once all pending operations have finished. Since the Prologix
+// controller gives up reading after its read timeout, use
+// WaitOperationComplete for operations that may take longer.
+func (i *Instrument) QueryOperationComplete() error {
+	s, err := i.Query("*OPC?")
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(s) != "1" {
+		return fmt.Errorf("operation complete not determinable; received %s", s)
+	}
+	return nil
+}
+
+// Wait sends the `*WAI` command, which makes the instrument finish all pending
+// operations before executing further commands.
+func (i *Instrument) Wait() error {
+	return i.Command("*WAI")
+}
+
+// queryRegister queries the value of a status register.
+func (i *Instrument) queryRegister(query string) (byte, error) {
+	s, err := i.Query(query)
+	if err != nil {
+		return 0, err
+	}
+	v, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || v < 0 || v > 255 {
+		return 0, fmt.Errorf("%s register not determinable; received %s", query, s)
+	}
+	return byte(v), nil
+}
+
+// WaitOption applies an option to WaitOperationComplete.
+type WaitOption func(*waitConfig)
+
+type waitConfig struct {
+	srq      bool
+	interval time.Duration
+}
+
+// WithServiceRequest waits for the instrument to assert SRQ when its
+// operations are complete, instead of polling with the `*OPC?` query. The
+// instrument's `*ESE` and `*SRE` masks are changed while waiting and restored
+// afterwards, and its Standard Event Status Register is cleared.
+func WithServiceRequest() WaitOption {
+	return func(cfg *waitConfig) {
+		cfg.srq = true
+	}
+}
+
+// WithPollInterval sets the interval between attempts to read the response to
+// `*OPC?`, or between checks of the SRQ line, which defaults to 20 ms.
+func WithPollInterval(d time.Duration) WaitOption {
+	return func(cfg *waitConfig) {
+		cfg.interval = d
+	}
+}
+
+// WaitOperationComplete waits until the instrument has finished all pending
+// operations or the context is done.
+//
+// By default, the `*OPC?` query is sent and the response is read repeatedly
+// until the instrument answers, each read lasting up to the Prologix read
+// timeout. Alternatively, WithServiceRequest sends the `*OPC` command and
+// waits for the instrument to request service, checking the SRQ line at each
+// poll interval, so no query is left pending in the instrument.
+//
+// The controller is held for the duration of the wait, so other instruments
+// sharing the controller can't be used. When the connection supports read
+// deadlines, canceling the context interrupts a read in progress.
+func (i *Instrument) WaitOperationComplete(ctx context.Context, opts ...WaitOption) error {
+	cfg := waitConfig{interval: 20 * time.Millisecond}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	i.c.mu.Lock()
+	defer i.c.mu.Unlock()
+	if err := i.c.selectAddress(i.primaryAddr, i.hasSecondaryAddr, i.secondaryAddr); err != nil {
+		return err
+	}
+	if err := i.verify(); err != nil {
+		return err
+	}
+	stop := i.c.interruptOn(ctx)
+	defer func() { stop() }()
+	p, err := newProber(ctx, i.c)
+	if err != nil {
+		return err
+	}
+	if cfg.srq {
+		return i.waitServiceRequest(p, cfg.interval, &stop)
+	}
+	return i.pollOperationComplete(p, cfg.interval)
+}
+
+// pollOperationComplete sends `*OPC?` and reads until the instrument answers.
+// If the wait is abandoned, the instrument is cleared so that its late answer
+// isn't read as the response to a later query.
+func (i *Instrument) pollOperationComplete(p *prober, interval time.Duration) (err error) {
+	if err := p.write("*OPC?"); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = p.write("++clr")
+		}
+	}()
+	for {
+		lines, err := p.exchange("++read eoi")
+		if err != nil {
+			return err
+		}
+		if len(lines) > 0 {
+			if lines[0] != "1" {
+				return fmt.Errorf("operation complete not determinable; received %s", lines[0])
+			}
+			return nil
+		}
+		if err := sleep(p.ctx, interval); err != nil {
+			return err
+		}
+	}
+}
+
+// waitServiceRequest enables SRQ on operation complete, sends `*OPC`, and
+// waits until the instrument requests service. The masks are restored even
+// when the context is done, replacing the interruption of the context, whose
+// stop function is given, by one bounded by restoreTimeout.
+func (i *Instrument) waitServiceRequest(p *prober, interval time.Duration, stop *func()) (err error) {
+	ese, err := p.queryRegister("*ESE?")
+	if err != nil {
+		return err
+	}
+	sre, err := p.queryRegister("*SRE?")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		(*stop)()
+		ctx, cancel := context.WithTimeout(context.Background(), restoreTimeout)
+		defer cancel()
+		*stop = i.c.interruptOn(ctx)
+		p.ctx = ctx
+		// Read the replies to an interrupted exchange, then clear the event
+		// status before restoring the masks, so the completed operation
+		// doesn't assert SRQ again.
+		rerr := p.resync()
+		if rerr == nil {
+			_, rerr = p.queryRegister("*ESR?")
+		}
+		if rerr == nil {
+			_, rerr = p.exchange(fmt.Sprintf("*ESE %d;*SRE %d", ese, sre))
+		}
+		if rerr != nil {
+			err = errors.Join(err, fmt.Errorf("error restoring *ESE and *SRE: %w", rerr))
+		}
+	}()
+	setup := fmt.Sprintf("*ESR?;*ESE %d;*SRE %d;*OPC", EventOperationComplete, StatusEventSummary|StatusByte(sre))
+	if _, err := p.exchange(setup, "++read eoi"); err != nil {
+		return err
+	}
+	for {
+		lines, err := p.exchange("++srq")
+		if err != nil {
+			return err
+		}
+		if len(lines) > 0 && lines[0] == "1" {
+			lines, err := p.exchange("++spoll")
+			if err != nil {
+				return err
+			}
+			if len(lines) > 0 {
+				stb, err := strconv.ParseUint(lines[0], 10, 8)
+				if err != nil {
+					return fmt.Errorf("status byte not determinable; received %s", lines[0])
+				}
+				if StatusByte(stb).Has(StatusRequestService | StatusEventSummary) {
+					return nil
+				}
+			}
+		}
+		if err := sleep(p.ctx, interval); err != nil {
+			return err
+		}
+	}
+}
+
+// restoreTimeout bounds restoring the masks of an instrument after waiting
+// for its service request, which is done even once the context is done.
+const restoreTimeout = 5 * time.Second
+
+// queryRegister queries the value of a status register of the instrument at
+// the current address.
+func (p *prober) queryRegister(query string) (byte, error) {
+	lines, err := p.exchange(query, "++read eoi")
+	if err != nil {
+		return 0, err
+	}
+	if len(lines) == 0 {
+		return 0, fmt.Errorf("no response to %s", query)
+	}
+	v, err := strconv.ParseFloat(lines[0], 64)
+	if err != nil || v < 0 || v > 255 {
+		return 0, fmt.Errorf("%s register not determinable; received %s", query, lines[0])
+	}
+	return byte(v), nil
+}
+
+// sleep waits for the duration or until the context is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// interruptOn sets a read deadline in the past when the context is done, so
+// that a read in progress returns, provided the connection supports read
+// deadlines. The deadline of the context, if any, is set up front, which is
+// all that's done for connections, such as the vcp driver's, that can't
+// interrupt a read in progress. The returned function stops watching the
+// context, waiting for a deadline being set as the context is done, and
+// clears the deadline.
+func (c *Controller) interruptOn(ctx context.Context) func() {
+	d, ok := c.rw.ReadWriter.(readDeadliner)
+	if !ok {
+		return func() {}
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = d.SetReadDeadline(deadline)
+	}
+	if !interruptsRead(d) {
+		return func() { _ = d.SetReadDeadline(time.Time{}) }
+	}
+	interrupted := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		defer close(interrupted)
+		_ = d.SetReadDeadline(time.Now())
+	})
+	return sync.OnceFunc(func() {
+		if !stop() {
+			<-interrupted
+		}
+		_ = d.SetReadDeadline(time.Time{})
+	})
+}
+
+// contextErr returns the error of the context if the operation failed
+// because it's done. The read deadline set by interruptOn may expire before
+// the context reports its own deadline as exceeded, so a timeout past the
+// deadline counts as context.DeadlineExceeded.
+func contextErr(ctx context.Context, err error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok && isTimeout(err) && !time.Now().Before(deadline) {
+		return context.DeadlineExceeded
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+// Copyright (c) 2020–2024 The prologix developers. All rights reserved.
+// Project site: https://github.com/gotmc/prologix
+// Use of this source code is governed by a MIT-style license that
+// can be found in the LICENSE.txt file for the project.
+
+package prologix
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gotmc/prologix/sim"
+)
+
+// newSimInstrument returns the simulated instrument attached at the address
+// of a simulated Prologix controller.
+func newSimInstrument(t *testing.T, addr int, inst sim.Instrument) *Instrument {
+	t.Helper()
+	adapter := sim.NewAdapter()
+	if err := adapter.Attach(addr, inst); err != nil {
+		t.Fatal(err)
+	}
+	conn := adapter.Dial()
+	t.Cleanup(func() { conn.Close() })
+	gpib, err := NewController(conn, addr, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i, err := gpib.Instrument(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return i
+}
+
+func TestStatusRegisters(t *testing.T) {
+	fgen := newSimInstrument(t, 6, sim.NewKey33220A(1))
+	if err := fgen.ClearStatus(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fgen.SetEventStatusEnable(EventCommandError | EventExecutionError); err != nil {
+		t.Fatal(err)
+	}
+	if ese, err := fgen.EventStatusEnable(); err != nil || ese != EventCommandError|EventExecutionError {
+		t.Errorf("got ESE %s (%v); want %s", ese, err, EventCommandError|EventExecutionError)
+	}
+	if err := fgen.Command("BURS: ON"); err != nil {
+		t.Fatal(err)
+	}
+	stb, err := fgen.StatusByte()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stb.Has(StatusEventSummary | StatusErrorAvailable) {
+		t.Errorf("got status byte %s; want ESB and EAV set", stb)
+	}
+	esr, err := fgen.EventStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if esr.Errors() != EventCommandError {
+		t.Errorf("got event status %s; want CME", esr)
+	}
+	if result, err := fgen.SelfTest(); err != nil || result != 0 {
+		t.Errorf("got self-test result %d (%v); want 0", result, err)
+	}
+}
+
+func TestWaitOperationComplete(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []WaitOption
+	}{
+		{"opc query", nil},
+		{"service request", []WaitOption{WithServiceRequest()}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fgen := newSimInstrument(t, 6, sim.NewKey33220A(1))
+			if err := fgen.SetServiceRequestEnable(StatusMessageAvailable); err != nil {
+				t.Fatal(err)
+			}
+			start := time.Now()
+			if err := fgen.Command("APPL:SIN 100,0.5,0.0"); err != nil {
+				t.Fatal(err)
+			}
+			if err := fgen.WaitOperationComplete(context.Background(), test.opts...); err != nil {
+				t.Fatal(err)
+			}
+			if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+				t.Errorf("returned after %s; want after the 200 ms operation", elapsed)
+			}
+			// The instrument is usable afterwards and its masks are unchanged.
+			if sre, err := fgen.ServiceRequestEnable(); err != nil || sre != StatusMessageAvailable {
+				t.Errorf("got SRE %s (%v); want %s", sre, err, StatusMessageAvailable)
+			}
+		})
+	}
+}
+
+func TestWaitOperationCompleteCanceled(t *testing.T) {
+	fgen := newSimInstrument(t, 6, sim.NewKey33220A(1))
+	if err := fgen.Command("APPL:SIN 100,0.5,0.0"); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	// With a read timeout shorter than the operation, each read of the
+	// response to *OPC? returns without waiting for the instrument.
+	if err := fgen.Controller().SetReadTimeout(10); err != nil {
+		t.Fatal(err)
+	}
+	err := fgen.WaitOperationComplete(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got error %v; want %v", err, context.DeadlineExceeded)
+	}
+	if err := fgen.Controller().SetReadTimeout(500); err != nil {
+		t.Fatal(err)
+	}
+	if id, err := fgen.Identify(); err != nil || id.Model != "33220A" {
+		t.Errorf("got model %q (%v) after canceled wait; want 33220A", id.Model, err)
+	}
+}
+
+func TestWaitServiceRequestCanceled(t *testing.T) {
+	// The instrument never requests service, and the replies of the adapter
+	// arrive after a delay, so that they aren't read once the deadline has
+	// expired.
+	dmm := sim.NewScripted("", map[string]string{"*ese?": "32", "*sre?": "16", "*esr?": "0"})
+	adapter := sim.NewAdapter()
+	if err := adapter.Attach(10, dmm); err != nil {
+		t.Fatal(err)
+	}
+	conn := newSlowConn(t, adapter.Dial())
+	gpib, err := NewController(conn, 10, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inst, err := gpib.Instrument(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.delay.Store(int64(time.Millisecond))
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = inst.WaitOperationComplete(ctx, WithServiceRequest(), WithPollInterval(5*time.Millisecond))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got error %v; want %v", err, context.DeadlineExceeded)
+	}
+	if strings.Contains(err.Error(), "restoring") {
+		t.Errorf("got error %v; want masks restored", err)
+	}
+	// The masks are restored although the context is done, leaving the
+	// controller usable.
+	received := dmm.Received()
+	if got := received[len(received)-1]; got != "*ESE 32;*SRE 16" {
+		t.Errorf("got last command %q after canceled wait; want masks restored", got)
+	}
+	if sre, err := inst.ServiceRequestEnable(); err != nil || sre != 16 {
+		t.Errorf("got SRE %s (%v) after canceled wait; want 16", sre, err)
+	}
+}
+
+func TestStatusByteString(t *testing.T) {
+	if got, want := (StatusRequestService | StatusEventSummary).String(), "96 (ESB|RQS)"; got != want {
+		t.Errorf("got %q; want %q", got, want)
+	}
+	if got, want := (EventPowerOn | EventOperationComplete).String(), "129 (OPC|PON)"; got != want {
+		t.Errorf("got %q; want %q", got, want)
+	}
+}
@@ -0,0 +1,380 @@
+// Copyright (c) 2020–2024 The prologix developers. All rights reserved.
+// Project site: https://github.com/gotmc/prologix
+// Use of this source code is governed by a MIT-style license that
+// can be found in the LICENSE.txt file for the project.
+
+package prologix
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Verify that Instrument implements the InstrumentIO and BusController
+// interfaces.
+var (
+	_ InstrumentIO  = (*Instrument)(nil)
+	_ BusController = (*Instrument)(nil)
+)
+
+// Instrument is an instrument at a GPIB address on the bus of a Controller.
+// Several Instruments can share a Controller. Each operation selects the
+// instrument's address before communicating, and the operations of all
+// Instruments sharing a Controller are serialized, so an Instrument is safe
+// for concurrent use.
+type Instrument struct {
+	c                *Controller
+	primaryAddr      int
+	hasSecondaryAddr bool
+	secondaryAddr    int
+	pinned           bool
+	pinModel         string
+	pinSerial        string
+	verified         bool
+	verifiedGen      uint64
+	strict           bool
+	interceptors     []Interceptor
+	// release releases the shared controller of an instrument opened by Open.
+	release func() error
+}
+
+// InstrumentOption applies an option to the instrument.
+type InstrumentOption func(*Instrument)
+
+// WithInstrumentSecondaryAddress sets the secondary address of the
+// instrument, which must be in the range of 96 and 126, inclusive.
+func WithInstrumentSecondaryAddress(addr int) InstrumentOption {
+	return func(i *Instrument) {
+		i.hasSecondaryAddr = true
+		i.secondaryAddr = addr
+	}
+}
+
+// WithPinnedIdentity pins the expected identity of the instrument, so that
+// commands aren't sent to the wrong instrument after the bench is recabled or
+// an address is changed. Before the first operation, the instrument is
+// identified and the model, and the serial number unless empty, are compared
+// ignoring case. On a mismatch, the operation fails with an error wrapping
+// ErrIdentityMismatch and no traffic is sent to the instrument. The identity
+// is checked again before each operation until it matches, and again after a
+// Reconnector reopens the connection.
+func WithPinnedIdentity(model, serialNumber string) InstrumentOption {
+	return func(i *Instrument) {
+		i.pinned = true
+		i.pinModel = model
+		i.pinSerial = serialNumber
+	}
+}
+
+// WithStrictErrors enables strict mode, in which the SCPI error queue of the
+// instrument is drained after each Command, and Command returns an error
+// wrapping the SCPIErrors that the command caused. The instrument must
+// support the `SYST:ERR?` query.
+func WithStrictErrors() InstrumentOption {
+	return func(i *Instrument) {
+		i.strict = true
+	}
+}
+
+// Instrument returns the instrument at the given primary address on the bus
+// of the controller. Optionally instrument configuration can be included
+// using an InstrumentOption.
+func (c *Controller) Instrument(addr int, opts ...InstrumentOption) (*Instrument, error) {
+	i := Instrument{
+		c:           c,
+		primaryAddr: addr,
+	}
+	for _, opt := range opts {
+		opt(&i)
+	}
+	if !isPrimaryAddressValid(i.primaryAddr) {
+		return nil, fmt.Errorf("invalid primary address %d (must by 0-30)", i.primaryAddr)
+	}
+	if i.hasSecondaryAddr && !isSecondaryAddressValid(i.secondaryAddr) {
+		return nil, fmt.Errorf("invalid secondary address %d (must be 96-126)", i.secondaryAddr)
+	}
+	return &i, nil
+}
+
+// Controller returns the controller of the bus the instrument is on.
+func (i *Instrument) Controller() *Controller {
+	return i.c
+}
+
+// Address returns the GPIB address of the instrument formatted as the primary
+// address followed by the secondary address, if any.
+func (i *Instrument) Address() string {
+	if i.hasSecondaryAddr {
+		return fmt.Sprintf("%d %d", i.primaryAddr, i.secondaryAddr)
+	}
+	return strconv.Itoa(i.primaryAddr)
+}
+
+// Identify identifies the instrument using the `*IDN?` query, falling back to
+// the `ID?` and `ID` queries used by older instruments. Each identification
+// query sent is passed to the interceptors as a query, which they may
+// rewrite.
+func (i *Instrument) Identify() (Identity, error) {
+	var raw string
+	err := i.do(func() (err error) {
+		raw, err = i.c.identification(i.c.intercept)
+		return err
+	})
+	if err != nil {
+		return Identity{}, err
+	}
+	return ParseIdentity(raw), nil
+}
+
+// Write writes the given data to the instrument.
+func (i *Instrument) Write(p []byte) (n int, err error) {
+	err = i.do(func() error {
+		n, err = i.c.Write(p)
+		return err
+	})
+	return n, err
+}
+
+// Read reads from the Prologix controller into the given byte slice. Since
+// data is only received after a query or a `++read` command, Read doesn't
+// select the instrument's address.
+func (i *Instrument) Read(p []byte) (n int, err error) {
+	i.c.mu.Lock()
+	defer i.c.mu.Unlock()
+	defer i.scope()()
+	return i.c.Read(p)
+}
+
+// WriteString writes a string to the instrument.
+func (i *Instrument) WriteString(s string) (n int, err error) {
+	err = i.do(func() error {
+		n, err = i.c.WriteString(s)
+		return err
+	})
+	return n, err
+}
+
+// Command formats according to a format specifier if provided and sends a
+// SCPI/ASCII command to the instrument. In strict mode, the errors caused by
+// the command are read from the instrument's error queue and returned.
+func (i *Instrument) Command(format string, a ...any) error {
+	return i.do(func() error {
+		if err := i.c.Command(format, a...); err != nil || !i.strict {
+			return err
+		}
+		errs, err := i.c.drainErrors()
+		if err != nil {
+			return fmt.Errorf("error reading error queue: %w", err)
+		}
+		if len(errs) > 0 {
+			cmd := format
+			if a != nil {
+				cmd = fmt.Sprintf(format, a...)
+			}
+			return fmt.Errorf("command %s: %w", strings.TrimSpace(cmd), errs)
+		}
+		return nil
+	})
+}
+
+// Query queries the instrument using the given SCPI/ASCII command and returns
+// the response.
+func (i *Instrument) Query(cmd string) (s string, err error) {
+	err = i.do(func() error {
+		s, err = i.c.query(cmd)
+		return err
+	})
+	return s, err
+}
+
+// QueryContext is like Query, but the response is abandoned when the context
+// is done before it's received, provided the connection supports read
+// deadlines. The instrument is then cleared so that its late answer isn't
+// read as the response to a later query. With the vcp driver, whose reads
+// can't be interrupted, only the deadline of the context is applied.
+func (i *Instrument) QueryContext(ctx context.Context, cmd string) (s string, err error) {
+	err = i.queryContext(ctx, cmd, func() error {
+		s, err = i.c.query(cmd)
+		return err
+	})
+	return s, err
+}
+
+// QueryBlock queries the instrument using the given command and returns the
+// data of the IEEE 488.2 definite length arbitrary block it answers with, such
+// as `#15hello`, which may contain any bytes.
+func (i *Instrument) QueryBlock(cmd string) (data []byte, err error) {
+	err = i.do(func() error {
+		data, err = i.c.queryBlock(cmd)
+		return err
+	})
+	return data, err
+}
+
+// QueryBlockContext is like QueryBlock, but the response is abandoned when the
+// context is done before it's received, as with QueryContext.
+func (i *Instrument) QueryBlockContext(ctx context.Context, cmd string) (data []byte, err error) {
+	err = i.queryContext(ctx, cmd, func() error {
+		data, err = i.c.queryBlock(cmd)
+		return err
+	})
+	return data, err
+}
+
+// queryContext performs the query using fn, interrupting it when the context
+// is done and clearing the instrument if it didn't answer.
+func (i *Instrument) queryContext(ctx context.Context, cmd string, fn func() error) error {
+	return i.do(func() error {
+		stop := i.c.interruptOn(ctx)
+		err := fn()
+		stop()
+		if err == nil {
+			return nil
+		}
+		ctxErr := contextErr(ctx, err)
+		if ctxErr != nil || isTimeout(err) {
+			_ = i.c.ClearDevice()
+		}
+		if ctxErr != nil {
+			return fmt.Errorf("query %s: %w", strings.TrimSpace(cmd), ctxErr)
+		}
+		return err
+	})
+}
+
+// ReadContext reads a response from the instrument by sending the `++read
+// eoi` command, such as after a query sent using Write. The read is abandoned
+// when the context is done before the response is received, provided the
+// connection supports read deadlines.
+func (i *Instrument) ReadContext(ctx context.Context) (s string, err error) {
+	err = i.do(func() error {
+		stop := i.c.interruptOn(ctx)
+		s, err = i.c.QueryController("read eoi")
+		stop()
+		if err == nil {
+			return nil
+		}
+		if ctxErr := contextErr(ctx, err); ctxErr != nil {
+			return fmt.Errorf("read: %w", ctxErr)
+		}
+		return err
+	})
+	return s, err
+}
+
+// ClearDevice sends the Selected Device Clear (SDC) message to the
+// instrument.
+func (i *Instrument) ClearDevice() error {
+	return i.do(i.c.ClearDevice)
+}
+
+// ClearInterface asserts the GPIB Interface Clear (IFC) signal, which affects
+// all instruments on the bus.
+func (i *Instrument) ClearInterface() error {
+	i.c.mu.Lock()
+	defer i.c.mu.Unlock()
+	return i.c.ClearInterface()
+}
+
+// FrontPanel enables or disables front panel operation of the instrument.
+func (i *Instrument) FrontPanel(enable bool) error {
+	return i.do(func() error {
+		return i.c.FrontPanel(enable)
+	})
+}
+
+// SerialPoll serial polls the instrument and returns its status byte.
+func (i *Instrument) SerialPoll() (stb byte, err error) {
+	err = i.do(func() error {
+		stb, err = i.c.SerialPoll()
+		return err
+	})
+	return stb, err
+}
+
+// ServiceRequest reports whether the SRQ line is asserted, which may be by
+// any instrument on the bus.
+func (i *Instrument) ServiceRequest() (srq bool, err error) {
+	err = i.do(func() error {
+		srq, err = i.c.ServiceRequest()
+		return err
+	})
+	return srq, err
+}
+
+// Trigger sends the Group Execute Trigger (GET) message to the instrument.
+func (i *Instrument) Trigger() error {
+	return i.do(i.c.Trigger)
+}
+
+// do locks the controller, selects the instrument's address, verifies the
+// pinned identity, and then calls fn, with the instrument's interceptors
+// applied throughout.
+func (i *Instrument) do(fn func() error) error {
+	i.c.mu.Lock()
+	defer i.c.mu.Unlock()
+	defer i.scope()()
+	if err := i.c.selectAddress(i.primaryAddr, i.hasSecondaryAddr, i.secondaryAddr); err != nil {
+		return err
+	}
+	if err := i.verify(); err != nil {
+		return err
+	}
+	return fn()
+}
+
+// scope applies the interceptors of the instrument to the operations of the
+// controller until the returned function is called. The controller lock must
+// be held.
+func (i *Instrument) scope() func() {
+	i.c.scoped = i.interceptors
+	return func() { i.c.scoped = nil }
+}
+
+// verify verifies the pinned identity of the instrument unless already
+// verified since the connection was last reopened. The controller lock must be
+// held with the instrument's address selected.
+func (i *Instrument) verify() error {
+	gen := i.c.connGeneration()
+	if !i.pinned || (i.verified && i.verifiedGen == gen) {
+		return nil
+	}
+	id, err := i.c.identify()
+	if err != nil {
+		return fmt.Errorf("error verifying identity at GPIB address %s: %w", i.Address(), err)
+	}
+	if !id.matches(i.pinModel, i.pinSerial) {
+		want := i.pinModel
+		if i.pinSerial != "" {
+			want += " serial number " + i.pinSerial
+		}
+		return fmt.Errorf(
+			"%w: GPIB address %s has %s %s serial number %s; want %s",
+			ErrIdentityMismatch, i.Address(), id.Manufacturer, id.Model, id.SerialNumber, want,
+		)
+	}
+	i.verified = true
+	i.verifiedGen = gen
+	return nil
+}
+
+// selectAddress sets the controller's instrument address unless already
+// selected. The lock must be held.
+func (c *Controller) selectAddress(pad int, hasSad bool, sad int) error {
+	if c.primaryAddr == pad && c.hasSecondaryAddr == hasSad && (!hasSad || c.secondaryAddr == sad) {
+		return nil
+	}
+	cmd := fmt.Sprintf("addr %d", pad)
+	if hasSad {
+		cmd = fmt.Sprintf("addr %d %d", pad, sad)
+	}
+	if err := c.CommandController(cmd); err != nil {
+		return err
+	}
+	c.primaryAddr = pad
+	c.hasSecondaryAddr = hasSad
+	c.secondaryAddr = sad
+	return nil
+}
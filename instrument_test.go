@@ -0,0 +1,205 @@
+// Copyright (c) 2020–2024 The prologix developers. All rights reserved.
+// Project site: https://github.com/gotmc/prologix
+// Use of this source code is governed by a MIT-style license that
+// can be found in the LICENSE.txt file for the project.
+
+package prologix
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gotmc/prologix/sim"
+)
+
+func TestPinnedIdentity(t *testing.T) {
+	adapter := sim.NewAdapter()
+	psu := sim.NewScripted("HEWLETT-PACKARD,E3631A,0,2.1-5.0-1.0", nil)
+	if err := adapter.Attach(5, psu); err != nil {
+		t.Fatal(err)
+	}
+	dmm := sim.NewScripted("FLUKE, 45, 4620108, 1.6 D1.0", nil)
+	if err := adapter.Attach(10, dmm); err != nil {
+		t.Fatal(err)
+	}
+	conn := adapter.Dial()
+	defer conn.Close()
+	gpib, err := NewController(conn, 5, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		addr   int
+		model  string
+		serial string
+		ok     bool
+	}{
+		{"model", 5, "e3631a", "", true},
+		{"model and serial", 10, "45", "4620108", true},
+		{"wrong serial", 10, "45", "1234", false},
+		{"recabled", 10, "E3631A", "", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			inst, err := gpib.Instrument(test.addr, WithPinnedIdentity(test.model, test.serial))
+			if err != nil {
+				t.Fatal(err)
+			}
+			before := len(received(psu, dmm))
+			err = inst.Command("OUTP ON")
+			if test.ok && err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !test.ok && !errors.Is(err, ErrIdentityMismatch) {
+				t.Fatalf("got error %v; want %v", err, ErrIdentityMismatch)
+			}
+			sent := strings.Contains(strings.Join(received(psu, dmm)[before:], "|"), "OUTP ON")
+			if sent != test.ok {
+				t.Errorf("command sent = %t; want %t", sent, test.ok)
+			}
+		})
+	}
+}
+
+func received(insts ...*sim.Scripted) []string {
+	var msgs []string
+	for _, inst := range insts {
+		msgs = append(msgs, inst.Received()...)
+	}
+	return msgs
+}
+
+func TestInstrumentsShareController(t *testing.T) {
+	adapter := sim.NewAdapter()
+	if err := adapter.Attach(5, sim.NewE3631A(1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := adapter.Attach(10, sim.NewFluke45(1)); err != nil {
+		t.Fatal(err)
+	}
+	conn := adapter.Dial()
+	defer conn.Close()
+	gpib, err := NewController(conn, 5, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	psu, err := gpib.Instrument(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dmm, err := gpib.Instrument(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, inst := range []*Instrument{psu, dmm, psu} {
+		id, err := inst.Identify()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := map[*Instrument]string{psu: "E3631A", dmm: "45"}[inst]
+		if id.Model != want {
+			t.Errorf("got model %s at address %s; want %s", id.Model, inst.Address(), want)
+		}
+	}
+	if _, err := gpib.Instrument(31); err == nil {
+		t.Error("expected error for invalid primary address")
+	}
+}
+
+func TestQueryContext(t *testing.T) {
+	inst := newSimInstrument(t, 10, sim.NewScripted("", map[string]string{"volt?": "1.5"}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := inst.QueryContext(ctx, "FREQ?"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got error %v for unanswered query; want deadline exceeded", err)
+	}
+	got, err := inst.QueryContext(context.Background(), "VOLT?")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "1.5\n" {
+		t.Errorf("got response %q; want 1.5", got)
+	}
+}
+
+// serialConn is a connection to a simulated adapter whose reads, like those
+// of the vcp driver, can't be interrupted by setting the read deadline.
+type serialConn struct {
+	*sim.Conn
+	mu        sync.Mutex
+	deadlines []time.Time
+}
+
+func (c *serialConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadlines = append(c.deadlines, t)
+	c.mu.Unlock()
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *serialConn) InterruptsRead() bool {
+	return false
+}
+
+func TestQueryContextUninterruptible(t *testing.T) {
+	adapter := sim.NewAdapter()
+	if err := adapter.Attach(10, sim.NewScripted("", nil)); err != nil {
+		t.Fatal(err)
+	}
+	conn := &serialConn{Conn: adapter.Dial()}
+	defer conn.Close()
+	gpib, err := NewController(conn, 10, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inst, err := gpib.Instrument(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the deadline of the context is set, before the read.
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := inst.QueryContext(ctx, "FREQ?"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got error %v for unanswered query; want deadline exceeded", err)
+	}
+	deadline, _ := ctx.Deadline()
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if len(conn.deadlines) != 2 || !conn.deadlines[0].Equal(deadline) || !conn.deadlines[1].IsZero() {
+		t.Errorf("got read deadlines %v; want the context deadline and then none", conn.deadlines)
+	}
+}
+
+func TestQueryBlock(t *testing.T) {
+	inst := newSimInstrument(t, 10, sim.NewScripted("", map[string]string{
+		"curv?":  "#16a\nb\x00\ncd",
+		"empty?": "#10",
+		"text?":  "1.5",
+	}))
+	got, err := inst.QueryBlock("CURV?")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "a\nb\x00\nc" {
+		t.Errorf("got block %q; want %q", got, "a\nb\x00\nc")
+	}
+	got, err = inst.QueryBlockContext(context.Background(), "EMPTY?")
+	if err != nil || len(got) != 0 {
+		t.Errorf("got block %q (%v); want empty block", got, err)
+	}
+	if _, err := inst.QueryBlock("TEXT?"); err == nil {
+		t.Error("got no error for response that isn't a block")
+	}
+	// The controller is left ready for the next query.
+	if got, err := inst.Query("TEXT?"); err != nil || got != "1.5\n" {
+		t.Errorf("got response %q (%v) after block; want 1.5", got, err)
+	}
+}
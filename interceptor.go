@@ -0,0 +1,123 @@
+// Copyright (c) 2020–2024 The prologix developers. All rights reserved.
+// Project site: https://github.com/gotmc/prologix
+// Use of this source code is governed by a MIT-style license that
+// can be found in the LICENSE.txt file for the project.
+
+package prologix
+
+import (
+	"time"
+)
+
+// OperationKind is the kind of an operation passed to an Interceptor.
+type OperationKind int
+
+// Kinds of operations.
+const (
+	// CommandOperation is a command sent to the instrument using Command.
+	CommandOperation OperationKind = iota
+	// QueryOperation is a query of the instrument using Query.
+	QueryOperation
+	// ControllerCommandOperation is a `++` command sent to the Prologix
+	// controller using CommandController.
+	ControllerCommandOperation
+	// ControllerQueryOperation is a `++` command answered by the Prologix
+	// controller using QueryController.
+	ControllerQueryOperation
+	// WriteOperation is data written using Write or WriteString.
+	WriteOperation
+	// ReadOperation is data read using Read.
+	ReadOperation
+)
+
+var operationKindDesc = map[OperationKind]string{
+	CommandOperation:           "command",
+	QueryOperation:             "query",
+	ControllerCommandOperation: "controller command",
+	ControllerQueryOperation:   "controller query",
+	WriteOperation:             "write",
+	ReadOperation:              "read",
+}
+
+func (k OperationKind) String() string {
+	return operationKindDesc[k]
+}
+
+// Operation is an operation of a Controller passed through its interceptors.
+type Operation struct {
+	Kind OperationKind
+	// Address is the GPIB address selected when the operation started,
+	// formatted as the primary address followed by the secondary address, if
+	// any.
+	Address string
+	// Payload is the data sent, which is the command without the USB
+	// terminator for a command or query, the command without the leading `++`
+	// for a controller command, or the data written. Interceptors may change
+	// the payload before calling the next interceptor. It's empty for a read.
+	Payload string
+	// Response is the response of a query or the data read, which is set once
+	// the operation is done. Interceptors may change the response after
+	// calling the next interceptor, though data read that no longer fits the
+	// buffer passed to Read makes it fail with io.ErrShortBuffer.
+	Response string
+	// Duration is the time taken by the operation, which is set once the
+	// operation is done.
+	Duration time.Duration
+	// Err is the error of the operation, which is set once the operation is
+	// done.
+	Err error
+}
+
+// Invoker performs an operation, or passes it to the next interceptor.
+type Invoker func(op *Operation) error
+
+// Interceptor wraps the operations of a Controller, such as to audit, trace,
+// rewrite, or rate limit them. The interceptor calls next to continue the
+// operation, or returns an error without calling next to abort it. The
+// error returned is returned by the operation.
+type Interceptor func(op *Operation, next Invoker) error
+
+// WithInterceptors adds interceptors wrapping the commands, queries, `++`
+// commands, writes, and reads of the controller, including those of its
+// Instruments. The first interceptor is the outermost. Each identification
+// query sent by Instrument.Identify is intercepted as a query, while the
+// traffic of Scan, Controller.Identify, and the probes of
+// WaitOperationComplete and the health monitor isn't intercepted.
+func WithInterceptors(interceptors ...Interceptor) ControllerOption {
+	return func(c *Controller) {
+		c.interceptors = append(c.interceptors, interceptors...)
+	}
+}
+
+// WithInstrumentInterceptors adds interceptors wrapping the operations of the
+// instrument, including the `++` commands selecting its address. They're
+// called inside the interceptors of the controller, with the first
+// interceptor the outermost.
+func WithInstrumentInterceptors(interceptors ...Interceptor) InstrumentOption {
+	return func(i *Instrument) {
+		i.interceptors = append(i.interceptors, interceptors...)
+	}
+}
+
+// intercept passes the operation through the interceptors of the controller
+// and of the instrument in use, and then performs it using do, recording its
+// duration and error.
+func (c *Controller) intercept(op *Operation, do Invoker) error {
+	op.Address = c.addrString()
+	chain := func(op *Operation) error {
+		start := time.Now()
+		err := do(op)
+		op.Duration = time.Since(start)
+		op.Err = err
+		c.metrics.observe(op)
+		return err
+	}
+	interceptors := append(c.interceptors[:len(c.interceptors):len(c.interceptors)], c.scoped...)
+	for k := len(interceptors) - 1; k >= 0; k-- {
+		next, interceptor := chain, interceptors[k]
+		chain = func(op *Operation) error {
+			return interceptor(op, next)
+		}
+	}
+	return chain(op)
+}
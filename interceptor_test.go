@@ -0,0 +1,244 @@
+// Copyright (c) 2020–2024 The prologix developers. All rights reserved.
+// Project site: https://github.com/gotmc/prologix
+// Use of this source code is governed by a MIT-style license that
+// can be found in the LICENSE.txt file for the project.
+
+package prologix
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/gotmc/prologix/sim"
+)
+
+func TestInterceptors(t *testing.T) {
+	adapter := sim.NewAdapter()
+	dmm := sim.NewScripted("", map[string]string{"x?": "1", "volt?": "2"})
+	if err := adapter.Attach(5, dmm); err != nil {
+		t.Fatal(err)
+	}
+	if err := adapter.Attach(6, sim.NewScripted("", nil)); err != nil {
+		t.Fatal(err)
+	}
+	conn := adapter.Dial()
+	defer conn.Close()
+
+	var log []string
+	trace := func(name string) Interceptor {
+		return func(op *Operation, next Invoker) error {
+			log = append(log, fmt.Sprintf("%s> %s %s %q", name, op.Kind, op.Address, op.Payload))
+			err := next(op)
+			log = append(log, fmt.Sprintf("%s< %q", name, op.Response))
+			return err
+		}
+	}
+	gpib, err := NewController(conn, 5, false, WithInterceptors(trace("a"), trace("b")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Rewrite queries on the way in and responses on the way out.
+	rewrite := func(op *Operation, next Invoker) error {
+		if op.Kind == QueryOperation && op.Payload == "x?" {
+			op.Payload = "volt?"
+		}
+		err := next(op)
+		op.Response = strings.TrimSpace(op.Response)
+		return err
+	}
+	dmmInst, err := gpib.Instrument(5, WithInstrumentInterceptors(rewrite))
+	if err != nil {
+		t.Fatal(err)
+	}
+	errReadOnly := errors.New("read only")
+	readOnly := func(op *Operation, next Invoker) error {
+		if op.Kind == CommandOperation {
+			return errReadOnly
+		}
+		return next(op)
+	}
+	other, err := gpib.Instrument(6, WithInstrumentInterceptors(readOnly))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	log = nil
+	got, err := dmmInst.Query("x?")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "2" {
+		t.Errorf("got response %q; want rewritten query answered and trimmed", got)
+	}
+	want := []string{
+		`a> query 5 "x?"`,
+		`b> query 5 "x?"`,
+		`b< "2"`,
+		`a< "2"`,
+	}
+	if strings.Join(log, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got log\n%s\nwant\n%s", strings.Join(log, "\n"), strings.Join(want, "\n"))
+	}
+
+	log = nil
+	if err := other.Command("OUTP ON"); !errors.Is(err, errReadOnly) {
+		t.Errorf("got error %v; want %v", err, errReadOnly)
+	}
+	want = []string{
+		`a> controller command 5 "addr 6"`,
+		`b> controller command 5 "addr 6"`,
+		`b< ""`,
+		`a< ""`,
+		`a> command 6 "OUTP ON"`,
+		`b> command 6 "OUTP ON"`,
+		`b< ""`,
+		`a< ""`,
+	}
+	if strings.Join(log, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got log\n%s\nwant\n%s", strings.Join(log, "\n"), strings.Join(want, "\n"))
+	}
+
+	// Instrument interceptors don't apply to the controller used directly.
+	if err := gpib.SetInstrumentAddress(5); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gpib.Query("x?"); err != nil {
+		t.Fatal(err)
+	}
+	if err := gpib.Command("OUTP ON"); err != nil {
+		t.Errorf("got error %v sending command without instrument interceptors", err)
+	}
+	received := strings.Join(dmm.Received(), ",")
+	if received != "VOLT?,X?,OUTP ON" {
+		t.Errorf("got commands %s received by instrument at address 5; want VOLT?,X?,OUTP ON", received)
+	}
+}
+
+func TestInterceptorRecordsOperation(t *testing.T) {
+	adapter := sim.NewAdapter()
+	conn := adapter.Dial()
+	defer conn.Close()
+	var ops []Operation
+	record := func(op *Operation, next Invoker) error {
+		err := next(op)
+		ops = append(ops, *op)
+		return err
+	}
+	gpib, err := NewController(conn, 5, false, WithInterceptors(record))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ops = nil
+	ver, err := gpib.Version()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ops) != 1 {
+		t.Fatalf("got %d operations; want 1", len(ops))
+	}
+	op := ops[0]
+	if op.Kind != ControllerQueryOperation || op.Payload != "ver" || op.Address != "5" {
+		t.Errorf("got operation %+v; want ++ver at address 5", op)
+	}
+	if op.Response == "" || !strings.Contains(op.Response, ver) || op.Duration <= 0 || op.Err != nil {
+		t.Errorf("got operation %+v; want response, duration and no error", op)
+	}
+}
+
+func TestInterceptorGrowsRead(t *testing.T) {
+	adapter := sim.NewAdapter()
+	conn := adapter.Dial()
+	defer conn.Close()
+	grow := func(op *Operation, next Invoker) error {
+		err := next(op)
+		if op.Kind == ReadOperation {
+			op.Response = strings.Repeat(op.Response, 3)
+		}
+		return err
+	}
+	gpib, err := NewController(conn, 5, false, WithInterceptors(grow))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := gpib.CommandController("ver"); err != nil {
+		t.Fatal(err)
+	}
+	p := make([]byte, len(sim.VersionUSB)+2)
+	n, err := gpib.Read(p)
+	if !errors.Is(err, io.ErrShortBuffer) || n != len(p) {
+		t.Errorf("got %d bytes (%v) for grown read; want %d bytes and %v", n, err, len(p), io.ErrShortBuffer)
+	}
+}
+
+func TestInstrumentIdentifyIntercepted(t *testing.T) {
+	adapter := sim.NewAdapter()
+	if err := adapter.Attach(6, sim.NewScripted("SIM,DMM,1,1.0", nil)); err != nil {
+		t.Fatal(err)
+	}
+	conn := adapter.Dial()
+	defer conn.Close()
+	gpib, err := NewController(conn, 5, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ops []string
+	record := func(op *Operation, next Invoker) error {
+		err := next(op)
+		ops = append(ops, fmt.Sprintf("%s %s %q => %q", op.Kind, op.Address, op.Payload, op.Response))
+		return err
+	}
+	dmm, err := gpib.Instrument(6, WithInstrumentInterceptors(record))
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := dmm.Identify()
+	if err != nil || id.Model != "DMM" {
+		t.Fatalf("got identity %+v (%v); want model DMM", id, err)
+	}
+	want := []string{
+		`controller command 5 "addr 6" => ""`,
+		`query 6 "*IDN?" => "SIM,DMM,1,1.0"`,
+	}
+	if strings.Join(ops, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got operations\n%s\nwant\n%s", strings.Join(ops, "\n"), strings.Join(want, "\n"))
+	}
+
+	// The legacy queries are reported as sent, and a rewritten query is sent
+	// as rewritten.
+	legacy := sim.NewScripted("", map[string]string{"ID?": "HP3478A", "ID": "HP3478A REV 2"})
+	if err := adapter.Attach(7, legacy); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		rewrite string
+		want    []string
+	}{
+		{"", []string{`query 7 "*IDN?" => ""`, `query 7 "ID?" => "HP3478A"`}},
+		{"ID", []string{`query 7 "ID" => "HP3478A REV 2"`}},
+	} {
+		ops = nil
+		rewrite := func(op *Operation, next Invoker) error {
+			if tc.rewrite != "" {
+				op.Payload = tc.rewrite
+			}
+			return next(op)
+		}
+		inst, err := gpib.Instrument(7, WithInstrumentInterceptors(record, rewrite))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := inst.Identify(); err != nil {
+			t.Fatal(err)
+		}
+		queries := slices.DeleteFunc(ops, func(op string) bool {
+			return strings.HasPrefix(op, "controller command")
+		})
+		if strings.Join(queries, "\n") != strings.Join(tc.want, "\n") {
+			t.Errorf("got queries\n%s\nwant\n%s", strings.Join(queries, "\n"), strings.Join(tc.want, "\n"))
+		}
+	}
+}
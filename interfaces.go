@@ -0,0 +1,66 @@
+// Copyright (c) 2020–2024 The prologix developers. All rights reserved.
+// Project site: https://github.com/gotmc/prologix
+// Use of this source code is governed by a MIT-style license that
+// can be found in the LICENSE.txt file for the project.
+
+package prologix
+
+import "io"
+
+// InstrumentIO sends data, commands, and queries to the instrument at the
+// currently assigned GPIB address.
+type InstrumentIO interface {
+	io.ReadWriter
+	WriteString(s string) (n int, err error)
+	Command(format string, a ...any) error
+	Query(cmd string) (string, error)
+}
+
+// BusController sends GPIB bus management messages to the instrument at the
+// currently assigned GPIB address or to the whole bus.
+type BusController interface {
+	ClearDevice() error
+	ClearInterface() error
+	FrontPanel(enable bool) error
+	SerialPoll() (byte, error)
+	Trigger() error
+}
+
+// ControllerConfigurer queries and changes the configuration of the Prologix
+// GPIB controller.
+type ControllerConfigurer interface {
+	AssertEOI() (bool, error)
+	SetAssertEOI(enable bool) error
+	GPIBTermination() (GpibTerm, error)
+	SetGPIBTermination(term GpibTerm) error
+	InstrumentAddress() (int, error)
+	SetInstrumentAddress(addr int) error
+	ReadAfterWrite() (bool, error)
+	SetReadAfterWrite(enable bool) error
+	ReadTimeout() (int, error)
+	SetReadTimeout(timeout int) error
+	CommandController(cmd string) error
+	QueryController(cmd string) (string, error)
+	Reset() error
+}
+
+// StatusReporter reports the status of the Prologix GPIB controller and the
+// GPIB SRQ line.
+type StatusReporter interface {
+	Version() (string, error)
+	ServiceRequest() (bool, error)
+}
+
+// GPIB combines all of the operations provided by a Prologix GPIB
+// controller. Code that depends on GPIB, or on one of the smaller interfaces,
+// instead of *Controller can be tested using the fake in the prologixtest
+// package.
+type GPIB interface {
+	InstrumentIO
+	BusController
+	ControllerConfigurer
+	StatusReporter
+}
+
+// Verify that Controller implements the GPIB interface.
+var _ GPIB = (*Controller)(nil)
@@ -0,0 +1,383 @@
+// Copyright (c) 2020–2024 The prologix developers. All rights reserved.
+// Project site: https://github.com/gotmc/prologix
+// Use of this source code is governed by a MIT-style license that
+// can be found in the LICENSE.txt file for the project.
+
+package prologix
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultLatencyBuckets are the upper bounds in seconds of the latency
+// histogram buckets used unless set using WithLatencyBuckets.
+var DefaultLatencyBuckets = []float64{
+	0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10,
+}
+
+// Metrics records the traffic of one or more Controllers per GPIB address,
+// along with the latency of the `++` commands sent to the Prologix
+// controllers. A Metrics is added to a Controller using WithMetrics, and is
+// an http.Handler serving the metrics in the Prometheus text exposition
+// format.
+type Metrics struct {
+	mu       sync.Mutex
+	buckets  []float64
+	addrs    map[string]*addressMetrics
+	commands map[string]*histogram
+}
+
+// MetricsOption applies an option to the metrics.
+type MetricsOption func(*Metrics)
+
+// NewMetrics creates metrics to be added to Controllers using WithMetrics.
+// Optionally the metrics can be configured using a MetricsOption.
+func NewMetrics(opts ...MetricsOption) *Metrics {
+	m := Metrics{
+		buckets:  DefaultLatencyBuckets,
+		addrs:    make(map[string]*addressMetrics),
+		commands: make(map[string]*histogram),
+	}
+	for _, opt := range opts {
+		opt(&m)
+	}
+	return &m
+}
+
+// WithLatencyBuckets sets the upper bounds in seconds, in increasing order, of
+// the latency histogram buckets.
+func WithLatencyBuckets(bounds ...float64) MetricsOption {
+	return func(m *Metrics) {
+		m.buckets = append([]float64(nil), bounds...)
+		sort.Float64s(m.buckets)
+	}
+}
+
+// WithMetrics records the traffic of the controller in the given metrics. The
+// commands, queries, reads and writes sent to an instrument are counted for
+// its address, and the `++` commands sent to the Prologix controller are
+// counted by command name, such as `addr` or `spoll`, with unknown commands
+// counted as `other`. Like for interceptors, the traffic of Scan,
+// Controller.Identify, and the probes of WaitOperationComplete and the health
+// monitor isn't counted.
+func WithMetrics(m *Metrics) ControllerOption {
+	return func(c *Controller) {
+		c.metrics = m
+	}
+}
+
+// AddressMetrics is a snapshot of the metrics of a GPIB address.
+type AddressMetrics struct {
+	Commands     uint64 `json:"commands"`
+	Queries      uint64 `json:"queries"`
+	BytesWritten uint64 `json:"bytes_written"`
+	BytesRead    uint64 `json:"bytes_read"`
+	Timeouts     uint64 `json:"timeouts"`
+	Errors       uint64 `json:"errors"`
+	// QueryLatency is the histogram of the time taken by queries.
+	QueryLatency Histogram `json:"query_latency"`
+}
+
+// ControllerCommandMetrics is a snapshot of the metrics of a `++` command.
+type ControllerCommandMetrics struct {
+	Timeouts uint64 `json:"timeouts"`
+	Errors   uint64 `json:"errors"`
+	// Latency is the histogram of the time taken to send the command and, if
+	// it's answered, to read the response.
+	Latency Histogram `json:"latency"`
+}
+
+// Histogram is a snapshot of a latency histogram.
+type Histogram struct {
+	// Bounds are the upper bounds in seconds of the buckets.
+	Bounds []float64 `json:"bounds"`
+	// Counts are the cumulative number of observations less than or equal to
+	// each bound.
+	Counts []uint64 `json:"counts"`
+	// Count is the total number of observations.
+	Count uint64 `json:"count"`
+	// Sum is the sum of the observations in seconds.
+	Sum float64 `json:"sum"`
+}
+
+// MetricsSnapshot is a snapshot of the metrics.
+type MetricsSnapshot struct {
+	// Addresses holds the metrics of each GPIB address, keyed by the primary
+	// address followed by the secondary address, if any, such as `5` or
+	// `5 96`.
+	Addresses map[string]AddressMetrics `json:"addresses"`
+	// ControllerCommands holds the metrics of each `++` command, keyed by the
+	// command name without the `++` and the arguments, or `other` for unknown
+	// commands.
+	ControllerCommands map[string]ControllerCommandMetrics `json:"controller_commands"`
+}
+
+// Snapshot returns a copy of the current metrics.
+func (m *Metrics) Snapshot() MetricsSnapshot {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := MetricsSnapshot{
+		Addresses:          make(map[string]AddressMetrics, len(m.addrs)),
+		ControllerCommands: make(map[string]ControllerCommandMetrics, len(m.commands)),
+	}
+	for addr, a := range m.addrs {
+		s.Addresses[addr] = AddressMetrics{
+			Commands:     a.commands,
+			Queries:      a.queries,
+			BytesWritten: a.bytesWritten,
+			BytesRead:    a.bytesRead,
+			Timeouts:     a.timeouts,
+			Errors:       a.errors,
+			QueryLatency: a.latency.snapshot(m.buckets),
+		}
+	}
+	for name, h := range m.commands {
+		s.ControllerCommands[name] = ControllerCommandMetrics{
+			Timeouts: h.timeouts,
+			Errors:   h.errors,
+			Latency:  h.snapshot(m.buckets),
+		}
+	}
+	return s
+}
+
+// ServeHTTP writes the metrics in the Prometheus text exposition format.
+// Since the response has already started, an error writing it, such as when
+// the scraper disconnects, is only logged.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if err := m.WritePrometheus(w); err != nil {
+		log.Printf("error writing metrics to %s: %s", r.RemoteAddr, err)
+	}
+}
+
+// WritePrometheus writes the metrics in the Prometheus text exposition format.
+func (m *Metrics) WritePrometheus(w io.Writer) error {
+	s := m.Snapshot()
+	bw := bufio.NewWriter(w)
+	addrs := sortedKeys(s.Addresses)
+	counters := []struct {
+		name, help string
+		value      func(AddressMetrics) uint64
+	}{
+		{"prologix_commands_total", "Commands sent to the instrument.",
+			func(a AddressMetrics) uint64 { return a.Commands }},
+		{"prologix_queries_total", "Queries sent to the instrument.",
+			func(a AddressMetrics) uint64 { return a.Queries }},
+		{"prologix_bytes_written_total", "Bytes written to the instrument.",
+			func(a AddressMetrics) uint64 { return a.BytesWritten }},
+		{"prologix_bytes_read_total", "Bytes read from the instrument.",
+			func(a AddressMetrics) uint64 { return a.BytesRead }},
+		{"prologix_timeouts_total", "Operations on the instrument that timed out.",
+			func(a AddressMetrics) uint64 { return a.Timeouts }},
+		{"prologix_errors_total", "Operations on the instrument that failed, including timeouts.",
+			func(a AddressMetrics) uint64 { return a.Errors }},
+	}
+	for _, counter := range counters {
+		writeHeader(bw, counter.name, counter.help, "counter")
+		for _, addr := range addrs {
+			fmt.Fprintf(bw, "%s{address=%s} %d\n", counter.name, labelValue(addr), counter.value(s.Addresses[addr]))
+		}
+	}
+	const queryDuration = "prologix_query_duration_seconds"
+	writeHeader(bw, queryDuration, "Time taken by queries to the instrument.", "histogram")
+	for _, addr := range addrs {
+		writeHistogram(bw, queryDuration, "address="+labelValue(addr), s.Addresses[addr].QueryLatency)
+	}
+
+	names := sortedKeys(s.ControllerCommands)
+	const (
+		cmdErrors   = "prologix_controller_command_errors_total"
+		cmdTimeouts = "prologix_controller_command_timeouts_total"
+		cmdDuration = "prologix_controller_command_duration_seconds"
+	)
+	writeHeader(bw, cmdTimeouts, "Prologix controller commands that timed out.", "counter")
+	for _, name := range names {
+		fmt.Fprintf(bw, "%s{command=%s} %d\n", cmdTimeouts, labelValue(name), s.ControllerCommands[name].Timeouts)
+	}
+	writeHeader(bw, cmdErrors, "Prologix controller commands that failed, including timeouts.", "counter")
+	for _, name := range names {
+		fmt.Fprintf(bw, "%s{command=%s} %d\n", cmdErrors, labelValue(name), s.ControllerCommands[name].Errors)
+	}
+	writeHeader(bw, cmdDuration, "Time taken by Prologix controller commands.", "histogram")
+	for _, name := range names {
+		writeHistogram(bw, cmdDuration, "command="+labelValue(name), s.ControllerCommands[name].Latency)
+	}
+	return bw.Flush()
+}
+
+// labelEscaper escapes the characters of label values as required by the
+// Prometheus text exposition format, which unlike Go only escapes these.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labelValue returns the label value quoted for the Prometheus text
+// exposition format.
+func labelValue(s string) string {
+	return `"` + labelEscaper.Replace(s) + `"`
+}
+
+func writeHeader(w io.Writer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func writeHistogram(w io.Writer, name, labels string, h Histogram) {
+	for i, bound := range h.Bounds {
+		le := strconv.FormatFloat(bound, 'g', -1, 64)
+		fmt.Fprintf(w, "%s_bucket{%s,le=%q} %d\n", name, labels, le, h.Counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, h.Count)
+	fmt.Fprintf(w, "%s_sum{%s} %s\n", name, labels, strconv.FormatFloat(h.Sum, 'g', -1, 64))
+	fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, h.Count)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+type addressMetrics struct {
+	commands     uint64
+	queries      uint64
+	bytesWritten uint64
+	bytesRead    uint64
+	failures
+	latency histogram
+}
+
+// failures counts the operations that failed, and those among them that timed
+// out.
+type failures struct {
+	timeouts uint64
+	errors   uint64
+}
+
+func (f *failures) fail(err error) {
+	if err == nil {
+		return
+	}
+	f.errors++
+	if isTimeout(err) {
+		f.timeouts++
+	}
+}
+
+// histogram counts observations in buckets, along with the failures of the
+// observed operations.
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+	failures
+}
+
+func (h *histogram) observe(bounds []float64, d time.Duration) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(bounds))
+	}
+	secs := d.Seconds()
+	if i := sort.SearchFloat64s(bounds, secs); i < len(bounds) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += secs
+}
+
+func (h *histogram) snapshot(bounds []float64) Histogram {
+	s := Histogram{
+		Bounds: append([]float64(nil), bounds...),
+		Counts: make([]uint64, len(bounds)),
+		Count:  h.count,
+		Sum:    h.sum,
+	}
+	var n uint64
+	for i := range bounds {
+		if h.counts != nil {
+			n += h.counts[i]
+		}
+		s.Counts[i] = n
+	}
+	return s
+}
+
+// controllerCommandNames lists the `++` commands of the Prologix controller.
+var controllerCommandNames = map[string]bool{
+	"addr": true, "auto": true, "clr": true, "eoi": true, "eos": true,
+	"eot_enable": true, "eot_char": true, "help": true, "ifc": true,
+	"llo": true, "loc": true, "lon": true, "mode": true, "read": true,
+	"read_tmo_ms": true, "rst": true, "savecfg": true, "spoll": true,
+	"srq": true, "status": true, "trg": true, "ver": true,
+}
+
+// controllerCommandName returns the name of the `++` command without its
+// arguments, or `other` for an unknown command, so that the number of
+// commands counted is bounded.
+func controllerCommandName(cmd string) string {
+	fields := strings.Fields(cmd)
+	if len(fields) == 0 {
+		return "other"
+	}
+	name := strings.ToLower(fields[0])
+	if !controllerCommandNames[name] {
+		return "other"
+	}
+	return name
+}
+
+// address returns the metrics of the address. The lock must be held.
+func (m *Metrics) address(addr string) *addressMetrics {
+	a, ok := m.addrs[addr]
+	if !ok {
+		a = &addressMetrics{}
+		m.addrs[addr] = a
+	}
+	return a
+}
+
+// observe records an operation performed by a controller. The bytes written
+// to the instrument include the USB terminator appended to commands and
+// queries.
+func (m *Metrics) observe(op *Operation) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if op.Kind == ControllerCommandOperation || op.Kind == ControllerQueryOperation {
+		name := controllerCommandName(op.Payload)
+		h, ok := m.commands[name]
+		if !ok {
+			h = &histogram{}
+			m.commands[name] = h
+		}
+		h.fail(op.Err)
+		h.observe(m.buckets, op.Duration)
+		return
+	}
+	a := m.address(op.Address)
+	a.fail(op.Err)
+	a.bytesRead += uint64(len(op.Response))
+	switch op.Kind {
+	case CommandOperation:
+		a.commands++
+		a.bytesWritten += uint64(len(op.Payload)) + 1
+	case QueryOperation:
+		a.queries++
+		a.bytesWritten += uint64(len(op.Payload)) + 1
+		a.latency.observe(m.buckets, op.Duration)
+	case WriteOperation:
+		a.bytesWritten += uint64(len(op.Payload))
+	}
+}
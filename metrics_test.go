@@ -0,0 +1,150 @@
+// Copyright (c) 2020–2024 The prologix developers. All rights reserved.
+// Project site: https://github.com/gotmc/prologix
+// Use of this source code is governed by a MIT-style license that
+// can be found in the LICENSE.txt file for the project.
+
+package prologix
+
+import (
+	"errors"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gotmc/prologix/sim"
+)
+
+func TestMetrics(t *testing.T) {
+	adapter := sim.NewAdapter()
+	if err := adapter.Attach(5, sim.NewScripted("", map[string]string{"x?": "1"})); err != nil {
+		t.Fatal(err)
+	}
+	conn := adapter.Dial()
+	defer conn.Close()
+	m := NewMetrics()
+	gpib, err := NewController(conn, 5, false, WithMetrics(m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := gpib.Command("X 1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gpib.Query("x?"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gpib.Version(); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, err := gpib.Query("y?"); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("got error %v querying unanswered query; want deadline exceeded", err)
+	}
+
+	s := m.Snapshot()
+	got := s.Addresses["5"]
+	want := AddressMetrics{
+		Commands:     1,
+		Queries:      2,
+		BytesWritten: 10,
+		BytesRead:    2,
+		Timeouts:     1,
+		Errors:       1,
+	}
+	if got.Commands != want.Commands || got.Queries != want.Queries ||
+		got.BytesWritten != want.BytesWritten || got.BytesRead != want.BytesRead ||
+		got.Timeouts != want.Timeouts || got.Errors != want.Errors {
+		t.Errorf("got address metrics %+v; want %+v", got, want)
+	}
+	if h := got.QueryLatency; h.Count != 2 || h.Counts[len(h.Counts)-1] != 2 || h.Sum <= 0 {
+		t.Errorf("got query latency %+v; want 2 observations", h)
+	}
+	if h := s.ControllerCommands["ver"].Latency; h.Count != 1 {
+		t.Errorf("got %d observations of ++ver; want 1", h.Count)
+	}
+	if h := s.ControllerCommands["addr"].Latency; h.Count != 1 {
+		t.Errorf("got %d observations of ++addr; want 1", h.Count)
+	}
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("got content type %s", ct)
+	}
+	body := rec.Body.String()
+	for _, line := range []string{
+		"# TYPE prologix_queries_total counter",
+		`prologix_queries_total{address="5"} 2`,
+		`prologix_timeouts_total{address="5"} 1`,
+		`prologix_bytes_written_total{address="5"} 10`,
+		"# TYPE prologix_query_duration_seconds histogram",
+		`prologix_query_duration_seconds_bucket{address="5",le="+Inf"} 2`,
+		`prologix_query_duration_seconds_count{address="5"} 2`,
+		`prologix_controller_command_duration_seconds_count{command="ver"} 1`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("metrics missing line %q", line)
+		}
+	}
+}
+
+func TestMetricsControllerCommandNames(t *testing.T) {
+	conn := sim.NewAdapter().Dial()
+	defer conn.Close()
+	m := NewMetrics()
+	gpib, err := NewController(conn, 5, false, WithMetrics(m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cmd := range []string{"ADDR\t7", "read_tmo_ms 200", "foo 1", "bar\"\n"} {
+		if err := gpib.CommandController(cmd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := m.Snapshot()
+	for name, count := range map[string]uint64{"addr": 2, "read_tmo_ms": 2, "other": 2} {
+		if got := s.ControllerCommands[name].Latency.Count; got != count {
+			t.Errorf("got %d observations of %s; want %d", got, name, count)
+		}
+	}
+	if len(s.ControllerCommands) != 10 {
+		t.Errorf("got controller commands %v; want those sent by NewController and other", sortedKeys(s.ControllerCommands))
+	}
+}
+
+func TestLabelValue(t *testing.T) {
+	for s, want := range map[string]string{
+		"5 96":         `"5 96"`,
+		`a\b"c` + "\n": `"a\\b\"c\n"`,
+		"\t\x00é":      "\"\t\x00é\"",
+	} {
+		if got := labelValue(s); got != want {
+			t.Errorf("labelValue(%q) = %s; want %s", s, got, want)
+		}
+	}
+}
+
+func TestHistogramBuckets(t *testing.T) {
+	bounds := []float64{0.01, 0.1, 1}
+	var h histogram
+	for _, d := range []time.Duration{
+		5 * time.Millisecond,
+		10 * time.Millisecond,
+		50 * time.Millisecond,
+		2 * time.Second,
+	} {
+		h.observe(bounds, d)
+	}
+	s := h.snapshot(bounds)
+	want := []uint64{2, 3, 3}
+	for i := range want {
+		if s.Counts[i] != want[i] {
+			t.Errorf("got cumulative counts %v; want %v", s.Counts, want)
+			break
+		}
+	}
+	if s.Count != 4 {
+		t.Errorf("got count %d; want 4", s.Count)
+	}
+}
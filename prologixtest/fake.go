@@ -0,0 +1,525 @@
+// Copyright (c) 2020–2024 The prologix developers. All rights reserved.
+// Project site: https://github.com/gotmc/prologix
+// Use of this source code is governed by a MIT-style license that
+// can be found in the LICENSE.txt file for the project.
+
+/*
+Package prologixtest provides a scriptable fake Prologix GPIB controller for
+testing code that depends on the interfaces defined by the prologix package.
+
+A test sets expectations on the instrument traffic, exercises the code under
+test, and the fake verifies when the test ends that every expectation was met:
+
+	func TestPowerOn(t *testing.T) {
+		gpib := prologixtest.New(t)
+		gpib.Expect("OUTP ON")
+		gpib.Expect("OUTP:STAT?").Reply("1")
+		if err := powerOn(gpib); err != nil {
+			t.Fatal(err)
+		}
+	}
+*/
+package prologixtest
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gotmc/prologix"
+)
+
+// Verify that Fake implements the prologix.GPIB interface.
+var _ prologix.GPIB = (*Fake)(nil)
+
+// Call records one method call made on the fake.
+type Call struct {
+	// Method is the name of the method called, such as Query or ClearDevice.
+	Method string
+	// Payload is the data, command, or argument passed to the method.
+	Payload string
+	// Response is the response returned by the method, if any.
+	Response string
+	// Err is the error returned by the method.
+	Err error
+}
+
+func (c Call) String() string {
+	if c.Payload == "" {
+		return c.Method + "()"
+	}
+	return fmt.Sprintf("%s(%q)", c.Method, c.Payload)
+}
+
+// Expectation is an expected command sent to the instrument using Write,
+// WriteString, Command, or Query.
+type Expectation struct {
+	cmd   string
+	reply string
+	err   error
+	times int
+	calls int
+}
+
+// Reply sets the response returned by Query, or made available to Read when
+// the command is written, when the expectation is met.
+func (e *Expectation) Reply(resp string) *Expectation {
+	e.reply = resp
+	return e
+}
+
+// ReturnError sets the error returned when the expectation is met.
+func (e *Expectation) ReturnError(err error) *Expectation {
+	e.err = err
+	return e
+}
+
+// Times sets the number of times the command is expected, which defaults to
+// one.
+func (e *Expectation) Times(n int) *Expectation {
+	e.times = n
+	return e
+}
+
+func (e *Expectation) String() string {
+	return fmt.Sprintf("%q (called %d of %d times)", e.cmd, e.calls, e.times)
+}
+
+// Fake is a scriptable fake Prologix GPIB controller implementing the
+// prologix.GPIB interface. Instrument traffic is checked against the
+// expectations in the order they were set, and all calls are recorded. The
+// controller configuration is kept in memory so that setters and getters are
+// consistent. A Fake is safe for concurrent use.
+type Fake struct {
+	t testing.TB
+
+	mu           sync.Mutex
+	expectations []*Expectation
+	calls        []Call
+	readBuf      bytes.Buffer
+	lenient      bool
+	failures     map[string]error
+
+	addr    int
+	auto    bool
+	eoi     bool
+	term    prologix.GpibTerm
+	timeout int
+	version string
+	srq     bool
+	stb     byte
+}
+
+// New creates a fake controller that reports failures to t and verifies the
+// expectations when the test and all its subtests complete.
+func New(t testing.TB) *Fake {
+	f := Fake{
+		t:        t,
+		failures: make(map[string]error),
+		eoi:      true,
+		timeout:  500,
+		version:  "Prologix GPIB-USB Controller version 6.107",
+	}
+	t.Cleanup(f.Verify)
+	return &f
+}
+
+// Expect adds an expectation that the command is sent to the instrument. The
+// command is compared case-insensitively after removing surrounding
+// whitespace.
+func (f *Fake) Expect(cmd string) *Expectation {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	e := Expectation{cmd: normalize(cmd), times: 1}
+	f.expectations = append(f.expectations, &e)
+	return &e
+}
+
+// AllowUnexpected stops the fake from failing the test when instrument
+// traffic doesn't match an expectation. Unmatched queries return an empty
+// response.
+func (f *Fake) AllowUnexpected() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.lenient = true
+}
+
+// FailWith makes the next call to the named method, such as ClearDevice or
+// Query, return the error.
+func (f *Fake) FailWith(method string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failures[method] = err
+}
+
+// SetServiceRequest sets whether the fake reports SRQ as asserted.
+func (f *Fake) SetServiceRequest(asserted bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.srq = asserted
+}
+
+// SetStatusByte sets the status byte returned by SerialPoll.
+func (f *Fake) SetStatusByte(stb byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.stb = stb
+}
+
+// SetVersion sets the version string returned by Version.
+func (f *Fake) SetVersion(version string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.version = version
+}
+
+// Calls returns the calls made on the fake in order.
+func (f *Fake) Calls() []Call {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]Call(nil), f.calls...)
+}
+
+// Called returns the number of calls made to the named method.
+func (f *Fake) Called(method string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for _, c := range f.calls {
+		if c.Method == method {
+			n++
+		}
+	}
+	return n
+}
+
+// Verify reports an error for each expectation that hasn't been met. It is
+// called automatically when the test completes.
+func (f *Fake) Verify() {
+	f.t.Helper()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, e := range f.expectations {
+		if e.calls < e.times {
+			f.t.Errorf("prologixtest: unmet expectation %s", e)
+		}
+	}
+}
+
+// Write implements the io.Writer interface.
+func (f *Fake) Write(p []byte) (int, error) {
+	_, err := f.send("Write", string(p), true)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// WriteString implements the prologix.InstrumentIO interface.
+func (f *Fake) WriteString(s string) (int, error) {
+	_, err := f.send("WriteString", s, true)
+	if err != nil {
+		return 0, err
+	}
+	return len(s), nil
+}
+
+// Command implements the prologix.InstrumentIO interface.
+func (f *Fake) Command(format string, a ...any) error {
+	cmd := format
+	if a != nil {
+		cmd = fmt.Sprintf(format, a...)
+	}
+	_, err := f.send("Command", cmd, false)
+	return err
+}
+
+// Query implements the prologix.InstrumentIO interface.
+func (f *Fake) Query(cmd string) (string, error) {
+	return f.send("Query", cmd, false)
+}
+
+// Read implements the io.Reader interface, returning the replies to commands
+// previously written with Write or WriteString.
+func (f *Fake) Read(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.failure("Read"); err != nil {
+		f.record(Call{Method: "Read", Err: err})
+		return 0, err
+	}
+	n, err := f.readBuf.Read(p)
+	f.record(Call{Method: "Read", Response: string(p[:n]), Err: err})
+	return n, err
+}
+
+// send matches the instrument traffic against the expectations. When buffer
+// is set, the reply is made available to Read instead of being returned.
+func (f *Fake) send(method, cmd string, buffer bool) (string, error) {
+	f.t.Helper()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	call := Call{Method: method, Payload: cmd}
+	if err := f.failure(method); err != nil {
+		call.Err = err
+		f.record(call)
+		return "", err
+	}
+	e := f.match(normalize(cmd))
+	if e == nil {
+		if !f.lenient {
+			f.t.Errorf("prologixtest: unexpected %s", call)
+		}
+		f.record(call)
+		return "", nil
+	}
+	e.calls++
+	call.Err = e.err
+	if e.err == nil {
+		if buffer {
+			f.readBuf.WriteString(e.reply)
+		} else {
+			call.Response = e.reply
+		}
+	}
+	f.record(call)
+	return call.Response, call.Err
+}
+
+// match returns the first unsatisfied expectation for the command, provided
+// all earlier expectations have been met.
+func (f *Fake) match(cmd string) *Expectation {
+	for _, e := range f.expectations {
+		if e.calls >= e.times {
+			continue
+		}
+		if e.cmd == cmd {
+			return e
+		}
+		if !f.lenient {
+			return nil
+		}
+	}
+	return nil
+}
+
+// failure returns and clears the error set with FailWith for the method. The
+// lock must be held.
+func (f *Fake) failure(method string) error {
+	err := f.failures[method]
+	delete(f.failures, method)
+	return err
+}
+
+// record appends the call to the call log. The lock must be held.
+func (f *Fake) record(c Call) {
+	f.calls = append(f.calls, c)
+}
+
+// do records a call to a method that doesn't send instrument traffic and runs
+// fn unless a failure was set for the method.
+func (f *Fake) do(method, payload string, fn func() string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	call := Call{Method: method, Payload: payload}
+	if err := f.failure(method); err != nil {
+		call.Err = err
+		f.record(call)
+		return "", err
+	}
+	if fn != nil {
+		call.Response = fn()
+	}
+	f.record(call)
+	return call.Response, nil
+}
+
+// ClearDevice implements the prologix.BusController interface.
+func (f *Fake) ClearDevice() error {
+	_, err := f.do("ClearDevice", "", func() string {
+		f.readBuf.Reset()
+		return ""
+	})
+	return err
+}
+
+// ClearInterface implements the prologix.BusController interface.
+func (f *Fake) ClearInterface() error {
+	_, err := f.do("ClearInterface", "", nil)
+	return err
+}
+
+// FrontPanel implements the prologix.BusController interface.
+func (f *Fake) FrontPanel(enable bool) error {
+	_, err := f.do("FrontPanel", fmt.Sprint(enable), nil)
+	return err
+}
+
+// SerialPoll implements the prologix.BusController interface.
+func (f *Fake) SerialPoll() (byte, error) {
+	var stb byte
+	_, err := f.do("SerialPoll", "", func() string {
+		stb = f.stb
+		return fmt.Sprint(stb)
+	})
+	return stb, err
+}
+
+// Trigger implements the prologix.BusController interface.
+func (f *Fake) Trigger() error {
+	_, err := f.do("Trigger", "", nil)
+	return err
+}
+
+// AssertEOI implements the prologix.ControllerConfigurer interface.
+func (f *Fake) AssertEOI() (bool, error) {
+	var eoi bool
+	_, err := f.do("AssertEOI", "", func() string {
+		eoi = f.eoi
+		return fmt.Sprint(eoi)
+	})
+	return eoi, err
+}
+
+// SetAssertEOI implements the prologix.ControllerConfigurer interface.
+func (f *Fake) SetAssertEOI(enable bool) error {
+	_, err := f.do("SetAssertEOI", fmt.Sprint(enable), func() string {
+		f.eoi = enable
+		return ""
+	})
+	return err
+}
+
+// GPIBTermination implements the prologix.ControllerConfigurer interface.
+func (f *Fake) GPIBTermination() (prologix.GpibTerm, error) {
+	var term prologix.GpibTerm
+	_, err := f.do("GPIBTermination", "", func() string {
+		term = f.term
+		return fmt.Sprint(int(term))
+	})
+	return term, err
+}
+
+// SetGPIBTermination implements the prologix.ControllerConfigurer interface.
+func (f *Fake) SetGPIBTermination(term prologix.GpibTerm) error {
+	_, err := f.do("SetGPIBTermination", fmt.Sprint(int(term)), func() string {
+		f.term = term
+		return ""
+	})
+	return err
+}
+
+// InstrumentAddress implements the prologix.ControllerConfigurer interface.
+func (f *Fake) InstrumentAddress() (int, error) {
+	var addr int
+	_, err := f.do("InstrumentAddress", "", func() string {
+		addr = f.addr
+		return fmt.Sprint(addr)
+	})
+	return addr, err
+}
+
+// SetInstrumentAddress implements the prologix.ControllerConfigurer
+// interface.
+func (f *Fake) SetInstrumentAddress(addr int) error {
+	_, err := f.do("SetInstrumentAddress", fmt.Sprint(addr), func() string {
+		f.addr = addr
+		return ""
+	})
+	return err
+}
+
+// ReadAfterWrite implements the prologix.ControllerConfigurer interface.
+func (f *Fake) ReadAfterWrite() (bool, error) {
+	var auto bool
+	_, err := f.do("ReadAfterWrite", "", func() string {
+		auto = f.auto
+		return fmt.Sprint(auto)
+	})
+	return auto, err
+}
+
+// SetReadAfterWrite implements the prologix.ControllerConfigurer interface.
+func (f *Fake) SetReadAfterWrite(enable bool) error {
+	_, err := f.do("SetReadAfterWrite", fmt.Sprint(enable), func() string {
+		f.auto = enable
+		return ""
+	})
+	return err
+}
+
+// ReadTimeout implements the prologix.ControllerConfigurer interface.
+func (f *Fake) ReadTimeout() (int, error) {
+	var timeout int
+	_, err := f.do("ReadTimeout", "", func() string {
+		timeout = f.timeout
+		return fmt.Sprint(timeout)
+	})
+	return timeout, err
+}
+
+// SetReadTimeout implements the prologix.ControllerConfigurer interface.
+func (f *Fake) SetReadTimeout(timeout int) error {
+	if timeout < 1 || timeout > 3000 {
+		return fmt.Errorf("read timeout outside 1 to 3000 ms; attempted to set to %d", timeout)
+	}
+	_, err := f.do("SetReadTimeout", fmt.Sprint(timeout), func() string {
+		f.timeout = timeout
+		return ""
+	})
+	return err
+}
+
+// CommandController implements the prologix.ControllerConfigurer interface.
+func (f *Fake) CommandController(cmd string) error {
+	_, err := f.do("CommandController", strings.TrimSpace(cmd), nil)
+	return err
+}
+
+// QueryController implements the prologix.ControllerConfigurer interface. The
+// `ver` and `srq` commands are answered from the fake's state, and other
+// commands return an empty response.
+func (f *Fake) QueryController(cmd string) (string, error) {
+	cmd = strings.ToLower(strings.TrimSpace(cmd))
+	return f.do("QueryController", cmd, func() string {
+		switch cmd {
+		case "ver":
+			return f.version + "\n"
+		case "srq":
+			if f.srq {
+				return "1\n"
+			}
+			return "0\n"
+		}
+		return ""
+	})
+}
+
+// Reset implements the prologix.ControllerConfigurer interface.
+func (f *Fake) Reset() error {
+	_, err := f.do("Reset", "", nil)
+	return err
+}
+
+// Version implements the prologix.StatusReporter interface.
+func (f *Fake) Version() (string, error) {
+	return f.do("Version", "", func() string {
+		return f.version + "\n"
+	})
+}
+
+// ServiceRequest implements the prologix.StatusReporter interface.
+func (f *Fake) ServiceRequest() (bool, error) {
+	var srq bool
+	_, err := f.do("ServiceRequest", "", func() string {
+		srq = f.srq
+		return fmt.Sprint(srq)
+	})
+	return srq, err
+}
+
+func normalize(cmd string) string {
+	return strings.ToUpper(strings.TrimSpace(cmd))
+}
@@ -0,0 +1,91 @@
+// Copyright (c) 2020–2024 The prologix developers. All rights reserved.
+// Project site: https://github.com/gotmc/prologix
+// Use of this source code is governed by a MIT-style license that
+// can be found in the LICENSE.txt file for the project.
+
+package prologixtest
+
+import (
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/gotmc/prologix"
+)
+
+// setVoltage is an example of code under test depending on the prologix
+// interfaces instead of *prologix.Controller.
+func setVoltage(gpib prologix.InstrumentIO, v float64) (string, error) {
+	if err := gpib.Command("VOLT %.2f", v); err != nil {
+		return "", err
+	}
+	return gpib.Query("VOLT?")
+}
+
+func TestExpectations(t *testing.T) {
+	f := New(t)
+	f.Expect("volt 4.10")
+	f.Expect("VOLT?").Reply("+4.10000E+00\n")
+	got, err := setVoltage(f, 4.1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "+4.10000E+00\n" {
+		t.Errorf("got %q; want %q", got, "+4.10000E+00\n")
+	}
+	if n := f.Called("Query"); n != 1 {
+		t.Errorf("got %d queries; want 1", n)
+	}
+}
+
+func TestWriteThenRead(t *testing.T) {
+	f := New(t)
+	f.Expect("*IDN?").Reply("FAKE,1,2,3\n")
+	if _, err := f.WriteString("*IDN?\n"); err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "FAKE,1,2,3\n" {
+		t.Errorf("got %q; want %q", b, "FAKE,1,2,3\n")
+	}
+}
+
+func TestErrors(t *testing.T) {
+	errBus := errors.New("bus error")
+	f := New(t)
+	f.Expect("*RST").ReturnError(errBus)
+	if err := f.Command("*RST"); !errors.Is(err, errBus) {
+		t.Errorf("got error %v; want %v", err, errBus)
+	}
+	f.FailWith("ClearDevice", errBus)
+	if err := f.ClearDevice(); !errors.Is(err, errBus) {
+		t.Errorf("got error %v; want %v", err, errBus)
+	}
+	if err := f.ClearDevice(); err != nil {
+		t.Errorf("failure not cleared after the first call: %v", err)
+	}
+}
+
+func TestControllerState(t *testing.T) {
+	f := New(t)
+	if err := f.SetInstrumentAddress(7); err != nil {
+		t.Fatal(err)
+	}
+	if addr, _ := f.InstrumentAddress(); addr != 7 {
+		t.Errorf("got address %d; want 7", addr)
+	}
+	if err := f.SetReadTimeout(5000); err == nil {
+		t.Error("expected error setting read timeout outside 1 to 3000 ms")
+	}
+	f.SetStatusByte(0x50)
+	if stb, _ := f.SerialPoll(); stb != 0x50 {
+		t.Errorf("got status byte %#x; want 0x50", stb)
+	}
+	f.SetServiceRequest(true)
+	if srq, _ := f.ServiceRequest(); !srq {
+		t.Error("SRQ not reported as asserted")
+	}
+}
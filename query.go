@@ -0,0 +1,223 @@
+// Copyright (c) 2020–2024 The prologix developers. All rights reserved.
+// Project site: https://github.com/gotmc/prologix
+// Use of this source code is governed by a MIT-style license that
+// can be found in the LICENSE.txt file for the project.
+
+package prologix
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Querier is implemented by the Controller and Instrument, which return the
+// response to a query.
+type Querier interface {
+	Query(cmd string) (string, error)
+}
+
+// SCPI represents an overrange measurement by 9.9E37, or -9.9E37 for a
+// negative one, and a measurement that isn't a number by 9.91E37.
+const (
+	scpiInfinity = 9.9e37
+	scpiNaN      = 9.91e37
+)
+
+// QueryFloat64 queries with the given command and parses the response as a
+// decimal number in the NR1, NR2, or NR3 format, ignoring a trailing unit,
+// such as the `VDC` of `+1.2345E+00VDC`. The SCPI values representing an
+// overrange, 9.9E37 and -9.9E37, are returned as positive and negative
+// infinity, and the value representing not a number, 9.91E37, is returned as
+// NaN.
+func QueryFloat64(q Querier, cmd string) (float64, error) {
+	s, err := q.Query(cmd)
+	if err != nil {
+		return 0, err
+	}
+	v, err := parseNumber(s)
+	if err != nil {
+		return 0, fmt.Errorf("number not determinable from response to %s; received %q", cmd, s)
+	}
+	return v, nil
+}
+
+// QueryFloat64s queries with the given command and parses the response as a
+// comma separated list of numbers, each parsed as by QueryFloat64. An empty
+// response returns an empty list.
+func QueryFloat64s(q Querier, cmd string) ([]float64, error) {
+	s, err := q.Query(cmd)
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(s) == "" {
+		return []float64{}, nil
+	}
+	fields := strings.Split(s, ",")
+	vals := make([]float64, len(fields))
+	for i, f := range fields {
+		v, err := parseNumber(f)
+		if err != nil {
+			return nil, fmt.Errorf(
+				"number %d not determinable from response to %s; received %q", i+1, cmd, s,
+			)
+		}
+		vals[i] = v
+	}
+	return vals, nil
+}
+
+// QueryInt queries with the given command and parses the response as an
+// integer. Besides the NR1 format, numbers in the NR2 or NR3 format without a
+// fractional part, such as `+1.00000000E+01`, and the SCPI non-decimal formats
+// `#H`, `#Q`, and `#B` are accepted.
+func QueryInt(q Querier, cmd string) (int, error) {
+	s, err := q.Query(cmd)
+	if err != nil {
+		return 0, err
+	}
+	v, err := parseInt(s)
+	if err != nil {
+		return 0, fmt.Errorf("integer not determinable from response to %s; received %q", cmd, s)
+	}
+	return v, nil
+}
+
+// QueryBool queries with the given command and parses the response as a
+// boolean, which is either `1` or `ON` for true and `0` or `OFF` for false,
+// ignoring case.
+func QueryBool(q Querier, cmd string) (bool, error) {
+	s, err := q.Query(cmd)
+	if err != nil {
+		return false, err
+	}
+	switch strings.ToUpper(strings.TrimSpace(s)) {
+	case "ON", "1", "+1":
+		return true, nil
+	case "OFF", "0", "+0":
+		return false, nil
+	}
+	return false, fmt.Errorf("boolean not determinable from response to %s; received %q", cmd, s)
+}
+
+// QueryEnum queries with the given command and returns the one of the given
+// values matching the response. A value written in the SCPI mixed case form,
+// such as `SINusoid`, matches either its short form `SIN` or its long form,
+// ignoring case.
+func QueryEnum(q Querier, cmd string, values ...string) (string, error) {
+	s, err := q.Query(cmd)
+	if err != nil {
+		return "", err
+	}
+	resp := strings.Trim(strings.TrimSpace(s), `"`)
+	for _, v := range values {
+		if strings.EqualFold(resp, v) || strings.EqualFold(resp, shortForm(v)) {
+			return v, nil
+		}
+	}
+	return "", fmt.Errorf(
+		"response to %s not one of %s; received %q", cmd, strings.Join(values, ", "), s,
+	)
+}
+
+// shortForm returns the upper case letters and digits of a SCPI mnemonic
+// written in the mixed case form.
+func shortForm(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if r < 'a' || r > 'z' {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// parseNumber parses a decimal number in the NR1, NR2, or NR3 format followed
+// by an optional unit, mapping the SCPI overrange and not a number values.
+func parseNumber(s string) (float64, error) {
+	num, unit := splitUnit(strings.TrimSpace(s))
+	if num == "" || !isUnit(unit) {
+		return 0, fmt.Errorf("invalid number %q", s)
+	}
+	v, err := strconv.ParseFloat(num, 64)
+	if err != nil {
+		return 0, err
+	}
+	switch v {
+	case scpiInfinity:
+		return math.Inf(1), nil
+	case -scpiInfinity:
+		return math.Inf(-1), nil
+	case scpiNaN, -scpiNaN:
+		return math.NaN(), nil
+	}
+	return v, nil
+}
+
+// parseInt parses an integer in a decimal or SCPI non-decimal format.
+func parseInt(s string) (int, error) {
+	s = strings.TrimSpace(s)
+	if len(s) > 2 && s[0] == '#' {
+		base := map[byte]int{'H': 16, 'Q': 8, 'B': 2}[s[1]&^0x20]
+		if base == 0 {
+			return 0, fmt.Errorf("invalid non-decimal number %q", s)
+		}
+		v, err := strconv.ParseInt(s[2:], base, 0)
+		return int(v), err
+	}
+	v, err := parseNumber(s)
+	if err != nil {
+		return 0, err
+	}
+	if v != math.Trunc(v) || math.IsInf(v, 0) || math.IsNaN(v) ||
+		v > math.MaxInt || v < math.MinInt {
+		return 0, fmt.Errorf("not an integer %q", s)
+	}
+	return int(v), nil
+}
+
+// splitUnit splits a string into the leading number and the trailing unit.
+func splitUnit(s string) (num, unit string) {
+	i := 0
+	if i < len(s) && (s[i] == '+' || s[i] == '-') {
+		i++
+	}
+	digits := 0
+	for ; i < len(s) && (isDigit(s[i]) || s[i] == '.'); i++ {
+		if isDigit(s[i]) {
+			digits++
+		}
+	}
+	if digits == 0 {
+		return "", s
+	}
+	// An exponent is only part of the number if followed by digits, so that
+	// units starting with E aren't mistaken for one.
+	if i < len(s) && (s[i] == 'e' || s[i] == 'E') {
+		j := i + 1
+		if j < len(s) && (s[j] == '+' || s[j] == '-') {
+			j++
+		}
+		if j < len(s) && isDigit(s[j]) {
+			for i = j; i < len(s) && isDigit(s[i]); i++ {
+			}
+		}
+	}
+	return s[:i], strings.TrimSpace(s[i:])
+}
+
+// isUnit reports whether the string is empty or a plausible unit, such as
+// `VDC`, `OHM`, or `%`.
+func isUnit(s string) bool {
+	for _, r := range s {
+		if !(r >= 'A' && r <= 'Z' || r >= 'a' && r <= 'z' || r == '%' || r == '/') {
+			return false
+		}
+	}
+	return true
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
@@ -0,0 +1,168 @@
+// Copyright (c) 2020–2024 The prologix developers. All rights reserved.
+// Project site: https://github.com/gotmc/prologix
+// Use of this source code is governed by a MIT-style license that
+// can be found in the LICENSE.txt file for the project.
+
+package prologix
+
+import (
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// response is a Querier returning itself as the response to every query.
+type response string
+
+func (r response) Query(cmd string) (string, error) {
+	return string(r), nil
+}
+
+func TestQueryFloat64(t *testing.T) {
+	testCases := []struct {
+		given string
+		want  float64
+	}{
+		{"42\n", 42},
+		{"-0.125", -0.125},
+		{"+1.23450000E+01\n", 12.345},
+		{"1e-3", 0.001},
+		{".5", 0.5},
+		{"+1.2345E+00VDC", 1.2345},
+		{"12.5 OHM", 12.5},
+		{"-3.2E+00 EV", -3.2},
+		{"99.5%", 99.5},
+		{"+9.90000000E+37", math.Inf(1)},
+		{"-9.9E37", math.Inf(-1)},
+	}
+	for _, tc := range testCases {
+		got, err := QueryFloat64(response(tc.given), "MEAS?")
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", tc.given, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("%q: got %g; want %g", tc.given, got, tc.want)
+		}
+	}
+	if got, err := QueryFloat64(response("+9.91000000E+37"), "MEAS?"); err != nil || !math.IsNaN(got) {
+		t.Errorf("9.91E37: got %g (%v); want NaN", got, err)
+	}
+	for _, given := range []string{"", "VDC", "1.2.3", "1,2", "0x10", "12 O-HM"} {
+		_, err := QueryFloat64(response(given), "MEAS?")
+		if err == nil {
+			t.Errorf("%q: got no error; want error", given)
+		} else if !strings.Contains(err.Error(), "MEAS?") || !strings.Contains(err.Error(), given) {
+			t.Errorf("%q: error %q doesn't contain the query and raw response", given, err)
+		}
+	}
+}
+
+func TestQueryFloat64s(t *testing.T) {
+	testCases := []struct {
+		given string
+		want  []float64
+	}{
+		{"", []float64{}},
+		{"+1.0E+00", []float64{1}},
+		{"+6.000000E+00,+1.000000E+00\n", []float64{6, 1}},
+		{"1 VDC, -2.5 VDC, 9.9E37", []float64{1, -2.5, math.Inf(1)}},
+	}
+	for _, tc := range testCases {
+		got, err := QueryFloat64s(response(tc.given), "APPL?")
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", tc.given, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%q: got %v; want %v", tc.given, got, tc.want)
+		}
+	}
+	if _, err := QueryFloat64s(response("1,,3"), "APPL?"); err == nil {
+		t.Errorf("got no error for missing value; want error")
+	}
+}
+
+func TestQueryInt(t *testing.T) {
+	testCases := []struct {
+		given string
+		want  int
+	}{
+		{"+40\n", 40},
+		{"-7", -7},
+		{"+1.00000000E+01", 10},
+		{"2.0", 2},
+		{"#H1F", 31},
+		{"#q17", 15},
+		{"#B101", 5},
+	}
+	for _, tc := range testCases {
+		got, err := QueryInt(response(tc.given), "BURS:NCYC?")
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", tc.given, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("%q: got %d; want %d", tc.given, got, tc.want)
+		}
+	}
+	for _, given := range []string{"1.5", "9.9E37", "9.91E37", "#X12", "ON"} {
+		if _, err := QueryInt(response(given), "BURS:NCYC?"); err == nil {
+			t.Errorf("%q: got no error; want error", given)
+		}
+	}
+}
+
+func TestQueryBool(t *testing.T) {
+	testCases := []struct {
+		given string
+		want  bool
+	}{
+		{"1\n", true},
+		{"0", false},
+		{"ON", true},
+		{"off", false},
+		{"+1", true},
+	}
+	for _, tc := range testCases {
+		got, err := QueryBool(response(tc.given), "OUTP?")
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", tc.given, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("%q: got %t; want %t", tc.given, got, tc.want)
+		}
+	}
+	if _, err := QueryBool(response("2"), "OUTP?"); err == nil {
+		t.Errorf("got no error for 2; want error")
+	}
+}
+
+func TestQueryEnum(t *testing.T) {
+	values := []string{"SINusoid", "SQUare", "RAMP", "DC"}
+	testCases := []struct {
+		given string
+		want  string
+	}{
+		{"SIN\n", "SINusoid"},
+		{"sinusoid", "SINusoid"},
+		{"SQU", "SQUare"},
+		{"RAMP", "RAMP"},
+		{`"DC"`, "DC"},
+	}
+	for _, tc := range testCases {
+		got, err := QueryEnum(response(tc.given), "FUNC?", values...)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", tc.given, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("%q: got %s; want %s", tc.given, got, tc.want)
+		}
+	}
+	if _, err := QueryEnum(response("SINU"), "FUNC?", values...); err == nil {
+		t.Errorf("got no error for SINU; want error")
+	}
+}
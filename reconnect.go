@@ -0,0 +1,444 @@
+// Copyright (c) 2020–2024 The prologix developers. All rights reserved.
+// Project site: https://github.com/gotmc/prologix
+// Use of this source code is governed by a MIT-style license that
+// can be found in the LICENSE.txt file for the project.
+
+package prologix
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrDisconnected is returned, wrapped with the last error, by the calls to a
+// Reconnector that has given up reconnecting.
+var ErrDisconnected = errors.New("disconnected from Prologix adapter")
+
+// ErrReconnected is returned, wrapped with the error that caused the
+// reconnect, by a Read that failed because the connection was lost. The
+// response being read is lost, so the query must be repeated.
+var ErrReconnected = errors.New("reconnected to Prologix adapter")
+
+// replayedCommands lists the `++` commands changing the configuration of the
+// Prologix controller, which a Reconnector replays after reconnecting. The
+// `savecfg` command is recorded separately, since it must be replayed last.
+var replayedCommands = map[string]bool{
+	"mode":        true,
+	"addr":        true,
+	"auto":        true,
+	"eoi":         true,
+	"eos":         true,
+	"eot_enable":  true,
+	"eot_char":    true,
+	"read_tmo_ms": true,
+	"lon":         true,
+	"status":      true,
+}
+
+// Dialer opens a connection to a Prologix adapter, such as by finding the
+// serial port of a GPIB-USB controller by its USB serial number or by
+// connecting to the host of a GPIB-ETHERNET controller, as done by the
+// dialers returned by vcp.Dialer and ethernet.Dialer.
+type Dialer func() (io.ReadWriteCloser, error)
+
+// ReconnectEvent reports a change in the connection of a Reconnector.
+type ReconnectEvent struct {
+	// Attempt is the number of the reconnect attempt, starting at 1, or zero
+	// when the loss of the connection is detected.
+	Attempt int
+	// Err is the error that showed the connection was lost or that made the
+	// reconnect attempt fail, or nil once reconnected.
+	Err error
+	// Reconnected reports that the connection was reestablished and the
+	// configuration replayed.
+	Reconnected bool
+	// GaveUp reports that all reconnect attempts failed, so calls fail fast
+	// until Reconnect succeeds.
+	GaveUp bool
+}
+
+func (e ReconnectEvent) String() string {
+	switch {
+	case e.Reconnected:
+		return fmt.Sprintf("reconnected after %d attempts", e.Attempt)
+	case e.GaveUp:
+		return fmt.Sprintf("gave up reconnecting after %d attempts: %s", e.Attempt, e.Err)
+	case e.Attempt == 0:
+		return fmt.Sprintf("connection lost: %s", e.Err)
+	}
+	return fmt.Sprintf("reconnect attempt %d failed: %s", e.Attempt, e.Err)
+}
+
+// Reconnector is a connection to a Prologix adapter that reopens the adapter
+// when the connection fails, such as when the GPIB-USB controller is
+// unplugged or the link to the GPIB-ETHERNET controller drops. It's used in
+// place of the io.ReadWriter provided by a Prologix driver when creating a
+// Controller.
+//
+// The Reconnector records the `++` commands configuring the Prologix
+// controller, including the instrument address, and replays them after
+// reconnecting. Saving the configuration in the EPROM of the controller is
+// disabled while replaying, and the recorded `++savecfg` setting is restored
+// last. A failed Write is retried once reconnected, while a failed
+// Read returns an error wrapping ErrReconnected, since the response is lost.
+// Timeouts aren't treated as failures. Instruments with a pinned identity are
+// identified again after a reconnect.
+type Reconnector struct {
+	mu     sync.Mutex
+	dial   Dialer
+	conn   io.ReadWriteCloser
+	config []string
+	// savecfg is the last `++savecfg` command, which is replayed after the
+	// other commands so that replaying them doesn't rewrite the EPROM of the
+	// Prologix controller.
+	savecfg     string
+	deadline    time.Time
+	minBackoff  time.Duration
+	maxBackoff  time.Duration
+	maxAttempts int
+	onEvent     func(ReconnectEvent)
+	down        error
+	closed      bool
+	generation  uint64
+	// closing is closed by Close, stopping a redial waiting to retry.
+	closing chan struct{}
+	// redialing is closed once the redial in progress, if any, is done.
+	redialing chan struct{}
+}
+
+// ReconnectOption applies an option to the Reconnector.
+type ReconnectOption func(*Reconnector)
+
+// NewReconnector opens a connection to the Prologix adapter using the
+// dialer. Optionally the reconnect behavior can be configured using a
+// ReconnectOption.
+func NewReconnector(dial Dialer, opts ...ReconnectOption) (*Reconnector, error) {
+	r := Reconnector{
+		dial:        dial,
+		minBackoff:  100 * time.Millisecond,
+		maxBackoff:  5 * time.Second,
+		maxAttempts: 10,
+		closing:     make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(&r)
+	}
+	if r.minBackoff <= 0 || r.maxBackoff < r.minBackoff {
+		return nil, fmt.Errorf("invalid backoff %s to %s", r.minBackoff, r.maxBackoff)
+	}
+	if r.maxAttempts < 1 {
+		return nil, fmt.Errorf("invalid reconnect attempts %d (must be at least 1)", r.maxAttempts)
+	}
+	conn, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	r.conn = conn
+	return &r, nil
+}
+
+// WithBackoff sets the delay before the first reconnect attempt, which
+// doubles after each failed attempt up to the maximum. The delay defaults to
+// 100 ms with a maximum of 5 s.
+func WithBackoff(initial, max time.Duration) ReconnectOption {
+	return func(r *Reconnector) {
+		r.minBackoff = initial
+		r.maxBackoff = max
+	}
+}
+
+// WithReconnectAttempts sets the number of reconnect attempts, which defaults
+// to 10. Once they have all failed, calls fail fast with an error wrapping
+// ErrDisconnected until Reconnect succeeds.
+func WithReconnectAttempts(n int) ReconnectOption {
+	return func(r *Reconnector) {
+		r.maxAttempts = n
+	}
+}
+
+// WithReconnectHandler sets the function called with each reconnect event.
+// The function is called while the Reconnector is locked, so it must not use
+// the Reconnector.
+func WithReconnectHandler(fn func(ReconnectEvent)) ReconnectOption {
+	return func(r *Reconnector) {
+		r.onEvent = fn
+	}
+}
+
+// Write writes the data to the adapter, reconnecting and retrying once if the
+// connection has failed.
+func (r *Reconnector) Write(p []byte) (int, error) {
+	conn, err := r.connection()
+	if err != nil {
+		return 0, err
+	}
+	r.record(p)
+	n, err := conn.Write(p)
+	if err == nil || isTimeout(err) {
+		return n, err
+	}
+	if err := r.reconnect(conn, err); err != nil {
+		return 0, err
+	}
+	if conn, err = r.connection(); err != nil {
+		return 0, err
+	}
+	return conn.Write(p)
+}
+
+// Read reads from the adapter. If the connection has failed, the adapter is
+// reconnected and an error wrapping ErrReconnected is returned.
+func (r *Reconnector) Read(p []byte) (int, error) {
+	conn, err := r.connection()
+	if err != nil {
+		return 0, err
+	}
+	n, err := conn.Read(p)
+	if err == nil || n > 0 || isTimeout(err) {
+		return n, err
+	}
+	if rerr := r.reconnect(conn, err); rerr != nil {
+		return 0, rerr
+	}
+	return 0, fmt.Errorf("%w: %s", ErrReconnected, err)
+}
+
+// SetReadDeadline sets the read deadline of the connection, if supported, and
+// of any connection reopened later. A zero value means Read won't time out.
+func (r *Reconnector) SetReadDeadline(t time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.deadline = t
+	if d, ok := r.conn.(readDeadliner); ok {
+		return d.SetReadDeadline(t)
+	}
+	return nil
+}
+
+// InterruptsRead reports whether setting the read deadline interrupts a read
+// in progress, which depends on the connection opened by the dial function.
+func (r *Reconnector) InterruptsRead() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return interruptsRead(r.conn)
+}
+
+// Close closes the connection. Calls after Close fail with os.ErrClosed.
+func (r *Reconnector) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	close(r.closing)
+	if r.down != nil || r.redialing != nil {
+		// The failed connection has already been closed, and a redial in
+		// progress closes the connection it opens.
+		return nil
+	}
+	return r.conn.Close()
+}
+
+// Reconnect closes the connection and reopens the adapter, making the given
+// number of attempts. After giving up, calling Reconnect tries again.
+func (r *Reconnector) Reconnect() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.waitRedial()
+	if r.closed {
+		return os.ErrClosed
+	}
+	if r.down == nil {
+		r.conn.Close()
+	}
+	return r.redial(errors.New("reconnect requested"))
+}
+
+// Generation returns the number of times the connection has been reopened.
+func (r *Reconnector) Generation() uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.generation
+}
+
+// connection returns the current connection or the error making calls fail
+// fast.
+func (r *Reconnector) connection() (io.ReadWriteCloser, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil, os.ErrClosed
+	}
+	if r.down != nil {
+		return nil, r.down
+	}
+	return r.conn, nil
+}
+
+// reconnect reopens the adapter after the connection failed, unless it has
+// already been reopened by another call.
+func (r *Reconnector) reconnect(failed io.ReadWriteCloser, cause error) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.waitRedial()
+	if r.closed {
+		return os.ErrClosed
+	}
+	if r.down != nil {
+		return r.down
+	}
+	if r.conn != failed {
+		return nil
+	}
+	r.conn.Close()
+	r.emit(ReconnectEvent{Err: cause})
+	return r.redial(cause)
+}
+
+// waitRedial waits for a redial in progress to be done. The lock must be
+// held, and is released while waiting.
+func (r *Reconnector) waitRedial() {
+	for r.redialing != nil {
+		done := r.redialing
+		r.mu.Unlock()
+		<-done
+		r.mu.Lock()
+	}
+}
+
+// redial reopens the adapter and replays the configuration. The lock must be
+// held, and is released while waiting to retry and dialing, so that Close and
+// SetReadDeadline don't block until the adapter is back.
+func (r *Reconnector) redial(cause error) error {
+	done := make(chan struct{})
+	r.redialing = done
+	defer func() {
+		r.redialing = nil
+		close(done)
+	}()
+	backoff := r.minBackoff
+	lastErr := cause
+	for attempt := 1; attempt <= r.maxAttempts; attempt++ {
+		r.mu.Unlock()
+		conn, err := r.sleepAndDial(backoff)
+		r.mu.Lock()
+		if r.closed {
+			if conn != nil {
+				conn.Close()
+			}
+			return os.ErrClosed
+		}
+		backoff = min(2*backoff, r.maxBackoff)
+		if err == nil {
+			if err = r.replay(conn); err != nil {
+				conn.Close()
+			}
+		}
+		if err != nil {
+			lastErr = err
+			r.emit(ReconnectEvent{Attempt: attempt, Err: err})
+			continue
+		}
+		r.conn = conn
+		r.down = nil
+		r.generation++
+		r.emit(ReconnectEvent{Attempt: attempt, Reconnected: true})
+		return nil
+	}
+	r.down = fmt.Errorf("%w: %s", ErrDisconnected, lastErr)
+	r.emit(ReconnectEvent{Attempt: r.maxAttempts, Err: lastErr, GaveUp: true})
+	return r.down
+}
+
+// sleepAndDial waits for the backoff, unless the Reconnector is closed, and
+// then reopens the adapter.
+func (r *Reconnector) sleepAndDial(backoff time.Duration) (io.ReadWriteCloser, error) {
+	t := time.NewTimer(backoff)
+	defer t.Stop()
+	select {
+	case <-r.closing:
+		return nil, os.ErrClosed
+	case <-t.C:
+	}
+	return r.dial()
+}
+
+// replay sends the recorded configuration commands to the new connection.
+func (r *Reconnector) replay(conn io.ReadWriteCloser) error {
+	cmds := r.config
+	if r.savecfg != "" {
+		cmds = append(append([]string{"++savecfg 0"}, r.config...), r.savecfg)
+	}
+	for _, cmd := range cmds {
+		if _, err := fmt.Fprintf(conn, "%s\n", cmd); err != nil {
+			return err
+		}
+	}
+	if d, ok := conn.(readDeadliner); ok {
+		return d.SetReadDeadline(r.deadline)
+	}
+	return nil
+}
+
+// record records the configuration commands in the data, keeping the last
+// setting of each in the order first set.
+func (r *Reconnector) record(p []byte) {
+	if !strings.Contains(string(p), "++") {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, line := range strings.FieldsFunc(string(p), func(c rune) bool { return c == '\n' || c == '\r' }) {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || !strings.HasPrefix(fields[0], "++") {
+			continue
+		}
+		name := strings.ToLower(strings.TrimPrefix(fields[0], "++"))
+		cmd := "++" + name + " " + strings.Join(fields[1:], " ")
+		if name == "savecfg" {
+			r.savecfg = cmd
+			continue
+		}
+		if !replayedCommands[name] {
+			continue
+		}
+		replaced := false
+		for i, prev := range r.config {
+			if strings.HasPrefix(prev, "++"+name+" ") {
+				r.config[i] = cmd
+				replaced = true
+			}
+		}
+		if !replaced {
+			r.config = append(r.config, cmd)
+		}
+	}
+}
+
+func (r *Reconnector) emit(e ReconnectEvent) {
+	if r.onEvent != nil {
+		r.onEvent(e)
+	}
+}
+
+// isTimeout reports whether the error is a timeout, such as an expired read
+// deadline, rather than a failure of the connection.
+func isTimeout(err error) bool {
+	var t interface{ Timeout() bool }
+	return errors.As(err, &t) && t.Timeout()
+}
+
+// connGeneration returns the number of times the connection of the
+// controller has been reopened by a Reconnector.
+func (c *Controller) connGeneration() uint64 {
+	if g, ok := c.rw.ReadWriter.(interface{ Generation() uint64 }); ok {
+		return g.Generation()
+	}
+	return 0
+}
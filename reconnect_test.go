@@ -0,0 +1,260 @@
+// Copyright (c) 2020–2024 The prologix developers. All rights reserved.
+// Project site: https://github.com/gotmc/prologix
+// Use of this source code is governed by a MIT-style license that
+// can be found in the LICENSE.txt file for the project.
+
+package prologix
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gotmc/prologix/sim"
+)
+
+// bench dials a new simulated adapter, which starts with the factory default
+// configuration, with the current instrument attached at address 5.
+type bench struct {
+	mu    sync.Mutex
+	inst  sim.Instrument
+	conn  *sim.Conn
+	down  bool
+	dials int
+}
+
+func (b *bench) dial() (io.ReadWriteCloser, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.dials++
+	if b.down {
+		return nil, errors.New("no such device")
+	}
+	adapter := sim.NewAdapter()
+	if err := adapter.Attach(5, b.inst); err != nil {
+		return nil, err
+	}
+	b.conn = adapter.Dial()
+	return b.conn, nil
+}
+
+// unplug closes the current connection and sets whether dialing fails.
+func (b *bench) unplug(down bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.conn.Close()
+	b.down = down
+}
+
+func TestReconnectReplaysConfiguration(t *testing.T) {
+	b := bench{inst: sim.NewE3631A(1)}
+	var events []ReconnectEvent
+	rc, err := NewReconnector(b.dial,
+		WithBackoff(time.Millisecond, 4*time.Millisecond),
+		WithReconnectHandler(func(e ReconnectEvent) { events = append(events, e) }),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	gpib, err := NewController(rc, 5, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := gpib.SetReadTimeout(1234); err != nil {
+		t.Fatal(err)
+	}
+
+	b.unplug(false)
+	idn, err := gpib.Query("*IDN?")
+	if err != nil {
+		t.Fatalf("error querying after reconnect: %s", err)
+	}
+	if got := ParseIdentity(idn); got.Model != "E3631A" {
+		t.Errorf("got identity %q after reconnect; want E3631A", idn)
+	}
+	if timeout, err := gpib.ReadTimeout(); err != nil || timeout != 1234 {
+		t.Errorf("got read timeout %d (%v) after reconnect; want 1234", timeout, err)
+	}
+	if len(events) != 2 || events[0].Err == nil || !events[1].Reconnected {
+		t.Errorf("got events %v; want connection lost and reconnected", events)
+	}
+	if rc.Generation() != 1 {
+		t.Errorf("got generation %d; want 1", rc.Generation())
+	}
+
+	// A read failing because the connection is lost is reported, since the
+	// response is lost.
+	if _, err := gpib.WriteString("*IDN?"); err != nil {
+		t.Fatal(err)
+	}
+	b.unplug(false)
+	if _, err := gpib.Read(make([]byte, 64)); !errors.Is(err, ErrReconnected) {
+		t.Errorf("got error %v; want %v", err, ErrReconnected)
+	}
+}
+
+// writeLog is a connection recording the data written to it.
+type writeLog struct {
+	bytes.Buffer
+}
+
+func (w *writeLog) Close() error {
+	return nil
+}
+
+func TestReconnectReplaysSaveConfigLast(t *testing.T) {
+	b := bench{inst: sim.NewE3631A(1)}
+	rc, err := NewReconnector(b.dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	gpib, err := NewController(rc, 5, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := gpib.SetReadTimeout(1234); err != nil {
+		t.Fatal(err)
+	}
+
+	// Replaying the configuration doesn't rewrite the EPROM of the
+	// controller, whose saving is only enabled again at the end.
+	var w writeLog
+	if err := rc.replay(&w); err != nil {
+		t.Fatal(err)
+	}
+	cmds := strings.Split(strings.TrimSpace(w.String()), "\n")
+	if cmds[0] != "++savecfg 0" || cmds[len(cmds)-1] != "++savecfg 1" || strings.Count(w.String(), "savecfg") != 2 {
+		t.Errorf("got replayed commands %q; want savecfg disabled first and enabled last", cmds)
+	}
+	if !slices.Contains(cmds, "++read_tmo_ms 1234") {
+		t.Errorf("got replayed commands %q; want the read timeout set", cmds)
+	}
+}
+
+func TestReconnectGivesUp(t *testing.T) {
+	b := bench{inst: sim.NewE3631A(1)}
+	var events []ReconnectEvent
+	rc, err := NewReconnector(b.dial,
+		WithBackoff(time.Millisecond, 2*time.Millisecond),
+		WithReconnectAttempts(3),
+		WithReconnectHandler(func(e ReconnectEvent) { events = append(events, e) }),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	gpib, err := NewController(rc, 5, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b.unplug(true)
+	if err := gpib.Command("OUTP ON"); !errors.Is(err, ErrDisconnected) {
+		t.Fatalf("got error %v; want %v", err, ErrDisconnected)
+	}
+	if n := len(events); n != 5 || !events[n-1].GaveUp || events[n-1].Attempt != 3 {
+		t.Errorf("got events %v; want connection lost, 3 failed attempts, and gave up", events)
+	}
+	dials := b.dials
+	if err := gpib.Command("OUTP ON"); !errors.Is(err, ErrDisconnected) {
+		t.Errorf("got error %v; want %v", err, ErrDisconnected)
+	}
+	if b.dials != dials {
+		t.Errorf("dialed %d more times after giving up; want fail fast", b.dials-dials)
+	}
+
+	b.mu.Lock()
+	b.down = false
+	b.mu.Unlock()
+	if err := rc.Reconnect(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gpib.Query("*IDN?"); err != nil {
+		t.Errorf("error querying after Reconnect: %s", err)
+	}
+}
+
+func TestReconnectClose(t *testing.T) {
+	b := bench{inst: sim.NewE3631A(1)}
+	lost := make(chan struct{}, 1)
+	rc, err := NewReconnector(b.dial,
+		WithBackoff(time.Hour, time.Hour),
+		WithReconnectHandler(func(e ReconnectEvent) {
+			if e.Attempt == 0 {
+				lost <- struct{}{}
+			}
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gpib, err := NewController(rc, 5, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The Reconnector waiting to retry isn't locked, and is stopped by Close.
+	b.unplug(true)
+	errc := make(chan error, 1)
+	go func() { errc <- gpib.Command("OUTP ON") }()
+	<-lost
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		rc.SetReadDeadline(time.Now())
+		rc.Close()
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("SetReadDeadline and Close blocked while reconnecting")
+	}
+	select {
+	case err := <-errc:
+		if !errors.Is(err, os.ErrClosed) {
+			t.Errorf("got error %v; want %v", err, os.ErrClosed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("reconnect not stopped by Close")
+	}
+}
+
+func TestReconnectReverifiesPinnedIdentity(t *testing.T) {
+	b := bench{inst: sim.NewE3631A(1)}
+	rc, err := NewReconnector(b.dial, WithBackoff(time.Millisecond, time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	gpib, err := NewController(rc, 5, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	psu, err := gpib.Instrument(5, WithPinnedIdentity("E3631A", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := psu.Command("OUTP OFF"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The bench is recabled while the adapter is unplugged.
+	b.mu.Lock()
+	b.inst = sim.NewKey33220A(1)
+	b.mu.Unlock()
+	b.unplug(false)
+	if err := rc.Reconnect(); err != nil {
+		t.Fatal(err)
+	}
+	if err := psu.Command("OUTP OFF"); !errors.Is(err, ErrIdentityMismatch) {
+		t.Errorf("got error %v after recabling; want %v", err, ErrIdentityMismatch)
+	}
+}
@@ -0,0 +1,333 @@
+// Copyright (c) 2020–2024 The prologix developers. All rights reserved.
+// Project site: https://github.com/gotmc/prologix
+// Use of this source code is governed by a MIT-style license that
+// can be found in the LICENSE.txt file for the project.
+
+package prologix
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gotmc/prologix/driver"
+)
+
+// ethernetPort is the TCP port on which the Prologix GPIB-ETHERNET controller
+// listens, which is used when a TCPIP resource doesn't include the port.
+const ethernetPort = "1234"
+
+// Resource is a parsed VISA resource name identifying an instrument on the
+// GPIB bus of a Prologix adapter.
+type Resource struct {
+	// Interface is the VISA interface type of the adapter, which selects the
+	// driver: ASRL for the GPIB-USB controller, TCPIP for the GPIB-ETHERNET
+	// controller, SIM for a simulated adapter, or BROKER for an adapter
+	// shared by the prologixd broker. It's empty for a GPIB
+	// resource, whose adapter is given by the board mapping.
+	Interface string
+	// Address is the address of the adapter passed to the driver, such as the
+	// serial port of an ASRL resource, the host and port of a TCPIP one, or
+	// the socket path of a BROKER one.
+	Address string
+	// Board is the board index of a GPIB resource, such as 0 for GPIB0.
+	Board            int
+	PrimaryAddress   int
+	SecondaryAddress int
+}
+
+// ParseResource parses a VISA resource name in one of the following forms,
+// where the secondary address and the INSTR suffix are optional and the
+// keywords are case insensitive:
+//
+//	GPIB0::10::96::INSTR
+//	ASRL/dev/ttyUSB0::GPIB::10::96::INSTR
+//	TCPIP::192.168.1.50::1234::SOCKET::GPIB::10::96::INSTR
+//	SIM::bench::GPIB::10::96::INSTR
+//	BROKER::/tmp/prologixd.sock::GPIB::10::96::INSTR
+//
+// A GPIB resource refers to the adapter mapped to its board index using
+// MapBoard. The port of a TCPIP resource defaults to 1234, and an ASRL
+// resource with a number, such as ASRL3, refers to the serial port COM3.
+func ParseResource(s string) (Resource, error) {
+	var r Resource
+	fields := strings.Split(strings.TrimSpace(s), "::")
+	if board, ok := cutPrefixFold(fields[0], "GPIB"); ok {
+		n, err := parseBoard(board)
+		if err != nil {
+			return r, fmt.Errorf("invalid resource %s: %w", s, err)
+		}
+		r.Board = n
+		fields = fields[1:]
+	} else {
+		iface, addr, rest, err := parseAdapter(fields)
+		if err != nil {
+			return r, fmt.Errorf("invalid resource %s: %w", s, err)
+		}
+		if len(rest) == 0 || !strings.EqualFold(rest[0], "GPIB") {
+			return r, fmt.Errorf("invalid resource %s: missing GPIB address", s)
+		}
+		r.Interface = iface
+		r.Address = addr
+		fields = rest[1:]
+	}
+	if n := len(fields); n > 0 && strings.EqualFold(fields[n-1], "INSTR") {
+		fields = fields[:n-1]
+	}
+	if len(fields) < 1 || len(fields) > 2 {
+		return r, fmt.Errorf("invalid resource %s: expected primary and optional secondary address", s)
+	}
+	pad, err := strconv.Atoi(fields[0])
+	if err != nil || !isPrimaryAddressValid(pad) {
+		return r, fmt.Errorf("invalid resource %s: invalid primary address %s (must by 0-30)", s, fields[0])
+	}
+	r.PrimaryAddress = pad
+	if len(fields) == 2 {
+		sad, err := strconv.Atoi(fields[1])
+		if err != nil || !isSecondaryAddressValid(sad) {
+			return r, fmt.Errorf("invalid resource %s: invalid secondary address %s (must be 96-126)", s, fields[1])
+		}
+		r.SecondaryAddress = sad
+	}
+	return r, nil
+}
+
+func (r Resource) String() string {
+	addr := strconv.Itoa(r.PrimaryAddress)
+	if r.SecondaryAddress != 0 {
+		addr += "::" + strconv.Itoa(r.SecondaryAddress)
+	}
+	if r.Interface == "" {
+		return fmt.Sprintf("GPIB%d::%s::INSTR", r.Board, addr)
+	}
+	return adapterName(r.Interface, r.Address) + "::GPIB::" + addr + "::INSTR"
+}
+
+// parseAdapter parses the leading fields of a resource naming an adapter and
+// returns the interface type, the address passed to its driver, and the
+// remaining fields.
+func parseAdapter(fields []string) (iface, addr string, rest []string, err error) {
+	head := fields[0]
+	if port, ok := cutPrefixFold(head, "ASRL"); ok {
+		if port == "" {
+			return "", "", nil, fmt.Errorf("missing serial port")
+		}
+		if _, err := strconv.Atoi(port); err == nil {
+			port = "COM" + port
+		}
+		return "ASRL", port, fields[1:], nil
+	}
+	if board, ok := cutPrefixFold(head, "TCPIP"); ok {
+		if _, err := parseBoard(board); err != nil {
+			return "", "", nil, err
+		}
+		if len(fields) < 2 || fields[1] == "" {
+			return "", "", nil, fmt.Errorf("missing host")
+		}
+		host, port, rest := fields[1], ethernetPort, fields[2:]
+		if len(rest) > 0 && !strings.EqualFold(rest[0], "SOCKET") {
+			if _, err := strconv.ParseUint(rest[0], 10, 16); err != nil {
+				return "", "", nil, fmt.Errorf("invalid port %s", rest[0])
+			}
+			port, rest = rest[0], rest[1:]
+		}
+		if len(rest) == 0 || !strings.EqualFold(rest[0], "SOCKET") {
+			return "", "", nil, fmt.Errorf("TCPIP resource must be a SOCKET")
+		}
+		return "TCPIP", net.JoinHostPort(host, port), rest[1:], nil
+	}
+	if strings.EqualFold(head, "SIM") {
+		if len(fields) < 2 || fields[1] == "" {
+			return "", "", nil, fmt.Errorf("missing simulated adapter name")
+		}
+		return "SIM", fields[1], fields[2:], nil
+	}
+	if strings.EqualFold(head, "BROKER") {
+		if len(fields) < 2 || fields[1] == "" {
+			return "", "", nil, fmt.Errorf("missing broker socket")
+		}
+		return "BROKER", fields[1], fields[2:], nil
+	}
+	return "", "", nil, fmt.Errorf("unsupported interface type %s", head)
+}
+
+// adapterName formats the resource name of an adapter.
+func adapterName(iface, addr string) string {
+	switch iface {
+	case "ASRL":
+		return "ASRL" + addr
+	case "TCPIP":
+		host, port, _ := net.SplitHostPort(addr)
+		return fmt.Sprintf("TCPIP::%s::%s::SOCKET", host, port)
+	}
+	return iface + "::" + addr
+}
+
+func parseBoard(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid board index %s", s)
+	}
+	return n, nil
+}
+
+// cutPrefixFold is strings.CutPrefix ignoring case.
+func cutPrefixFold(s, prefix string) (string, bool) {
+	if len(s) < len(prefix) || !strings.EqualFold(s[:len(prefix)], prefix) {
+		return s, false
+	}
+	return s[len(prefix):], true
+}
+
+// adapter identifies a Prologix adapter by the interface type of its driver
+// and its address.
+type adapter struct {
+	iface string
+	addr  string
+}
+
+// sharedController is a controller opened by Open and the number of
+// instruments using it.
+type sharedController struct {
+	c    *Controller
+	conn io.ReadWriteCloser
+	refs int
+}
+
+var (
+	openMu      sync.Mutex
+	boards      = make(map[int]adapter)
+	controllers = make(map[adapter]*sharedController)
+)
+
+// MapBoard maps the board index of GPIB resources, such as 0 for GPIB0, to
+// the adapter with the given resource name, such as `ASRL/dev/ttyUSB0`,
+// `TCPIP::192.168.1.50::1234::SOCKET`, `SIM::bench`, or
+// `BROKER::/tmp/prologixd.sock`.
+func MapBoard(board int, adapterResource string) error {
+	if board < 0 {
+		return fmt.Errorf("invalid board index %d", board)
+	}
+	a, err := parseAdapterResource(adapterResource)
+	if err != nil {
+		return err
+	}
+	openMu.Lock()
+	defer openMu.Unlock()
+	boards[board] = a
+	return nil
+}
+
+// OpenAdapter opens a connection to the adapter with the given resource name,
+// such as `ASRL/dev/ttyUSB0` or `TCPIP::192.168.1.50::1234::SOCKET`, using
+// the driver registered for its interface type. Unlike Open, the adapter
+// isn't configured.
+func OpenAdapter(adapterResource string) (io.ReadWriteCloser, error) {
+	a, err := parseAdapterResource(adapterResource)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := driver.Open(a.iface, a.addr)
+	if err != nil {
+		return nil, fmt.Errorf("error opening %s: %w", adapterName(a.iface, a.addr), err)
+	}
+	return conn, nil
+}
+
+// parseAdapterResource parses the resource name of an adapter.
+func parseAdapterResource(s string) (adapter, error) {
+	fields := strings.Split(strings.TrimSpace(s), "::")
+	iface, addr, rest, err := parseAdapter(fields)
+	if err != nil {
+		return adapter{}, fmt.Errorf("invalid adapter resource %s: %w", s, err)
+	}
+	if len(rest) > 0 {
+		return adapter{}, fmt.Errorf("invalid adapter resource %s: unexpected %s", s, strings.Join(rest, "::"))
+	}
+	return adapter{iface: iface, addr: addr}, nil
+}
+
+// Open opens the instrument identified by the VISA resource name, as
+// described by ParseResource, using the driver registered for the adapter's
+// interface type. The drivers register themselves when their packages, such
+// as github.com/gotmc/prologix/driver/vcp, are imported.
+//
+// Instruments opened on the same adapter share its connection and Controller,
+// which is created with the instrument's address. Close the instrument when
+// done, which closes the connection once no other instrument uses it.
+func Open(resource string, opts ...InstrumentOption) (*Instrument, error) {
+	r, err := ParseResource(resource)
+	if err != nil {
+		return nil, err
+	}
+	openMu.Lock()
+	defer openMu.Unlock()
+	a := adapter{iface: r.Interface, addr: r.Address}
+	if r.Interface == "" {
+		var ok bool
+		if a, ok = boards[r.Board]; !ok {
+			return nil, fmt.Errorf("no adapter mapped to board GPIB%d", r.Board)
+		}
+	}
+
+	sc, ok := controllers[a]
+	if !ok {
+		conn, err := driver.Open(a.iface, a.addr)
+		if err != nil {
+			return nil, fmt.Errorf("error opening %s: %w", adapterName(a.iface, a.addr), err)
+		}
+		var copts []ControllerOption
+		if r.SecondaryAddress != 0 {
+			copts = append(copts, WithSecondaryAddress(r.SecondaryAddress))
+		}
+		c, err := NewController(conn, r.PrimaryAddress, false, copts...)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		sc = &sharedController{c: c, conn: conn}
+		controllers[a] = sc
+	}
+
+	if r.SecondaryAddress != 0 {
+		opts = append([]InstrumentOption{WithInstrumentSecondaryAddress(r.SecondaryAddress)}, opts...)
+	}
+	i, err := sc.c.Instrument(r.PrimaryAddress, opts...)
+	if err != nil {
+		if sc.refs == 0 {
+			delete(controllers, a)
+			sc.conn.Close()
+		}
+		return nil, err
+	}
+	sc.refs++
+	i.release = func() error {
+		sc.refs--
+		if sc.refs > 0 {
+			return nil
+		}
+		delete(controllers, a)
+		return sc.conn.Close()
+	}
+	return i, nil
+}
+
+// Close releases an instrument opened by Open, closing the connection to the
+// adapter once no other instrument opened by Open uses it. Close does
+// nothing for an instrument returned by Controller.Instrument.
+func (i *Instrument) Close() error {
+	openMu.Lock()
+	defer openMu.Unlock()
+	if i.release == nil {
+		return nil
+	}
+	release := i.release
+	i.release = nil
+	return release()
+}
@@ -0,0 +1,183 @@
+// Copyright (c) 2020–2024 The prologix developers. All rights reserved.
+// Project site: https://github.com/gotmc/prologix
+// Use of this source code is governed by a MIT-style license that
+// can be found in the LICENSE.txt file for the project.
+
+package prologix
+
+import (
+	"net"
+	"testing"
+
+	_ "github.com/gotmc/prologix/driver/ethernet"
+	"github.com/gotmc/prologix/sim"
+)
+
+func TestParseResource(t *testing.T) {
+	testCases := []struct {
+		given string
+		want  Resource
+		str   string
+	}{
+		{
+			"GPIB0::10::INSTR",
+			Resource{PrimaryAddress: 10},
+			"GPIB0::10::INSTR",
+		},
+		{
+			"gpib1::10::96::instr",
+			Resource{Board: 1, PrimaryAddress: 10, SecondaryAddress: 96},
+			"GPIB1::10::96::INSTR",
+		},
+		{
+			"GPIB::4",
+			Resource{PrimaryAddress: 4},
+			"GPIB0::4::INSTR",
+		},
+		{
+			"ASRL/dev/ttyUSB0::GPIB::10",
+			Resource{Interface: "ASRL", Address: "/dev/ttyUSB0", PrimaryAddress: 10},
+			"ASRL/dev/ttyUSB0::GPIB::10::INSTR",
+		},
+		{
+			"ASRL3::GPIB::10::100::INSTR",
+			Resource{Interface: "ASRL", Address: "COM3", PrimaryAddress: 10, SecondaryAddress: 100},
+			"ASRLCOM3::GPIB::10::100::INSTR",
+		},
+		{
+			"TCPIP::192.168.1.50::1234::SOCKET::GPIB::10",
+			Resource{Interface: "TCPIP", Address: "192.168.1.50:1234", PrimaryAddress: 10},
+			"TCPIP::192.168.1.50::1234::SOCKET::GPIB::10::INSTR",
+		},
+		{
+			"TCPIP0::prologix.local::SOCKET::GPIB::22::INSTR",
+			Resource{Interface: "TCPIP", Address: "prologix.local:1234", PrimaryAddress: 22},
+			"TCPIP::prologix.local::1234::SOCKET::GPIB::22::INSTR",
+		},
+		{
+			"SIM::bench::GPIB::5",
+			Resource{Interface: "SIM", Address: "bench", PrimaryAddress: 5},
+			"SIM::bench::GPIB::5::INSTR",
+		},
+		{
+			"broker::/tmp/prologixd.sock::GPIB::10::96::INSTR",
+			Resource{Interface: "BROKER", Address: "/tmp/prologixd.sock", PrimaryAddress: 10, SecondaryAddress: 96},
+			"BROKER::/tmp/prologixd.sock::GPIB::10::96::INSTR",
+		},
+	}
+	for _, tc := range testCases {
+		got, err := ParseResource(tc.given)
+		if err != nil {
+			t.Errorf("ParseResource(%q) error: %s", tc.given, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("ParseResource(%q) = %+v; want %+v", tc.given, got, tc.want)
+		}
+		if got.String() != tc.str {
+			t.Errorf("ParseResource(%q).String() = %s; want %s", tc.given, got, tc.str)
+		}
+	}
+
+	invalid := []string{
+		"",
+		"GPIB0",
+		"GPIBX::10",
+		"GPIB0::31::INSTR",
+		"GPIB0::10::95",
+		"GPIB0::10::96::97",
+		"ASRL::GPIB::10",
+		"ASRL/dev/ttyUSB0::10",
+		"TCPIP::192.168.1.50::1234::INSTR",
+		"TCPIP::192.168.1.50::http::SOCKET::GPIB::10",
+		"USB0::0x0957::0x0407::MY44021127::INSTR",
+		"SIM::::GPIB::5",
+		"BROKER::::GPIB::5",
+	}
+	for _, given := range invalid {
+		if r, err := ParseResource(given); err == nil {
+			t.Errorf("ParseResource(%q) = %+v; want error", given, r)
+		}
+	}
+}
+
+func TestOpen(t *testing.T) {
+	adapter := sim.NewAdapter()
+	if err := adapter.Attach(5, sim.NewE3631A(1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := adapter.Attach(6, sim.NewKey33220A(1)); err != nil {
+		t.Fatal(err)
+	}
+	adapter.Register("open-test")
+	if err := MapBoard(7, "SIM::open-test"); err != nil {
+		t.Fatal(err)
+	}
+
+	psu, err := Open("GPIB7::5::INSTR", WithPinnedIdentity("E3631A", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fgen, err := Open("SIM::open-test::GPIB::6")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if psu.Controller() != fgen.Controller() {
+		t.Errorf("instruments on the same adapter don't share the controller")
+	}
+	for _, i := range []*Instrument{psu, fgen, psu} {
+		if _, err := i.Identify(); err != nil {
+			t.Errorf("error identifying instrument at %s: %s", i.Address(), err)
+		}
+	}
+
+	if err := psu.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := psu.Close(); err != nil {
+		t.Errorf("second Close returned %s; want nil", err)
+	}
+	if _, err := fgen.Query("*IDN?"); err != nil {
+		t.Errorf("error querying after closing the other instrument: %s", err)
+	}
+	if err := fgen.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fgen.Query("*IDN?"); err == nil {
+		t.Errorf("query after closing all instruments succeeded; want error")
+	}
+
+	if _, err := Open("GPIB9::5::INSTR"); err == nil {
+		t.Errorf("opening unmapped board succeeded; want error")
+	}
+	if _, err := Open("SIM::no-such-adapter::GPIB::5"); err == nil {
+		t.Errorf("opening unregistered simulator succeeded; want error")
+	}
+}
+
+func TestOpenEthernet(t *testing.T) {
+	adapter := sim.NewAdapter(sim.WithVersion(sim.VersionEthernet))
+	if err := adapter.Attach(5, sim.NewE3631A(1)); err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go adapter.Serve(l)
+
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	psu, err := Open("TCPIP::" + host + "::" + port + "::SOCKET::GPIB::5::INSTR")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer psu.Close()
+	id, err := psu.Identify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.Model != "E3631A" {
+		t.Errorf("got model %s; want E3631A", id.Model)
+	}
+}
@@ -0,0 +1,359 @@
+// Copyright (c) 2020–2024 The prologix developers. All rights reserved.
+// Project site: https://github.com/gotmc/prologix
+// Use of this source code is governed by a MIT-style license that
+// can be found in the LICENSE.txt file for the project.
+
+package prologix
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// identificationQueries lists the queries used to identify an instrument in
+// order of preference: the IEEE 488.2 query followed by the queries used by
+// many older instruments.
+var identificationQueries = []string{"*IDN?", "ID?", "ID"}
+
+// Listener is an instrument found on the GPIB bus by Scan.
+type Listener struct {
+	PrimaryAddress   int  `json:"primary_address"`
+	SecondaryAddress int  `json:"secondary_address,omitempty"`
+	StatusByte       byte `json:"status_byte"`
+	// Query is the identification query answered by the instrument, or empty
+	// if the instrument didn't answer any.
+	Query    string   `json:"query,omitempty"`
+	RawID    string   `json:"raw_id,omitempty"`
+	Identity Identity `json:"identity"`
+}
+
+// Address returns the GPIB address of the listener formatted as the primary
+// address followed by the secondary address, if any.
+func (l Listener) Address() string {
+	if l.SecondaryAddress != 0 {
+		return fmt.Sprintf("%d %d", l.PrimaryAddress, l.SecondaryAddress)
+	}
+	return strconv.Itoa(l.PrimaryAddress)
+}
+
+// Inventory lists the instruments found on the GPIB bus by Scan.
+type Inventory struct {
+	// Controller is the version string of the Prologix controller.
+	Controller string     `json:"controller"`
+	Listeners  []Listener `json:"listeners"`
+}
+
+// ScanOption applies an option to a GPIB bus scan.
+type ScanOption func(*scanConfig)
+
+type scanConfig struct {
+	addrs        []int
+	secondary    bool
+	probeTimeout int
+}
+
+// WithScanAddresses limits the scan to the given primary addresses instead of
+// all addresses from 0 to 30.
+func WithScanAddresses(addrs ...int) ScanOption {
+	return func(cfg *scanConfig) {
+		cfg.addrs = addrs
+	}
+}
+
+// WithScanSecondary also probes the secondary addresses 96 to 126 of each
+// primary address at which no instrument responded.
+func WithScanSecondary() ScanOption {
+	return func(cfg *scanConfig) {
+		cfg.secondary = true
+	}
+}
+
+// WithScanTimeout sets the read timeout in milliseconds used while serial
+// polling each address, which defaults to 100 ms. Since each empty address
+// takes the full timeout, a short timeout speeds up the scan.
+func WithScanTimeout(timeout int) ScanOption {
+	return func(cfg *scanConfig) {
+		cfg.probeTimeout = timeout
+	}
+}
+
+// readDeadliner is implemented by connections, such as a net.Conn, whose reads
+// can be interrupted.
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// readInterrupter is implemented by connections, such as the vcp driver's,
+// that report whether the read deadline can be set while a read is in
+// progress to interrupt it. Connections that don't implement it are expected
+// to behave like a net.Conn.
+type readInterrupter interface {
+	InterruptsRead() bool
+}
+
+// interruptsRead reports whether setting the read deadline of the connection
+// interrupts a read in progress.
+func interruptsRead(conn any) bool {
+	i, ok := conn.(readInterrupter)
+	return !ok || i.InterruptsRead()
+}
+
+// Scan probes the GPIB bus for instruments by serial polling each address and
+// then identifies each instrument found using the `*IDN?` query, falling back
+// to the `ID?` and `ID` queries used by older instruments. Serial polling an
+// instrument clears its Request Service (RQS) bit.
+//
+// The Prologix controller doesn't respond when a serial poll times out, so
+// each probe is followed by the `++ver` command, whose response marks the end
+// of any reply. When the connection supports read deadlines, canceling the
+// context interrupts the scan. The read timeout and instrument address of the
+// controller are restored afterwards.
+func (c *Controller) Scan(ctx context.Context, opts ...ScanOption) (inv Inventory, err error) {
+	cfg := scanConfig{probeTimeout: 100}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if cfg.addrs == nil {
+		for addr := 0; addr <= 30; addr++ {
+			cfg.addrs = append(cfg.addrs, addr)
+		}
+	}
+	for _, addr := range cfg.addrs {
+		if !isPrimaryAddressValid(addr) {
+			return inv, fmt.Errorf("invalid primary address %d (must by 0-30)", addr)
+		}
+	}
+	if cfg.probeTimeout < 1 || cfg.probeTimeout > 3000 {
+		return inv, fmt.Errorf("scan timeout outside 1 to 3000 ms; attempted to set to %d", cfg.probeTimeout)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	defer c.interruptOn(ctx)()
+	p, err := newProber(ctx, c)
+	if err != nil {
+		return inv, err
+	}
+	inv.Controller = p.ver
+	lines, err := p.exchange("++read_tmo_ms")
+	if err != nil {
+		return inv, err
+	}
+	timeout, err := strconv.Atoi(strings.Join(lines, ""))
+	if err != nil {
+		return inv, fmt.Errorf("read timeout not determinable; received %s", lines)
+	}
+	defer func() {
+		restore := []string{fmt.Sprintf("++read_tmo_ms %d", timeout), "++addr " + c.addrString()}
+		if _, rerr := p.exchange(restore...); err == nil {
+			err = rerr
+		}
+	}()
+
+	if _, err := p.exchange(fmt.Sprintf("++read_tmo_ms %d", cfg.probeTimeout)); err != nil {
+		return inv, err
+	}
+	for _, pad := range cfg.addrs {
+		l, ok, err := p.poll(pad, 0)
+		if err != nil {
+			return inv, err
+		}
+		if ok {
+			inv.Listeners = append(inv.Listeners, l)
+			continue
+		}
+		if !cfg.secondary {
+			continue
+		}
+		for sad := 96; sad <= 126; sad++ {
+			l, ok, err := p.poll(pad, sad)
+			if err != nil {
+				return inv, err
+			}
+			if ok {
+				inv.Listeners = append(inv.Listeners, l)
+			}
+		}
+	}
+
+	if _, err := p.exchange(fmt.Sprintf("++read_tmo_ms %d", timeout)); err != nil {
+		return inv, err
+	}
+	for i := range inv.Listeners {
+		l := &inv.Listeners[i]
+		if l.Query, l.RawID, err = p.identify(l.Address(), nil); err != nil {
+			return inv, err
+		}
+		if l.RawID != "" {
+			l.Identity = ParseIdentity(l.RawID)
+		}
+	}
+	return inv, nil
+}
+
+// addrString returns the arguments of the `addr` command selecting the
+// controller's instrument address.
+func (c *Controller) addrString() string {
+	if c.hasSecondaryAddr {
+		return fmt.Sprintf("%d %d", c.primaryAddr, c.secondaryAddr)
+	}
+	return strconv.Itoa(c.primaryAddr)
+}
+
+// prober sends commands to the Prologix controller, each followed by the
+// `++ver` command whose response marks the end of the replies, so that
+// commands that may not be answered can be sent without waiting for the
+// connection to time out.
+type prober struct {
+	c   *Controller
+	ctx context.Context
+	r   *bufio.Reader
+	ver string
+	// markers is the number of end markers requested but not yet read.
+	markers int
+}
+
+// newProber creates a prober, reading the version of the Prologix controller
+// to use as the end marker of the replies.
+func newProber(ctx context.Context, c *Controller) (*prober, error) {
+	p := prober{c: c, ctx: ctx, r: bufio.NewReader(c.rw)}
+	if err := p.write("++ver"); err != nil {
+		return nil, err
+	}
+	line, err := p.readLine()
+	if err != nil {
+		return nil, err
+	}
+	p.ver = line
+	p.markers = 0
+	return &p, nil
+}
+
+// exchange sends the lines and returns the non-empty lines received in reply.
+func (p *prober) exchange(lines ...string) ([]string, error) {
+	for _, line := range append(lines, "++ver") {
+		if err := p.write(line); err != nil {
+			return nil, err
+		}
+	}
+	var replies []string
+	for {
+		line, err := p.readLine()
+		if err != nil {
+			return replies, err
+		}
+		if line == p.ver {
+			p.markers--
+			return replies, nil
+		}
+		if line != "" {
+			replies = append(replies, line)
+		}
+	}
+}
+
+// poll serial polls the address and reports whether an instrument responded.
+func (p *prober) poll(pad, sad int) (Listener, bool, error) {
+	l := Listener{PrimaryAddress: pad, SecondaryAddress: sad}
+	if err := p.err(); err != nil {
+		return l, false, err
+	}
+	lines, err := p.exchange("++spoll " + l.Address())
+	if err != nil || len(lines) == 0 {
+		return l, false, err
+	}
+	stb, err := strconv.ParseUint(lines[0], 10, 8)
+	if err != nil {
+		return l, false, fmt.Errorf("status byte not determinable; received %s", lines[0])
+	}
+	l.StatusByte = byte(stb)
+	return l, true, nil
+}
+
+// identify returns the identification query answered by the instrument at
+// the address and its response. Both are empty if the instrument doesn't
+// answer any of the queries. Unless intercept is nil, each query is sent
+// using intercept, so the query returned is the one actually sent.
+func (p *prober) identify(addr string, intercept func(*Operation, Invoker) error) (query, raw string, err error) {
+	send := func(op *Operation) error {
+		lines, err := p.exchange("++addr "+addr, op.Payload, "++read eoi")
+		op.Response = strings.Join(lines, " ")
+		return err
+	}
+	for _, query := range identificationQueries {
+		if err := p.err(); err != nil {
+			return "", "", err
+		}
+		op := Operation{Kind: QueryOperation, Payload: query}
+		if intercept != nil {
+			err = intercept(&op, send)
+		} else {
+			err = send(&op)
+		}
+		if err != nil {
+			return "", "", err
+		}
+		if op.Response != "" {
+			return op.Payload, op.Response, nil
+		}
+		// Clear the instrument, which may be confused by the unknown query,
+		// before trying the next one.
+		if _, err := p.exchange("++clr"); err != nil {
+			return "", "", err
+		}
+	}
+	return "", "", nil
+}
+
+func (p *prober) write(line string) error {
+	_, err := fmt.Fprintf(p.c.rw, "%s%c", line, p.c.usbTerm)
+	if err == nil && line == "++ver" {
+		p.markers++
+	}
+	return err
+}
+
+// resync reads the replies left by exchanges that were interrupted, up to
+// their end markers.
+func (p *prober) resync() error {
+	for p.markers > 0 {
+		line, err := p.readLine()
+		if err != nil {
+			return err
+		}
+		if line == p.ver {
+			p.markers--
+		}
+	}
+	return nil
+}
+
+// err returns the error of the context once it's done. A context past its
+// deadline counts as done even if its timer hasn't fired yet, so a scan
+// started with an expired context doesn't poll the bus.
+func (p *prober) err() error {
+	if err := p.ctx.Err(); err != nil {
+		return err
+	}
+	if deadline, ok := p.ctx.Deadline(); ok && !time.Now().Before(deadline) {
+		return context.DeadlineExceeded
+	}
+	return nil
+}
+
+// readLine reads a line without the trailing CR and LF. When the read fails
+// because the context is done, the context's error is returned.
+func (p *prober) readLine() (string, error) {
+	line, err := p.r.ReadString('\n')
+	if err != nil {
+		if ctxErr := contextErr(p.ctx, err); ctxErr != nil {
+			return "", ctxErr
+		}
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
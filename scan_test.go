@@ -0,0 +1,94 @@
+// Copyright (c) 2020–2024 The prologix developers. All rights reserved.
+// Project site: https://github.com/gotmc/prologix
+// Use of this source code is governed by a MIT-style license that
+// can be found in the LICENSE.txt file for the project.
+
+package prologix
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gotmc/prologix/sim"
+)
+
+func TestScan(t *testing.T) {
+	adapter := sim.NewAdapter()
+	if err := adapter.Attach(5, sim.NewE3631A(1)); err != nil {
+		t.Fatal(err)
+	}
+	legacy := sim.NewScripted("", map[string]string{"ID?": "HP3478A"})
+	if err := adapter.Attach(9, legacy); err != nil {
+		t.Fatal(err)
+	}
+	if err := adapter.AttachSecondary(12, 98, sim.NewScripted("ACME,X1,42,1.0", nil)); err != nil {
+		t.Fatal(err)
+	}
+	conn := adapter.Dial()
+	defer conn.Close()
+	gpib, err := NewController(conn, 3, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inv, err := gpib.Scan(context.Background(), WithScanSecondary(), WithScanAddresses(4, 5, 9, 12))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Listener{
+		{
+			PrimaryAddress: 5,
+			Query:          "*IDN?",
+			RawID:          "HEWLETT-PACKARD,E3631A,0,2.1-5.0-1.0",
+			Identity:       Identity{"HEWLETT-PACKARD", "E3631A", "0", "2.1-5.0-1.0"},
+		},
+		{
+			PrimaryAddress: 9,
+			Query:          "ID?",
+			RawID:          "HP3478A",
+			Identity:       Identity{Manufacturer: "HEWLETT-PACKARD", Model: "3478A"},
+		},
+		{
+			PrimaryAddress:   12,
+			SecondaryAddress: 98,
+			Query:            "*IDN?",
+			RawID:            "ACME,X1,42,1.0",
+			Identity:         Identity{"ACME", "X1", "42", "1.0"},
+		},
+	}
+	if len(inv.Listeners) != len(want) {
+		t.Fatalf("got listeners %+v; want %+v", inv.Listeners, want)
+	}
+	for i, l := range inv.Listeners {
+		if l != want[i] {
+			t.Errorf("got listener %+v; want %+v", l, want[i])
+		}
+	}
+	if inv.Controller != sim.VersionUSB {
+		t.Errorf("got controller %q; want %q", inv.Controller, sim.VersionUSB)
+	}
+
+	// The controller configuration is restored after the scan.
+	if addr, err := gpib.InstrumentAddress(); err != nil || addr != 3 {
+		t.Errorf("got address %d (%v); want 3", addr, err)
+	}
+	if timeout, err := gpib.ReadTimeout(); err != nil || timeout != 500 {
+		t.Errorf("got read timeout %d (%v); want 500", timeout, err)
+	}
+}
+
+func TestScanCanceled(t *testing.T) {
+	conn := sim.NewAdapter().Dial()
+	defer conn.Close()
+	gpib, err := NewController(conn, 3, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	if _, err := gpib.Scan(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got error %v; want %v", err, context.DeadlineExceeded)
+	}
+}
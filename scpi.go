@@ -0,0 +1,180 @@
+// Copyright (c) 2020–2024 The prologix developers. All rights reserved.
+// Project site: https://github.com/gotmc/prologix
+// Use of this source code is governed by a MIT-style license that
+// can be found in the LICENSE.txt file for the project.
+
+package prologix
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// maxErrorQueue limits the number of `SYST:ERR?` queries used to drain the
+// error queue, which guards against an instrument that never reports that
+// the queue is empty.
+const maxErrorQueue = 100
+
+// ErrorClass is the class of an SCPI error or event, which is determined by
+// the range of its code.
+type ErrorClass int
+
+// SCPI error and event classes.
+const (
+	NoError                ErrorClass = iota // 0
+	CommandError                             // -100 to -199
+	ExecutionError                           // -200 to -299
+	DeviceSpecificError                      // -300 to -399
+	QueryError                               // -400 to -499
+	PowerOnEvent                             // -500 to -599
+	UserRequestEvent                         // -600 to -699
+	RequestControlEvent                      // -700 to -799
+	OperationCompleteEvent                   // -800 to -899
+	InstrumentError                          // positive codes defined by the instrument
+	ReservedError                            // other negative codes
+)
+
+var errorClassDesc = map[ErrorClass]string{
+	NoError:                "no error",
+	CommandError:           "command error",
+	ExecutionError:         "execution error",
+	DeviceSpecificError:    "device-specific error",
+	QueryError:             "query error",
+	PowerOnEvent:           "power on event",
+	UserRequestEvent:       "user request event",
+	RequestControlEvent:    "request control event",
+	OperationCompleteEvent: "operation complete event",
+	InstrumentError:        "instrument error",
+	ReservedError:          "reserved error",
+}
+
+func (class ErrorClass) String() string {
+	return errorClassDesc[class]
+}
+
+// SCPIError is an entry of an SCPI error queue as returned by the
+// `SYST:ERR?` query, such as `-113,"Undefined header"`.
+type SCPIError struct {
+	Code    int
+	Message string
+	// Info is the optional device-dependent information following the
+	// message, separated by a semicolon.
+	Info string
+}
+
+// ParseSCPIError parses the response to the `SYST:ERR?` query.
+func ParseSCPIError(s string) (SCPIError, error) {
+	s = strings.TrimSpace(s)
+	code, msg, ok := strings.Cut(s, ",")
+	if !ok {
+		return SCPIError{}, fmt.Errorf("SCPI error not determinable; received %s", s)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(code))
+	if err != nil {
+		return SCPIError{}, fmt.Errorf("SCPI error code not determinable; received %s", s)
+	}
+	msg = strings.TrimSpace(msg)
+	if len(msg) >= 2 && msg[0] == '"' && msg[len(msg)-1] == '"' {
+		msg = strings.ReplaceAll(msg[1:len(msg)-1], `""`, `"`)
+	}
+	e := SCPIError{Code: n, Message: msg}
+	if m, info, ok := strings.Cut(msg, ";"); ok {
+		e.Message = m
+		e.Info = info
+	}
+	return e, nil
+}
+
+// Class returns the class of the error.
+func (e SCPIError) Class() ErrorClass {
+	switch {
+	case e.Code == 0:
+		return NoError
+	case e.Code > 0:
+		return InstrumentError
+	case e.Code <= -100 && e.Code >= -899:
+		return ErrorClass(-e.Code / 100)
+	}
+	return ReservedError
+}
+
+func (e SCPIError) Error() string {
+	if e.Info != "" {
+		return fmt.Sprintf("%d,\"%s;%s\"", e.Code, e.Message, e.Info)
+	}
+	return fmt.Sprintf("%d,\"%s\"", e.Code, e.Message)
+}
+
+// SCPIErrors are the errors drained from an error queue.
+type SCPIErrors []SCPIError
+
+func (errs SCPIErrors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, e := range errs {
+		msgs[i] = e.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Unwrap returns the errors, so that errors.As finds an SCPIError.
+func (errs SCPIErrors) Unwrap() []error {
+	unwrapped := make([]error, len(errs))
+	for i, e := range errs {
+		unwrapped[i] = e
+	}
+	return unwrapped
+}
+
+// DrainErrors reads the SCPI error queue of the instrument at the currently
+// assigned GPIB address using the `SYST:ERR?` query until it's empty, and
+// returns the errors in the order they occurred.
+func (c *Controller) DrainErrors() (SCPIErrors, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.drainErrors()
+}
+
+// drainErrors reads the error queue. The lock must be held.
+func (c *Controller) drainErrors() (SCPIErrors, error) {
+	var errs SCPIErrors
+	for n := 0; n < maxErrorQueue; n++ {
+		s, err := c.query("SYST:ERR?")
+		if err != nil {
+			return errs, err
+		}
+		e, err := ParseSCPIError(s)
+		if err != nil {
+			return errs, err
+		}
+		if e.Code == 0 {
+			return errs, nil
+		}
+		errs = append(errs, e)
+	}
+	return errs, fmt.Errorf("error queue not empty after %d queries", maxErrorQueue)
+}
+
+// DrainErrors reads the SCPI error queue of the instrument using the
+// `SYST:ERR?` query until it's empty, and returns the errors in the order
+// they occurred.
+func (i *Instrument) DrainErrors() (errs SCPIErrors, err error) {
+	err = i.do(func() error {
+		errs, err = i.c.drainErrors()
+		return err
+	})
+	return errs, err
+}
+
+// IsQuery reports whether any of the semicolon separated commands in the
+// line has a header ending in a question mark, such as `*IDN?` or
+// `MEAS:VOLT? P6V`, so that a response is expected.
+func IsQuery(line string) bool {
+	for _, msg := range strings.Split(line, ";") {
+		header, _, _ := strings.Cut(strings.TrimSpace(msg), " ")
+		if strings.HasSuffix(header, "?") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,96 @@
+// Copyright (c) 2020–2024 The prologix developers. All rights reserved.
+// Project site: https://github.com/gotmc/prologix
+// Use of this source code is governed by a MIT-style license that
+// can be found in the LICENSE.txt file for the project.
+
+package prologix
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/gotmc/prologix/sim"
+)
+
+func TestParseSCPIError(t *testing.T) {
+	testCases := []struct {
+		given string
+		want  SCPIError
+		class ErrorClass
+	}{
+		{`+0,"No error"`, SCPIError{0, "No error", ""}, NoError},
+		{"-113,\"Undefined header\"\n", SCPIError{-113, "Undefined header", ""}, CommandError},
+		{`-222,"Data out of range;VOLT 40"`, SCPIError{-222, "Data out of range", "VOLT 40"}, ExecutionError},
+		{`-350, "Queue overflow"`, SCPIError{-350, "Queue overflow", ""}, DeviceSpecificError},
+		{`-410,"Query INTERRUPTED"`, SCPIError{-410, "Query INTERRUPTED", ""}, QueryError},
+		{`-500,"Power on"`, SCPIError{-500, "Power on", ""}, PowerOnEvent},
+		{`-800,"Operation complete"`, SCPIError{-800, "Operation complete", ""}, OperationCompleteEvent},
+		{`501,"Isolator UART framing error"`, SCPIError{501, "Isolator UART framing error", ""}, InstrumentError},
+		{`-42,"Odd"`, SCPIError{-42, "Odd", ""}, ReservedError},
+		{`-100,"Said ""hi"""`, SCPIError{-100, `Said "hi"`, ""}, CommandError},
+	}
+	for _, tc := range testCases {
+		got, err := ParseSCPIError(tc.given)
+		if err != nil {
+			t.Errorf("ParseSCPIError(%q) error: %s", tc.given, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("ParseSCPIError(%q) = %#v; want %#v", tc.given, got, tc.want)
+		}
+		if got.Class() != tc.class {
+			t.Errorf("class of %q = %s; want %s", tc.given, got.Class(), tc.class)
+		}
+	}
+	for _, given := range []string{"", "No error", `x,"Bad code"`} {
+		if _, err := ParseSCPIError(given); err == nil {
+			t.Errorf("ParseSCPIError(%q) succeeded; want error", given)
+		}
+	}
+}
+
+func TestDrainErrors(t *testing.T) {
+	fgen := newSimInstrument(t, 6, sim.NewKey33220A(1))
+	for _, cmd := range []string{"BURS: ON", "FREQ 1e12"} {
+		if err := fgen.Command(cmd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	errs, err := fgen.DrainErrors()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(errs) != 2 || errs[0].Class() != CommandError || errs[1].Class() != ExecutionError {
+		t.Errorf("got errors %v; want a command error and an execution error", errs)
+	}
+	if errs, err := fgen.DrainErrors(); err != nil || len(errs) != 0 {
+		t.Errorf("got errors %v (%v) from drained queue; want none", errs, err)
+	}
+}
+
+func TestStrictErrors(t *testing.T) {
+	fgen := newSimInstrument(t, 6, sim.NewKey33220A(1))
+	strict, err := fgen.Controller().Instrument(6, WithStrictErrors())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := strict.Command("FREQ %d", 1000); err != nil {
+		t.Errorf("got error %v for valid command; want none", err)
+	}
+	err = strict.Command("BURS: ON")
+	var scpiErr SCPIError
+	if !errors.As(err, &scpiErr) || scpiErr.Code != -113 {
+		t.Fatalf("got error %v; want -113 undefined header", err)
+	}
+	if got, want := err.Error(), `command BURS: ON: -113,"Undefined header"`; got != want {
+		t.Errorf("got error %q; want %q", got, want)
+	}
+	// Errors caused by other commands are reported by the next strict command.
+	if err := fgen.Command("FREQ 1e12"); err != nil {
+		t.Fatal(err)
+	}
+	var errs SCPIErrors
+	if err := strict.Command("OUTP OFF"); !errors.As(err, &errs) || len(errs) != 1 {
+		t.Errorf("got error %v; want the pending execution error", err)
+	}
+}
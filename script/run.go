@@ -0,0 +1,387 @@
+// Copyright (c) 2020–2024 The prologix developers. All rights reserved.
+// Project site: https://github.com/gotmc/prologix
+// Use of this source code is governed by a MIT-style license that
+// can be found in the LICENSE.txt file for the project.
+
+package script
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gotmc/prologix"
+)
+
+// defaultOPCTimeout is the time allowed for the `opc` statement when the
+// script doesn't give one.
+const defaultOPCTimeout = 10 * time.Second
+
+// ErrAssertion is returned by Run when assertions failed.
+var ErrAssertion = errors.New("assertion failed")
+
+// Result is the outcome of a step of a script.
+type Result struct {
+	File string
+	Line int
+	// Step is the statement with its variables expanded.
+	Step string
+	// Response is the response read by the step, if any.
+	Response string
+	Err      error
+	Duration time.Duration
+}
+
+// Option applies an option to Run.
+type Option func(*runner)
+
+// WithAddress selects the instrument at the primary address, and the
+// secondary address if not zero, before the script's first `addr`
+// statement. It defaults to the primary address 0.
+func WithAddress(pad, sad int) Option {
+	return func(r *runner) {
+		r.pad, r.sad = pad, sad
+	}
+}
+
+// WithTimeout sets the time allowed for each response to be read, which
+// defaults to 5 seconds.
+func WithTimeout(timeout time.Duration) Option {
+	return func(r *runner) {
+		r.timeout = timeout
+	}
+}
+
+// WithVariable sets the variable before the script runs.
+func WithVariable(name, value string) Option {
+	return func(r *runner) {
+		r.vars[name] = value
+	}
+}
+
+// WithReporter calls report with the result of each step once it's done.
+func WithReporter(report func(Result)) Option {
+	return func(r *runner) {
+		r.report = report
+	}
+}
+
+// runner holds the state of a running script.
+type runner struct {
+	c        *prologix.Controller
+	inst     *prologix.Instrument
+	pad, sad int
+	timeout  time.Duration
+	vars     map[string]string
+	report   func(Result)
+	failed   int
+}
+
+// Run runs the script on the bus of the controller until a step fails or the
+// context is done. If only assertions failed, the error wraps ErrAssertion.
+func (s *Script) Run(ctx context.Context, c *prologix.Controller, opts ...Option) error {
+	r := runner{
+		c:       c,
+		timeout: 5 * time.Second,
+		vars:    make(map[string]string),
+		report:  func(Result) {},
+	}
+	for _, opt := range opts {
+		opt(&r)
+	}
+	if err := r.selectAddress(r.pad, r.sad); err != nil {
+		return err
+	}
+	if err := r.run(ctx, s.steps); err != nil {
+		return err
+	}
+	if r.failed > 0 {
+		return fmt.Errorf("%d %w", r.failed, ErrAssertion)
+	}
+	return nil
+}
+
+func (r *runner) selectAddress(pad, sad int) error {
+	var opts []prologix.InstrumentOption
+	if sad != 0 {
+		opts = append(opts, prologix.WithInstrumentSecondaryAddress(sad))
+	}
+	inst, err := r.c.Instrument(pad, opts...)
+	if err != nil {
+		return err
+	}
+	r.inst = inst
+	return nil
+}
+
+// run runs the steps, returning the error of the first one failing other
+// than by an assertion.
+func (r *runner) run(ctx context.Context, steps []step) error {
+	for _, st := range steps {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if st.op == "repeat" {
+			if err := r.repeat(ctx, st); err != nil {
+				return err
+			}
+			continue
+		}
+		start := time.Now()
+		resp, err := r.exec(ctx, st)
+		res := Result{
+			File:     st.file,
+			Line:     st.line,
+			Step:     st.text(r.vars),
+			Response: resp,
+			Err:      err,
+			Duration: time.Since(start),
+		}
+		r.report(res)
+		var aerr *assertionError
+		if errors.As(err, &aerr) {
+			r.failed++
+		} else if err != nil {
+			return fmt.Errorf("%s:%d: %w", st.file, st.line, err)
+		}
+	}
+	return nil
+}
+
+func (r *runner) repeat(ctx context.Context, st step) error {
+	arg, err := expand(st.arg, r.vars)
+	if err != nil {
+		return fmt.Errorf("%s:%d: %w", st.file, st.line, err)
+	}
+	n, err := parseCount(arg)
+	if err != nil {
+		return fmt.Errorf("%s:%d: %w", st.file, st.line, err)
+	}
+	for i := 1; i <= n; i++ {
+		if st.capture != "" {
+			r.vars[st.capture] = strconv.Itoa(i)
+		}
+		if err := r.run(ctx, st.body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exec executes a statement other than a loop and returns its response.
+func (r *runner) exec(ctx context.Context, st step) (string, error) {
+	if st.op == "assert" {
+		// The operands are expanded separately, so that values with spaces
+		// don't change the meaning of the assertion.
+		a, err := parseAssertion(st.arg)
+		if err != nil {
+			return "", err
+		}
+		return "", a.check(r.vars)
+	}
+	arg, err := expand(st.arg, r.vars)
+	if err != nil {
+		return "", err
+	}
+	switch st.op {
+	case "addr":
+		pad, sad, err := parseAddress(arg)
+		if err != nil {
+			return "", err
+		}
+		return "", r.selectAddress(pad, sad)
+	case "write":
+		return "", r.inst.Command(arg)
+	case "query":
+		ctx, cancel := context.WithTimeout(ctx, r.timeout)
+		defer cancel()
+		resp, err := r.inst.QueryContext(ctx, arg)
+		return r.capture(st, resp), err
+	case "read":
+		ctx, cancel := context.WithTimeout(ctx, r.timeout)
+		defer cancel()
+		resp, err := r.inst.ReadContext(ctx)
+		return r.capture(st, resp), err
+	case "trigger":
+		return "", r.inst.Trigger()
+	case "clear":
+		return "", r.inst.ClearDevice()
+	case "wait":
+		d, err := parseDuration(arg)
+		if err != nil {
+			return "", err
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			return "", nil
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	case "opc":
+		timeout := defaultOPCTimeout
+		if arg != "" {
+			if timeout, err = parseDuration(arg); err != nil {
+				return "", err
+			}
+		}
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		return "", r.inst.WaitOperationComplete(ctx)
+	case "set":
+		name, value := cutSpace(arg)
+		r.vars[name] = strings.TrimSpace(value)
+		return "", nil
+	case "echo":
+		// The text is reported as the step.
+		return "", nil
+	}
+	return "", fmt.Errorf("unknown statement %q", st.op)
+}
+
+// capture trims the response and sets the variable of the step to it.
+func (r *runner) capture(st step, resp string) string {
+	resp = strings.TrimSpace(resp)
+	if st.capture != "" {
+		r.vars[st.capture] = resp
+	}
+	return resp
+}
+
+// assertion is the condition of an `assert` statement, whose operands may
+// refer to variables.
+type assertion struct {
+	a, op, b string
+	tol      string
+	percent  bool
+}
+
+// assertionError reports a failed assertion.
+type assertionError struct {
+	msg string
+}
+
+func (e *assertionError) Error() string {
+	return e.msg
+}
+
+var operators = map[string]bool{
+	"==": true, "!=": true, "<": true, "<=": true, ">": true, ">=": true,
+	"contains": true, "matches": true,
+}
+
+// parseAssertion parses a condition like `$v == 1.5 +/- 0.01`.
+func parseAssertion(s string) (assertion, error) {
+	fields := strings.Fields(s)
+	i := 0
+	for i < len(fields) && !operators[fields[i]] {
+		i++
+	}
+	if i == 0 || i >= len(fields)-1 {
+		return assertion{}, fmt.Errorf("invalid condition %q (want a op b [+/- tol])", s)
+	}
+	a := assertion{a: strings.Join(fields[:i], " "), op: fields[i]}
+	rest := fields[i+1:]
+	for j, f := range rest {
+		if f == "+/-" || f == "±" {
+			if j == 0 || j != len(rest)-2 {
+				return assertion{}, fmt.Errorf("invalid tolerance in %q", s)
+			}
+			if a.op != "==" && a.op != "!=" {
+				return assertion{}, fmt.Errorf("tolerance only applies to == and !=")
+			}
+			a.tol, a.percent = strings.CutSuffix(rest[j+1], "%")
+			rest = rest[:j]
+			break
+		}
+	}
+	a.b = strings.Join(rest, " ")
+	if a.op == "matches" && !strings.Contains(a.b, "$") {
+		if _, err := regexp.Compile(a.b); err != nil {
+			return assertion{}, fmt.Errorf("invalid regular expression: %w", err)
+		}
+	}
+	return a, nil
+}
+
+// check evaluates the condition, returning an assertionError if it doesn't
+// hold.
+func (a assertion) check(vars map[string]string) error {
+	var vals [3]string
+	for i, s := range []string{a.a, a.b, a.tol} {
+		v, err := expand(s, vars)
+		if err != nil {
+			return err
+		}
+		vals[i] = v
+	}
+	got, want, tol := vals[0], vals[1], vals[2]
+	x, xerr := strconv.ParseFloat(got, 64)
+	y, yerr := strconv.ParseFloat(want, 64)
+	numeric := xerr == nil && yerr == nil
+
+	var ok bool
+	switch a.op {
+	case "==", "!=":
+		switch {
+		case a.tol != "":
+			d, err := strconv.ParseFloat(tol, 64)
+			if err != nil || d < 0 {
+				return fmt.Errorf("invalid tolerance %q", tol)
+			}
+			if !numeric {
+				return &assertionError{fmt.Sprintf("got %q; want a number within %s of %q", got, tol, want)}
+			}
+			if a.percent {
+				d *= math.Abs(y) / 100
+			}
+			ok = math.Abs(x-y) <= d
+		case numeric:
+			ok = x == y
+		default:
+			ok = got == want
+		}
+		if a.op == "!=" {
+			ok = !ok
+		}
+	case "<", "<=", ">", ">=":
+		if !numeric {
+			return &assertionError{fmt.Sprintf("got %q %s %q; want numbers", got, a.op, want)}
+		}
+		switch a.op {
+		case "<":
+			ok = x < y
+		case "<=":
+			ok = x <= y
+		case ">":
+			ok = x > y
+		case ">=":
+			ok = x >= y
+		}
+	case "contains":
+		ok = strings.Contains(got, want)
+	case "matches":
+		re, err := regexp.Compile(want)
+		if err != nil {
+			return fmt.Errorf("invalid regular expression: %w", err)
+		}
+		ok = re.MatchString(got)
+	}
+	if ok {
+		return nil
+	}
+	want = a.op + " " + want
+	if a.tol != "" {
+		want += " +/- " + tol
+		if a.percent {
+			want += "%"
+		}
+	}
+	return &assertionError{fmt.Sprintf("got %s; want %s", got, want)}
+}
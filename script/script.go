@@ -0,0 +1,332 @@
+// Copyright (c) 2020–2024 The prologix developers. All rights reserved.
+// Project site: https://github.com/gotmc/prologix
+// Use of this source code is governed by a MIT-style license that
+// can be found in the LICENSE.txt file for the project.
+
+// Package script runs scripts of instrument commands, so that sequences of
+// commands, waits, and checks don't need a Go program of their own. Each line
+// of a script holds one statement, and blank lines and lines starting with
+// `#` are ignored. The statements are:
+//
+//	addr pad[,sad]         select the instrument at the GPIB address
+//	write cmd              send the command to the instrument
+//	query cmd [-> var]     send the query and read the response
+//	read [-> var]          read a response, such as after a query sent by write
+//	trigger                send Group Execute Trigger (GET) to the instrument
+//	clear                  send Selected Device Clear (SDC) to the instrument
+//	wait duration          pause, for a duration such as 500ms or 2s
+//	opc [timeout]          wait for the instrument to complete its operations
+//	                       using `*OPC?`, for up to 10s by default
+//	set var value          set the variable to the value
+//	echo text              report the text as a step
+//	assert a op b [+/- tol[%]]
+//	                       check a condition, where op is ==, !=, <, <=, >, >=,
+//	                       contains, or matches (a regular expression)
+//	repeat n [-> var] ... end
+//	                       run the statements up to the matching end n times,
+//	                       setting the variable to the iteration from 1 to n
+//	include file           run the statements of the file, whose path, unless
+//	                       absolute, is relative to the including script
+//
+// The keyword of a statement is separated from its arguments by spaces or
+// tabs.
+//
+// The responses captured with `->` have surrounding whitespace removed.
+// Variables are expanded in the arguments of the statements as `$var` or
+// `${var}`, and `$$` stands for a dollar sign.
+//
+// Operands of assertions that are both numbers are compared numerically;
+// otherwise == and != compare the text. With a tolerance, the operands must be
+// numbers, and == checks that they differ by at most the tolerance, which may
+// be a percentage of the expected value b:
+//
+//	query MEAS:VOLT? P6V -> v
+//	assert $v == 3.3 +/- 1%
+//
+// A failed assertion is reported without stopping the script, while any other
+// failure stops it.
+package script
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// varName matches the name of a variable.
+var varName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Script is a parsed script, with its include files inlined.
+type Script struct {
+	steps []step
+}
+
+// step is a statement of a script.
+type step struct {
+	file string
+	line int
+	// op is the statement keyword, in lowercase.
+	op  string
+	arg string
+	// capture is the variable set by the statement, if any.
+	capture string
+	// body holds the statements of a repeat loop.
+	body []step
+}
+
+// text returns the statement with its variables expanded, if possible.
+func (st step) text(vars map[string]string) string {
+	s := st.op
+	if arg, err := expand(st.arg, vars); err == nil && arg != "" {
+		s += " " + arg
+	} else if st.arg != "" {
+		s += " " + st.arg
+	}
+	if st.capture != "" {
+		s += " -> " + st.capture
+	}
+	return s
+}
+
+// ParseFile parses the script in the named file along with the files it
+// includes.
+func ParseFile(name string) (*Script, error) {
+	p := parser{open: make(map[string]bool)}
+	steps, err := p.parseFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return &Script{steps: steps}, nil
+}
+
+// parser parses a script and its include files.
+type parser struct {
+	// open holds the files being parsed, to detect recursive includes.
+	open map[string]bool
+}
+
+func (p *parser) parseFile(name string) ([]step, error) {
+	path, err := filepath.Abs(name)
+	if err != nil {
+		return nil, err
+	}
+	if p.open[path] {
+		return nil, fmt.Errorf("%s includes itself", name)
+	}
+	p.open[path] = true
+	defer delete(p.open, path)
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// stack holds the steps of the script followed by those of the loops
+	// being parsed.
+	stack := [][]step{nil}
+	var loops []step
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		st, err := parseStep(name, n, line)
+		if err != nil {
+			return nil, err
+		}
+		switch st.op {
+		case "repeat":
+			loops = append(loops, st)
+			stack = append(stack, nil)
+			continue
+		case "end":
+			if len(loops) == 0 {
+				return nil, fmt.Errorf("%s:%d: end without repeat", name, n)
+			}
+			st = loops[len(loops)-1]
+			st.body = stack[len(stack)-1]
+			loops = loops[:len(loops)-1]
+			stack = stack[:len(stack)-1]
+		case "include":
+			path := st.arg
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(filepath.Dir(name), path)
+			}
+			included, err := p.parseFile(path)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", name, n, err)
+			}
+			stack[len(stack)-1] = append(stack[len(stack)-1], included...)
+			continue
+		}
+		stack[len(stack)-1] = append(stack[len(stack)-1], st)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(loops) > 0 {
+		st := loops[len(loops)-1]
+		return nil, fmt.Errorf("%s:%d: repeat without end", st.file, st.line)
+	}
+	return stack[0], nil
+}
+
+// parseStep parses the statement on the line, checking its arguments unless
+// they contain variables, which are only known when the script runs.
+func parseStep(file string, n int, line string) (step, error) {
+	op, arg := cutSpace(line)
+	st := step{file: file, line: n, op: strings.ToLower(op), arg: strings.TrimSpace(arg)}
+	fail := func(format string, a ...any) (step, error) {
+		return st, fmt.Errorf("%s:%d: %s: %s", file, n, st.op, fmt.Sprintf(format, a...))
+	}
+	switch st.op {
+	case "query", "read", "repeat":
+		if i := strings.LastIndex(st.arg, "->"); i >= 0 {
+			st.capture = strings.TrimSpace(st.arg[i+2:])
+			st.arg = strings.TrimSpace(st.arg[:i])
+			if !varName.MatchString(st.capture) {
+				return fail("invalid variable name %q", st.capture)
+			}
+		}
+	}
+	known := !strings.Contains(st.arg, "$")
+	switch st.op {
+	case "addr":
+		if known {
+			if _, _, err := parseAddress(st.arg); err != nil {
+				return fail("%v", err)
+			}
+		}
+	case "write", "query", "echo", "include":
+		if st.arg == "" {
+			return fail("missing argument")
+		}
+	case "read", "trigger", "clear", "end":
+		if st.arg != "" {
+			return fail("unexpected argument %q", st.arg)
+		}
+	case "wait":
+		if known {
+			if _, err := parseDuration(st.arg); err != nil {
+				return fail("%v", err)
+			}
+		}
+	case "opc":
+		if known && st.arg != "" {
+			if _, err := parseDuration(st.arg); err != nil {
+				return fail("%v", err)
+			}
+		}
+	case "set":
+		name, _ := cutSpace(st.arg)
+		if !varName.MatchString(name) {
+			return fail("invalid variable name %q", name)
+		}
+	case "assert":
+		if _, err := parseAssertion(st.arg); err != nil {
+			return fail("%v", err)
+		}
+	case "repeat":
+		if known {
+			if _, err := parseCount(st.arg); err != nil {
+				return fail("%v", err)
+			}
+		}
+	default:
+		return st, fmt.Errorf("%s:%d: unknown statement %q", file, n, op)
+	}
+	return st, nil
+}
+
+// cutSpace slices s around the first run of whitespace, returning the text
+// before and after it.
+func cutSpace(s string) (before, after string) {
+	i := strings.IndexFunc(s, unicode.IsSpace)
+	if i < 0 {
+		return s, ""
+	}
+	return s[:i], strings.TrimLeftFunc(s[i:], unicode.IsSpace)
+}
+
+// parseAddress parses a GPIB address given as the primary address optionally
+// followed by a comma or whitespace and the secondary address.
+func parseAddress(s string) (pad, sad int, err error) {
+	fields := strings.FieldsFunc(s, func(r rune) bool { return r == ',' || unicode.IsSpace(r) })
+	if len(fields) < 1 || len(fields) > 2 {
+		return 0, 0, fmt.Errorf("invalid GPIB address %q", s)
+	}
+	if pad, err = strconv.Atoi(fields[0]); err != nil || pad < 0 || pad > 30 {
+		return 0, 0, fmt.Errorf("invalid primary address %q (must be 0-30)", fields[0])
+	}
+	if len(fields) == 2 {
+		if sad, err = strconv.Atoi(fields[1]); err != nil || sad < 96 || sad > 126 {
+			return 0, 0, fmt.Errorf("invalid secondary address %q (must be 96-126)", fields[1])
+		}
+	}
+	return pad, sad, nil
+}
+
+func parseDuration(s string) (time.Duration, error) {
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return d, nil
+}
+
+func parseCount(s string) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid count %q", s)
+	}
+	return n, nil
+}
+
+// expand replaces the variables in s by their values.
+func expand(s string, vars map[string]string) (string, error) {
+	var b strings.Builder
+	for {
+		i := strings.IndexByte(s, '$')
+		if i < 0 {
+			b.WriteString(s)
+			return b.String(), nil
+		}
+		b.WriteString(s[:i])
+		s = s[i+1:]
+		var name string
+		switch {
+		case strings.HasPrefix(s, "$"):
+			b.WriteByte('$')
+			s = s[1:]
+			continue
+		case strings.HasPrefix(s, "{"):
+			end := strings.IndexByte(s, '}')
+			if end < 0 {
+				return "", fmt.Errorf("unterminated variable reference ${%s", s[1:])
+			}
+			name, s = s[1:end], s[end+1:]
+		default:
+			end := 0
+			for end < len(s) && (s[end] == '_' || isAlphanumeric(s[end])) {
+				end++
+			}
+			name, s = s[:end], s[end:]
+		}
+		v, ok := vars[name]
+		if !ok {
+			return "", fmt.Errorf("undefined variable $%s", name)
+		}
+		b.WriteString(v)
+	}
+}
+
+func isAlphanumeric(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
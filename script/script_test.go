@@ -0,0 +1,240 @@
+// Copyright (c) 2020–2024 The prologix developers. All rights reserved.
+// Project site: https://github.com/gotmc/prologix
+// Use of this source code is governed by a MIT-style license that
+// can be found in the LICENSE.txt file for the project.
+
+package script
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gotmc/prologix"
+	"github.com/gotmc/prologix/sim"
+)
+
+// writeScripts writes the files, named relative to a temporary directory,
+// and returns the path of the first one.
+func writeScripts(t *testing.T, files ...string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for i := 0; i < len(files); i += 2 {
+		name := filepath.Join(dir, files[i])
+		if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, []byte(files[i+1]), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return filepath.Join(dir, files[0])
+}
+
+func TestRun(t *testing.T) {
+	adapter := sim.NewAdapter()
+	supply := sim.NewE3631A(1)
+	if err := adapter.Attach(5, supply); err != nil {
+		t.Fatal(err)
+	}
+	if err := adapter.Attach(10, sim.NewKey33220A(1)); err != nil {
+		t.Fatal(err)
+	}
+	conn := adapter.Dial()
+	defer conn.Close()
+	c, err := prologix.NewController(conn, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	name := writeScripts(t,
+		"test.txt", `# Power up the supply and check its output.
+include lib/setup.txt
+set volts 3.3
+write APPL P6V, $volts, 0.5
+write OUTP ON
+repeat 2 -> i
+  query MEAS:VOLT? P6V -> v
+  assert $v == $volts +/- 1%
+  echo reading $i is ${v}V
+end
+assert $v > 5
+addr 10
+write APPL:SIN 100,0.5,0.0
+opc 2s
+query *IDN? -> idn
+assert $idn contains 33220A
+`,
+		"lib/setup.txt", `addr 5
+clear
+write *RST
+wait 1ms
+`,
+	)
+	s, err := ParseFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var results []Result
+	err = s.Run(context.Background(), c, WithReporter(func(r Result) {
+		results = append(results, r)
+	}))
+	if !errors.Is(err, ErrAssertion) || !strings.HasPrefix(err.Error(), "1 ") {
+		t.Errorf("got error %v; want 1 assertion failed", err)
+	}
+
+	// The steps are reported with their variables expanded, so only the
+	// beginning of those depending on measurements is known.
+	want := []string{
+		"addr 5",
+		"clear",
+		"write *RST",
+		"wait 1ms",
+		"set volts 3.3",
+		"write APPL P6V, 3.3, 0.5",
+		"write OUTP ON",
+		"query MEAS:VOLT? P6V -> v",
+		"assert +3.",
+		"echo reading 1 is +3.",
+		"query MEAS:VOLT? P6V -> v",
+		"assert +3.",
+		"echo reading 2 is +3.",
+		"assert +3.",
+		"addr 10",
+		"write APPL:SIN 100,0.5,0.0",
+		"opc 2s",
+		"query *IDN? -> idn",
+		"assert Agilent Technologies,33220A",
+	}
+	if len(results) != len(want) {
+		t.Fatalf("got %d results; want %d", len(results), len(want))
+	}
+	for i, r := range results {
+		if !strings.HasPrefix(r.Step, want[i]) {
+			t.Errorf("got step %d %q; want %s...", i, r.Step, want[i])
+		}
+	}
+	if r := results[1]; r.File != filepath.Join(filepath.Dir(name), "lib/setup.txt") || r.Line != 2 {
+		t.Errorf("got %s:%d for clear; want line 2 of the include file", r.File, r.Line)
+	}
+	for i, r := range results {
+		if wantErr := i == 13; (r.Err != nil) != wantErr {
+			t.Errorf("%s: got error %v", r.Step, r.Err)
+		}
+	}
+	if r := results[9]; !strings.HasSuffix(r.Step, "V") {
+		t.Errorf("got echo %q; want the first reading", r.Step)
+	}
+	if r := results[13]; !strings.HasSuffix(r.Err.Error(), "; want > 5") {
+		t.Errorf("got error %v for failed assertion", r.Err)
+	}
+}
+
+func TestRunStopsOnError(t *testing.T) {
+	adapter := sim.NewAdapter()
+	conn := adapter.Dial()
+	defer conn.Close()
+	c, err := prologix.NewController(conn, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := writeScripts(t, "test.txt", "echo $missing\necho unreached\n")
+	s, err := ParseFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	err = s.Run(context.Background(), c, WithReporter(func(Result) { n++ }))
+	if err == nil || !strings.Contains(err.Error(), "test.txt:1: undefined variable $missing") || n != 1 {
+		t.Errorf("got error %v after %d steps; want undefined variable after 1 step", err, n)
+	}
+}
+
+func TestParseFileErrors(t *testing.T) {
+	for _, tc := range []struct {
+		src  string
+		want string
+	}{
+		{"frobnicate", `unknown statement "frobnicate"`},
+		{"end", "end without repeat"},
+		{"repeat 2\nwrite *RST", "test.txt:1: repeat without end"},
+		{"repeat x\nend", `invalid count "x"`},
+		{"addr 31", "invalid primary address"},
+		{"addr 5,95", "invalid secondary address"},
+		{"wait soon", `invalid duration "soon"`},
+		{"query *IDN? -> 1x", `invalid variable name "1x"`},
+		{"write", "missing argument"},
+		{"read 5", "unexpected argument"},
+		{"assert $v", "invalid condition"},
+		{"assert $v < 5 +/- 1", "tolerance only applies"},
+		{"assert $v matches (", "invalid regular expression"},
+		{"include test.txt", "includes itself"},
+		{"include missing.txt", "missing.txt"},
+	} {
+		_, err := ParseFile(writeScripts(t, "test.txt", tc.src))
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%q: got error %v; want %s", tc.src, err, tc.want)
+		}
+	}
+}
+
+func TestParseFileSeparators(t *testing.T) {
+	// The included file is given by its absolute path, and the keywords are
+	// followed by tabs.
+	lib := writeScripts(t, "lib.txt", "write\t*RST\n")
+	name := writeScripts(t, "test.txt", "include\t"+lib+"\nset\tvolts\t3.3\naddr\t5\t96\n")
+	s, err := ParseFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, st := range s.steps {
+		got = append(got, st.op+" "+st.arg)
+	}
+	want := []string{"write *RST", "set volts\t3.3", "addr 5\t96"}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("got steps %q; want %q", got, want)
+	}
+	if s.steps[0].file != lib {
+		t.Errorf("got file %s for included step; want %s", s.steps[0].file, lib)
+	}
+}
+
+func TestAssertion(t *testing.T) {
+	vars := map[string]string{"v": "1.52", "idn": "FLUKE, 45, 0, 1.6 D1.0"}
+	for _, tc := range []struct {
+		cond string
+		ok   bool
+	}{
+		{"$v == 1.52", true},
+		{"$v == 1.520", true},
+		{"$v == 1.5", false},
+		{"$v != 1.5", true},
+		{"$v == 1.5 +/- 0.05", true},
+		{"$v == 1.5 ± 0.01", false},
+		{"$v == 1.5 +/- 2%", true},
+		{"$v != 1.5 +/- 1%", true},
+		{"$v < 2", true},
+		{"$v >= 1.52", true},
+		{"$v > 10", false},
+		{"$idn == FLUKE, 45, 0, 1.6 D1.0", true},
+		{"$idn contains 45", true},
+		{"$idn matches ^FLUKE,\\s*4[56],", true},
+		{"$idn > 1", false},
+		{"$idn == 1 +/- 1", false},
+	} {
+		a, err := parseAssertion(tc.cond)
+		if err != nil {
+			t.Errorf("%s: %v", tc.cond, err)
+			continue
+		}
+		err = a.check(vars)
+		var aerr *assertionError
+		if tc.ok && err != nil || !tc.ok && !errors.As(err, &aerr) {
+			t.Errorf("%s: got %v; want ok %t", tc.cond, err, tc.ok)
+		}
+	}
+}
@@ -0,0 +1,608 @@
+// Copyright (c) 2020–2024 The prologix developers. All rights reserved.
+// Project site: https://github.com/gotmc/prologix
+// Use of this source code is governed by a MIT-style license that
+// can be found in the LICENSE.txt file for the project.
+
+/*
+Package sim emulates a Prologix GPIB-USB or GPIB-ETHERNET controller along
+with the GPIB instruments attached to its bus. The emulated adapter speaks the
+`++` protocol described in the Prologix user manuals, so it can stand in for
+real hardware when testing code built on the prologix package or when running
+the example applications without a bench.
+*/
+package sim
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Firmware version strings reported by the emulated adapter in response to
+// the `++ver` command.
+const (
+	VersionUSB      = "Prologix GPIB-USB Controller version 6.107"
+	VersionEthernet = "Prologix GPIB-ETHERNET Controller version 01.06.06.00"
+)
+
+const (
+	esc = 27
+	cr  = '\r'
+	lf  = '\n'
+)
+
+// address is a GPIB primary address with an optional secondary address. A
+// secondary address of zero indicates none is used.
+type address struct {
+	primary   int
+	secondary int
+}
+
+func (a address) String() string {
+	if a.secondary == 0 {
+		return strconv.Itoa(a.primary)
+	}
+	return fmt.Sprintf("%d %d", a.primary, a.secondary)
+}
+
+// config holds the adapter parameters that can be saved to EPROM using the
+// `++savecfg` command.
+type config struct {
+	addr      address
+	auto      bool
+	eoi       bool
+	eos       int
+	eotEnable bool
+	eotChar   byte
+	mode      int
+	readTmoMs int
+}
+
+// defaultConfig is the factory configuration of the Prologix controller.
+var defaultConfig = config{
+	addr:      address{primary: 0},
+	auto:      false,
+	eoi:       true,
+	eos:       0,
+	eotEnable: false,
+	eotChar:   0,
+	mode:      1,
+	readTmoMs: 500,
+}
+
+// Adapter emulates the firmware of a Prologix GPIB controller operating in
+// controller mode along with the instruments attached to its GPIB bus. An
+// Adapter is safe for concurrent use by multiple connections, although, like
+// the real hardware, all connections share the same configuration.
+type Adapter struct {
+	mu          sync.Mutex
+	version     string
+	cfg         config
+	saved       config
+	savecfg     bool
+	instruments map[address]Instrument
+	pending     map[address][]byte
+	lockout     bool
+	faults      *faultInjector
+	hangup      bool
+}
+
+// AdapterOption applies an option to the emulated adapter.
+type AdapterOption func(*Adapter)
+
+// NewAdapter creates an emulated Prologix GPIB controller with the factory
+// default configuration and no instruments attached.
+func NewAdapter(opts ...AdapterOption) *Adapter {
+	a := Adapter{
+		version:     VersionUSB,
+		cfg:         defaultConfig,
+		saved:       defaultConfig,
+		savecfg:     true,
+		instruments: make(map[address]Instrument),
+		pending:     make(map[address][]byte),
+	}
+	for _, opt := range opts {
+		opt(&a)
+	}
+	return &a
+}
+
+// WithVersion sets the version string returned by the `++ver` command.
+func WithVersion(version string) AdapterOption {
+	return func(a *Adapter) {
+		a.version = version
+	}
+}
+
+// Attach attaches the instrument to the GPIB bus at the given primary
+// address, which must be in the range of 0 to 30, inclusive.
+func (a *Adapter) Attach(addr int, inst Instrument) error {
+	return a.attach(address{primary: addr}, inst)
+}
+
+// AttachSecondary attaches the instrument to the GPIB bus at the given primary
+// and secondary address. The secondary address must be in the range of 96 to
+// 126, inclusive.
+func (a *Adapter) AttachSecondary(addr, secondary int, inst Instrument) error {
+	if secondary < 96 || secondary > 126 {
+		return fmt.Errorf("invalid secondary address %d (must be 96-126)", secondary)
+	}
+	return a.attach(address{primary: addr, secondary: secondary}, inst)
+}
+
+func (a *Adapter) attach(addr address, inst Instrument) error {
+	if addr.primary < 0 || addr.primary > 30 {
+		return fmt.Errorf("invalid primary address %d (must be 0-30)", addr.primary)
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := a.instruments[addr]; ok {
+		return fmt.Errorf("instrument already attached at address %s", addr)
+	}
+	a.instruments[addr] = inst
+	return nil
+}
+
+// Serve accepts connections on the listener and serves the Prologix protocol
+// on each one until the listener is closed.
+func (a *Adapter) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			_ = a.ServeConn(conn)
+		}()
+	}
+}
+
+// ServeConn reads `++` commands and instrument data from the given connection
+// and writes the adapter's responses back to it until the connection returns
+// an error. A nil error is returned when the connection reaches EOF or when a
+// disconnect fault is injected, in which case the caller should close the
+// connection.
+func (a *Adapter) ServeConn(rw io.ReadWriter) error {
+	s := newSession(a, rw)
+	buf := make([]byte, 4096)
+	for {
+		n, err := rw.Read(buf)
+		if n > 0 {
+			if werr := s.feed(buf[:n]); werr == errHangup {
+				return nil
+			} else if werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// session holds the parser state for one connection to the adapter.
+type session struct {
+	a       *Adapter
+	w       io.Writer
+	line    []byte
+	escaped bool
+	// literal is set when either of the first two characters of the line was
+	// escaped, which prevents the line from being treated as a `++` command.
+	literal bool
+}
+
+func newSession(a *Adapter, w io.Writer) *session {
+	return &session{a: a, w: w}
+}
+
+// feed parses the bytes received from the host. Unescaped CR and LF characters
+// terminate a line, and the ESC character escapes the character that follows.
+func (s *session) feed(p []byte) error {
+	for _, b := range p {
+		if s.escaped {
+			if len(s.line) < 2 {
+				s.literal = true
+			}
+			s.line = append(s.line, b)
+			s.escaped = false
+			continue
+		}
+		switch b {
+		case esc:
+			s.escaped = true
+		case cr, lf:
+			if len(s.line) == 0 {
+				continue
+			}
+			line := s.line
+			literal := s.literal
+			s.line = nil
+			s.literal = false
+			if err := s.process(line, literal); err != nil {
+				return err
+			}
+		default:
+			s.line = append(s.line, b)
+		}
+	}
+	return nil
+}
+
+func (s *session) process(line []byte, literal bool) (err error) {
+	s.a.mu.Lock()
+	defer s.a.mu.Unlock()
+	defer func() {
+		if s.a.hangup {
+			s.a.hangup = false
+			err = errHangup
+		}
+	}()
+	if !literal && len(line) >= 2 && line[0] == '+' && line[1] == '+' {
+		resp := s.a.command(string(line[2:]))
+		if len(resp) == 0 {
+			return nil
+		}
+		_, err = s.w.Write(resp)
+		return err
+	}
+	if s.a.cfg.mode != 1 {
+		return nil
+	}
+	s.a.send(s.a.cfg.addr, line)
+	if !s.a.cfg.auto {
+		return nil
+	}
+	resp := s.a.read(s.a.cfg.addr, readUntilEOI, 0)
+	if len(resp) == 0 {
+		return nil
+	}
+	_, err = s.w.Write(resp)
+	return err
+}
+
+// send transmits the data to the instrument at the given address, appending
+// the GPIB terminator selected with the `++eos` command.
+func (a *Adapter) send(addr address, data []byte) {
+	inst, ok := a.instruments[addr]
+	if !ok {
+		return
+	}
+	msg := make([]byte, 0, len(data)+2)
+	msg = append(msg, data...)
+	switch a.cfg.eos {
+	case 0:
+		msg = append(msg, cr, lf)
+	case 1:
+		msg = append(msg, cr)
+	case 2:
+		msg = append(msg, lf)
+	}
+	inst.Listen(msg)
+}
+
+type readMode int
+
+const (
+	readUntilTimeout readMode = iota
+	readUntilEOI
+	readUntilChar
+)
+
+// read addresses the instrument to talk and returns the data it sends. The
+// EOT character is appended when enabled and the read ended because EOI was
+// asserted. Data not consumed by a read terminated by a character is retained
+// for the next read.
+func (a *Adapter) read(addr address, mode readMode, char byte) []byte {
+	inst, ok := a.instruments[addr]
+	if !ok {
+		return nil
+	}
+	data := a.pending[addr]
+	delete(a.pending, addr)
+	if len(data) == 0 {
+		// Like the real controller, wait up to the read timeout for an
+		// instrument that is still preparing its response.
+		if d, ok := inst.(Delayer); ok {
+			wait := time.Until(d.OutputReady())
+			if wait > 0 && wait <= time.Duration(a.cfg.readTmoMs)*time.Millisecond {
+				time.Sleep(wait)
+			}
+		}
+		msg, ok := inst.Talk()
+		if !ok {
+			return nil
+		}
+		data = msg
+	}
+	eoi := true
+	if mode == readUntilChar {
+		if i := bytes.IndexByte(data, char); i >= 0 && i < len(data)-1 {
+			a.pending[addr] = append([]byte(nil), data[i+1:]...)
+			data = data[:i+1]
+			eoi = false
+		}
+	}
+	out := append([]byte(nil), data...)
+	if eoi && a.cfg.eotEnable {
+		out = append(out, a.cfg.eotChar)
+	}
+	return a.applyFaults(addr, out)
+}
+
+// command executes the `++` command, which has had the leading plus signs
+// removed, and returns the response to send to the host, if any.
+func (a *Adapter) command(line string) []byte {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return nil
+	}
+	name := strings.ToLower(fields[0])
+	args := fields[1:]
+	defer func() {
+		if a.savecfg {
+			a.saved = a.cfg
+		}
+	}()
+	switch name {
+	case "addr":
+		return a.cmdAddr(args)
+	case "auto":
+		return boolParam(&a.cfg.auto, args)
+	case "clr":
+		if inst, ok := a.instruments[a.cfg.addr]; ok {
+			if c, ok := inst.(Clearer); ok {
+				c.Clear()
+			}
+			delete(a.pending, a.cfg.addr)
+		}
+	case "eoi":
+		return boolParam(&a.cfg.eoi, args)
+	case "eos":
+		return intParam(&a.cfg.eos, args, 0, 3)
+	case "eot_enable":
+		return boolParam(&a.cfg.eotEnable, args)
+	case "eot_char":
+		v := int(a.cfg.eotChar)
+		resp := intParam(&v, args, 0, 255)
+		a.cfg.eotChar = byte(v)
+		return resp
+	case "help":
+		return []byte(helpText)
+	case "ifc":
+		for addr := range a.pending {
+			delete(a.pending, addr)
+		}
+	case "llo":
+		a.lockout = true
+		a.remote(args, true)
+	case "loc":
+		a.lockout = false
+		a.remote(args, false)
+	case "mode":
+		return intParam(&a.cfg.mode, args, 0, 1)
+	case "read":
+		return a.cmdRead(args)
+	case "read_tmo_ms":
+		return intParam(&a.cfg.readTmoMs, args, 1, 3000)
+	case "rst":
+		a.reset()
+	case "savecfg":
+		return boolParam(&a.savecfg, args)
+	case "spoll":
+		return a.cmdSpoll(args)
+	case "srq":
+		return response(boolString(a.serviceRequest() || a.spuriousSRQ(a.cfg.addr)))
+	case "trg":
+		a.cmdTrigger(args)
+	case "ver":
+		return response(a.version)
+	case "lon", "status":
+		// Device mode commands are accepted but have no effect since only
+		// controller mode is emulated.
+	default:
+		return response("Unrecognized command")
+	}
+	return nil
+}
+
+func (a *Adapter) cmdAddr(args []string) []byte {
+	if len(args) == 0 {
+		return response(a.cfg.addr.String())
+	}
+	addr, ok := parseAddress(args)
+	if !ok {
+		return nil
+	}
+	a.cfg.addr = addr
+	return nil
+}
+
+func (a *Adapter) cmdRead(args []string) []byte {
+	if a.cfg.mode != 1 {
+		return nil
+	}
+	mode := readUntilTimeout
+	var char byte
+	if len(args) > 0 {
+		if strings.EqualFold(args[0], "eoi") {
+			mode = readUntilEOI
+		} else if v, err := strconv.Atoi(args[0]); err == nil && v >= 0 && v <= 255 {
+			mode = readUntilChar
+			char = byte(v)
+		}
+	}
+	return a.read(a.cfg.addr, mode, char)
+}
+
+func (a *Adapter) cmdSpoll(args []string) []byte {
+	addr := a.cfg.addr
+	if len(args) > 0 {
+		var ok bool
+		if addr, ok = parseAddress(args); !ok {
+			return nil
+		}
+	}
+	inst, ok := a.instruments[addr]
+	if !ok {
+		// No device responds, so the serial poll times out without a reply.
+		return nil
+	}
+	var stb byte
+	if p, ok := inst.(Poller); ok {
+		stb = p.SerialPoll()
+	}
+	if a.spuriousSRQ(addr) {
+		stb |= 0x40
+	}
+	return a.applyFaults(addr, response(strconv.Itoa(int(stb))))
+}
+
+func (a *Adapter) cmdTrigger(args []string) {
+	addrs := []address{a.cfg.addr}
+	if len(args) > 0 {
+		addrs = addrs[:0]
+		for i := 0; i < len(args); i++ {
+			pad, err := strconv.Atoi(args[i])
+			if err != nil {
+				return
+			}
+			addr := address{primary: pad}
+			if i+1 < len(args) {
+				if sad, err := strconv.Atoi(args[i+1]); err == nil && sad >= 96 {
+					addr.secondary = sad
+					i++
+				}
+			}
+			addrs = append(addrs, addr)
+		}
+	}
+	for _, addr := range addrs {
+		if t, ok := a.instruments[addr].(Triggerer); ok {
+			t.Trigger()
+		}
+	}
+}
+
+// remote sends the instruments at the given addresses, or at the current
+// address when none are given, to either remote or local state.
+func (a *Adapter) remote(args []string, remote bool) {
+	if len(args) > 0 && strings.EqualFold(args[0], "all") {
+		for _, inst := range a.instruments {
+			if r, ok := inst.(Remoter); ok {
+				r.SetRemote(remote, a.lockout)
+			}
+		}
+		return
+	}
+	if r, ok := a.instruments[a.cfg.addr].(Remoter); ok {
+		r.SetRemote(remote, a.lockout)
+	}
+}
+
+func (a *Adapter) serviceRequest() bool {
+	for _, inst := range a.instruments {
+		if p, ok := inst.(Poller); ok && p.ServiceRequest() {
+			return true
+		}
+	}
+	return false
+}
+
+// reset performs a power-on reset, which restores the configuration last saved
+// to EPROM.
+func (a *Adapter) reset() {
+	a.cfg = a.saved
+	a.lockout = false
+	for addr := range a.pending {
+		delete(a.pending, addr)
+	}
+}
+
+func parseAddress(args []string) (address, bool) {
+	pad, err := strconv.Atoi(args[0])
+	if err != nil || pad < 0 || pad > 30 {
+		return address{}, false
+	}
+	addr := address{primary: pad}
+	if len(args) > 1 {
+		sad, err := strconv.Atoi(args[1])
+		if err != nil || sad < 96 || sad > 126 {
+			return address{}, false
+		}
+		addr.secondary = sad
+	}
+	return addr, true
+}
+
+// boolParam either queries or sets a parameter accepting 0 or 1.
+func boolParam(p *bool, args []string) []byte {
+	if len(args) == 0 {
+		return response(boolString(*p))
+	}
+	switch args[0] {
+	case "0":
+		*p = false
+	case "1":
+		*p = true
+	}
+	return nil
+}
+
+// intParam either queries or sets an integer parameter, ignoring values
+// outside of the range min to max, inclusive.
+func intParam(p *int, args []string, min, max int) []byte {
+	if len(args) == 0 {
+		return response(strconv.Itoa(*p))
+	}
+	v, err := strconv.Atoi(args[0])
+	if err != nil || v < min || v > max {
+		return nil
+	}
+	*p = v
+	return nil
+}
+
+func boolString(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
+
+// response formats a reply from the Prologix controller itself, which is
+// always terminated with CR LF.
+func response(s string) []byte {
+	return []byte(s + "\r\n")
+}
+
+const helpText = "++addr [pad [sad]]\r\n" +
+	"++auto [0|1]\r\n" +
+	"++clr\r\n" +
+	"++eoi [0|1]\r\n" +
+	"++eos [0|1|2|3]\r\n" +
+	"++eot_enable [0|1]\r\n" +
+	"++eot_char [char]\r\n" +
+	"++help\r\n" +
+	"++ifc\r\n" +
+	"++llo [all]\r\n" +
+	"++loc [all]\r\n" +
+	"++lon [0|1]\r\n" +
+	"++mode [0|1]\r\n" +
+	"++read [eoi|char]\r\n" +
+	"++read_tmo_ms time\r\n" +
+	"++rst\r\n" +
+	"++savecfg [0|1]\r\n" +
+	"++spoll [pad [sad]]\r\n" +
+	"++srq\r\n" +
+	"++status [byte]\r\n" +
+	"++trg [pad1 [sad1] pad2 [sad2] ...]\r\n" +
+	"++ver\r\n"
@@ -0,0 +1,187 @@
+// Copyright (c) 2020–2024 The prologix developers. All rights reserved.
+// Project site: https://github.com/gotmc/prologix
+// Use of this source code is governed by a MIT-style license that
+// can be found in the LICENSE.txt file for the project.
+
+package sim
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestAdapterCommands(t *testing.T) {
+	a := NewAdapter()
+	inst := NewScripted("SIM,MODEL1,123,1.0", map[string]string{"meas?": "+1.0E+00"})
+	if err := a.Attach(5, inst); err != nil {
+		t.Fatal(err)
+	}
+	conn := a.Dial()
+	r := bufio.NewReader(conn)
+	tests := []struct {
+		send string
+		want string
+	}{
+		{"++ver\n", VersionUSB + "\r\n"},
+		{"++addr 5\n++addr\n", "5\r\n"},
+		{"++auto\n", "0\r\n"},
+		{"++eot_enable 1\n++eot_char 10\n++eot_char\n", "10\r\n"},
+		{"*idn?\n++read eoi\n", "SIM,MODEL1,123,1.0\n\n"},
+		{"++auto 1\nMEAS?\n", "+1.0E+00\n\n"},
+		{"++spoll\n", "0\r\n"},
+		{"++srq\n", "0\r\n"},
+		{"++bogus\n", "Unrecognized command\r\n"},
+		{"++read_tmo_ms 5000\n++read_tmo_ms\n", "500\r\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.send, func(t *testing.T) {
+			if _, err := conn.Write([]byte(test.send)); err != nil {
+				t.Fatal(err)
+			}
+			got := make([]byte, len(test.want))
+			if _, err := r.Read(got); err != nil {
+				t.Fatal(err)
+			}
+			if r.Buffered() > 0 {
+				rest, _ := r.Peek(r.Buffered())
+				got = append(got, rest...)
+				r.Discard(len(rest))
+			}
+			if string(got) != test.want {
+				t.Errorf("got %q; want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestEscapedData(t *testing.T) {
+	a := NewAdapter()
+	inst := NewScripted("", nil)
+	if err := a.Attach(0, inst); err != nil {
+		t.Fatal(err)
+	}
+	conn := a.Dial()
+	if _, err := conn.Write([]byte("\x1b+\x1b+ver\n")); err != nil {
+		t.Fatal(err)
+	}
+	got := inst.Received()
+	if len(got) != 1 || got[0] != "++VER" {
+		t.Errorf("got %q; want [\"++VER\"]", got)
+	}
+}
+
+func TestNetFinderReply(t *testing.T) {
+	nf := NewNetFinder(net.IPv4(127, 0, 0, 1))
+	req := []byte{nfMagic, nfIdentify, 0x12, 0x34, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0, 0}
+	reply, ok := nf.reply(req)
+	if !ok {
+		t.Fatal("no reply to broadcast identify request")
+	}
+	if reply[1] != nfIdentifyReply || reply[2] != 0x12 || reply[3] != 0x34 {
+		t.Errorf("bad reply header % x", reply[:nfHeaderLen])
+	}
+	if got := net.IP(reply[nfHeaderLen+8 : nfHeaderLen+12]); !got.Equal(nf.IP) {
+		t.Errorf("got IP %s; want %s", got, nf.IP)
+	}
+}
+
+func TestFaults(t *testing.T) {
+	tests := []struct {
+		name  string
+		fault Fault
+		want  string
+	}{
+		{"timeout", Fault{Kind: FaultTimeout, Address: 5, Every: 1}, ""},
+		{"other address", Fault{Kind: FaultTimeout, Address: 6, Every: 1}, "1\n"},
+		{"truncate", Fault{Kind: FaultTruncate, Address: AnyAddress, Every: 1}, ""},
+		{"drop", Fault{Kind: FaultDropBytes, Address: 5, Every: 1}, "1"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a := NewAdapter(WithFaults(1, test.fault))
+			if err := a.Attach(5, NewScripted("", map[string]string{"x?": "1"})); err != nil {
+				t.Fatal(err)
+			}
+			a.mu.Lock()
+			a.cfg.addr = address{primary: 5}
+			a.send(a.cfg.addr, []byte("x?"))
+			got := string(a.read(a.cfg.addr, readUntilEOI, 0))
+			a.mu.Unlock()
+			if test.fault.Kind == FaultTruncate {
+				if len(got) >= 2 {
+					t.Errorf("got %q; want truncated response", got)
+				}
+				return
+			}
+			if test.fault.Kind == FaultDropBytes {
+				if len(got) != len(test.want) {
+					t.Errorf("got %q; want one byte dropped", got)
+				}
+				return
+			}
+			if got != test.want {
+				t.Errorf("got %q; want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestSpuriousSRQFault(t *testing.T) {
+	a := NewAdapter(WithFaults(1, Fault{Kind: FaultSpuriousSRQ, Address: 5, Every: 1}))
+	if err := a.Attach(5, NewScripted("", nil)); err != nil {
+		t.Fatal(err)
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if got := string(a.command("spoll 5")); got != "64\r\n" {
+		t.Errorf("got %q; want %q", got, "64\r\n")
+	}
+	if got := string(a.command("srq")); got != "0\r\n" {
+		t.Errorf("got %q for SRQ at address 0; want %q", got, "0\r\n")
+	}
+}
+
+func TestFaultScheduleIsReproducible(t *testing.T) {
+	run := func() string {
+		fault := Fault{Kind: FaultDropBytes, Address: AnyAddress, Probability: 0.5}
+		a := NewAdapter(WithFaults(42, fault))
+		if err := a.Attach(1, NewScripted("", map[string]string{"q?": "0123456789"})); err != nil {
+			t.Fatal(err)
+		}
+		var out []byte
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		a.cfg.addr = address{primary: 1}
+		for i := 0; i < 20; i++ {
+			a.send(a.cfg.addr, []byte("q?"))
+			out = append(out, a.read(a.cfg.addr, readUntilEOI, 0)...)
+		}
+		return string(out)
+	}
+	if first, second := run(), run(); first != second {
+		t.Errorf("same seed produced different faults:\n%q\n%q", first, second)
+	}
+}
+
+func TestDisconnectFault(t *testing.T) {
+	a := NewAdapter(WithFaults(1, Fault{Kind: FaultDisconnect, Address: AnyAddress, Every: 2}))
+	if err := a.Attach(0, NewScripted("SIM", nil)); err != nil {
+		t.Fatal(err)
+	}
+	conn := a.Dial()
+	if _, err := conn.Write([]byte("*idn?\n++read eoi\n*idn?\n++read eoi\n")); err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "SIM\n" {
+		t.Errorf("got %q; want %q", got, "SIM\n")
+	}
+	if _, err := conn.Write([]byte("++ver\n")); err == nil {
+		t.Error("expected error writing to disconnected adapter")
+	}
+}
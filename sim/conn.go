@@ -0,0 +1,125 @@
+// Copyright (c) 2020–2024 The prologix developers. All rights reserved.
+// Project site: https://github.com/gotmc/prologix
+// Use of this source code is governed by a MIT-style license that
+// can be found in the LICENSE.txt file for the project.
+
+package sim
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Conn is an in-memory connection to an emulated adapter, which can be used in
+// place of the io.ReadWriter provided by a Prologix driver. Writes are
+// processed by the adapter before Write returns, and the adapter's responses
+// are buffered until read.
+type Conn struct {
+	s *session
+
+	mu       sync.Mutex
+	buf      bytes.Buffer
+	closed   bool
+	deadline time.Time
+	notify   chan struct{}
+}
+
+// Dial returns a new in-memory connection to the adapter.
+func (a *Adapter) Dial() *Conn {
+	c := Conn{notify: make(chan struct{}, 1)}
+	c.s = newSession(a, (*connWriter)(&c))
+	return &c
+}
+
+// Write sends the data to the emulated adapter.
+func (c *Conn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	closed := c.closed
+	c.mu.Unlock()
+	if closed {
+		return 0, io.ErrClosedPipe
+	}
+	if err := c.s.feed(p); err == errHangup {
+		// The data was delivered, but the adapter has gone away, so
+		// subsequent reads return io.EOF.
+		c.Close()
+	} else if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Read reads the responses from the emulated adapter, blocking until data is
+// available, the read deadline expires, or the connection is closed.
+func (c *Conn) Read(p []byte) (int, error) {
+	for {
+		c.mu.Lock()
+		if c.buf.Len() > 0 {
+			n, err := c.buf.Read(p)
+			c.mu.Unlock()
+			return n, err
+		}
+		if c.closed {
+			c.mu.Unlock()
+			return 0, io.EOF
+		}
+		deadline := c.deadline
+		c.mu.Unlock()
+
+		if deadline.IsZero() {
+			<-c.notify
+			continue
+		}
+		d := time.Until(deadline)
+		if d <= 0 {
+			return 0, os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(d)
+		select {
+		case <-c.notify:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// SetReadDeadline sets the deadline for future Read calls. A zero value for t
+// means Read will not time out.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	c.wake()
+	return nil
+}
+
+// Close closes the connection. Blocked reads return io.EOF.
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+	c.wake()
+	return nil
+}
+
+func (c *Conn) wake() {
+	select {
+	case c.notify <- struct{}{}:
+	default:
+	}
+}
+
+// connWriter receives the adapter's responses for a Conn.
+type connWriter Conn
+
+func (w *connWriter) Write(p []byte) (int, error) {
+	c := (*Conn)(w)
+	c.mu.Lock()
+	n, err := c.buf.Write(p)
+	c.mu.Unlock()
+	c.wake()
+	return n, err
+}
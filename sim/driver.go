@@ -0,0 +1,41 @@
+// Copyright (c) 2020–2024 The prologix developers. All rights reserved.
+// Project site: https://github.com/gotmc/prologix
+// Use of this source code is governed by a MIT-style license that
+// can be found in the LICENSE.txt file for the project.
+
+package sim
+
+import (
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/gotmc/prologix/driver"
+)
+
+var (
+	registryMu sync.Mutex
+	registry   = make(map[string]*Adapter)
+)
+
+func init() {
+	driver.Register("SIM", driver.OpenFunc(func(name string) (io.ReadWriteCloser, error) {
+		registryMu.Lock()
+		a, ok := registry[name]
+		registryMu.Unlock()
+		if !ok {
+			return nil, fmt.Errorf("no simulated adapter registered as %q", name)
+		}
+		return a.Dial(), nil
+	}))
+}
+
+// Register makes the adapter available under the given name to the SIM
+// driver, so that prologix.Open connects to it using a resource such as
+// `SIM::bench::GPIB::5`. Registering another adapter under the same name
+// replaces it.
+func (a *Adapter) Register(name string) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry[name] = a
+}
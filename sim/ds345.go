@@ -0,0 +1,231 @@
+// Copyright (c) 2020–2024 The prologix developers. All rights reserved.
+// Project site: https://github.com/gotmc/prologix
+// Use of this source code is governed by a MIT-style license that
+// can be found in the LICENSE.txt file for the project.
+
+package sim
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DS345 models the Stanford Research Systems DS345 30 MHz synthesized function
+// generator. Like the real instrument, it uses four letter mnemonics whose
+// parameter may follow without a space, such as `MENA0`, reports amplitudes
+// with a unit suffix, and has no SCPI error queue; errors are only reported
+// through the Standard Event Status Register.
+type DS345 struct {
+	*device
+	function int
+	freq     float64
+	ampl     float64 // Peak-to-peak volts
+	offset   float64
+	phase    float64
+	modEna   bool
+	modType  int
+	bcnt     int
+	tsrc     int
+	trat     float64
+	triggers int
+}
+
+// NewDS345 creates a simulated DS345 function generator.
+func NewDS345(seed int64) *DS345 {
+	m := DS345{}
+	m.device = newDevice(&m, "StanfordResearchSystems,DS345,12345,1.04", seed)
+	m.errorQueue = false
+	return &m
+}
+
+func (m *DS345) reset() {
+	m.function = 0
+	m.freq = 1e3
+	m.ampl = 1
+	m.offset = 0
+	m.phase = 0
+	m.modEna = false
+	m.modType = 2
+	m.bcnt = 1
+	m.tsrc = 0
+	m.trat = 1e3
+}
+
+func (m *DS345) trigger() {
+	if m.modEna && m.modType == 5 && m.tsrc == 0 {
+		m.triggers++
+	}
+}
+
+// maxFreq returns the maximum frequency of the selected function.
+func (m *DS345) maxFreq() float64 {
+	switch m.function {
+	case 0, 1:
+		return 30.2e6
+	case 2, 3:
+		return 100e3
+	case 4:
+		return 10e6
+	}
+	return 40e6
+}
+
+// vrmsFactor returns the ratio of the peak-to-peak to RMS amplitude of the
+// selected function.
+func (m *DS345) vrmsFactor() float64 {
+	switch m.function {
+	case 1:
+		return 2
+	case 2, 3:
+		return 2 * math.Sqrt(3)
+	}
+	return 2 * math.Sqrt(2)
+}
+
+// formatAmplitude formats the amplitude in the given units of VP
+// (peak-to-peak volts), VR (RMS volts), or DB (dBm into 50 ohms).
+func (m *DS345) formatAmplitude(unit string) (string, error) {
+	switch unit {
+	case "", "VP":
+		return fmt.Sprintf("%.2fVP", m.ampl), nil
+	case "VR":
+		return fmt.Sprintf("%.3fVR", m.ampl/m.vrmsFactor()), nil
+	case "DB":
+		vrms := m.ampl / m.vrmsFactor()
+		return fmt.Sprintf("%.2fDB", 10*math.Log10(vrms*vrms/50/1e-3)), nil
+	}
+	return "", errIllegalParam
+}
+
+func (m *DS345) setAmplitude(s string) error {
+	s = strings.ToUpper(s)
+	unit := "VP"
+	for _, u := range []string{"VP", "VR", "DB"} {
+		if strings.HasSuffix(s, u) {
+			unit = u
+			s = strings.TrimSuffix(s, u)
+		}
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return errSyntax
+	}
+	switch unit {
+	case "VR":
+		v *= m.vrmsFactor()
+	case "DB":
+		v = math.Sqrt(math.Pow(10, v/10)*1e-3*50) * m.vrmsFactor()
+	}
+	if v < 0.01 || v > 10 {
+		return errOutOfRange
+	}
+	m.ampl = v
+	return nil
+}
+
+func (m *DS345) execute(cmd command) (string, error) {
+	// The parameter may be appended directly to the mnemonic, so reassemble
+	// the command and split it after the fourth character.
+	if len(cmd.header) < 4 {
+		return "", errUndefinedHeader
+	}
+	mnemonic := cmd.header[:4]
+	param := cmd.header[4:] + strings.Join(cmd.args, ",")
+
+	if cmd.query {
+		switch mnemonic {
+		case "FUNC":
+			return strconv.Itoa(m.function), nil
+		case "FREQ":
+			return strconv.FormatFloat(m.freq, 'f', -1, 64), nil
+		case "AMPL":
+			return m.formatAmplitude(strings.ToUpper(param))
+		case "OFFS":
+			return strconv.FormatFloat(m.offset, 'f', -1, 64), nil
+		case "PHSE":
+			return strconv.FormatFloat(m.phase, 'f', -1, 64), nil
+		case "MENA":
+			return boolString(m.modEna), nil
+		case "MTYP":
+			return strconv.Itoa(m.modType), nil
+		case "BCNT":
+			return strconv.Itoa(m.bcnt), nil
+		case "TSRC":
+			return strconv.Itoa(m.tsrc), nil
+		case "TRAT":
+			return strconv.FormatFloat(m.trat, 'f', -1, 64), nil
+		case "STAT":
+			return "0", nil
+		}
+		return "", errUndefinedHeader
+	}
+
+	switch mnemonic {
+	case "FUNC":
+		v, err := parseNumber(param, 0, 5, 0)
+		if err != nil {
+			return "", err
+		}
+		m.function = int(v)
+		m.freq = math.Min(m.freq, m.maxFreq())
+		m.busy(100 * time.Millisecond)
+	case "FREQ":
+		v, err := parseNumber(param, 1e-6, m.maxFreq(), 1e3)
+		if err != nil {
+			return "", err
+		}
+		m.freq = v
+	case "AMPL":
+		return "", m.setAmplitude(param)
+	case "OFFS":
+		v, err := parseNumber(param, -5, 5, 0)
+		if err != nil {
+			return "", err
+		}
+		m.offset = v
+	case "PHSE":
+		v, err := parseNumber(param, -7199.999, 7199.999, 0)
+		if err != nil {
+			return "", err
+		}
+		m.phase = v
+	case "MENA":
+		on, err := parseBool(param)
+		if err != nil {
+			return "", err
+		}
+		m.modEna = on
+		m.busy(100 * time.Millisecond)
+	case "MTYP":
+		v, err := parseNumber(param, 0, 5, 0)
+		if err != nil {
+			return "", err
+		}
+		m.modType = int(v)
+		m.busy(50 * time.Millisecond)
+	case "BCNT":
+		v, err := parseNumber(param, 1, 30000, 1)
+		if err != nil {
+			return "", err
+		}
+		m.bcnt = int(math.Round(v))
+	case "TSRC":
+		v, err := parseNumber(param, 0, 4, 0)
+		if err != nil {
+			return "", err
+		}
+		m.tsrc = int(v)
+	case "TRAT":
+		v, err := parseNumber(param, 0.001, 10000, 1e3)
+		if err != nil {
+			return "", err
+		}
+		m.trat = v
+	default:
+		return "", errUndefinedHeader
+	}
+	return "", nil
+}
@@ -0,0 +1,202 @@
+// Copyright (c) 2020–2024 The prologix developers. All rights reserved.
+// Project site: https://github.com/gotmc/prologix
+// Use of this source code is governed by a MIT-style license that
+// can be found in the LICENSE.txt file for the project.
+
+package sim
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// supplyOutput models one output of a programmable power supply.
+type supplyOutput struct {
+	name     string
+	maxVolt  float64 // Maximum programmable voltage magnitude
+	maxCurr  float64
+	negative bool
+	volt     float64
+	curr     float64
+}
+
+// E3631A models the Keysight (Agilent/HP) E3631A triple output DC power
+// supply with its +6 V, +25 V, and -25 V outputs. The outputs are unloaded,
+// so measured voltages follow the programmed values when the outputs are
+// enabled and measured currents are near zero.
+type E3631A struct {
+	*device
+	outputs  [3]supplyOutput
+	selected int
+	enabled  bool
+	tracking bool
+}
+
+// NewE3631A creates a simulated E3631A power supply using the seed for its
+// measurement noise.
+func NewE3631A(seed int64) *E3631A {
+	m := E3631A{}
+	m.device = newDevice(&m, "HEWLETT-PACKARD,E3631A,0,2.1-5.0-1.0", seed)
+	return &m
+}
+
+func (m *E3631A) reset() {
+	m.outputs = [3]supplyOutput{
+		{name: "P6V", maxVolt: 6.18, maxCurr: 5.15, curr: 5},
+		{name: "P25V", maxVolt: 25.75, maxCurr: 1.03, curr: 1},
+		{name: "N25V", maxVolt: 25.75, maxCurr: 1.03, curr: 1, negative: true},
+	}
+	m.selected = 0
+	m.enabled = false
+	m.tracking = false
+}
+
+// output returns the index of the output named by the parameter or the
+// selected output if the parameter is empty.
+func (m *E3631A) output(name string) (int, error) {
+	if name == "" {
+		return m.selected, nil
+	}
+	for i, out := range m.outputs {
+		if strings.EqualFold(name, out.name) {
+			return i, nil
+		}
+	}
+	return 0, errIllegalParam
+}
+
+func (m *E3631A) setVoltage(i int, s string) error {
+	out := &m.outputs[i]
+	lo, hi := 0.0, out.maxVolt
+	if out.negative {
+		lo, hi = -out.maxVolt, 0
+	}
+	v, err := parseNumber(s, lo, hi, 0)
+	if err != nil {
+		return err
+	}
+	out.volt = v
+	if m.tracking && i > 0 {
+		m.outputs[3-i].volt = -v
+	}
+	return nil
+}
+
+func (m *E3631A) setCurrent(i int, s string) error {
+	out := &m.outputs[i]
+	v, err := parseNumber(s, 0, out.maxCurr, out.maxCurr)
+	if err != nil {
+		return err
+	}
+	out.curr = v
+	return nil
+}
+
+func (m *E3631A) execute(cmd command) (string, error) {
+	switch {
+	case cmd.is("APPLy"):
+		if cmd.query {
+			i, err := m.output(cmd.arg(0))
+			if err != nil {
+				return "", err
+			}
+			out := m.outputs[i]
+			return fmt.Sprintf("\"%+.5E,%+.5E\"", out.volt, out.curr), nil
+		}
+		i, err := m.output(cmd.arg(0))
+		if err != nil || cmd.arg(0) == "" {
+			return "", errIllegalParam
+		}
+		if len(cmd.args) > 1 {
+			if err := m.setVoltage(i, cmd.arg(1)); err != nil {
+				return "", err
+			}
+		}
+		if len(cmd.args) > 2 {
+			if err := m.setCurrent(i, cmd.arg(2)); err != nil {
+				return "", err
+			}
+		}
+		m.busy(50 * time.Millisecond)
+	case cmd.is("INSTrument[:SELect]"):
+		if cmd.query {
+			return m.outputs[m.selected].name, nil
+		}
+		i, err := m.output(cmd.arg(0))
+		if err != nil {
+			return "", err
+		}
+		m.selected = i
+	case cmd.is("INSTrument:NSELect"):
+		if cmd.query {
+			return fmt.Sprint(m.selected + 1), nil
+		}
+		v, err := parseNumber(cmd.arg(0), 1, 3, 1)
+		if err != nil {
+			return "", err
+		}
+		m.selected = int(v) - 1
+	case cmd.is("[SOURce:]VOLTage[:LEVel][:IMMediate][:AMPLitude]"):
+		if cmd.query {
+			return fmt.Sprintf("%+.8E", m.outputs[m.selected].volt), nil
+		}
+		return "", m.setVoltage(m.selected, cmd.arg(0))
+	case cmd.is("[SOURce:]CURRent[:LEVel][:IMMediate][:AMPLitude]"):
+		if cmd.query {
+			return fmt.Sprintf("%+.8E", m.outputs[m.selected].curr), nil
+		}
+		return "", m.setCurrent(m.selected, cmd.arg(0))
+	case cmd.query && cmd.is("MEASure[:SCALar]:CURRent[:DC]"):
+		if _, err := m.output(cmd.arg(0)); err != nil {
+			return "", err
+		}
+		m.busy(100 * time.Millisecond)
+		return fmt.Sprintf("%+.8E", m.noise(5e-5)), nil
+	case cmd.query && cmd.is("MEASure[:SCALar][:VOLTage][:DC]"):
+		i, err := m.output(cmd.arg(0))
+		if err != nil {
+			return "", err
+		}
+		v := 0.0
+		if m.enabled {
+			v = m.outputs[i].volt
+		}
+		m.busy(100 * time.Millisecond)
+		return fmt.Sprintf("%+.8E", v+m.noise(5e-4)), nil
+	case cmd.is("OUTPut[:STATe]"):
+		if cmd.query {
+			return boolString(m.enabled), nil
+		}
+		on, err := parseBool(cmd.arg(0))
+		if err != nil {
+			return "", err
+		}
+		m.enabled = on
+		m.busy(50 * time.Millisecond)
+	case cmd.is("OUTPut:TRACk[:STATe]"):
+		if cmd.query {
+			return boolString(m.tracking), nil
+		}
+		on, err := parseBool(cmd.arg(0))
+		if err != nil {
+			return "", err
+		}
+		m.tracking = on
+		if on {
+			m.outputs[2].volt = -m.outputs[1].volt
+		}
+	case cmd.is("SYSTem:REMote") && !cmd.query:
+		m.remote, m.lockout = true, false
+	case cmd.is("SYSTem:RWLock") && !cmd.query:
+		m.remote, m.lockout = true, true
+	case cmd.is("SYSTem:LOCal") && !cmd.query:
+		m.remote, m.lockout = false, false
+	case cmd.is("SYSTem:VERSion") && cmd.query:
+		return "1995.0", nil
+	case cmd.is("SYSTem:BEEPer[:IMMediate]") && !cmd.query:
+	default:
+		return "", errUndefinedHeader
+	}
+	return "", nil
+}
@@ -0,0 +1,260 @@
+// Copyright (c) 2020–2024 The prologix developers. All rights reserved.
+// Project site: https://github.com/gotmc/prologix
+// Use of this source code is governed by a MIT-style license that
+// can be found in the LICENSE.txt file for the project.
+
+package sim
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"time"
+)
+
+// AnyAddress applies a fault to transactions with every GPIB address.
+const AnyAddress = -1
+
+// errHangup is returned by a session when a disconnect fault is injected.
+var errHangup = errors.New("sim: adapter disconnected by fault injection")
+
+// FaultKind identifies the type of failure injected by the emulated adapter.
+type FaultKind int
+
+// Available fault kinds.
+const (
+	// FaultLatency delays the response by the fault's Latency.
+	FaultLatency FaultKind = iota
+	// FaultTimeout discards the instrument's response, so the read times out.
+	FaultTimeout
+	// FaultDropBytes removes bytes from the response.
+	FaultDropBytes
+	// FaultDuplicateBytes repeats bytes within the response.
+	FaultDuplicateBytes
+	// FaultTruncate cuts the response short, losing its terminator.
+	FaultTruncate
+	// FaultSpuriousSRQ reports SRQ asserted and sets the RQS bit on serial
+	// polls although no instrument is requesting service.
+	FaultSpuriousSRQ
+	// FaultReset performs a power-on reset of the adapter in the middle of the
+	// transaction, losing the response and any unsaved configuration.
+	FaultReset
+	// FaultDisconnect closes the transport, as when the USB cable is pulled,
+	// so the host sees EOF.
+	FaultDisconnect
+)
+
+var faultKindNames = map[FaultKind]string{
+	FaultLatency:        "latency",
+	FaultTimeout:        "timeout",
+	FaultDropBytes:      "drop",
+	FaultDuplicateBytes: "duplicate",
+	FaultTruncate:       "truncate",
+	FaultSpuriousSRQ:    "srq",
+	FaultReset:          "reset",
+	FaultDisconnect:     "disconnect",
+}
+
+func (k FaultKind) String() string {
+	if s, ok := faultKindNames[k]; ok {
+		return s
+	}
+	return fmt.Sprintf("FaultKind(%d)", int(k))
+}
+
+// MarshalText implements the encoding.TextMarshaler interface.
+func (k FaultKind) MarshalText() ([]byte, error) {
+	return []byte(k.String()), nil
+}
+
+// UnmarshalText implements the encoding.TextUnmarshaler interface.
+func (k *FaultKind) UnmarshalText(b []byte) error {
+	for kind, name := range faultKindNames {
+		if name == string(b) {
+			*k = kind
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown fault kind %q", b)
+}
+
+// Fault describes a failure injected into the transactions of the emulated
+// adapter. A transaction is a read from an instrument, either requested with
+// `++read` or performed automatically in read-after-write mode, or a serial
+// poll.
+type Fault struct {
+	Kind FaultKind
+	// Address is the GPIB primary address whose transactions are affected or
+	// AnyAddress to affect all transactions.
+	Address int
+	// Every injects the fault on every Nth matching transaction. When zero,
+	// Probability is used instead.
+	Every int
+	// Probability is the chance, from 0 to 1, of injecting the fault into a
+	// matching transaction.
+	Probability float64
+	// Limit is the maximum number of times the fault is injected, with zero
+	// meaning no limit.
+	Limit int
+	// Latency is the delay added by a FaultLatency fault.
+	Latency time.Duration
+	// Bytes is the number of bytes affected by a FaultDropBytes or
+	// FaultDuplicateBytes fault, which defaults to one.
+	Bytes int
+}
+
+// WithFaults injects the faults into the adapter's transactions. The schedule
+// is driven by a pseudo-random number generator initialized with the seed, so
+// a given seed reproduces the same sequence of faults for the same traffic.
+func WithFaults(seed int64, faults ...Fault) AdapterOption {
+	return func(a *Adapter) {
+		a.faults = &faultInjector{
+			rng:     rand.New(rand.NewSource(seed)),
+			faults:  faults,
+			matched: make([]int, len(faults)),
+			fired:   make([]int, len(faults)),
+		}
+	}
+}
+
+// faultSchedule is the JSON representation of a fault injection schedule.
+type faultSchedule struct {
+	Seed   int64       `json:"seed"`
+	Faults []faultJSON `json:"faults"`
+}
+
+type faultJSON struct {
+	Kind        FaultKind `json:"kind"`
+	Address     *int      `json:"address,omitempty"`
+	Every       int       `json:"every,omitempty"`
+	Probability float64   `json:"probability,omitempty"`
+	Limit       int       `json:"limit,omitempty"`
+	Latency     string    `json:"latency,omitempty"`
+	Bytes       int       `json:"bytes,omitempty"`
+}
+
+// LoadFaultSchedule reads a JSON fault schedule, such as
+//
+//	{"seed": 1, "faults": [{"kind": "latency", "address": 5, "every": 3, "latency": "200ms"}]}
+//
+// and returns the corresponding adapter option. Faults without an address
+// apply to all addresses.
+func LoadFaultSchedule(path string) (AdapterOption, error) {
+	var sched faultSchedule
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &sched); err != nil {
+		return nil, fmt.Errorf("error parsing fault schedule %s: %w", path, err)
+	}
+	faults := make([]Fault, 0, len(sched.Faults))
+	for _, f := range sched.Faults {
+		fault := Fault{
+			Kind:        f.Kind,
+			Address:     AnyAddress,
+			Every:       f.Every,
+			Probability: f.Probability,
+			Limit:       f.Limit,
+			Bytes:       f.Bytes,
+		}
+		if f.Address != nil {
+			fault.Address = *f.Address
+		}
+		if f.Latency != "" {
+			d, err := time.ParseDuration(f.Latency)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing fault schedule %s: %w", path, err)
+			}
+			fault.Latency = d
+		}
+		faults = append(faults, fault)
+	}
+	return WithFaults(sched.Seed, faults...), nil
+}
+
+// faultInjector decides which faults to inject into each transaction.
+type faultInjector struct {
+	rng     *rand.Rand
+	faults  []Fault
+	matched []int
+	fired   []int
+}
+
+// triggered returns the faults of the given kind to inject into the current
+// transaction with the address. Each call counts as a transaction for the
+// faults of that kind.
+func (fi *faultInjector) triggered(addr address, kind FaultKind) []Fault {
+	var faults []Fault
+	for i, f := range fi.faults {
+		if f.Kind != kind || (f.Address != AnyAddress && f.Address != addr.primary) {
+			continue
+		}
+		if f.Limit > 0 && fi.fired[i] >= f.Limit {
+			continue
+		}
+		fi.matched[i]++
+		var fire bool
+		if f.Every > 0 {
+			fire = fi.matched[i]%f.Every == 0
+		} else {
+			fire = fi.rng.Float64() < f.Probability
+		}
+		if fire {
+			fi.fired[i]++
+			faults = append(faults, f)
+		}
+	}
+	return faults
+}
+
+func (fi *faultInjector) fires(addr address, kind FaultKind) bool {
+	return len(fi.triggered(addr, kind)) > 0
+}
+
+// applyFaults injects the scheduled faults into the response of a transaction
+// with the instrument at the address. The adapter's lock must be held.
+func (a *Adapter) applyFaults(addr address, resp []byte) []byte {
+	fi := a.faults
+	if fi == nil {
+		return resp
+	}
+	for _, f := range fi.triggered(addr, FaultLatency) {
+		time.Sleep(f.Latency)
+	}
+	if fi.fires(addr, FaultDisconnect) {
+		a.hangup = true
+		return nil
+	}
+	if fi.fires(addr, FaultReset) {
+		a.reset()
+		return nil
+	}
+	if fi.fires(addr, FaultTimeout) {
+		return nil
+	}
+	for _, f := range fi.triggered(addr, FaultDropBytes) {
+		for i := 0; i < max(f.Bytes, 1) && len(resp) > 0; i++ {
+			j := fi.rng.Intn(len(resp))
+			resp = append(resp[:j:j], resp[j+1:]...)
+		}
+	}
+	for _, f := range fi.triggered(addr, FaultDuplicateBytes) {
+		for i := 0; i < max(f.Bytes, 1) && len(resp) > 0; i++ {
+			j := fi.rng.Intn(len(resp))
+			resp = append(resp[:j+1:j+1], resp[j:]...)
+		}
+	}
+	if len(resp) > 0 && fi.fires(addr, FaultTruncate) {
+		resp = resp[:fi.rng.Intn(len(resp))]
+	}
+	return resp
+}
+
+// spuriousSRQ reports whether a spurious service request is injected into the
+// transaction with the instrument at the address.
+func (a *Adapter) spuriousSRQ(addr address) bool {
+	return a.faults != nil && a.faults.fires(addr, FaultSpuriousSRQ)
+}
@@ -0,0 +1,184 @@
+// Copyright (c) 2020–2024 The prologix developers. All rights reserved.
+// Project site: https://github.com/gotmc/prologix
+// Use of this source code is governed by a MIT-style license that
+// can be found in the LICENSE.txt file for the project.
+
+package sim
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// fluke45Ranges lists the full scale value of ranges 1 through 7 for each
+// measurement function of the Fluke 45.
+var fluke45Ranges = map[string][]float64{
+	"VDC":   {0.3, 3, 30, 300, 1000},
+	"VAC":   {0.3, 3, 30, 300, 750},
+	"ADC":   {0.03, 0.1, 10},
+	"AAC":   {0.03, 0.1, 10},
+	"OHMS":  {300, 3e3, 30e3, 300e3, 3e6, 30e6, 300e6},
+	"FREQ":  {1e3, 10e3, 100e3, 1e6},
+	"DIODE": {3},
+	"CONT":  {300},
+}
+
+// Fluke45 models the Fluke 45 dual display multimeter. The Fluke 45 predates
+// IEEE 488.2 message exchange conventions in several ways: its responses are
+// terminated with CR LF, it has no SCPI error queue so errors are only
+// reported through the Standard Event Status Register, readings use an
+// unpadded exponent such as `+1.0002E+2`, and `MEAS?` waits for the next
+// reading at the selected rate.
+type Fluke45 struct {
+	*device
+	function string
+	rate     string
+	autorng  bool
+	rangeNum int
+	inputs   map[string]float64
+}
+
+// NewFluke45 creates a simulated Fluke 45 multimeter measuring a 1 V DC
+// source, a 100 ohm resistor, and a 1 kHz signal.
+func NewFluke45(seed int64) *Fluke45 {
+	m := Fluke45{
+		inputs: map[string]float64{
+			"VDC":   1,
+			"VAC":   0.5,
+			"ADC":   0.001,
+			"AAC":   0.001,
+			"OHMS":  100,
+			"FREQ":  1e3,
+			"DIODE": 0.6,
+			"CONT":  0.5,
+		},
+	}
+	m.device = newDevice(&m, "FLUKE, 45, 4620108, 1.6 D1.0", seed)
+	m.terminator = "\r\n"
+	m.errorQueue = false
+	return &m
+}
+
+// SetInput sets the value applied to the input for the measurement function,
+// such as VDC or OHMS.
+func (m *Fluke45) SetInput(function string, v float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.inputs[strings.ToUpper(function)] = v
+}
+
+func (m *Fluke45) reset() {
+	m.function = "VDC"
+	m.rate = "S"
+	m.autorng = true
+	m.rangeNum = 1
+}
+
+// readingTime returns the time taken for a reading at the selected rate.
+func (m *Fluke45) readingTime() time.Duration {
+	switch m.rate {
+	case "F":
+		return 50 * time.Millisecond
+	case "M":
+		return 200 * time.Millisecond
+	}
+	return 400 * time.Millisecond
+}
+
+// reading returns the current reading formatted as the Fluke 45 does.
+func (m *Fluke45) reading() string {
+	ranges := fluke45Ranges[m.function]
+	v := m.inputs[m.function]
+	if m.autorng {
+		m.rangeNum = len(ranges)
+		for i, fs := range ranges {
+			if math.Abs(v) <= fs {
+				m.rangeNum = i + 1
+				break
+			}
+		}
+	}
+	fs := ranges[m.rangeNum-1]
+	if math.Abs(v) > fs {
+		return "+1E+9"
+	}
+	v += m.noise(fs * 1e-5)
+
+	digits := map[string]int{"S": 4, "M": 3, "F": 2}[m.rate]
+	s := strconv.FormatFloat(v, 'E', digits, 64)
+	mant, exp, _ := strings.Cut(s, "E")
+	e, _ := strconv.Atoi(exp)
+	if v >= 0 {
+		mant = "+" + mant
+	}
+	return fmt.Sprintf("%sE%+d", mant, e)
+}
+
+func (m *Fluke45) execute(cmd command) (string, error) {
+	if _, ok := fluke45Ranges[cmd.header]; ok && !cmd.query {
+		m.function = cmd.header
+		m.autorng = true
+		return "", nil
+	}
+	switch cmd.header {
+	case "FUNC1":
+		if cmd.query {
+			return m.function, nil
+		}
+	case "MEAS1", "MEAS":
+		if cmd.query {
+			m.busy(m.readingTime())
+			return m.reading(), nil
+		}
+	case "VAL1", "VAL":
+		if cmd.query {
+			return m.reading(), nil
+		}
+	case "RATE":
+		if cmd.query {
+			return m.rate, nil
+		}
+		switch r := strings.ToUpper(cmd.arg(0)); r {
+		case "S", "M", "F":
+			m.rate = r
+			return "", nil
+		}
+		return "", errIllegalParam
+	case "RANGE", "RANGE1":
+		if cmd.query {
+			return strconv.Itoa(m.rangeNum), nil
+		}
+		v, err := strconv.Atoi(cmd.arg(0))
+		if err != nil || v < 1 || v > len(fluke45Ranges[m.function]) {
+			return "", errOutOfRange
+		}
+		m.rangeNum = v
+		m.autorng = false
+		return "", nil
+	case "AUTO":
+		if cmd.query {
+			return boolString(m.autorng), nil
+		}
+		m.autorng = true
+		return "", nil
+	case "FIXED":
+		if !cmd.query {
+			m.autorng = false
+			return "", nil
+		}
+	case "TRIGGER":
+		if !cmd.query {
+			return "", nil
+		}
+	case "REMS", "RWLS", "LOCS":
+		if !cmd.query {
+			m.remote = cmd.header != "LOCS"
+			m.lockout = cmd.header == "RWLS"
+			return "", nil
+		}
+	}
+	return "", errUndefinedHeader
+}
@@ -0,0 +1,537 @@
+// Copyright (c) 2020–2024 The prologix developers. All rights reserved.
+// Project site: https://github.com/gotmc/prologix
+// Use of this source code is governed by a MIT-style license that
+// can be found in the LICENSE.txt file for the project.
+
+package sim
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Standard Event Status Register bits defined by IEEE 488.2.
+const (
+	esrOPC = 1 << 0 // Operation complete
+	esrQYE = 1 << 2 // Query error
+	esrDDE = 1 << 3 // Device dependent error
+	esrEXE = 1 << 4 // Execution error
+	esrCME = 1 << 5 // Command error
+	esrPON = 1 << 7 // Power on
+)
+
+// Status Byte Register bits defined by IEEE 488.2 and SCPI.
+const (
+	stbEAV = 1 << 2 // Error queue not empty
+	stbMAV = 1 << 4 // Message available
+	stbESB = 1 << 5 // Event status bit
+	stbRQS = 1 << 6 // Request service
+)
+
+// Delayer is implemented by instruments whose next output message only
+// becomes available after a delay, such as a measurement in progress. The
+// adapter waits for the message up to its read timeout.
+type Delayer interface {
+	// OutputReady returns when the next output message will be available or
+	// the zero time when no message is pending.
+	OutputReady() time.Time
+}
+
+// cmdError is an error raised while executing a command. Instruments with an
+// SCPI error queue report the code and message using `SYST:ERR?`, while all
+// instruments set the corresponding bit in the Standard Event Status Register.
+type cmdError struct {
+	code int
+	msg  string
+}
+
+func (e cmdError) Error() string {
+	return fmt.Sprintf("%d,\"%s\"", e.code, e.msg)
+}
+
+// esrBit returns the Standard Event Status Register bit for the error's SCPI
+// error class.
+func (e cmdError) esrBit() byte {
+	switch {
+	case e.code <= -100 && e.code > -200:
+		return esrCME
+	case e.code <= -200 && e.code > -300:
+		return esrEXE
+	case e.code <= -400 && e.code > -500:
+		return esrQYE
+	}
+	return esrDDE
+}
+
+var (
+	errSyntax          = cmdError{-102, "Syntax error"}
+	errUndefinedHeader = cmdError{-113, "Undefined header"}
+	errMissingParam    = cmdError{-109, "Missing parameter"}
+	errOutOfRange      = cmdError{-222, "Data out of range"}
+	errIllegalParam    = cmdError{-224, "Illegal parameter value"}
+	errQueueOverflow   = cmdError{-350, "Queue overflow"}
+	errInterrupted     = cmdError{-410, "Query INTERRUPTED"}
+	errUnterminated    = cmdError{-420, "Query UNTERMINATED"}
+)
+
+// command is a single command parsed from a program message.
+type command struct {
+	header string   // Upper case header without the trailing question mark
+	query  bool     // Whether the header ended with a question mark
+	args   []string // Comma separated parameters with whitespace removed
+}
+
+func (c command) arg(i int) string {
+	if i < len(c.args) {
+		return c.args[i]
+	}
+	return ""
+}
+
+// is reports whether the command header matches the SCPI pattern, in which
+// each node is written with the short form in upper case and the remainder
+// in lower case, and optional nodes are enclosed in square brackets, such as
+// `[SOURce:]VOLTage[:LEVel]`.
+func (c command) is(pattern string) bool {
+	return matchHeader(splitNodes(strings.TrimPrefix(c.header, ":")), parsePattern(pattern))
+}
+
+type patternNode struct {
+	short, long string
+	optional    bool
+}
+
+func parsePattern(pattern string) []patternNode {
+	var nodes []patternNode
+	for len(pattern) > 0 {
+		optional := false
+		var node string
+		if pattern[0] == '[' {
+			end := strings.IndexByte(pattern, ']')
+			node = pattern[1:end]
+			pattern = pattern[end+1:]
+			optional = true
+		} else {
+			end := strings.IndexAny(pattern[1:], ":[")
+			if end < 0 {
+				node, pattern = pattern, ""
+			} else {
+				node, pattern = pattern[:end+1], pattern[end+1:]
+			}
+		}
+		node = strings.TrimPrefix(node, ":")
+		var short strings.Builder
+		for _, r := range node {
+			if r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '*' {
+				short.WriteRune(r)
+			}
+		}
+		nodes = append(nodes, patternNode{
+			short:    short.String(),
+			long:     strings.ToUpper(node),
+			optional: optional,
+		})
+	}
+	return nodes
+}
+
+func splitNodes(header string) []string {
+	if header == "" {
+		return nil
+	}
+	return strings.Split(header, ":")
+}
+
+func matchHeader(header []string, pattern []patternNode) bool {
+	if len(pattern) == 0 {
+		return len(header) == 0
+	}
+	p := pattern[0]
+	if len(header) > 0 && (header[0] == p.short || header[0] == p.long) {
+		if matchHeader(header[1:], pattern[1:]) {
+			return true
+		}
+	}
+	return p.optional && matchHeader(header, pattern[1:])
+}
+
+// parseMessage splits a program message into its commands, which are
+// separated by semicolons.
+func parseMessage(msg string) []command {
+	var cmds []command
+	for _, unit := range splitOutsideQuotes(msg, ';') {
+		unit = strings.TrimSpace(unit)
+		if unit == "" {
+			continue
+		}
+		header, params, _ := strings.Cut(unit, " ")
+		cmd := command{header: strings.ToUpper(header)}
+		if strings.HasSuffix(cmd.header, "?") {
+			cmd.query = true
+			cmd.header = strings.TrimSuffix(cmd.header, "?")
+		}
+		if params = strings.TrimSpace(params); params != "" {
+			for _, p := range splitOutsideQuotes(params, ',') {
+				cmd.args = append(cmd.args, strings.TrimSpace(p))
+			}
+		}
+		cmds = append(cmds, cmd)
+	}
+	return cmds
+}
+
+func splitOutsideQuotes(s string, sep byte) []string {
+	var parts []string
+	quoted := false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '"':
+			quoted = !quoted
+		case s[i] == sep && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// parseNumber parses a numeric parameter, accepting the MINimum, MAXimum, and
+// DEFault keywords in addition to decimal numbers.
+func parseNumber(s string, min, max, def float64) (float64, error) {
+	switch strings.ToUpper(s) {
+	case "":
+		return 0, errMissingParam
+	case "MIN", "MINIMUM":
+		return min, nil
+	case "MAX", "MAXIMUM":
+		return max, nil
+	case "DEF", "DEFAULT":
+		return def, nil
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, errSyntax
+	}
+	if v < min || v > max {
+		return 0, errOutOfRange
+	}
+	return v, nil
+}
+
+// parseBool parses a boolean parameter given as ON, OFF, 1, or 0.
+func parseBool(s string) (bool, error) {
+	switch strings.ToUpper(s) {
+	case "ON", "1":
+		return true, nil
+	case "OFF", "0":
+		return false, nil
+	case "":
+		return false, errMissingParam
+	}
+	return false, errIllegalParam
+}
+
+// output is a response message waiting in the output queue.
+type output struct {
+	msg     string
+	readyAt time.Time
+}
+
+// commandSet is implemented by the instrument models to execute the device
+// specific commands. The device's lock is held during calls.
+type commandSet interface {
+	execute(cmd command) (string, error)
+	reset()
+}
+
+// triggerable is implemented by the instrument models that respond to a bus
+// trigger or the `*TRG` command. The device's lock is held during calls.
+type triggerable interface {
+	trigger()
+}
+
+// device implements the IEEE 488.2 common commands, status reporting, error
+// queue, and output queue shared by the instrument models.
+type device struct {
+	mu         sync.Mutex
+	cmds       commandSet
+	identity   string
+	terminator string
+	errorQueue bool // Whether SYST:ERR? is supported
+	rng        *rand.Rand
+
+	out       []output
+	errors    []cmdError
+	esr       byte
+	ese       byte
+	sre       byte
+	rqs       bool
+	serviced  bool
+	busyUntil time.Time
+	opcArmed  bool
+	remote    bool
+	lockout   bool
+	now       func() time.Time
+}
+
+func newDevice(cmds commandSet, identity string, seed int64) *device {
+	d := device{
+		cmds:       cmds,
+		identity:   identity,
+		terminator: "\n",
+		errorQueue: true,
+		rng:        rand.New(rand.NewSource(seed)),
+		esr:        esrPON,
+		now:        time.Now,
+	}
+	cmds.reset()
+	return &d
+}
+
+// Listen implements the Instrument interface.
+func (d *device) Listen(msg []byte) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.out) > 0 {
+		// A new program message discards any unread response.
+		d.out = nil
+		d.raise(errInterrupted)
+	}
+	var resps []string
+	for _, cmd := range parseMessage(string(msg)) {
+		resp, err := d.execute(cmd)
+		if err != nil {
+			if e, ok := err.(cmdError); ok {
+				d.raise(e)
+			}
+			continue
+		}
+		if cmd.query {
+			resps = append(resps, resp)
+		}
+	}
+	if len(resps) > 0 {
+		readyAt := d.busyUntil
+		d.out = append(d.out, output{
+			msg:     strings.Join(resps, ";") + d.terminator,
+			readyAt: readyAt,
+		})
+	}
+	d.update()
+}
+
+// Talk implements the Instrument interface.
+func (d *device) Talk() ([]byte, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.out) == 0 {
+		d.raise(errUnterminated)
+		d.update()
+		return nil, false
+	}
+	if d.out[0].readyAt.After(d.now()) {
+		return nil, false
+	}
+	msg := d.out[0].msg
+	d.out = d.out[1:]
+	d.update()
+	return []byte(msg), true
+}
+
+// OutputReady implements the Delayer interface.
+func (d *device) OutputReady() time.Time {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.out) == 0 {
+		return time.Time{}
+	}
+	return d.out[0].readyAt
+}
+
+// Clear implements the Clearer interface.
+func (d *device) Clear() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.out = nil
+	d.opcArmed = false
+	d.update()
+}
+
+// SerialPoll implements the Poller interface.
+func (d *device) SerialPoll() byte {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.update()
+	stb := d.stb()
+	d.rqs = false
+	d.serviced = true
+	return stb
+}
+
+// ServiceRequest implements the Poller interface.
+func (d *device) ServiceRequest() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.update()
+	return d.rqs
+}
+
+// Trigger implements the Triggerer interface.
+func (d *device) Trigger() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if t, ok := d.cmds.(triggerable); ok {
+		t.trigger()
+	}
+	d.update()
+}
+
+// SetRemote implements the Remoter interface.
+func (d *device) SetRemote(remote, lockout bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.remote = remote
+	d.lockout = lockout
+}
+
+// busy marks the device as busy executing an operation for the duration.
+func (d *device) busy(dur time.Duration) {
+	until := d.now().Add(dur)
+	if until.After(d.busyUntil) {
+		d.busyUntil = until
+	}
+}
+
+// noise returns normally distributed noise with the standard deviation.
+func (d *device) noise(sigma float64) float64 {
+	return d.rng.NormFloat64() * sigma
+}
+
+// raise records the error in the error queue, if supported, and sets the
+// corresponding bit of the Standard Event Status Register.
+func (d *device) raise(e cmdError) {
+	d.esr |= e.esrBit()
+	if !d.errorQueue {
+		return
+	}
+	const maxErrors = 20
+	switch {
+	case len(d.errors) < maxErrors-1:
+		d.errors = append(d.errors, e)
+	case len(d.errors) == maxErrors-1:
+		d.errors = append(d.errors, errQueueOverflow)
+	}
+}
+
+// stb returns the status byte, including the RQS bit.
+func (d *device) stb() byte {
+	stb := d.summary()
+	if d.rqs {
+		stb |= stbRQS
+	}
+	return stb
+}
+
+// summary returns the status byte summary bits without the RQS bit.
+func (d *device) summary() byte {
+	var stb byte
+	if len(d.errors) > 0 {
+		stb |= stbEAV
+	}
+	if len(d.out) > 0 {
+		stb |= stbMAV
+	}
+	if d.esr&d.ese != 0 {
+		stb |= stbESB
+	}
+	return stb
+}
+
+// update completes pending operations and asserts a service request when a
+// status byte bit enabled by the Service Request Enable register becomes set.
+func (d *device) update() {
+	if d.opcArmed && !d.busyUntil.After(d.now()) {
+		d.esr |= esrOPC
+		d.opcArmed = false
+	}
+	if d.summary()&d.sre&^stbRQS != 0 {
+		if !d.serviced {
+			d.rqs = true
+		}
+	} else {
+		d.serviced = false
+	}
+}
+
+// execute runs a common command or passes the command to the model.
+func (d *device) execute(cmd command) (string, error) {
+	if !strings.HasPrefix(cmd.header, "*") {
+		if d.errorQueue && cmd.query && cmd.is("SYSTem:ERRor[:NEXT]") {
+			if len(d.errors) == 0 {
+				return `+0,"No error"`, nil
+			}
+			e := d.errors[0]
+			d.errors = d.errors[1:]
+			return fmt.Sprintf("%+d,\"%s\"", e.code, e.msg), nil
+		}
+		return d.cmds.execute(cmd)
+	}
+	switch {
+	case cmd.header == "*IDN" && cmd.query:
+		return d.identity, nil
+	case cmd.header == "*RST" && !cmd.query:
+		d.cmds.reset()
+		d.busy(10 * time.Millisecond)
+	case cmd.header == "*CLS" && !cmd.query:
+		d.esr = 0
+		d.errors = nil
+		d.opcArmed = false
+	case cmd.header == "*ESE" && cmd.query:
+		return strconv.Itoa(int(d.ese)), nil
+	case cmd.header == "*ESE":
+		v, err := parseNumber(cmd.arg(0), 0, 255, 0)
+		if err != nil {
+			return "", err
+		}
+		d.ese = byte(v)
+	case cmd.header == "*ESR" && cmd.query:
+		d.update()
+		esr := d.esr
+		d.esr = 0
+		return strconv.Itoa(int(esr)), nil
+	case cmd.header == "*SRE" && cmd.query:
+		return strconv.Itoa(int(d.sre)), nil
+	case cmd.header == "*SRE":
+		v, err := parseNumber(cmd.arg(0), 0, 255, 0)
+		if err != nil {
+			return "", err
+		}
+		d.sre = byte(v) &^ stbRQS
+	case cmd.header == "*STB" && cmd.query:
+		d.update()
+		return strconv.Itoa(int(d.stb())), nil
+	case cmd.header == "*TST" && cmd.query:
+		d.busy(100 * time.Millisecond)
+		return "0", nil
+	case cmd.header == "*OPC" && cmd.query:
+		// The response is queued with the others, so it only becomes
+		// available once the device is no longer busy.
+		return "1", nil
+	case cmd.header == "*OPC":
+		d.opcArmed = true
+	case cmd.header == "*WAI" && !cmd.query:
+		// Subsequent responses are already delayed until the device is idle.
+	case cmd.header == "*TRG" && !cmd.query:
+		if t, ok := d.cmds.(triggerable); ok {
+			t.trigger()
+		}
+	default:
+		return "", errUndefinedHeader
+	}
+	return "", nil
+}
@@ -0,0 +1,201 @@
+// Copyright (c) 2020–2024 The prologix developers. All rights reserved.
+// Project site: https://github.com/gotmc/prologix
+// Use of this source code is governed by a MIT-style license that
+// can be found in the LICENSE.txt file for the project.
+
+package sim
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Instrument models a device attached to the emulated GPIB bus.
+type Instrument interface {
+	// Listen delivers a message sent by the controller to the instrument. The
+	// message includes the GPIB terminator, if any, and EOI is asserted with the
+	// last byte.
+	Listen(msg []byte)
+	// Talk returns the next message the instrument has to send when addressed
+	// to talk. The boolean is false when the instrument has nothing to send,
+	// which results in a read timeout on the adapter.
+	Talk() ([]byte, bool)
+}
+
+// Clearer is implemented by instruments that respond to the Selected Device
+// Clear (SDC) message.
+type Clearer interface {
+	Clear()
+}
+
+// Triggerer is implemented by instruments that respond to the Group Execute
+// Trigger (GET) message.
+type Triggerer interface {
+	Trigger()
+}
+
+// Poller is implemented by instruments that respond to a serial poll and can
+// assert the SRQ line.
+type Poller interface {
+	// SerialPoll returns the status byte and clears the Request Service (RQS)
+	// bit as a serial poll does.
+	SerialPoll() byte
+	// ServiceRequest reports whether the instrument is asserting SRQ.
+	ServiceRequest() bool
+}
+
+// Remoter is implemented by instruments that track their remote/local state.
+type Remoter interface {
+	SetRemote(remote, lockout bool)
+}
+
+// Scripted is an instrument that answers queries from a fixed table of
+// responses. Commands without a response are accepted and recorded.
+type Scripted struct {
+	mu         sync.Mutex
+	identity   string
+	responses  map[string]string
+	terminator string
+	out        [][]byte
+	received   []string
+}
+
+// NewScripted creates a scripted instrument that answers `*IDN?` with the
+// given identity and answers the other queries using the responses map. The
+// keys of the responses map are matched case-insensitively against the
+// commands received with surrounding whitespace removed.
+func NewScripted(identity string, responses map[string]string) *Scripted {
+	s := Scripted{
+		identity:   identity,
+		responses:  make(map[string]string, len(responses)),
+		terminator: "\n",
+	}
+	for cmd, resp := range responses {
+		s.responses[normalize(cmd)] = resp
+	}
+	return &s
+}
+
+// Listen implements the Instrument interface.
+func (s *Scripted) Listen(msg []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cmd := normalize(string(msg))
+	s.received = append(s.received, cmd)
+	if resp, ok := s.responses[cmd]; ok {
+		s.out = append(s.out, []byte(resp+s.terminator))
+		return
+	}
+	if cmd == "*IDN?" && s.identity != "" {
+		s.out = append(s.out, []byte(s.identity+s.terminator))
+	}
+}
+
+// Talk implements the Instrument interface.
+func (s *Scripted) Talk() ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.out) == 0 {
+		return nil, false
+	}
+	msg := s.out[0]
+	s.out = s.out[1:]
+	return msg, true
+}
+
+// Clear implements the Clearer interface by discarding pending output.
+func (s *Scripted) Clear() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.out = nil
+}
+
+// Received returns the commands received by the instrument.
+func (s *Scripted) Received() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.received...)
+}
+
+func normalize(cmd string) string {
+	return strings.ToUpper(strings.TrimSpace(cmd))
+}
+
+// InstrumentConfig describes a simulated instrument in a JSON configuration
+// file.
+type InstrumentConfig struct {
+	// Model selects one of the bundled instrument models: e3631a, 33220a,
+	// ds345, or fluke45. When empty, a scripted instrument answering from
+	// Identity and Responses is created.
+	Model string `json:"model,omitempty"`
+	// Seed initializes the measurement noise of the bundled models.
+	Seed int64 `json:"seed,omitempty"`
+	// Address is the GPIB primary address of the instrument.
+	Address int `json:"address"`
+	// SecondaryAddress is the optional GPIB secondary address.
+	SecondaryAddress int `json:"secondary_address,omitempty"`
+	// Identity is the response to the `*IDN?` query.
+	Identity string `json:"identity,omitempty"`
+	// Responses maps queries to their responses.
+	Responses map[string]string `json:"responses,omitempty"`
+	// Terminator is appended to each response and defaults to a newline.
+	Terminator *string `json:"terminator,omitempty"`
+}
+
+// LoadInstrumentConfig reads the JSON instrument configuration file.
+func LoadInstrumentConfig(path string) (InstrumentConfig, error) {
+	var cfg InstrumentConfig
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return cfg, fmt.Errorf("error parsing instrument config %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// New creates the instrument described by the configuration.
+func (cfg InstrumentConfig) New() (Instrument, error) {
+	if cfg.Model != "" {
+		return NewModel(cfg.Model, cfg.Seed)
+	}
+	s := NewScripted(cfg.Identity, cfg.Responses)
+	if cfg.Terminator != nil {
+		s.terminator = *cfg.Terminator
+	}
+	return s, nil
+}
+
+// AttachConfig creates the instrument described by the configuration and
+// attaches it to the adapter at the configured address.
+func (a *Adapter) AttachConfig(cfg InstrumentConfig) error {
+	inst, err := cfg.New()
+	if err != nil {
+		return err
+	}
+	if cfg.SecondaryAddress != 0 {
+		return a.AttachSecondary(cfg.Address, cfg.SecondaryAddress, inst)
+	}
+	return a.Attach(cfg.Address, inst)
+}
+
+// NewModel creates the bundled instrument model with the given name, which is
+// one of e3631a, 33220a, ds345, or fluke45, using the seed for its
+// measurement noise.
+func NewModel(name string, seed int64) (Instrument, error) {
+	switch strings.ToLower(name) {
+	case "e3631a":
+		return NewE3631A(seed), nil
+	case "33220a":
+		return NewKey33220A(seed), nil
+	case "ds345":
+		return NewDS345(seed), nil
+	case "fluke45":
+		return NewFluke45(seed), nil
+	}
+	return nil, fmt.Errorf("unknown instrument model %q", name)
+}
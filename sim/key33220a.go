@@ -0,0 +1,261 @@
+// Copyright (c) 2020–2024 The prologix developers. All rights reserved.
+// Project site: https://github.com/gotmc/prologix
+// Use of this source code is governed by a MIT-style license that
+// can be found in the LICENSE.txt file for the project.
+
+package sim
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// waveform describes a function available on a function generator along with
+// its frequency limits.
+type waveform struct {
+	short   string
+	long    string
+	minFreq float64
+	maxFreq float64
+}
+
+var key33220aWaveforms = []waveform{
+	{"SIN", "SINUSOID", 1e-6, 20e6},
+	{"SQU", "SQUARE", 1e-6, 20e6},
+	{"RAMP", "RAMP", 1e-6, 200e3},
+	{"PULS", "PULSE", 500e-6, 5e6},
+	{"NOIS", "NOISE", 0, 0},
+	{"DC", "DC", 0, 0},
+	{"USER", "USER", 1e-6, 6e6},
+}
+
+// Key33220A models the Keysight (Agilent) 33220A 20 MHz function/arbitrary
+// waveform generator, including its burst modulation. Applying settings and
+// enabling bursts keep the generator busy for a short time, which delays the
+// response to `*OPC?` as on the real instrument.
+type Key33220A struct {
+	*device
+	function  int
+	freq      float64
+	ampl      float64
+	offset    float64
+	output    bool
+	burst     bool
+	burstMode string
+	burstNcyc float64
+	burstPer  float64
+	burstPhas float64
+	triggers  int
+}
+
+// NewKey33220A creates a simulated 33220A function generator.
+func NewKey33220A(seed int64) *Key33220A {
+	m := Key33220A{}
+	m.device = newDevice(&m, "Agilent Technologies,33220A,MY44000000,2.02-2.02-22-2", seed)
+	return &m
+}
+
+func (m *Key33220A) reset() {
+	m.function = 0
+	m.freq = 1e3
+	m.ampl = 0.1
+	m.offset = 0
+	m.output = false
+	m.burst = false
+	m.burstMode = "TRIG"
+	m.burstNcyc = 1
+	m.burstPer = 0.01
+	m.burstPhas = 0
+}
+
+func (m *Key33220A) trigger() {
+	if m.burst && m.output {
+		m.triggers++
+	}
+}
+
+func (m *Key33220A) waveform(name string) (int, bool) {
+	name = strings.ToUpper(name)
+	for i, w := range key33220aWaveforms {
+		if name == w.short || name == w.long {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+func (m *Key33220A) setFrequency(s string) error {
+	w := key33220aWaveforms[m.function]
+	if w.maxFreq == 0 {
+		return nil
+	}
+	v, err := parseNumber(s, w.minFreq, w.maxFreq, 1e3)
+	if err != nil {
+		return err
+	}
+	m.freq = v
+	return nil
+}
+
+func (m *Key33220A) setAmplitude(s string) error {
+	v, err := parseNumber(s, 0.01, 10, 0.1)
+	if err != nil {
+		return err
+	}
+	if v/2+math.Abs(m.offset) > 5 {
+		return cmdError{-221, "Settings conflict"}
+	}
+	m.ampl = v
+	return nil
+}
+
+func (m *Key33220A) setOffset(s string) error {
+	v, err := parseNumber(s, -5, 5, 0)
+	if err != nil {
+		return err
+	}
+	if m.ampl/2+math.Abs(v) > 5 {
+		return cmdError{-221, "Settings conflict"}
+	}
+	m.offset = v
+	return nil
+}
+
+func (m *Key33220A) execute(cmd command) (string, error) {
+	switch {
+	case cmd.query && cmd.is("APPLy"):
+		return fmt.Sprintf("\"%s %+.15E,%+.15E,%+.15E\"",
+			key33220aWaveforms[m.function].short, m.freq, m.ampl, m.offset), nil
+	case !cmd.query && strings.HasPrefix(cmd.header, "APPL"):
+		// The waveform is given by the second node, as in `APPL:SIN`.
+		nodes := splitNodes(cmd.header)
+		if len(nodes) != 2 || (nodes[0] != "APPL" && nodes[0] != "APPLY") {
+			return "", errUndefinedHeader
+		}
+		i, ok := m.waveform(nodes[1])
+		if !ok {
+			return "", errUndefinedHeader
+		}
+		m.function = i
+		if len(cmd.args) > 0 {
+			if err := m.setFrequency(cmd.arg(0)); err != nil {
+				return "", err
+			}
+		}
+		if len(cmd.args) > 1 {
+			if err := m.setAmplitude(cmd.arg(1)); err != nil {
+				return "", err
+			}
+		}
+		if len(cmd.args) > 2 {
+			if err := m.setOffset(cmd.arg(2)); err != nil {
+				return "", err
+			}
+		}
+		// APPLy enables the output as well.
+		m.output = true
+		m.busy(200 * time.Millisecond)
+	case cmd.is("[SOURce:]FUNCtion[:SHAPe]"):
+		if cmd.query {
+			return key33220aWaveforms[m.function].short, nil
+		}
+		i, ok := m.waveform(cmd.arg(0))
+		if !ok {
+			return "", errIllegalParam
+		}
+		m.function = i
+		m.busy(100 * time.Millisecond)
+	case cmd.is("[SOURce:]FREQuency[:CW]"):
+		if cmd.query {
+			return fmt.Sprintf("%+.15E", m.freq), nil
+		}
+		return "", m.setFrequency(cmd.arg(0))
+	case cmd.is("[SOURce:]VOLTage:OFFSet"):
+		if cmd.query {
+			return fmt.Sprintf("%+.15E", m.offset), nil
+		}
+		return "", m.setOffset(cmd.arg(0))
+	case cmd.is("[SOURce:]VOLTage[:LEVel][:IMMediate][:AMPLitude]"):
+		if cmd.query {
+			return fmt.Sprintf("%+.15E", m.ampl), nil
+		}
+		return "", m.setAmplitude(cmd.arg(0))
+	case cmd.is("OUTPut[:STATe]"):
+		if cmd.query {
+			return boolString(m.output), nil
+		}
+		on, err := parseBool(cmd.arg(0))
+		if err != nil {
+			return "", err
+		}
+		m.output = on
+		m.busy(50 * time.Millisecond)
+	case cmd.is("[SOURce:]BURSt:MODE"):
+		if cmd.query {
+			return m.burstMode, nil
+		}
+		switch strings.ToUpper(cmd.arg(0)) {
+		case "TRIG", "TRIGGERED":
+			m.burstMode = "TRIG"
+		case "GAT", "GATED":
+			m.burstMode = "GAT"
+		default:
+			return "", errIllegalParam
+		}
+	case cmd.is("[SOURce:]BURSt:NCYCles"):
+		if cmd.query {
+			return fmt.Sprintf("%+.15E", m.burstNcyc), nil
+		}
+		v, err := parseNumber(cmd.arg(0), 1, 50000, 1)
+		if err != nil {
+			return "", err
+		}
+		m.burstNcyc = float64(int(v + 0.5))
+	case cmd.is("[SOURce:]BURSt:INTernal:PERiod"):
+		if cmd.query {
+			return fmt.Sprintf("%+.15E", m.burstPer), nil
+		}
+		v, err := parseNumber(cmd.arg(0), 1e-6, 500, 0.01)
+		if err != nil {
+			return "", err
+		}
+		m.burstPer = v
+	case cmd.is("[SOURce:]BURSt:PHASe"):
+		if cmd.query {
+			return fmt.Sprintf("%+.15E", m.burstPhas), nil
+		}
+		v, err := parseNumber(cmd.arg(0), -360, 360, 0)
+		if err != nil {
+			return "", err
+		}
+		m.burstPhas = v
+	case cmd.is("[SOURce:]BURSt:STATe"):
+		if cmd.query {
+			return boolString(m.burst), nil
+		}
+		on, err := parseBool(cmd.arg(0))
+		if err != nil {
+			return "", err
+		}
+		if on && m.burstNcyc/m.freq > m.burstPer {
+			return "", cmdError{-221, "Settings conflict"}
+		}
+		m.burst = on
+		m.busy(200 * time.Millisecond)
+	case cmd.is("TRIGger[:IMMediate]") && !cmd.query:
+		m.trigger()
+	case cmd.is("SYSTem:REMote") && !cmd.query:
+		m.remote, m.lockout = true, false
+	case cmd.is("SYSTem:RWLock") && !cmd.query:
+		m.remote, m.lockout = true, true
+	case cmd.is("SYSTem:LOCal") && !cmd.query:
+		m.remote, m.lockout = false, false
+	case cmd.is("SYSTem:VERSion") && cmd.query:
+		return "1999.0", nil
+	default:
+		return "", errUndefinedHeader
+	}
+	return "", nil
+}
@@ -0,0 +1,134 @@
+// Copyright (c) 2020–2024 The prologix developers. All rights reserved.
+// Project site: https://github.com/gotmc/prologix
+// Use of this source code is governed by a MIT-style license that
+// can be found in the LICENSE.txt file for the project.
+
+package sim
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// exchange sends each message to the instrument and returns the responses to
+// those ending with a question mark.
+func exchange(inst Instrument, msgs ...string) []string {
+	var resps []string
+	for _, msg := range msgs {
+		inst.Listen([]byte(msg + "\n"))
+		if !strings.HasSuffix(msg, "?") && !strings.Contains(msg, "? ") {
+			continue
+		}
+		if d, ok := inst.(Delayer); ok {
+			time.Sleep(time.Until(d.OutputReady()))
+		}
+		resp, _ := inst.Talk()
+		resps = append(resps, string(resp))
+	}
+	return resps
+}
+
+func TestModels(t *testing.T) {
+	tests := []struct {
+		name string
+		inst Instrument
+		msgs []string
+		want []string
+	}{
+		{
+			"e3631a apply",
+			NewE3631A(1),
+			[]string{"apply p6v,4.1,1.2", "appl? p6v", "outp:stat?"},
+			[]string{"\"+4.10000E+00,+1.20000E+00\"\n", "0\n"},
+		},
+		{
+			"e3631a error queue",
+			NewE3631A(1),
+			[]string{"volt 7", "bogus", "syst:err?", "syst:err?", "syst:err?"},
+			[]string{
+				"-222,\"Data out of range\"\n",
+				"-113,\"Undefined header\"\n",
+				"+0,\"No error\"\n",
+			},
+		},
+		{
+			"33220a burst",
+			NewKey33220A(1),
+			[]string{"APPL:SIN 100,0.5,0.0", "BURS:NCYC 40", "BURS:INT:PER 0.6",
+				"BURS:STAT ON", "BURS:STAT?", "BURS: ON", "SYST:ERR?"},
+			[]string{"1\n", "-113,\"Undefined header\"\n"},
+		},
+		{
+			"ds345 attached parameters",
+			NewDS345(1),
+			[]string{"MENA1", "MTYP5", "mena?", "mtyp?", "AMPL 0.5VP", "AMPL? VP"},
+			[]string{"1\n", "5\n", "0.50VP\n"},
+		},
+		{
+			"ds345 errors in esr",
+			NewDS345(1),
+			[]string{"*CLS", "XXXX1", "FREQ 1E9", "*ESR?", "SYST:ERR?"},
+			[]string{"48\n", ""},
+		},
+		{
+			"fluke45 reading",
+			NewFluke45(1),
+			[]string{"ohms", "rate f", "range 1", "func1?", "range1?"},
+			[]string{"OHMS\r\n", "1\r\n"},
+		},
+		{
+			"fluke45 overload",
+			NewFluke45(1),
+			[]string{"vdc", "range 1", "val1?"},
+			[]string{"+1E+9\r\n"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := exchange(test.inst, test.msgs...)
+			if strings.Join(got, "|") != strings.Join(test.want, "|") {
+				t.Errorf("got %q; want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestOperationCompleteDelay(t *testing.T) {
+	inst := NewKey33220A(1)
+	inst.Listen([]byte("APPL:SIN 100,0.5,0.0;*OPC?\n"))
+	if _, ok := inst.Talk(); ok {
+		t.Error("*OPC? answered while the generator is busy")
+	}
+	time.Sleep(time.Until(inst.OutputReady()))
+	if resp, ok := inst.Talk(); !ok || string(resp) != "1\n" {
+		t.Errorf("got %q; want %q", resp, "1\n")
+	}
+}
+
+func TestServiceRequestOnOperationComplete(t *testing.T) {
+	inst := NewE3631A(1)
+	inst.Listen([]byte("*CLS;*ESE 1;*SRE 32;OUTP ON;*OPC\n"))
+	if inst.ServiceRequest() {
+		t.Error("SRQ asserted before the operation completed")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if !inst.ServiceRequest() {
+		t.Fatal("SRQ not asserted after the operation completed")
+	}
+	if stb := inst.SerialPoll(); stb&(stbRQS|stbESB) != stbRQS|stbESB {
+		t.Errorf("got status byte %#x; want RQS and ESB set", stb)
+	}
+	if inst.ServiceRequest() {
+		t.Error("SRQ still asserted after serial poll")
+	}
+}
+
+func TestFluke45ReadingFormat(t *testing.T) {
+	inst := NewFluke45(1)
+	inst.SetInput("VDC", 12.5)
+	resp := exchange(inst, "vdc", "val?")[0]
+	if !strings.HasPrefix(resp, "+1.2500E+1") || !strings.HasSuffix(resp, "\r\n") {
+		t.Errorf("got %q; want reading near +1.2500E+1 terminated with CR LF", resp)
+	}
+}
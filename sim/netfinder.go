@@ -0,0 +1,122 @@
+// Copyright (c) 2020–2024 The prologix developers. All rights reserved.
+// Project site: https://github.com/gotmc/prologix
+// Use of this source code is governed by a MIT-style license that
+// can be found in the LICENSE.txt file for the project.
+
+package sim
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+)
+
+// NetFinderPort is the UDP port on which the Prologix GPIB-ETHERNET listens
+// for NetFinder discovery requests.
+const NetFinderPort = 3040
+
+// NetFinder message constants from the Prologix NetFinder protocol.
+const (
+	nfMagic         = 0x5a
+	nfIdentify      = 0
+	nfIdentifyReply = 1
+	nfHeaderLen     = 12
+	nfNameLen       = 32
+)
+
+// NetFinder answers Prologix NetFinder identify requests on behalf of an
+// emulated GPIB-ETHERNET controller.
+type NetFinder struct {
+	// HardwareAddr is the Ethernet MAC address reported by the adapter.
+	HardwareAddr net.HardwareAddr
+	// IP, Netmask, and Gateway are the network settings reported.
+	IP      net.IP
+	Netmask net.IP
+	Gateway net.IP
+	// Name is the device name of up to 32 characters.
+	Name  string
+	start time.Time
+}
+
+// NewNetFinder creates a NetFinder responder reporting the given IP address.
+func NewNetFinder(ip net.IP) *NetFinder {
+	return &NetFinder{
+		HardwareAddr: net.HardwareAddr{0x00, 0x21, 0x69, 0x00, 0x00, 0x01},
+		IP:           ip,
+		Netmask:      net.IPv4(255, 0, 0, 0),
+		Gateway:      net.IPv4zero,
+		Name:         "prologix-sim",
+		start:        time.Now(),
+	}
+}
+
+// Serve answers identify requests received on the packet connection until
+// reading from the connection fails.
+func (nf *NetFinder) Serve(pc net.PacketConn) error {
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		reply, ok := nf.reply(buf[:n])
+		if !ok {
+			continue
+		}
+		if _, err := pc.WriteTo(reply, addr); err != nil {
+			return err
+		}
+	}
+}
+
+// reply builds the identify reply for the request, returning false if the
+// request is not an identify request addressed to this adapter.
+func (nf *NetFinder) reply(req []byte) ([]byte, bool) {
+	if len(req) < nfHeaderLen || req[0] != nfMagic || req[1] != nfIdentify {
+		return nil, false
+	}
+	target := req[4:10]
+	if !isBroadcast(target) && string(target) != string(nf.HardwareAddr) {
+		return nil, false
+	}
+
+	b := make([]byte, 0, nfHeaderLen+30+nfNameLen)
+	b = append(b, nfMagic, nfIdentifyReply, req[2], req[3])
+	b = append(b, nf.HardwareAddr[:6]...)
+	b = append(b, 0, 0) // reserved
+
+	uptime := time.Since(nf.start)
+	b = binary.BigEndian.AppendUint16(b, uint16(uptime/(24*time.Hour)))
+	b = append(b,
+		byte(uptime/time.Hour%24),
+		byte(uptime/time.Minute%60),
+		byte(uptime/time.Second%60),
+	)
+	b = append(b, 1, 0, 1) // mode, alert, static IP
+	b = append(b, ipv4(nf.IP)...)
+	b = append(b, ipv4(nf.Netmask)...)
+	b = append(b, ipv4(nf.Gateway)...)
+	b = append(b, 1, 6, 6, 0) // application version
+	b = append(b, 1, 0, 0, 0) // boot loader version
+	b = append(b, 1, 0, 0, 0) // hardware version
+	name := make([]byte, nfNameLen)
+	copy(name, nf.Name)
+	b = append(b, name...)
+	return b, true
+}
+
+func isBroadcast(mac []byte) bool {
+	for _, b := range mac {
+		if b != 0xff {
+			return false
+		}
+	}
+	return true
+}
+
+func ipv4(ip net.IP) []byte {
+	if v4 := ip.To4(); v4 != nil {
+		return v4
+	}
+	return make([]byte, 4)
+}
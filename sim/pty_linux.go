@@ -0,0 +1,103 @@
+// Copyright (c) 2020–2024 The prologix developers. All rights reserved.
+// Project site: https://github.com/gotmc/prologix
+// Use of this source code is governed by a MIT-style license that
+// can be found in the LICENSE.txt file for the project.
+
+package sim
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// PTY is a pseudo-terminal pair whose master side is served by an emulated
+// adapter. The slave side behaves like the Virtual COM Port (VCP) created by
+// the FTDI driver for a Prologix GPIB-USB controller, so its path can be given
+// to vcp.NewVCP.
+type PTY struct {
+	a      *Adapter
+	master *os.File
+	slave  *os.File
+	path   string
+}
+
+// OpenPTY allocates a pseudo-terminal pair for the adapter. Call Serve to
+// start emulating the Prologix controller on the master side.
+func (a *Adapter) OpenPTY() (*PTY, error) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		return nil, err
+	}
+	fd := int(master.Fd())
+	if err := unix.IoctlSetPointerInt(fd, unix.TIOCSPTLCK, 0); err != nil {
+		master.Close()
+		return nil, fmt.Errorf("error unlocking pty: %w", err)
+	}
+	n, err := unix.IoctlGetInt(fd, unix.TIOCGPTN)
+	if err != nil {
+		master.Close()
+		return nil, fmt.Errorf("error getting pty number: %w", err)
+	}
+	path := fmt.Sprintf("/dev/pts/%d", n)
+
+	// Hold the slave side open so reads on the master don't fail with EIO
+	// while no client has the serial port open, and put it in raw mode so the
+	// line discipline doesn't echo or translate the traffic.
+	slave, err := os.OpenFile(path, os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, err
+	}
+	if err := makeRaw(int(slave.Fd())); err != nil {
+		master.Close()
+		slave.Close()
+		return nil, fmt.Errorf("error setting pty to raw mode: %w", err)
+	}
+	return &PTY{a: a, master: master, slave: slave, path: path}, nil
+}
+
+// Path returns the path of the slave side of the pseudo-terminal, such as
+// `/dev/pts/3`.
+func (p *PTY) Path() string {
+	return p.path
+}
+
+// Serve emulates the Prologix controller on the master side of the
+// pseudo-terminal until the PTY is closed. When a disconnect fault is
+// injected, the PTY is closed, so the host sees the serial port go away as if
+// the USB cable had been pulled.
+func (p *PTY) Serve() error {
+	err := p.a.ServeConn(p.master)
+	if err == nil {
+		p.Close()
+	}
+	return err
+}
+
+// Close closes both sides of the pseudo-terminal.
+func (p *PTY) Close() error {
+	err := p.slave.Close()
+	if merr := p.master.Close(); err == nil {
+		err = merr
+	}
+	return err
+}
+
+// makeRaw sets the terminal to raw mode in the same way as cfmakeraw(3).
+func makeRaw(fd int) error {
+	t, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		return err
+	}
+	t.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP |
+		unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+	t.Oflag &^= unix.OPOST
+	t.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+	t.Cflag &^= unix.CSIZE | unix.PARENB
+	t.Cflag |= unix.CS8
+	t.Cc[unix.VMIN] = 1
+	t.Cc[unix.VTIME] = 0
+	return unix.IoctlSetTermios(fd, unix.TCSETS, t)
+}
@@ -0,0 +1,98 @@
+// Copyright (c) 2020–2024 The prologix developers. All rights reserved.
+// Project site: https://github.com/gotmc/prologix
+// Use of this source code is governed by a MIT-style license that
+// can be found in the LICENSE.txt file for the project.
+
+package sim
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gotmc/prologix"
+	"github.com/gotmc/prologix/driver/vcp"
+)
+
+func TestPTYWithVCP(t *testing.T) {
+	a := NewAdapter()
+	if err := a.Attach(10, NewScripted("SIM,PTY,0,1.0", nil)); err != nil {
+		t.Fatal(err)
+	}
+	pty, err := a.OpenPTY()
+	if err != nil {
+		t.Skipf("pseudo-terminals unavailable: %s", err)
+	}
+	defer pty.Close()
+	go pty.Serve()
+
+	port, err := vcp.NewVCP(pty.Path())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer port.Close()
+	gpib, err := prologix.NewController(port, 10, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idn, err := gpib.Query("*idn?")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.TrimSpace(idn); got != "SIM,PTY,0,1.0" {
+		t.Errorf("got %q; want %q", got, "SIM,PTY,0,1.0")
+	}
+}
+
+func TestPTYExclusiveLock(t *testing.T) {
+	a := NewAdapter()
+	pty, err := a.OpenPTY()
+	if err != nil {
+		t.Skipf("pseudo-terminals unavailable: %s", err)
+	}
+	defer pty.Close()
+	go pty.Serve()
+
+	port, err := vcp.NewVCP(pty.Path(), vcp.WithExclusiveLock(), vcp.WithReadTimeout(50*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := vcp.NewVCP(pty.Path(), vcp.WithExclusiveLock()); !errors.Is(err, vcp.ErrInUse) {
+		t.Fatalf("got error %v opening locked port; want %v", err, vcp.ErrInUse)
+	}
+
+	// A read with nothing pending times out.
+	buf := make([]byte, 64)
+	start := time.Now()
+	if _, err := port.Read(buf); !errors.Is(err, vcp.ErrTimeout) {
+		t.Errorf("got error %v; want %v", err, vcp.ErrTimeout)
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond || elapsed > time.Second {
+		t.Errorf("read timed out after %s; want 50 ms", elapsed)
+	}
+	if _, err := port.WriteString("++ver"); err != nil {
+		t.Fatal(err)
+	}
+	var got []byte
+	for !strings.HasSuffix(string(got), "\n") {
+		n, err := port.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, buf[:n]...)
+	}
+	if v := strings.TrimSpace(string(got)); v != VersionUSB {
+		t.Errorf("got version %q; want %q", v, VersionUSB)
+	}
+
+	// Closing the port releases the lock.
+	if err := port.Close(); err != nil {
+		t.Fatal(err)
+	}
+	port, err = vcp.NewVCP(pty.Path(), vcp.WithExclusiveLock())
+	if err != nil {
+		t.Fatalf("error reopening port after close: %s", err)
+	}
+	port.Close()
+}
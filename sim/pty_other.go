@@ -0,0 +1,34 @@
+// Copyright (c) 2020–2024 The prologix developers. All rights reserved.
+// Project site: https://github.com/gotmc/prologix
+// Use of this source code is governed by a MIT-style license that
+// can be found in the LICENSE.txt file for the project.
+
+//go:build !linux
+
+package sim
+
+import "errors"
+
+// PTY is a pseudo-terminal pair whose master side is served by an emulated
+// adapter. Pseudo-terminals are only supported on Linux.
+type PTY struct{}
+
+// OpenPTY returns an error since pseudo-terminals are only supported on Linux.
+func (a *Adapter) OpenPTY() (*PTY, error) {
+	return nil, errors.New("pseudo-terminal simulator only supported on linux")
+}
+
+// Path returns an empty string.
+func (p *PTY) Path() string {
+	return ""
+}
+
+// Serve returns an error since pseudo-terminals are only supported on Linux.
+func (p *PTY) Serve() error {
+	return errors.New("pseudo-terminal simulator only supported on linux")
+}
+
+// Close does nothing.
+func (p *PTY) Close() error {
+	return nil
+}